@@ -17,6 +17,13 @@ const (
 // Encrypt encrypts buf using key with AES-GCM AEAD mode,
 // nonce is prepended to encrypted text and result is hex encoded.
 func Encrypt(buf []byte, key []byte) ([]byte, error) {
+	return EncryptWithAssociatedData(buf, key, nil)
+}
+
+// EncryptWithAssociatedData is like Encrypt but authenticates the given
+// associated data along with buf. The same associated data must be given to
+// decrypt the result.
+func EncryptWithAssociatedData(buf, key, associatedData []byte) ([]byte, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, errors.New("failed to initialize cipher").
@@ -37,7 +44,7 @@ func Encrypt(buf []byte, key []byte) ([]byte, error) {
 			Wrap(err)
 	}
 
-	encrypted := aesGCM.Seal(nil, nonce, buf, nil)
+	encrypted := aesGCM.Seal(nil, nonce, buf, associatedData)
 
 	// prepend nonce into payload
 	encrypted = append(nonce, encrypted...)
@@ -46,6 +53,12 @@ func Encrypt(buf []byte, key []byte) ([]byte, error) {
 
 // Decrypt decrypts buf using key with AES-GCM AEAD mode.
 func Decrypt(buf []byte, key []byte) ([]byte, error) {
+	return DecryptWithAssociatedData(buf, key, nil)
+}
+
+// DecryptWithAssociatedData decrypts buf produced by
+// EncryptWithAssociatedData with the same key and associated data.
+func DecryptWithAssociatedData(buf, key, associatedData []byte) ([]byte, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, errors.New("failed to initialize cipher").Wrap(err)
@@ -64,7 +77,7 @@ func Decrypt(buf []byte, key []byte) ([]byte, error) {
 		return nil, errors.New("failed to initialize decryptor").Wrap(err)
 	}
 
-	decrypted, err := aesGCM.Open(nil, nonce, encrypted, nil)
+	decrypted, err := aesGCM.Open(nil, nonce, encrypted, associatedData)
 	if err != nil {
 		return nil, errors.New("failed to decrypt payload").Wrap(err)
 	}
@@ -2,7 +2,10 @@ package crypt
 
 import (
 	"bytes"
+	"io"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/aukilabs/go-tooling/pkg/errors"
 	"github.com/aukilabs/go-tooling/pkg/logs"
@@ -10,19 +13,88 @@ import (
 
 const (
 	acceptEncodingHeader = "Accept-Encoding"
+
+	// The header that carries the KeyID of the key used to encrypt a
+	// response.
+	KeyIDHeader = "X-Encryption-Key-Id"
+
+	// The header that carries the Unix time at which a response bound to its
+	// request was encrypted.
+	TimestampHeader = "X-Encryption-Timestamp"
+)
+
+var (
+	// Error returned by DecryptResponse when a response bound to its request
+	// is older than the maximum response age.
+	ErrExpiredResponse = errors.New("encrypted response is expired")
+
+	// Error returned by DecryptResponse when a response is expected to be
+	// bound to its request but has no TimestampHeader.
+	ErrUnboundResponse = errors.New("encrypted response is not bound to its request")
 )
 
 type secretProvider interface {
 	GetKey() ([]byte, error)
 }
 
+type keyRingProvider interface {
+	secretProvider
+	GetKeyByID(id string) ([]byte, error)
+}
+
+type EncryptionOpts func(*encryptionOptions)
+
+type encryptionOptions struct {
+	requestBinding bool
+	maxAge         time.Duration
+	now            func() time.Time
+}
+
+// WithRequestBinding makes HandleWithEncryption encrypt responses with a key
+// derived with DeriveKey for KeyPurposeResponseEncryption, and bind them to
+// the request method, path and encryption time with RequestAssociatedData. A
+// bound response cannot be decrypted as the response of another endpoint.
+//
+// Passed to DecryptResponse, it makes it reject the responses that are not
+// bound to their request, so that the binding cannot be removed by stripping
+// the TimestampHeader.
+func WithRequestBinding() EncryptionOpts {
+	return func(o *encryptionOptions) {
+		o.requestBinding = true
+	}
+}
+
+// WithMaxResponseAge makes DecryptResponse reject the responses bound to their
+// request that were encrypted longer than the given duration ago. Responses
+// that are not bound to their request are rejected.
+func WithMaxResponseAge(v time.Duration) EncryptionOpts {
+	return func(o *encryptionOptions) {
+		o.maxAge = v
+	}
+}
+
+func newEncryptionOptions(opts []EncryptionOpts) encryptionOptions {
+	o := encryptionOptions{
+		now: time.Now,
+	}
+
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
 // HandleWithEncryption returns a http handler function that encrypts content
 // returned by handler using key provided by secretProvider.
-func HandleWithEncryption(provider secretProvider, handler http.Handler) http.HandlerFunc {
+func HandleWithEncryption(provider secretProvider, handler http.Handler, opts ...EncryptionOpts) http.HandlerFunc {
+	options := newEncryptionOptions(opts)
+
 	return func(w http.ResponseWriter, r *http.Request) {
 		responseWriter := &responseEncrypter{
-			secret: provider,
-			writer: w,
+			secret:  provider,
+			writer:  w,
+			request: r,
+			options: options,
 		}
 
 		removeCompression(r.Header)
@@ -48,6 +120,8 @@ type responseEncrypter struct {
 	buf        bytes.Buffer
 	writer     http.ResponseWriter
 	statusCode int
+	request    *http.Request
+	options    encryptionOptions
 }
 
 // Returns underlying response writer header.
@@ -80,7 +154,14 @@ func (w responseEncrypter) encryptResponse() {
 		return
 	}
 
-	enc, err := Encrypt(w.buf.Bytes(), key)
+	key, associatedData, err := w.options.responseKey(key, w.request, w.writer.Header())
+	if err != nil {
+		logs.Error(errors.New("failed deriving key").Wrap(err))
+		w.writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	enc, err := EncryptWithAssociatedData(w.buf.Bytes(), key, associatedData)
 	if err != nil {
 		logs.Error(errors.New("failed encrypting content").Wrap(err))
 		w.writer.WriteHeader(http.StatusInternalServerError)
@@ -96,6 +177,122 @@ func (w responseEncrypter) encryptResponse() {
 	}
 }
 
+// responseKey returns the key and the associated data that encrypt the
+// response of the given request, and sets the headers that allow the client
+// to find them.
+func (o encryptionOptions) responseKey(key []byte, r *http.Request, header http.Header) ([]byte, []byte, error) {
+	header.Set(KeyIDHeader, KeyID(key))
+
+	if !o.requestBinding {
+		return key, nil, nil
+	}
+
+	key, err := DeriveKey(key, KeyPurposeResponseEncryption)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	timestamp := o.now()
+	header.Set(TimestampHeader, strconv.FormatInt(timestamp.Unix(), 10))
+	return key, RequestAssociatedData(r.Method, requestPath(r), timestamp), nil
+}
+
+// DecryptResponse reads and decrypts the body of a response produced by
+// HandleWithEncryption or HandleWithStreamEncryption. The key is selected with
+// the KeyIDHeader, which allows decrypting responses encrypted with a key that
+// was rotated in the meantime. Responses without a key ID are decrypted with
+// the current key.
+//
+// Responses bound to their request with WithRequestBinding are decrypted
+// with the method and path of res.Request.
+//
+// Responses with a status code other than 200 are not encrypted and are
+// returned as an error.
+func DecryptResponse(res *http.Response, provider keyRingProvider, opts ...EncryptionOpts) ([]byte, error) {
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusOK && res.Header.Get(EncryptionFormatHeader) == EncryptionFormatStream {
+		r, err := NewResponseDecryptReader(res, provider, opts...)
+		if err != nil {
+			return nil, err
+		}
+		return io.ReadAll(r)
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, errors.New("reading response failed").Wrap(err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.New("response is not encrypted").
+			WithTag("status_code", res.StatusCode).
+			WithTag("body", string(body))
+	}
+
+	key, associatedData, err := responseDecryptionKey(res, provider, newEncryptionOptions(opts))
+	if err != nil {
+		return nil, err
+	}
+	return DecryptWithAssociatedData(body, key, associatedData)
+}
+
+// responseDecryptionKey returns the key and the associated data that decrypt
+// the given response.
+func responseDecryptionKey(res *http.Response, provider keyRingProvider, options encryptionOptions) ([]byte, []byte, error) {
+	var key []byte
+	var err error
+	if id := res.Header.Get(KeyIDHeader); id != "" {
+		key, err = provider.GetKeyByID(id)
+	} else {
+		key, err = provider.GetKey()
+	}
+	if err != nil {
+		return nil, nil, errors.New("getting key failed").Wrap(err)
+	}
+
+	ts := res.Header.Get(TimestampHeader)
+	if ts == "" && (options.requestBinding || options.maxAge > 0) {
+		return nil, nil, errors.New("decrypting response failed").
+			WithTag("header", TimestampHeader).
+			Wrap(ErrUnboundResponse)
+	}
+	if ts == "" {
+		return key, nil, nil
+	}
+
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return nil, nil, errors.New("parsing response timestamp failed").
+			WithTag("timestamp", ts).
+			Wrap(err)
+	}
+	timestamp := time.Unix(unix, 0)
+
+	if age := options.now().Sub(timestamp); options.maxAge > 0 && age > options.maxAge {
+		return nil, nil, errors.New("decrypting response failed").
+			WithTag("age", age).
+			WithTag("max_age", options.maxAge).
+			Wrap(ErrExpiredResponse)
+	}
+
+	if res.Request == nil {
+		return nil, nil, errors.New("response is bound to a request that is missing")
+	}
+
+	if key, err = DeriveKey(key, KeyPurposeResponseEncryption); err != nil {
+		return nil, nil, err
+	}
+	return key, RequestAssociatedData(res.Request.Method, requestPath(res.Request), timestamp), nil
+}
+
+func requestPath(r *http.Request) string {
+	if r.URL == nil {
+		return ""
+	}
+	return r.URL.Path
+}
+
 // removeCompression removes "gzip" from http Accept-Encoding request header.
 func removeCompression(header http.Header) {
 	acceptEncoding := header.Values(acceptEncodingHeader)
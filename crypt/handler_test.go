@@ -3,7 +3,9 @@ package crypt
 import (
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -26,6 +28,129 @@ func TestHandleWithEncryption(t *testing.T) {
 	require.Equal(t, testBody, string(decrypted))
 }
 
+func TestDecryptResponse(t *testing.T) {
+	testBody := "super secret content"
+	client := &mockHdsClient{secret: "secret-1"}
+	provider := NewHagallSecretProvider(client)
+
+	handle := HandleWithEncryption(provider, http.HandlerFunc((mockHandler(http.StatusOK, testBody))))
+
+	t.Run("response encrypted before rotation", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		handle(rec, &http.Request{})
+		require.NotEmpty(t, rec.Result().Header.Get(KeyIDHeader))
+
+		client.secret = "secret-2"
+		decrypted, err := DecryptResponse(rec.Result(), provider)
+		require.NoError(t, err)
+		require.Equal(t, testBody, string(decrypted))
+	})
+
+	t.Run("response without key id", func(t *testing.T) {
+		key, err := provider.GetKey()
+		require.NoError(t, err)
+
+		enc, err := Encrypt([]byte(testBody), key)
+		require.NoError(t, err)
+
+		rec := httptest.NewRecorder()
+		rec.Write(enc)
+
+		decrypted, err := DecryptResponse(rec.Result(), provider)
+		require.NoError(t, err)
+		require.Equal(t, testBody, string(decrypted))
+	})
+
+	t.Run("unknown key id", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		rec.Header().Set(KeyIDHeader, "deadbeef")
+		rec.Write([]byte("payload"))
+
+		_, err := DecryptResponse(rec.Result(), provider)
+		require.ErrorIs(t, err, ErrUnknownKeyID)
+	})
+
+	t.Run("error response", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		HandleWithEncryption(provider, mockHandler(http.StatusNotFound, "not found"))(rec, &http.Request{})
+
+		_, err := DecryptResponse(rec.Result(), provider)
+		require.Error(t, err)
+	})
+}
+
+func TestHandleWithRequestBinding(t *testing.T) {
+	testBody := "super secret content"
+	provider := NewHagallSecretProvider(&mockHdsClient{secret: "secret"})
+
+	handle := HandleWithEncryption(provider, mockHandler(http.StatusOK, testBody), WithRequestBinding())
+	rec := httptest.NewRecorder()
+	handle(rec, httptest.NewRequest(http.MethodGet, "/debug", nil))
+
+	res := func(method, target string) *http.Response {
+		res := rec.Result()
+		res.Request = httptest.NewRequest(method, target, nil)
+		return res
+	}
+
+	t.Run("decrypt bound response", func(t *testing.T) {
+		require.NotEmpty(t, rec.Result().Header.Get(TimestampHeader))
+
+		decrypted, err := DecryptResponse(res(http.MethodGet, "/debug"), provider, WithMaxResponseAge(time.Minute))
+		require.NoError(t, err)
+		require.Equal(t, testBody, string(decrypted))
+	})
+
+	t.Run("response is not decrypted with the secret key", func(t *testing.T) {
+		key, err := provider.GetKey()
+		require.NoError(t, err)
+
+		_, err = Decrypt(rec.Body.Bytes(), key)
+		require.Error(t, err)
+	})
+
+	t.Run("response replayed for another endpoint", func(t *testing.T) {
+		_, err := DecryptResponse(res(http.MethodGet, "/status"), provider)
+		require.Error(t, err)
+
+		_, err = DecryptResponse(res(http.MethodPost, "/debug"), provider)
+		require.Error(t, err)
+	})
+
+	t.Run("expired response", func(t *testing.T) {
+		r := res(http.MethodGet, "/debug")
+		r.Header.Set(TimestampHeader, strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10))
+
+		_, err := DecryptResponse(r, provider, WithMaxResponseAge(time.Minute))
+		require.ErrorIs(t, err, ErrExpiredResponse)
+	})
+
+	t.Run("response with stripped timestamp", func(t *testing.T) {
+		r := res(http.MethodGet, "/debug")
+		r.Header.Del(TimestampHeader)
+
+		_, err := DecryptResponse(r, provider, WithRequestBinding())
+		require.ErrorIs(t, err, ErrUnboundResponse)
+
+		r = res(http.MethodGet, "/debug")
+		r.Header.Del(TimestampHeader)
+
+		_, err = DecryptResponse(r, provider, WithMaxResponseAge(time.Minute))
+		require.ErrorIs(t, err, ErrUnboundResponse)
+	})
+
+	t.Run("unbound response replayed for a bound endpoint", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		HandleWithEncryption(provider, mockHandler(http.StatusOK, testBody))(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+
+		r := rec.Result()
+		r.Request = httptest.NewRequest(http.MethodGet, "/debug", nil)
+
+		_, err := DecryptResponse(r, provider, WithRequestBinding(), WithMaxResponseAge(time.Minute))
+		require.ErrorIs(t, err, ErrUnboundResponse)
+	})
+}
+
 type mockProvider struct{}
 
 func (m mockProvider) GetKey() ([]byte, error) {
@@ -0,0 +1,72 @@
+package crypt
+
+import (
+	"crypto/sha256"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aukilabs/go-tooling/pkg/errors"
+	"golang.org/x/crypto/hkdf"
+)
+
+// KeyPurpose describes what a derived key is used for. Keys derived for
+// different purposes are independent.
+type KeyPurpose string
+
+const (
+	KeyPurposeResponseEncryption KeyPurpose = "response-encryption"
+)
+
+const (
+	// The HKDF salt of the key schedule. Changing it changes every derived
+	// key.
+	keyScheduleSalt = "hagall-common/crypt/v1"
+
+	// The prefix of the HKDF info label of derived keys.
+	keyScheduleInfoPrefix = "hagall-common "
+
+	// The length of derived keys, for AES-256.
+	derivedKeyLength = 32
+)
+
+// DeriveKey derives a 256-bit key for the given purpose from the given secret
+// with HKDF-SHA256. The secret is typically the key returned by a secret
+// provider.
+func DeriveKey(secret []byte, purpose KeyPurpose) ([]byte, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("deriving key from an empty secret").
+			WithTag("purpose", purpose)
+	}
+
+	if purpose == "" {
+		return nil, errors.New("deriving key without purpose")
+	}
+
+	r := hkdf.New(
+		sha256.New,
+		secret,
+		[]byte(keyScheduleSalt),
+		[]byte(keyScheduleInfoPrefix+string(purpose)),
+	)
+
+	key := make([]byte, derivedKeyLength)
+	if _, err := io.ReadFull(r, key); err != nil {
+		return nil, errors.New("deriving key failed").
+			WithTag("purpose", purpose).
+			Wrap(err)
+	}
+	return key, nil
+}
+
+// RequestAssociatedData returns the associated data that binds an encrypted
+// response to the method and path of the request it answers and to the time
+// it was encrypted.
+func RequestAssociatedData(method, path string, timestamp time.Time) []byte {
+	return []byte(strings.Join([]string{
+		strings.ToUpper(method),
+		path,
+		strconv.FormatInt(timestamp.Unix(), 10),
+	}, "\n"))
+}
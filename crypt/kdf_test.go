@@ -0,0 +1,65 @@
+package crypt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeriveKey(t *testing.T) {
+	secret, err := sha256hash([]byte("super-secret"))
+	require.NoError(t, err)
+
+	t.Run("derived keys are deterministic", func(t *testing.T) {
+		key1, err := DeriveKey(secret, KeyPurposeResponseEncryption)
+		require.NoError(t, err)
+		require.Len(t, key1, 32)
+		require.NotEqual(t, secret, key1)
+
+		key2, err := DeriveKey(secret, KeyPurposeResponseEncryption)
+		require.NoError(t, err)
+		require.Equal(t, key1, key2)
+	})
+
+	t.Run("purposes derive different keys", func(t *testing.T) {
+		key1, err := DeriveKey(secret, KeyPurposeResponseEncryption)
+		require.NoError(t, err)
+
+		key2, err := DeriveKey(secret, "other-purpose")
+		require.NoError(t, err)
+		require.NotEqual(t, key1, key2)
+	})
+
+	t.Run("empty secret", func(t *testing.T) {
+		_, err := DeriveKey(nil, KeyPurposeResponseEncryption)
+		require.Error(t, err)
+	})
+
+	t.Run("empty purpose", func(t *testing.T) {
+		_, err := DeriveKey(secret, "")
+		require.Error(t, err)
+	})
+}
+
+func TestEncryptWithAssociatedData(t *testing.T) {
+	key, err := sha256hash([]byte("super-secret"))
+	require.NoError(t, err)
+
+	now := time.Now()
+	ad := RequestAssociatedData("get", "/debug", now)
+	require.Equal(t, ad, RequestAssociatedData("GET", "/debug", now))
+
+	enc, err := EncryptWithAssociatedData([]byte("content"), key, ad)
+	require.NoError(t, err)
+
+	dec, err := DecryptWithAssociatedData(enc, key, ad)
+	require.NoError(t, err)
+	require.Equal(t, "content", string(dec))
+
+	_, err = DecryptWithAssociatedData(enc, key, RequestAssociatedData("GET", "/other", now))
+	require.Error(t, err)
+
+	_, err = Decrypt(enc, key)
+	require.Error(t, err)
+}
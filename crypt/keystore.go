@@ -0,0 +1,47 @@
+package crypt
+
+import (
+	"crypto/ecdsa"
+	"os"
+
+	"github.com/aukilabs/go-tooling/pkg/errors"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+)
+
+var (
+	// Error returned when decrypting a keystore with a wrong passphrase.
+	ErrInvalidKeystorePassphrase = errors.New("invalid keystore passphrase")
+)
+
+// NewKeystoreSigner creates a signer with the key stored in the given
+// go-ethereum keystore file, encrypted with the given passphrase.
+func NewKeystoreSigner(filename, passphrase string) (*PrivateKeySigner, error) {
+	keyJSON, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, errors.New("reading keystore failed").
+			WithTag("filename", filename).
+			Wrap(err)
+	}
+
+	privateKey, err := DecryptKeystore(keyJSON, passphrase)
+	if err != nil {
+		return nil, errors.New("decrypting keystore failed").
+			WithTag("filename", filename).
+			Wrap(err)
+	}
+	return NewPrivateKeySigner(privateKey), nil
+}
+
+// DecryptKeystore decrypts the private key of the given go-ethereum keystore
+// JSON with the given passphrase. It returns an error that wraps
+// ErrInvalidKeystorePassphrase when the passphrase is wrong.
+func DecryptKeystore(keyJSON []byte, passphrase string) (*ecdsa.PrivateKey, error) {
+	key, err := keystore.DecryptKey(keyJSON, passphrase)
+	if errors.Is(err, keystore.ErrDecrypt) {
+		return nil, ErrInvalidKeystorePassphrase
+	}
+	if err != nil {
+		return nil, errors.New("decoding keystore failed").Wrap(err)
+	}
+	return key.PrivateKey, nil
+}
@@ -0,0 +1,286 @@
+package crypt
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/aukilabs/go-tooling/pkg/errors"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+const (
+	unixSocketScheme = "unix://"
+
+	// The host used in the URLs of requests sent over a Unix socket.
+	unixSocketHost = "http://signer"
+
+	// The maximum size of a request body accepted by a signer daemon.
+	maxSignerRequestSize = 1 << 20
+)
+
+var (
+	// Error returned when a remote signer is asked to sign a hash or a message
+	// with SignatureSchemeRaw. Signer daemons only sign messages they hash
+	// themselves with EIP-191 or EIP-712, so that they cannot be used to sign
+	// arbitrary hashes such as Ethereum transactions.
+	ErrRemoteRawSigning = errors.New("remote signers only sign eip191 and eip712 messages")
+)
+
+// SignerAddressOut is the response of a signer daemon to GET /address.
+type SignerAddressOut struct {
+	Address common.Address `json:"address"`
+}
+
+// SignMessageIn is the request body sent to a signer daemon on POST /sign.
+type SignMessageIn struct {
+	Scheme  SignatureScheme `json:"scheme"`
+	Domain  TypedDataDomain `json:"domain"`
+	Message string          `json:"message"`
+}
+
+// SignMessageOut is the response of a signer daemon to POST /sign.
+type SignMessageOut struct {
+	Signature hexutil.Bytes `json:"signature"`
+}
+
+type RemoteSignerOpts func(*RemoteSigner)
+
+// WithRemoteSignerTransport sets the transport used to reach the signer
+// daemon. Ignored for Unix socket endpoints.
+func WithRemoteSignerTransport(v http.RoundTripper) RemoteSignerOpts {
+	return func(s *RemoteSigner) {
+		s.transport = v
+	}
+}
+
+// RemoteSigner is a signer that delegates signing to a local signer daemon,
+// reached over HTTP or a Unix socket, so that the wallet key is never loaded
+// in the process.
+//
+// The daemon serves GET /address, that responds with a SignerAddressOut, and
+// POST /sign, that takes a SignMessageIn and responds with a SignMessageOut.
+// Requests are authenticated with a token shared with the daemon and sent as
+// a bearer token. NewSignerHandler implements such a daemon.
+//
+// The daemon hashes the messages itself and only signs them with
+// SignatureSchemePersonal or SignatureSchemeTypedData. SignHash and
+// SignatureSchemeRaw are not supported.
+type RemoteSigner struct {
+	endpoint  string
+	token     string
+	transport http.RoundTripper
+	address   common.Address
+}
+
+// NewRemoteSigner creates a signer that delegates signing to the signer
+// daemon at the given endpoint, authenticated with the given token. Endpoints
+// with the unix:// scheme designate a Unix socket path.
+//
+// The wallet address is fetched from the daemon on creation.
+func NewRemoteSigner(ctx context.Context, endpoint, token string, opts ...RemoteSignerOpts) (*RemoteSigner, error) {
+	s := &RemoteSigner{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		token:    token,
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if path, ok := strings.CutPrefix(s.endpoint, unixSocketScheme); ok {
+		var dialer net.Dialer
+		s.endpoint = unixSocketHost
+		s.transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return dialer.DialContext(ctx, "unix", path)
+			},
+		}
+	}
+
+	if s.transport == nil {
+		s.transport = http.DefaultTransport
+	}
+
+	var out SignerAddressOut
+	if err := s.do(ctx, http.MethodGet, "/address", nil, &out); err != nil {
+		return nil, errors.New("fetching signer address failed").
+			WithTag("endpoint", endpoint).
+			Wrap(err)
+	}
+	s.address = out.Address
+	return s, nil
+}
+
+// Address satisfies the Signer interface.
+func (s *RemoteSigner) Address() common.Address {
+	return s.address
+}
+
+// SignHash satisfies the Signer interface. It always returns
+// ErrRemoteRawSigning since signer daemons do not sign raw hashes.
+func (s *RemoteSigner) SignHash(ctx context.Context, hash []byte) ([]byte, error) {
+	return nil, ErrRemoteRawSigning
+}
+
+// SignMessage satisfies the MessageSigner interface. Signatures that are not
+// produced by the wallet of the signer address are rejected.
+func (s *RemoteSigner) SignMessage(ctx context.Context, scheme SignatureScheme, domain TypedDataDomain, message string) ([]byte, error) {
+	if scheme == SignatureSchemeRaw {
+		return nil, ErrRemoteRawSigning
+	}
+
+	hash, err := MessageHash(scheme, domain, message)
+	if err != nil {
+		return nil, err
+	}
+
+	var out SignMessageOut
+	in := SignMessageIn{
+		Scheme:  scheme,
+		Domain:  domain,
+		Message: message,
+	}
+	if err := s.do(ctx, http.MethodPost, "/sign", in, &out); err != nil {
+		return nil, errors.New("remote signing failed").Wrap(err)
+	}
+
+	signature := []byte(out.Signature)
+	signer, err := RecoverHashSigner(hash, signature)
+	if err != nil {
+		return nil, errors.New("invalid remote signature").Wrap(err)
+	}
+
+	if signer != s.address {
+		return nil, errors.New("remote signature is not from the signer address").
+			WithTag("address", s.address.Hex()).
+			WithTag("signer", signer.Hex())
+	}
+
+	if signature[crypto.RecoveryIDOffset] >= 27 {
+		signature[crypto.RecoveryIDOffset] -= 27
+	}
+	return signature, nil
+}
+
+func (s *RemoteSigner) do(ctx context.Context, method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return errors.New("encoding request failed").Wrap(err)
+		}
+		body = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, s.endpoint+path, body)
+	if err != nil {
+		return errors.New("creating request failed").Wrap(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+s.token)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := s.transport.RoundTrip(req)
+	if err != nil {
+		return errors.New("sending request failed").Wrap(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return errors.New("signer responded with an error").
+			WithTag("status_code", res.StatusCode).
+			WithTag("message", strings.TrimSpace(string(msg)))
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+		return errors.New("decoding response failed").Wrap(err)
+	}
+	return nil
+}
+
+// NewSignerHandler returns a handler that serves the signer daemon API with
+// the given signer. It is meant to run in a separate process that holds the
+// wallet key, on a loopback address or a Unix socket.
+//
+// Requests must carry the given token as a bearer token, and POST /sign
+// requests must be JSON. Messages are hashed by the handler with
+// SignatureSchemePersonal or SignatureSchemeTypedData, so that it never signs
+// a hash chosen by the caller. An empty token rejects all requests.
+func NewSignerHandler(signer Signer, token string) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/address", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeSignerJSON(w, SignerAddressOut{Address: signer.Address()})
+	})
+
+	mux.HandleFunc("/sign", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		var in SignMessageIn
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSignerRequestSize)).Decode(&in); err != nil {
+			http.Error(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		if in.Scheme != SignatureSchemePersonal && in.Scheme != SignatureSchemeTypedData {
+			http.Error(w, "unsupported signature scheme", http.StatusBadRequest)
+			return
+		}
+
+		hash, err := MessageHash(in.Scheme, in.Domain, in.Message)
+		if err != nil {
+			http.Error(w, "invalid message", http.StatusBadRequest)
+			return
+		}
+
+		signature, err := signer.SignHash(r.Context(), hash)
+		if err != nil {
+			http.Error(w, "signing failed", http.StatusInternalServerError)
+			return
+		}
+		writeSignerJSON(w, SignMessageOut{Signature: signature})
+	})
+
+	return signerAuthHandler(mux, token)
+}
+
+// signerAuthHandler rejects the requests that do not carry the given token as
+// a bearer token.
+func signerAuthHandler(h http.Handler, token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" || subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func writeSignerJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -2,38 +2,91 @@ package crypt
 
 import (
 	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
 
 	"github.com/aukilabs/go-tooling/pkg/errors"
 )
 
+const (
+	defaultPreviousKeyTTL = 5 * time.Minute
+	maxPreviousKeys       = 4
+
+	// The length, in bytes, of the hash prefix used as key ID.
+	keyIDLength = 8
+)
+
+var (
+	// Error returned when no key matches a key ID.
+	ErrUnknownKeyID = errors.New("unknown key id")
+)
+
 type hdsClient interface {
 	Secret() string
 }
 
-type cacher func(func() ([]byte, error)) ([]byte, error)
+type HagallSecretProviderOpts func(*HagallSecretProvider)
+
+// WithPreviousKeyTTL sets how long a key stays available with GetKeyByID
+// after the Hagall secret changed. Defaults to 5 minutes.
+func WithPreviousKeyTTL(v time.Duration) HagallSecretProviderOpts {
+	return func(h *HagallSecretProvider) {
+		h.keys.previousKeyTTL = v
+	}
+}
 
 // A secret provider using Hagall token from HDS client.
+//
+// The keys derived from the previous Hagall secrets are kept for a short
+// window so that responses encrypted before a secret rotation can still be
+// decrypted.
 type HagallSecretProvider struct {
 	client hdsClient
-	cacher
+	keys   *keyRing
 }
 
 // Returns a new HagallSecretProvider.
-func NewHagallSecretProvider(client hdsClient) HagallSecretProvider {
-	return HagallSecretProvider{
+func NewHagallSecretProvider(client hdsClient, opts ...HagallSecretProviderOpts) HagallSecretProvider {
+	h := HagallSecretProvider{
 		client: client,
-		cacher: keyCacher(client),
+		keys: &keyRing{
+			previousKeyTTL: defaultPreviousKeyTTL,
+			now:            time.Now,
+		},
+	}
+
+	for _, opt := range opts {
+		opt(&h)
 	}
+	return h
 }
 
 // GetKey generates a 256-bit key using sha256 hash of Hagall secret with cache.
 func (h HagallSecretProvider) GetKey() ([]byte, error) {
-	return h.cacher(h.getKey)
+	return h.keys.current(h.client.Secret())
 }
 
-// getKey generates a 256-bit key using sha256 hash of Hagall secret.
-func (h HagallSecretProvider) getKey() ([]byte, error) {
-	return sha256hash([]byte(h.client.Secret()))
+// GetKeyByID returns the current key or a previous key that is still in the
+// rotation window, whose KeyID matches the given ID. It returns an error that
+// wraps ErrUnknownKeyID when no key matches.
+func (h HagallSecretProvider) GetKeyByID(id string) ([]byte, error) {
+	key, err := h.GetKey()
+	if err != nil {
+		return nil, err
+	}
+
+	if KeyID(key) == id {
+		return key, nil
+	}
+	return h.keys.previous(id)
+}
+
+// KeyID returns the identifier of the given key. It is derived from the key
+// with a one-way hash and can be sent in clear.
+func KeyID(key []byte) string {
+	hash := sha256.Sum256(append([]byte("hagall-key-id:"), key...))
+	return hex.EncodeToString(hash[:keyIDLength])
 }
 
 func sha256hash(buf []byte) ([]byte, error) {
@@ -45,21 +98,78 @@ func sha256hash(buf []byte) ([]byte, error) {
 	return hash.Sum(nil), nil
 }
 
-// keyCacher returns cacher function that caches key generated from fn.
-// Cache is invalidated when client secret changes.
-func keyCacher(client hdsClient) cacher {
-	var cachedSecret string
-	var cachedKey []byte
-	return func(fn func() ([]byte, error)) ([]byte, error) {
-		var err error
-		if len(cachedKey) == 0 ||
-			cachedSecret != client.Secret() {
-			cachedKey, err = fn()
-			if err != nil {
-				return nil, err
-			}
-			cachedSecret = client.Secret()
+// keyRing caches the key generated from the current secret and keeps the keys
+// of the previous secrets until they expire.
+type keyRing struct {
+	previousKeyTTL time.Duration
+	now            func() time.Time
+
+	mutex         sync.Mutex
+	currentSecret string
+	currentKey    []byte
+	previousKeys  []previousKey
+}
+
+type previousKey struct {
+	id        string
+	key       []byte
+	expiresAt time.Time
+}
+
+// current returns the key generated from the given secret. The cache is
+// invalidated when the secret changes and the key of the replaced secret is
+// kept as a previous key.
+func (k *keyRing) current(secret string) ([]byte, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	if len(k.currentKey) != 0 && k.currentSecret == secret {
+		return k.currentKey, nil
+	}
+
+	key, err := sha256hash([]byte(secret))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(k.currentKey) != 0 && k.previousKeyTTL > 0 {
+		k.previousKeys = append(k.previousKeys, previousKey{
+			id:        KeyID(k.currentKey),
+			key:       k.currentKey,
+			expiresAt: k.now().Add(k.previousKeyTTL),
+		})
+
+		if len(k.previousKeys) > maxPreviousKeys {
+			k.previousKeys = k.previousKeys[len(k.previousKeys)-maxPreviousKeys:]
 		}
-		return cachedKey, nil
 	}
+
+	k.currentSecret = secret
+	k.currentKey = key
+	return key, nil
+}
+
+// previous returns the unexpired previous key with the given ID.
+func (k *keyRing) previous(id string) ([]byte, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	now := k.now()
+	keys := k.previousKeys[:0]
+	for _, p := range k.previousKeys {
+		if p.expiresAt.After(now) {
+			keys = append(keys, p)
+		}
+	}
+	k.previousKeys = keys
+
+	for i := len(keys) - 1; i >= 0; i-- {
+		if keys[i].id == id {
+			return keys[i].key, nil
+		}
+	}
+
+	return nil, errors.New("getting key failed").
+		WithTag("key_id", id).
+		Wrap(ErrUnknownKeyID)
 }
@@ -1,7 +1,9 @@
 package crypt
 
 import (
+	"fmt"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -25,6 +27,65 @@ func TestHagallSecretProvider(t *testing.T) {
 
 }
 
+func TestHagallSecretProviderRotation(t *testing.T) {
+	client := &mockHdsClient{secret: "secret-1"}
+	p := NewHagallSecretProvider(client, WithPreviousKeyTTL(time.Minute))
+
+	now := time.Now()
+	p.keys.now = func() time.Time { return now }
+
+	key1, err := p.GetKey()
+	require.NoError(t, err)
+
+	t.Run("current key", func(t *testing.T) {
+		key, err := p.GetKeyByID(KeyID(key1))
+		require.NoError(t, err)
+		require.Equal(t, key1, key)
+	})
+
+	client.secret = "secret-2"
+	key2, err := p.GetKey()
+	require.NoError(t, err)
+
+	t.Run("previous key within the window", func(t *testing.T) {
+		key, err := p.GetKeyByID(KeyID(key1))
+		require.NoError(t, err)
+		require.Equal(t, key1, key)
+
+		key, err = p.GetKeyByID(KeyID(key2))
+		require.NoError(t, err)
+		require.Equal(t, key2, key)
+	})
+
+	t.Run("unknown key", func(t *testing.T) {
+		_, err := p.GetKeyByID("deadbeef")
+		require.ErrorIs(t, err, ErrUnknownKeyID)
+	})
+
+	t.Run("previous key after the window", func(t *testing.T) {
+		now = now.Add(2 * time.Minute)
+
+		_, err := p.GetKeyByID(KeyID(key1))
+		require.ErrorIs(t, err, ErrUnknownKeyID)
+	})
+
+	t.Run("previous keys are bounded", func(t *testing.T) {
+		var ids []string
+		for i := 0; i < maxPreviousKeys+2; i++ {
+			client.secret = fmt.Sprintf("secret-%d", i+3)
+			key, err := p.GetKey()
+			require.NoError(t, err)
+			ids = append(ids, KeyID(key))
+		}
+
+		_, err := p.GetKeyByID(ids[0])
+		require.ErrorIs(t, err, ErrUnknownKeyID)
+
+		_, err = p.GetKeyByID(ids[len(ids)-2])
+		require.NoError(t, err)
+	})
+}
+
 type mockHdsClient struct {
 	secret string
 }
@@ -1,25 +1,19 @@
 package crypt
 
 import (
+	"context"
 	"crypto/ecdsa"
 	"time"
 
 	"github.com/aukilabs/go-tooling/pkg/errors"
 	"github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/crypto"
 )
 
 // Sign signs a message with an ECDSA private key.
 // Returns signature in 0x string format.
 func Sign(privateKey *ecdsa.PrivateKey, message string) (string, error) {
-	signature, err := crypto.Sign(crypto.Keccak256([]byte(message)), privateKey)
-	if err != nil {
-		return "", errors.New("signing message failed").
-			Wrap(err)
-	}
-
-	return hexutil.Encode(signature), nil
+	return SignWithSigner(context.Background(), NewPrivateKeySigner(privateKey), message)
 }
 
 // SignWithTimestamp signs a message with an ECDSA private key.
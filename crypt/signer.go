@@ -0,0 +1,116 @@
+package crypt
+
+import (
+	"context"
+	"crypto/ecdsa"
+
+	"github.com/aukilabs/go-tooling/pkg/errors"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// Signer is the interface that signs hashes with a wallet key. It allows
+// keeping the key out of the process memory.
+type Signer interface {
+	// Address returns the address of the wallet that signs the hashes.
+	Address() common.Address
+
+	// SignHash signs the given 32 bytes hash. The signature is 65 bytes long
+	// in the [R || S || V] format, where V is 0 or 1.
+	SignHash(ctx context.Context, hash []byte) ([]byte, error)
+}
+
+// MessageSigner is a signer that hashes the messages it signs itself, such as
+// a signer that refuses to sign arbitrary hashes. SignMessageWithSigner and
+// SignMessageBytes use SignMessage instead of SignHash when a signer
+// implements it.
+type MessageSigner interface {
+	Signer
+
+	// SignMessage signs the given message hashed with the given scheme. The
+	// signature is in the same format as the ones returned by SignHash.
+	SignMessage(ctx context.Context, scheme SignatureScheme, domain TypedDataDomain, message string) ([]byte, error)
+}
+
+// PrivateKeySigner is a signer that holds the wallet key in memory.
+type PrivateKeySigner struct {
+	privateKey *ecdsa.PrivateKey
+	address    common.Address
+}
+
+// NewPrivateKeySigner creates a signer that signs hashes with the given
+// private key.
+func NewPrivateKeySigner(privateKey *ecdsa.PrivateKey) *PrivateKeySigner {
+	return &PrivateKeySigner{
+		privateKey: privateKey,
+		address:    crypto.PubkeyToAddress(privateKey.PublicKey),
+	}
+}
+
+// NewHexKeySigner creates a signer that signs hashes with the given
+// hex-encoded private key.
+func NewHexKeySigner(privateKey string) (*PrivateKeySigner, error) {
+	key, err := crypto.HexToECDSA(privateKey)
+	if err != nil {
+		return nil, errors.New("decoding private key failed").Wrap(err)
+	}
+	return NewPrivateKeySigner(key), nil
+}
+
+// Address satisfies the Signer interface.
+func (s *PrivateKeySigner) Address() common.Address {
+	return s.address
+}
+
+// SignHash satisfies the Signer interface.
+func (s *PrivateKeySigner) SignHash(ctx context.Context, hash []byte) ([]byte, error) {
+	return crypto.Sign(hash, s.privateKey)
+}
+
+// SignWithSigner signs a message with the given signer. Returns signature in
+// 0x string format.
+func SignWithSigner(ctx context.Context, signer Signer, message string) (string, error) {
+	return SignMessageWithSigner(ctx, signer, SignatureSchemeRaw, TypedDataDomain{}, message)
+}
+
+// SignHashWithScheme signs the given hash with the given signer. The recovery
+// ID is set to 27 or 28 for the schemes used by standard wallets.
+func SignHashWithScheme(ctx context.Context, signer Signer, scheme SignatureScheme, hash []byte) ([]byte, error) {
+	signature, err := signer.SignHash(ctx, hash)
+	return schemeSignature(signer, scheme, signature, err)
+}
+
+// SignMessageBytes signs a message with the given signer and scheme, and
+// returns the signature in the format of SignHashWithScheme. The message is
+// hashed with MessageHash unless the signer is a MessageSigner.
+func SignMessageBytes(ctx context.Context, signer Signer, scheme SignatureScheme, domain TypedDataDomain, message string) ([]byte, error) {
+	if s, ok := signer.(MessageSigner); ok {
+		signature, err := s.SignMessage(ctx, scheme, domain, message)
+		return schemeSignature(signer, scheme, signature, err)
+	}
+
+	hash, err := MessageHash(scheme, domain, message)
+	if err != nil {
+		return nil, err
+	}
+	return SignHashWithScheme(ctx, signer, scheme, hash)
+}
+
+func schemeSignature(signer Signer, scheme SignatureScheme, signature []byte, err error) ([]byte, error) {
+	if err != nil {
+		return nil, errors.New("signing hash failed").
+			WithTag("address", signer.Address().Hex()).
+			Wrap(err)
+	}
+
+	if len(signature) != crypto.SignatureLength {
+		return nil, errors.New("invalid signature length").
+			WithTag("address", signer.Address().Hex()).
+			WithTag("length", len(signature))
+	}
+
+	if scheme != SignatureSchemeRaw {
+		signature[crypto.RecoveryIDOffset] += 27
+	}
+	return signature, nil
+}
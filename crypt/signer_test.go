@@ -0,0 +1,210 @@
+package crypt
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/require"
+)
+
+// The go-ethereum keystore test vector encrypted with very light scrypt
+// parameters and an empty passphrase.
+const testKeystore = `{"address":"45dea0fb0bba44f4fcf290bba71fd57d7117cbb8","crypto":{"cipher":"aes-128-ctr","ciphertext":"b87781948a1befd247bff51ef4063f716cf6c2d3481163e9a8f42e1f9bb74145","cipherparams":{"iv":"dc4926b48a105133d2f16b96833abf1e"},"kdf":"scrypt","kdfparams":{"dklen":32,"n":2,"p":1,"r":8,"salt":"004244bbdc51cadda545b1cfa43cff9ed2ae88e08c61f1479dbb45410722f8f0"},"mac":"39990c1684557447940d4c69e06b1b82b2aceacb43f284df65c956daf3046b85"},"id":"ce541d8d-c79b-40f8-9f8c-20f59616faba","version":3}`
+
+func TestPrivateKeySigner(t *testing.T) {
+	privateKey, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	signer := NewPrivateKeySigner(privateKey)
+	require.Equal(t, crypto.PubkeyToAddress(privateKey.PublicKey), signer.Address())
+
+	t.Run("sign with signer matches sign", func(t *testing.T) {
+		expected, err := Sign(privateKey, "message")
+		require.NoError(t, err)
+
+		signature, err := SignWithSigner(context.Background(), signer, "message")
+		require.NoError(t, err)
+		require.Equal(t, expected, signature)
+	})
+
+	t.Run("hex key", func(t *testing.T) {
+		hexSigner, err := NewHexKeySigner(common.Bytes2Hex(crypto.FromECDSA(privateKey)))
+		require.NoError(t, err)
+		require.Equal(t, signer.Address(), hexSigner.Address())
+
+		_, err = NewHexKeySigner("not a key")
+		require.Error(t, err)
+	})
+}
+
+func TestDecryptKeystore(t *testing.T) {
+	t.Run("scrypt", func(t *testing.T) {
+		privateKey, err := DecryptKeystore([]byte(testKeystore), "")
+		require.NoError(t, err)
+		require.Equal(t, common.HexToAddress("45dea0fb0bba44f4fcf290bba71fd57d7117cbb8"), crypto.PubkeyToAddress(privateKey.PublicKey))
+	})
+
+	t.Run("wrong passphrase", func(t *testing.T) {
+		_, err := DecryptKeystore([]byte(testKeystore), "bad")
+		require.ErrorIs(t, err, ErrInvalidKeystorePassphrase)
+	})
+
+	t.Run("pbkdf2", func(t *testing.T) {
+		keyJSON := `{"crypto":{"cipher":"aes-128-ctr","cipherparams":{"iv":"6087dab2f9fdbbfaddc31a909735c1e6"},"ciphertext":"5318b4d5bcd28de64ee5559e671353e16f075ecae9f99c7a79a38af5f869aa46","kdf":"pbkdf2","kdfparams":{"c":262144,"dklen":32,"prf":"hmac-sha256","salt":"ae3cd4e7013836a3df6bd7241b12db061dbe2c6785853cce422d148a624ce0bd"},"mac":"517ead924a9d0dc3124507e3393d175ce3ff7c1e96529c6c555ce9e51205e9b2"},"id":"3198bc9c-6672-5ab3-d995-4942343ae5b6","version":3}`
+
+		privateKey, err := DecryptKeystore([]byte(keyJSON), "testpassword")
+		require.NoError(t, err)
+		require.Equal(t, "7a28b5ba57c53603b0b07b56bba752f7784bf506fa95edc395f5cf6c7514fe9d", common.Bytes2Hex(crypto.FromECDSA(privateKey)))
+	})
+
+	t.Run("keystore file", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "key.json")
+		require.NoError(t, os.WriteFile(filename, []byte(testKeystore), 0600))
+
+		signer, err := NewKeystoreSigner(filename, "")
+		require.NoError(t, err)
+		require.Equal(t, common.HexToAddress("45dea0fb0bba44f4fcf290bba71fd57d7117cbb8"), signer.Address())
+
+		_, err = NewKeystoreSigner(filepath.Join(t.TempDir(), "missing.json"), "")
+		require.Error(t, err)
+	})
+}
+
+func TestRemoteSigner(t *testing.T) {
+	privateKey, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	keySigner := NewPrivateKeySigner(privateKey)
+	domain := NewTypedDataDomain(PurposeHagallRegistration, 1)
+
+	t.Run("http", func(t *testing.T) {
+		server := httptest.NewServer(NewSignerHandler(keySigner, "token"))
+		defer server.Close()
+
+		signer, err := NewRemoteSigner(context.Background(), server.URL, "token")
+		require.NoError(t, err)
+		require.Equal(t, keySigner.Address(), signer.Address())
+
+		signature, err := SignMessageWithSigner(context.Background(), signer, SignatureSchemeTypedData, domain, "message")
+		require.NoError(t, err)
+
+		address, err := RecoverMessageSigner(SignatureSchemeTypedData, domain, "message", signature)
+		require.NoError(t, err)
+		require.Equal(t, keySigner.Address(), address)
+	})
+
+	t.Run("unix socket", func(t *testing.T) {
+		socket := filepath.Join(t.TempDir(), "signer.sock")
+		l, err := net.Listen("unix", socket)
+		require.NoError(t, err)
+
+		server := &http.Server{Handler: NewSignerHandler(keySigner, "token")}
+		go server.Serve(l)
+		defer server.Close()
+
+		signer, err := NewRemoteSigner(context.Background(), "unix://"+socket, "token")
+		require.NoError(t, err)
+
+		expected, err := SignMessage(privateKey, SignatureSchemePersonal, TypedDataDomain{}, "message")
+		require.NoError(t, err)
+
+		signature, err := SignMessageWithSigner(context.Background(), signer, SignatureSchemePersonal, TypedDataDomain{}, "message")
+		require.NoError(t, err)
+		require.Equal(t, expected, signature)
+	})
+
+	t.Run("raw hashes are not signed", func(t *testing.T) {
+		server := httptest.NewServer(NewSignerHandler(keySigner, "token"))
+		defer server.Close()
+
+		signer, err := NewRemoteSigner(context.Background(), server.URL, "token")
+		require.NoError(t, err)
+
+		_, err = signer.SignHash(context.Background(), crypto.Keccak256([]byte("message")))
+		require.ErrorIs(t, err, ErrRemoteRawSigning)
+
+		_, err = SignWithSigner(context.Background(), signer, "message")
+		require.ErrorIs(t, err, ErrRemoteRawSigning)
+
+		res := postSignRequest(t, server.URL, "token", "application/json", `{"scheme":"","message":"message"}`)
+		require.Equal(t, http.StatusBadRequest, res.StatusCode)
+	})
+
+	t.Run("unauthenticated requests are rejected", func(t *testing.T) {
+		server := httptest.NewServer(NewSignerHandler(keySigner, "token"))
+		defer server.Close()
+
+		_, err := NewRemoteSigner(context.Background(), server.URL, "bad")
+		require.Error(t, err)
+
+		res := postSignRequest(t, server.URL, "", "application/json", `{"scheme":"eip191","message":"message"}`)
+		require.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+		res = postSignRequest(t, server.URL, "bad", "application/json", `{"scheme":"eip191","message":"message"}`)
+		require.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	})
+
+	t.Run("empty token rejects all requests", func(t *testing.T) {
+		server := httptest.NewServer(NewSignerHandler(keySigner, ""))
+		defer server.Close()
+
+		_, err := NewRemoteSigner(context.Background(), server.URL, "")
+		require.Error(t, err)
+	})
+
+	t.Run("non json requests are rejected", func(t *testing.T) {
+		server := httptest.NewServer(NewSignerHandler(keySigner, "token"))
+		defer server.Close()
+
+		res := postSignRequest(t, server.URL, "token", "text/plain", `{"scheme":"eip191","message":"message"}`)
+		require.Equal(t, http.StatusUnsupportedMediaType, res.StatusCode)
+
+		res = postSignRequest(t, server.URL, "token", "application/json; charset=utf-8", `{"scheme":"eip191","message":"message"}`)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+	})
+
+	t.Run("signature from another key is rejected", func(t *testing.T) {
+		otherKey, err := crypto.GenerateKey()
+		require.NoError(t, err)
+
+		mux := http.NewServeMux()
+		mux.Handle("/address", NewSignerHandler(keySigner, "token"))
+		mux.Handle("/sign", NewSignerHandler(NewPrivateKeySigner(otherKey), "token"))
+		server := httptest.NewServer(mux)
+		defer server.Close()
+
+		signer, err := NewRemoteSigner(context.Background(), server.URL, "token")
+		require.NoError(t, err)
+
+		_, err = signer.SignMessage(context.Background(), SignatureSchemeTypedData, domain, "message")
+		require.Error(t, err)
+	})
+
+	t.Run("unreachable signer", func(t *testing.T) {
+		server := httptest.NewServer(http.NotFoundHandler())
+		server.Close()
+
+		_, err := NewRemoteSigner(context.Background(), server.URL, "token")
+		require.Error(t, err)
+	})
+}
+
+func postSignRequest(t *testing.T, endpoint, token, contentType, body string) *http.Response {
+	req, err := http.NewRequest(http.MethodPost, endpoint+"/sign", strings.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", contentType)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+	return res
+}
@@ -0,0 +1,312 @@
+package crypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"math"
+
+	"github.com/aukilabs/go-tooling/pkg/errors"
+)
+
+const (
+	// The maximum size of the plaintext of a stream chunk.
+	StreamChunkSize = 64 * 1024
+
+	streamVersion      = 1
+	streamPrefixSize   = 7
+	streamHeaderSize   = 1 + streamPrefixSize
+	streamChunkHeader  = 1 + 4
+	streamLastChunk    = 1
+	streamNotLastChunk = 0
+)
+
+var (
+	// Error returned when reading an encrypted stream that was tampered with,
+	// truncated or encrypted with another key or associated data.
+	ErrInvalidStream = errors.New("invalid encrypted stream")
+)
+
+// The encrypted stream format follows the STREAM construction: the plaintext
+// is split in chunks that are sealed with AES-GCM under a nonce made of a
+// random prefix, the chunk counter and a flag set on the last chunk only.
+// Reordered, dropped or truncated chunks fail authentication.
+//
+// A stream starts with a header made of the format version and the nonce
+// prefix. Each chunk is the last chunk flag as a byte and the ciphertext
+// length as a 4 bytes big endian integer, followed by the ciphertext. The flag
+// is authenticated through the nonce. The last chunk can be empty.
+
+// EncryptWriter is an io.WriteCloser that encrypts what is written to it in
+// the encrypted stream format.
+type EncryptWriter struct {
+	writer         io.Writer
+	aead           cipher.AEAD
+	associatedData []byte
+	prefix         [streamPrefixSize]byte
+	counter        uint64
+	buf            []byte
+	headerWritten  bool
+	closed         bool
+	err            error
+}
+
+// NewEncryptWriter returns a writer that encrypts with key and authenticates
+// the given associated data. Close must be called to write the last chunk.
+func NewEncryptWriter(w io.Writer, key, associatedData []byte) (*EncryptWriter, error) {
+	aead, err := newStreamAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &EncryptWriter{
+		writer:         w,
+		aead:           aead,
+		associatedData: associatedData,
+		buf:            make([]byte, 0, StreamChunkSize),
+	}
+
+	if _, err := io.ReadFull(rand.Reader, e.prefix[:]); err != nil {
+		return nil, errors.New("failed to initialize nonce").
+			WithTag("nonce_size", streamPrefixSize).
+			Wrap(err)
+	}
+	return e, nil
+}
+
+// Write satisfies the io.Writer interface. Data is written to the underlying
+// writer by chunks of StreamChunkSize bytes.
+func (e *EncryptWriter) Write(p []byte) (int, error) {
+	if e.closed {
+		return 0, errors.New("writing to a closed encrypt writer")
+	}
+
+	n := 0
+	for len(p) > 0 {
+		if len(e.buf) == StreamChunkSize {
+			if err := e.writeChunk(false); err != nil {
+				return n, err
+			}
+		}
+
+		c := copy(e.buf[len(e.buf):StreamChunkSize], p)
+		e.buf = e.buf[:len(e.buf)+c]
+		p = p[c:]
+		n += c
+	}
+	return n, nil
+}
+
+// Flush writes the buffered data to the underlying writer as a chunk, even
+// when it is smaller than StreamChunkSize.
+func (e *EncryptWriter) Flush() error {
+	if e.closed {
+		return errors.New("flushing a closed encrypt writer")
+	}
+
+	if len(e.buf) == 0 {
+		return e.writeHeader()
+	}
+	return e.writeChunk(false)
+}
+
+// Close writes the buffered data as the last chunk. It does not close the
+// underlying writer.
+func (e *EncryptWriter) Close() error {
+	if e.closed {
+		return e.err
+	}
+
+	err := e.writeChunk(true)
+	e.closed = true
+	return err
+}
+
+func (e *EncryptWriter) writeHeader() error {
+	if e.err != nil || e.headerWritten {
+		return e.err
+	}
+
+	header := make([]byte, 0, streamHeaderSize)
+	header = append(header, streamVersion)
+	header = append(header, e.prefix[:]...)
+
+	if _, e.err = e.writer.Write(header); e.err != nil {
+		return errors.New("writing stream header failed").Wrap(e.err)
+	}
+	e.headerWritten = true
+	return nil
+}
+
+func (e *EncryptWriter) writeChunk(last bool) error {
+	if err := e.writeHeader(); err != nil {
+		return err
+	}
+
+	if e.counter > math.MaxUint32 {
+		e.err = errors.New("too many stream chunks")
+		return e.err
+	}
+
+	nonce := streamNonce(e.prefix, e.counter, last)
+	e.counter++
+
+	chunk := make([]byte, streamChunkHeader, streamChunkHeader+len(e.buf)+e.aead.Overhead())
+	chunk = e.aead.Seal(chunk, nonce, e.buf, e.associatedData)
+	chunk[0] = nonce[nonceSize-1]
+	binary.BigEndian.PutUint32(chunk[1:], uint32(len(chunk)-streamChunkHeader))
+	e.buf = e.buf[:0]
+
+	if _, e.err = e.writer.Write(chunk); e.err != nil {
+		return errors.New("writing stream chunk failed").Wrap(e.err)
+	}
+	return nil
+}
+
+// DecryptReader is an io.Reader that decrypts a stream produced by an
+// EncryptWriter.
+type DecryptReader struct {
+	reader         io.Reader
+	associatedData []byte
+	aead           cipher.AEAD
+	prefix         [streamPrefixSize]byte
+	counter        uint64
+	plaintext      []byte
+	done           bool
+	err            error
+}
+
+// NewDecryptReader returns a reader that decrypts the stream read from r with
+// key and the associated data given to NewEncryptWriter. Read returns an error
+// that wraps ErrInvalidStream when the stream is not authentic.
+func NewDecryptReader(r io.Reader, key, associatedData []byte) (*DecryptReader, error) {
+	aead, err := newStreamAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DecryptReader{
+		reader:         r,
+		aead:           aead,
+		associatedData: associatedData,
+	}, nil
+}
+
+// Read satisfies the io.Reader interface.
+func (d *DecryptReader) Read(p []byte) (int, error) {
+	for len(d.plaintext) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+
+		if d.done {
+			return 0, io.EOF
+		}
+
+		d.err = d.readChunk()
+	}
+
+	n := copy(p, d.plaintext)
+	d.plaintext = d.plaintext[n:]
+	return n, nil
+}
+
+func (d *DecryptReader) readChunk() error {
+	if d.counter == 0 {
+		var header [streamHeaderSize]byte
+		if _, err := io.ReadFull(d.reader, header[:]); err != nil {
+			return invalidStreamError("reading stream header failed", err)
+		}
+
+		if header[0] != streamVersion {
+			return errors.New("unsupported stream version").
+				WithTag("version", header[0]).
+				Wrap(ErrInvalidStream)
+		}
+		copy(d.prefix[:], header[1:])
+	}
+
+	var chunkHeader [streamChunkHeader]byte
+	if _, err := io.ReadFull(d.reader, chunkHeader[:]); err != nil {
+		return invalidStreamError("reading stream chunk header failed", err)
+	}
+
+	if flag := chunkHeader[0]; flag != streamLastChunk && flag != streamNotLastChunk {
+		return errors.New("invalid stream chunk flag").
+			WithTag("flag", flag).
+			Wrap(ErrInvalidStream)
+	}
+
+	last := chunkHeader[0] == streamLastChunk
+	size := int(binary.BigEndian.Uint32(chunkHeader[1:]))
+	if size < d.aead.Overhead() || size > StreamChunkSize+d.aead.Overhead() {
+		return errors.New("invalid stream chunk length").
+			WithTag("length", size).
+			Wrap(ErrInvalidStream)
+	}
+
+	chunk := make([]byte, size)
+	if _, err := io.ReadFull(d.reader, chunk); err != nil {
+		return invalidStreamError("reading stream chunk failed", err)
+	}
+
+	if d.counter > math.MaxUint32 {
+		return errors.New("too many stream chunks").Wrap(ErrInvalidStream)
+	}
+
+	nonce := streamNonce(d.prefix, d.counter, last)
+	d.counter++
+
+	plaintext, err := d.aead.Open(chunk[:0], nonce, chunk, d.associatedData)
+	if err != nil {
+		return errors.New("failed to decrypt stream chunk").
+			WithTag("chunk", d.counter-1).
+			WithTag("last", last).
+			WithTag("reason", err.Error()).
+			Wrap(ErrInvalidStream)
+	}
+
+	d.plaintext = plaintext
+	d.done = last
+	return nil
+}
+
+func newStreamAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.New("failed to initialize cipher").
+			WithTag("key_length", len(key)).
+			Wrap(err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.New("failed to initialize encryptor").
+			Wrap(err)
+	}
+	return aead, nil
+}
+
+// streamNonce returns the nonce of the chunk at the given position.
+func streamNonce(prefix [streamPrefixSize]byte, counter uint64, last bool) []byte {
+	nonce := make([]byte, nonceSize)
+	copy(nonce, prefix[:])
+	binary.BigEndian.PutUint32(nonce[streamPrefixSize:], uint32(counter))
+
+	nonce[nonceSize-1] = streamNotLastChunk
+	if last {
+		nonce[nonceSize-1] = streamLastChunk
+	}
+	return nonce
+}
+
+func invalidStreamError(msg string, err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errors.New(msg).
+			WithTag("reason", "stream is truncated").
+			Wrap(ErrInvalidStream)
+	}
+	return errors.New(msg).Wrap(err)
+}
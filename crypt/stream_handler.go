@@ -0,0 +1,184 @@
+package crypt
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/aukilabs/go-tooling/pkg/errors"
+	"github.com/aukilabs/go-tooling/pkg/logs"
+)
+
+const (
+	// The header that carries the format of an encrypted response. It is only
+	// set on streamed responses.
+	EncryptionFormatHeader = "X-Encryption-Format"
+
+	// The format of responses encrypted with HandleWithStreamEncryption.
+	EncryptionFormatStream = "stream-v1"
+)
+
+// HandleWithStreamEncryption returns a http handler function that encrypts
+// content returned by handler in the encrypted stream format, using key
+// provided by secretProvider.
+//
+// Unlike HandleWithEncryption, the content is not buffered: it is encrypted
+// and sent by chunks of StreamChunkSize bytes, or earlier when the handler
+// flushes the response. Responses with a status code other than 200 are sent
+// unencrypted.
+func HandleWithStreamEncryption(provider secretProvider, handler http.Handler, opts ...EncryptionOpts) http.HandlerFunc {
+	options := newEncryptionOptions(opts)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		responseWriter := &streamEncrypter{
+			secret:  provider,
+			writer:  w,
+			request: r,
+			options: options,
+		}
+
+		removeCompression(r.Header)
+
+		handler.ServeHTTP(responseWriter, r)
+
+		if err := responseWriter.close(); err != nil {
+			logs.Error(errors.New("failed closing encrypted stream").Wrap(err))
+		}
+	}
+}
+
+// streamEncrypter implements http.ResponseWriter and http.Flusher interfaces
+// to encrypt the plaintext response from upstream http.Handler as it is
+// written.
+type streamEncrypter struct {
+	secret     secretProvider
+	writer     http.ResponseWriter
+	request    *http.Request
+	options    encryptionOptions
+	statusCode int
+	encrypter  *EncryptWriter
+	err        error
+}
+
+// Returns underlying response writer header.
+func (w *streamEncrypter) Header() http.Header {
+	return w.writer.Header()
+}
+
+// WriteHeader starts the encrypted stream when statusCode is 200 and writes
+// the header to the underlying response writer.
+func (w *streamEncrypter) WriteHeader(statusCode int) {
+	if w.statusCode != 0 {
+		return
+	}
+	w.statusCode = statusCode
+
+	if statusCode != http.StatusOK {
+		w.writer.WriteHeader(statusCode)
+		return
+	}
+
+	key, err := w.secret.GetKey()
+	if err != nil {
+		w.fail(http.StatusInternalServerError, errors.New("failed getting key").Wrap(err))
+		return
+	}
+
+	// return status 403 when key is empty (hagall unregistered)
+	if len(key) == 0 {
+		w.fail(http.StatusForbidden, errors.New("encryption key is empty"))
+		return
+	}
+
+	key, associatedData, err := w.options.responseKey(key, w.request, w.writer.Header())
+	if err != nil {
+		w.fail(http.StatusInternalServerError, errors.New("failed deriving key").Wrap(err))
+		return
+	}
+
+	if w.encrypter, err = NewEncryptWriter(w.writer, key, associatedData); err != nil {
+		w.fail(http.StatusInternalServerError, errors.New("failed initializing encryption").Wrap(err))
+		return
+	}
+
+	header := w.writer.Header()
+	header.Set(EncryptionFormatHeader, EncryptionFormatStream)
+	header.Del("Content-Length")
+	w.writer.WriteHeader(statusCode)
+}
+
+// Write encrypts upstream content and writes it to the underlying response
+// writer.
+func (w *streamEncrypter) Write(buf []byte) (int, error) {
+	if w.statusCode == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	if w.encrypter == nil {
+		return w.writer.Write(buf)
+	}
+	return w.encrypter.Write(buf)
+}
+
+// Flush writes the encrypted content buffered so far to the client.
+func (w *streamEncrypter) Flush() {
+	if w.encrypter != nil && w.err == nil {
+		if w.err = w.encrypter.Flush(); w.err != nil {
+			return
+		}
+	}
+
+	if f, ok := w.writer.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// close writes the last chunk of the encrypted stream.
+func (w *streamEncrypter) close() error {
+	if w.encrypter == nil || w.err != nil {
+		return nil
+	}
+	return w.encrypter.Close()
+}
+
+// fail writes the given status code and makes the following writes fail.
+func (w *streamEncrypter) fail(statusCode int, err error) {
+	logs.Error(err)
+	w.err = err
+
+	header := w.writer.Header()
+	header.Del(KeyIDHeader)
+	header.Del(TimestampHeader)
+	header.Del("Content-Length")
+	w.writer.WriteHeader(statusCode)
+}
+
+// NewResponseDecryptReader returns a reader that decrypts the body of a
+// response produced by HandleWithStreamEncryption as it is read. Keys are
+// selected like with DecryptResponse. The caller must close the response
+// body.
+//
+// Responses with a status code other than 200 are not encrypted and are
+// returned as an error.
+func NewResponseDecryptReader(res *http.Response, provider keyRingProvider, opts ...EncryptionOpts) (io.Reader, error) {
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return nil, errors.New("response is not encrypted").
+			WithTag("status_code", res.StatusCode).
+			WithTag("body", string(body))
+	}
+
+	if format := res.Header.Get(EncryptionFormatHeader); format != EncryptionFormatStream {
+		return nil, errors.New("response is not an encrypted stream").
+			WithTag("format", format)
+	}
+
+	key, associatedData, err := responseDecryptionKey(res, provider, newEncryptionOptions(opts))
+	if err != nil {
+		return nil, err
+	}
+	return NewDecryptReader(res.Body, key, associatedData)
+}
@@ -0,0 +1,176 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptStream(t *testing.T) {
+	key, err := sha256hash([]byte("super-secret"))
+	require.NoError(t, err)
+
+	encrypt := func(t *testing.T, plaintext []byte, associatedData []byte) []byte {
+		var buf bytes.Buffer
+		w, err := NewEncryptWriter(&buf, key, associatedData)
+		require.NoError(t, err)
+
+		_, err = w.Write(plaintext)
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+		return buf.Bytes()
+	}
+
+	decrypt := func(encrypted []byte, associatedData []byte) ([]byte, error) {
+		r, err := NewDecryptReader(bytes.NewReader(encrypted), key, associatedData)
+		if err != nil {
+			return nil, err
+		}
+		return io.ReadAll(r)
+	}
+
+	plaintext := make([]byte, 3*StreamChunkSize+42)
+	_, err = rand.Read(plaintext)
+	require.NoError(t, err)
+
+	t.Run("round trip", func(t *testing.T) {
+		sizes := []int{0, 1, StreamChunkSize, StreamChunkSize + 1, len(plaintext)}
+		for _, size := range sizes {
+			decrypted, err := decrypt(encrypt(t, plaintext[:size], []byte("ad")), []byte("ad"))
+			require.NoError(t, err)
+			require.Equal(t, plaintext[:size], decrypted)
+		}
+	})
+
+	t.Run("flushed chunks", func(t *testing.T) {
+		var buf bytes.Buffer
+		w, err := NewEncryptWriter(&buf, key, nil)
+		require.NoError(t, err)
+
+		_, err = w.Write([]byte("hello "))
+		require.NoError(t, err)
+		require.NoError(t, w.Flush())
+		flushed := buf.Len()
+		require.Greater(t, flushed, 0)
+
+		_, err = w.Write([]byte("world"))
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+
+		decrypted, err := decrypt(buf.Bytes(), nil)
+		require.NoError(t, err)
+		require.Equal(t, "hello world", string(decrypted))
+
+		_, err = decrypt(buf.Bytes()[:flushed], nil)
+		require.ErrorIs(t, err, ErrInvalidStream)
+	})
+
+	t.Run("truncated stream", func(t *testing.T) {
+		encrypted := encrypt(t, plaintext, nil)
+		chunk := streamChunkHeader + StreamChunkSize + 16
+
+		_, err := decrypt(encrypted[:streamHeaderSize+chunk], nil)
+		require.ErrorIs(t, err, ErrInvalidStream)
+
+		_, err = decrypt(encrypted[:len(encrypted)-1], nil)
+		require.ErrorIs(t, err, ErrInvalidStream)
+	})
+
+	t.Run("forged last chunk flag", func(t *testing.T) {
+		encrypted := encrypt(t, plaintext, nil)
+		chunk := streamChunkHeader + StreamChunkSize + 16
+
+		truncated := append([]byte(nil), encrypted[:streamHeaderSize+chunk]...)
+		truncated[streamHeaderSize] = streamLastChunk
+
+		_, err := decrypt(truncated, nil)
+		require.ErrorIs(t, err, ErrInvalidStream)
+	})
+
+	t.Run("reordered chunks", func(t *testing.T) {
+		encrypted := encrypt(t, plaintext, nil)
+		chunk := streamChunkHeader + StreamChunkSize + 16
+
+		reordered := append([]byte(nil), encrypted[:streamHeaderSize]...)
+		reordered = append(reordered, encrypted[streamHeaderSize+chunk:streamHeaderSize+2*chunk]...)
+		reordered = append(reordered, encrypted[streamHeaderSize:streamHeaderSize+chunk]...)
+		reordered = append(reordered, encrypted[streamHeaderSize+2*chunk:]...)
+
+		_, err := decrypt(reordered, nil)
+		require.ErrorIs(t, err, ErrInvalidStream)
+	})
+
+	t.Run("wrong associated data", func(t *testing.T) {
+		_, err := decrypt(encrypt(t, plaintext[:10], []byte("ad")), []byte("other"))
+		require.ErrorIs(t, err, ErrInvalidStream)
+	})
+}
+
+func TestHandleWithStreamEncryption(t *testing.T) {
+	provider := NewHagallSecretProvider(&mockHdsClient{secret: "secret"})
+
+	body := make([]byte, 2*StreamChunkSize+7)
+	_, err := rand.Read(body)
+	require.NoError(t, err)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body[:10])
+		w.(http.Flusher).Flush()
+		w.Write(body[10:])
+	})
+
+	t.Run("decrypt streamed response", func(t *testing.T) {
+		server := httptest.NewServer(HandleWithStreamEncryption(provider, handler, WithRequestBinding()))
+		defer server.Close()
+
+		res, err := http.Get(server.URL + "/dump")
+		require.NoError(t, err)
+		require.Equal(t, EncryptionFormatStream, res.Header.Get(EncryptionFormatHeader))
+
+		r, err := NewResponseDecryptReader(res, provider, WithRequestBinding(), WithMaxResponseAge(time.Minute))
+		require.NoError(t, err)
+		defer res.Body.Close()
+
+		decrypted, err := io.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, body, decrypted)
+	})
+
+	t.Run("decrypt response", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		HandleWithStreamEncryption(provider, handler)(rec, httptest.NewRequest(http.MethodGet, "/dump", nil))
+
+		decrypted, err := DecryptResponse(rec.Result(), provider)
+		require.NoError(t, err)
+		require.Equal(t, body, decrypted)
+	})
+
+	t.Run("error response is not encrypted", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		HandleWithStreamEncryption(provider, mockHandler(http.StatusNotFound, "not found"))(rec, httptest.NewRequest(http.MethodGet, "/dump", nil))
+		require.Equal(t, http.StatusNotFound, rec.Code)
+		require.Equal(t, "not found", rec.Body.String())
+
+		_, err := NewResponseDecryptReader(rec.Result(), provider)
+		require.Error(t, err)
+	})
+
+	t.Run("unregistered hagall", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		HandleWithStreamEncryption(mockEmptyProvider{}, handler)(rec, httptest.NewRequest(http.MethodGet, "/dump", nil))
+		require.Equal(t, http.StatusForbidden, rec.Code)
+		require.Empty(t, rec.Body.Bytes())
+	})
+}
+
+type mockEmptyProvider struct{}
+
+func (m mockEmptyProvider) GetKey() ([]byte, error) {
+	return nil, nil
+}
@@ -0,0 +1,248 @@
+package crypt
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"math/big"
+	"time"
+
+	"github.com/aukilabs/go-tooling/pkg/errors"
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+)
+
+// SignatureScheme describes how a message is hashed before being signed.
+type SignatureScheme string
+
+const (
+	// The message is hashed with Keccak256. This is the scheme used by Sign.
+	SignatureSchemeRaw SignatureScheme = ""
+
+	// The message is hashed as an EIP-191 personal message, as produced by
+	// the personal_sign method of standard wallets.
+	SignatureSchemePersonal SignatureScheme = "eip191"
+
+	// The message is hashed as EIP-712 typed data bound to a domain, as
+	// produced by the eth_signTypedData_v4 method of standard wallets.
+	SignatureSchemeTypedData SignatureScheme = "eip712"
+)
+
+// SignaturePurpose describes what a signature is used for. It is the name of
+// the EIP-712 domain so that a signature produced for one purpose cannot be
+// replayed for another.
+type SignaturePurpose string
+
+const (
+	PurposeHagallRegistration SignaturePurpose = "hagall-registration"
+	PurposeNCSReceipt         SignaturePurpose = "ncs-receipt"
+	PurposeSignedLatency      SignaturePurpose = "signed-latency"
+)
+
+const (
+	typedDataDomainVersion = "1"
+	typedDataDomainType    = "EIP712Domain"
+	typedDataMessageType   = "Message"
+)
+
+var typedDataDomainTypes = map[string][]TypedDataField{
+	typedDataDomainType: {
+		{Name: "name", Type: "string"},
+		{Name: "version", Type: "string"},
+		{Name: "chainId", Type: "uint256"},
+	},
+}
+
+// TypedDataField is a field of an EIP-712 struct type.
+type TypedDataField struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// TypedDataDomain is an EIP-712 domain.
+type TypedDataDomain struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	ChainID int64  `json:"chainId"`
+}
+
+// NewTypedDataDomain returns the domain that binds signatures to the given
+// purpose and chain id.
+func NewTypedDataDomain(purpose SignaturePurpose, chainID int64) TypedDataDomain {
+	return TypedDataDomain{
+		Name:    string(purpose),
+		Version: typedDataDomainVersion,
+		ChainID: chainID,
+	}
+}
+
+// TypedData is EIP-712 typed data. Its JSON encoding is the one expected by
+// the eth_signTypedData_v4 method of standard wallets.
+//
+// Message values are encoded like the JSON values accepted by wallets:
+// integers are float64, *big.Int or decimal and hex strings, and bytes and
+// addresses are hex strings.
+type TypedData struct {
+	Types       map[string][]TypedDataField `json:"types"`
+	PrimaryType string                      `json:"primaryType"`
+	Domain      TypedDataDomain             `json:"domain"`
+	Message     map[string]interface{}      `json:"message"`
+}
+
+// NewMessageTypedData returns typed data that carries the given message in
+// the given domain.
+func NewMessageTypedData(domain TypedDataDomain, message string) TypedData {
+	return TypedData{
+		Types: map[string][]TypedDataField{
+			typedDataDomainType: typedDataDomainTypes[typedDataDomainType],
+			typedDataMessageType: {
+				{Name: "message", Type: "string"},
+			},
+		},
+		PrimaryType: typedDataMessageType,
+		Domain:      domain,
+		Message: map[string]interface{}{
+			"message": message,
+		},
+	}
+}
+
+// HashTypedData returns the EIP-712 hash of the given typed data. The domain
+// is always hashed with its name, version and chainId fields.
+func HashTypedData(data TypedData) ([]byte, error) {
+	types := make(apitypes.Types, len(data.Types)+1)
+	for name, fields := range data.Types {
+		types[name] = apiTypedDataFields(fields)
+	}
+	types[typedDataDomainType] = apiTypedDataFields(typedDataDomainTypes[typedDataDomainType])
+
+	hash, _, err := apitypes.TypedDataAndHash(apitypes.TypedData{
+		Types:       types,
+		PrimaryType: data.PrimaryType,
+		Domain: apitypes.TypedDataDomain{
+			Name:    data.Domain.Name,
+			Version: data.Domain.Version,
+			ChainId: math.NewHexOrDecimal256(data.Domain.ChainID),
+		},
+		Message: data.Message,
+	})
+	if err != nil {
+		return nil, errors.New("hashing typed data failed").
+			WithTag("primary_type", data.PrimaryType).
+			Wrap(err)
+	}
+	return hash, nil
+}
+
+func apiTypedDataFields(fields []TypedDataField) []apitypes.Type {
+	types := make([]apitypes.Type, 0, len(fields))
+	for _, f := range fields {
+		types = append(types, apitypes.Type{Name: f.Name, Type: f.Type})
+	}
+	return types
+}
+
+// MessageHash returns the hash of the given message signed with the given
+// scheme. The domain is only used by SignatureSchemeTypedData.
+func MessageHash(scheme SignatureScheme, domain TypedDataDomain, message string) ([]byte, error) {
+	switch scheme {
+	case SignatureSchemeRaw:
+		return crypto.Keccak256([]byte(message)), nil
+	case SignatureSchemePersonal:
+		return accounts.TextHash([]byte(message)), nil
+	case SignatureSchemeTypedData:
+		return HashTypedData(NewMessageTypedData(domain, message))
+	default:
+		return nil, errors.New("unsupported signature scheme").
+			WithTag("scheme", scheme)
+	}
+}
+
+// SignMessage signs a message with an ECDSA private key and the given scheme.
+// Returns signature in 0x string format.
+//
+// Signatures produced with SignatureSchemePersonal and
+// SignatureSchemeTypedData have a recovery ID of 27 or 28, like the ones
+// produced by standard wallets.
+func SignMessage(privateKey *ecdsa.PrivateKey, scheme SignatureScheme, domain TypedDataDomain, message string) (string, error) {
+	return SignMessageWithSigner(context.Background(), NewPrivateKeySigner(privateKey), scheme, domain, message)
+}
+
+// SignMessageWithSigner signs a message with the given signer and scheme.
+// Returns signature in 0x string format.
+func SignMessageWithSigner(ctx context.Context, signer Signer, scheme SignatureScheme, domain TypedDataDomain, message string) (string, error) {
+	signature, err := SignMessageBytes(ctx, signer, scheme, domain, message)
+	if err != nil {
+		return "", errors.New("signing message failed").
+			Wrap(err)
+	}
+	return hexutil.Encode(signature), nil
+}
+
+// SignMessageWithTimestamp signs a message concatenated with the current
+// timestamp in RFC3339Nano format, with the given scheme. Returns the
+// signature in 0x string format and the timestamp.
+func SignMessageWithTimestamp(privateKey *ecdsa.PrivateKey, scheme SignatureScheme, domain TypedDataDomain, message string) (string, string, error) {
+	return SignMessageWithTimestampAndSigner(context.Background(), NewPrivateKeySigner(privateKey), scheme, domain, message)
+}
+
+// SignMessageWithTimestampAndSigner is like SignMessageWithTimestamp but signs
+// with the given signer.
+func SignMessageWithTimestampAndSigner(ctx context.Context, signer Signer, scheme SignatureScheme, domain TypedDataDomain, message string) (string, string, error) {
+	timestamp := time.Now().Format(time.RFC3339Nano)
+	signature, err := SignMessageWithSigner(ctx, signer, scheme, domain, message+timestamp)
+	if err != nil {
+		return "", "", err
+	}
+	return signature, timestamp, nil
+}
+
+// RecoverMessageSigner returns the wallet address that signed the given
+// message with the given scheme. Expects signature in 0x string format (hex)
+// with a recovery ID of 0, 1, 27 or 28.
+func RecoverMessageSigner(scheme SignatureScheme, domain TypedDataDomain, message, signature string) (common.Address, error) {
+	if message == "" {
+		return common.Address{}, errors.New("message is empty")
+	}
+
+	hash, err := MessageHash(scheme, domain, message)
+	if err != nil {
+		return common.Address{}, err
+	}
+
+	sig, err := hexutil.Decode(signature)
+	if err != nil {
+		return common.Address{}, errors.New("decoding signature failed").Wrap(err)
+	}
+	return RecoverHashSigner(hash, sig)
+}
+
+// RecoverHashSigner returns the wallet address that signed the given hash.
+// Signatures with a recovery ID of 27 or 28 are accepted along with 0 and 1.
+// Malleable signatures are rejected.
+func RecoverHashSigner(hash, signature []byte) (common.Address, error) {
+	if len(signature) != crypto.SignatureLength {
+		return common.Address{}, errors.New("invalid signature length").
+			WithTag("length", len(signature))
+	}
+
+	sig := append([]byte(nil), signature...)
+	if sig[crypto.RecoveryIDOffset] >= 27 {
+		sig[crypto.RecoveryIDOffset] -= 27
+	}
+
+	r := new(big.Int).SetBytes(sig[:32])
+	s := new(big.Int).SetBytes(sig[32:64])
+	if !crypto.ValidateSignatureValues(sig[crypto.RecoveryIDOffset], r, s, true) {
+		return common.Address{}, errors.New("invalid signature values")
+	}
+
+	publicKey, err := crypto.SigToPub(hash, sig)
+	if err != nil {
+		return common.Address{}, errors.New("recovering signer failed").Wrap(err)
+	}
+	return crypto.PubkeyToAddress(*publicKey), nil
+}
@@ -0,0 +1,168 @@
+package crypt
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHashTypedData(t *testing.T) {
+	t.Run("hash matches the eip-712 example", func(t *testing.T) {
+		domain := NewTypedDataDomain(PurposeNCSReceipt, 1)
+		hash, err := HashTypedData(TypedData{
+			Types: map[string][]TypedDataField{
+				"Person": {
+					{Name: "name", Type: "string"},
+					{Name: "wallet", Type: "address"},
+				},
+				"Mail": {
+					{Name: "from", Type: "Person"},
+					{Name: "to", Type: "Person"},
+					{Name: "contents", Type: "string"},
+				},
+			},
+			PrimaryType: "Mail",
+			Domain:      domain,
+			Message: map[string]interface{}{
+				"from": map[string]interface{}{
+					"name":   "Cow",
+					"wallet": "0xCD2a3d9F938E13CD947Ec05AbC7FE734Df8DD826",
+				},
+				"to": map[string]interface{}{
+					"name":   "Bob",
+					"wallet": "0xbBbBBBBbbBBBbbbBbbBbbbbBBbBbbbbBbBbbBBbB",
+				},
+				"contents": "Hello, Bob!",
+			},
+		})
+		require.NoError(t, err)
+
+		domainSeparator := crypto.Keccak256(
+			crypto.Keccak256([]byte("EIP712Domain(string name,string version,uint256 chainId)")),
+			crypto.Keccak256([]byte(domain.Name)),
+			crypto.Keccak256([]byte(domain.Version)),
+			common.LeftPadBytes(big.NewInt(domain.ChainID).Bytes(), 32),
+		)
+		mailHash := hexutil.MustDecode("0xc52c0ee5d84264471806290a3f2c4cecfc5490626bf912d01f240d7a274b371e")
+		require.Equal(t, crypto.Keccak256([]byte{0x19, 0x01}, domainSeparator, mailHash), hash)
+	})
+
+	t.Run("missing field", func(t *testing.T) {
+		data := NewMessageTypedData(NewTypedDataDomain(PurposeNCSReceipt, 1), "receipt")
+		delete(data.Message, "message")
+
+		_, err := HashTypedData(data)
+		require.Error(t, err)
+	})
+
+	t.Run("integer overflow", func(t *testing.T) {
+		data := TypedData{
+			Types: map[string][]TypedDataField{
+				"Count": {
+					{Name: "count", Type: "uint8"},
+				},
+			},
+			PrimaryType: "Count",
+			Domain:      NewTypedDataDomain(PurposeNCSReceipt, 1),
+			Message: map[string]interface{}{
+				"count": float64(256),
+			},
+		}
+		_, err := HashTypedData(data)
+		require.Error(t, err)
+
+		data.Message["count"] = float64(255)
+		_, err = HashTypedData(data)
+		require.NoError(t, err)
+	})
+}
+
+func TestMessageHash(t *testing.T) {
+	hash, err := MessageHash(SignatureSchemePersonal, TypedDataDomain{}, "hello world")
+	require.NoError(t, err)
+	require.Equal(t,
+		"0xd9eba16ed0ecae432b71fe008c98cc872bb4cc214d3220a36f365326cf807d68",
+		hexutil.Encode(hash),
+	)
+}
+
+func TestSignMessage(t *testing.T) {
+	privateKey, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	address := crypto.PubkeyToAddress(privateKey.PublicKey)
+
+	domain := NewTypedDataDomain(PurposeHagallRegistration, 1)
+	schemes := []SignatureScheme{
+		SignatureSchemeRaw,
+		SignatureSchemePersonal,
+		SignatureSchemeTypedData,
+	}
+
+	for _, scheme := range schemes {
+		t.Run("sign and recover "+string(scheme), func(t *testing.T) {
+			signature, err := SignMessage(privateKey, scheme, domain, "https://hagall.example.com")
+			require.NoError(t, err)
+
+			signer, err := RecoverMessageSigner(scheme, domain, "https://hagall.example.com", signature)
+			require.NoError(t, err)
+			require.Equal(t, address, signer)
+
+			signer, err = RecoverMessageSigner(scheme, domain, "https://evil.example.com", signature)
+			require.NoError(t, err)
+			require.NotEqual(t, address, signer)
+		})
+	}
+
+	t.Run("raw signatures match sign", func(t *testing.T) {
+		signature, err := SignMessage(privateKey, SignatureSchemeRaw, TypedDataDomain{}, "message")
+		require.NoError(t, err)
+
+		expected, err := Sign(privateKey, "message")
+		require.NoError(t, err)
+		require.Equal(t, expected, signature)
+	})
+
+	t.Run("wallet recovery ids", func(t *testing.T) {
+		signature, err := SignMessage(privateKey, SignatureSchemePersonal, domain, "message")
+		require.NoError(t, err)
+
+		v := common.FromHex(signature)[crypto.RecoveryIDOffset]
+		require.True(t, v == 27 || v == 28)
+	})
+
+	t.Run("typed data signatures are bound to their domain", func(t *testing.T) {
+		signature, err := SignMessage(privateKey, SignatureSchemeTypedData, domain, "message")
+		require.NoError(t, err)
+
+		otherDomains := []TypedDataDomain{
+			NewTypedDataDomain(PurposeNCSReceipt, 1),
+			NewTypedDataDomain(PurposeHagallRegistration, 5),
+		}
+		for _, other := range otherDomains {
+			signer, err := RecoverMessageSigner(SignatureSchemeTypedData, other, "message", signature)
+			require.NoError(t, err)
+			require.NotEqual(t, address, signer)
+		}
+	})
+
+	t.Run("unsupported scheme", func(t *testing.T) {
+		_, err := SignMessage(privateKey, "eip-42", domain, "message")
+		require.Error(t, err)
+	})
+
+	t.Run("malleable signature", func(t *testing.T) {
+		signature, err := SignMessage(privateKey, SignatureSchemePersonal, domain, "message")
+		require.NoError(t, err)
+
+		sig := common.FromHex(signature)
+		s := new(big.Int).SetBytes(sig[32:64])
+		copy(sig[32:64], common.LeftPadBytes(new(big.Int).Sub(crypto.S256().Params().N, s).Bytes(), 32))
+
+		_, err = RecoverMessageSigner(SignatureSchemePersonal, domain, "message", hexutil.Encode(sig))
+		require.Error(t, err)
+	})
+}
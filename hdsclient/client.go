@@ -1,14 +1,10 @@
 package hdsclient
 
 import (
-	"bytes"
 	"context"
-	"crypto/ecdsa"
-	"encoding/json"
-	"io"
 	"net"
 	"net/http"
-	"strconv"
+	"net/url"
 	"strings"
 	"sync"
 	"time"
@@ -20,7 +16,18 @@ import (
 	hsmoketest "github.com/aukilabs/hagall-common/smoketest"
 )
 
+const (
+	defaultUnpairTimeout = 3 * time.Second
+)
+
+// Encoder is a function that encodes request bodies in JSON.
+//
+// Deprecated: Use a Codec instead.
 type Encoder func(interface{}) ([]byte, error)
+
+// Decoder is a function that decodes response bodies.
+//
+// Deprecated: Use a Codec instead.
 type Decoder func([]byte, interface{}) error
 
 // Client represents an HTTP client to communicate with Hagall Discovery Service.
@@ -35,16 +42,26 @@ type Client struct {
 	// (optional)
 	Transport http.RoundTripper
 
-	// The function to encode request bodies.
+	// The function to encode request bodies. It takes precedence over the
+	// codecs when set.
+	//
+	// Deprecated: Use WithCodecs instead.
 	Encode Encoder
 
-	// The function to decode response bodies.
+	// The function to decode response bodies. It takes precedence over the
+	// codecs when set.
+	//
+	// Deprecated: Use WithCodecs instead.
 	Decode Decoder
 
 	// Setting RemoteAddr to insert a http header x-real-ip=RemoteAddr to request,
 	// allows override of client IP address which read from req.RemoteAddr by default
 	RemoteAddr string
 
+	// The policy used to retry failed requests. Retries are disabled by
+	// default.
+	RetryPolicy RetryPolicy
+
 	mutex              sync.RWMutex
 	serverID           string
 	secret             string
@@ -53,7 +70,31 @@ type Client struct {
 	clientID           string
 	registrationStatus RegistrationStatus
 
-	privateKey *ecdsa.PrivateKey
+	registrationEndpoint string
+	stateStore           StateStore
+	stateSavedAt         time.Time
+	pairing              *pairing
+	unpairing            int
+	baseTransport        http.RoundTripper
+	interceptors         []httpcmn.Interceptor
+	clock                Clock
+	registrations        map[string]*hdsRegistration
+	quorum               int
+	healthReporter       HealthReporter
+	draining             bool
+	codecs               []Codec
+	compression          bool
+	compressionThreshold int
+
+	endpointMutex sync.RWMutex
+	endpoints     []*hdsEndpoint
+
+	eventMutex  sync.RWMutex
+	subscribers map[chan Event]struct{}
+
+	signer          crypt.Signer
+	signatureScheme crypt.SignatureScheme
+	chainID         int64
 }
 
 // NewClient creates new client with optional parameters.
@@ -68,12 +109,24 @@ func NewClient(opts ...ClientOpts) *Client {
 		c.Transport = http.DefaultTransport
 	}
 
-	if c.Encode == nil {
-		c.Encode = json.Marshal
+	c.baseTransport = c.Transport
+	if len(c.interceptors) != 0 {
+		c.Transport = httpcmn.ChainInterceptors(c.Transport, c.interceptors...)
 	}
 
-	if c.Decode == nil {
-		c.Decode = json.Unmarshal
+	if len(c.codecs) == 0 {
+		c.codecs = []Codec{JSONCodec{}}
+	}
+
+	if c.clock == nil {
+		c.clock = systemClock{}
+	}
+
+	if c.multiHDS() {
+		c.registrations = make(map[string]*hdsRegistration, len(c.endpoints))
+		for _, e := range c.endpoints {
+			c.registrations[e.url] = &hdsRegistration{endpoint: e.url}
+		}
 	}
 	return c
 }
@@ -95,10 +148,11 @@ func (c *Client) ServerID() string {
 // SetServerData sets internal serverID & server secret state.
 func (c *Client) SetServerData(serverID, secret string) {
 	c.mutex.Lock()
-	defer c.mutex.Unlock()
-
 	c.serverID = serverID
 	c.secret = secret
+	c.mutex.Unlock()
+
+	c.saveState()
 }
 
 // LastHealthCheck returns the time when HDS performed the latest healthcheck.
@@ -109,10 +163,15 @@ func (c *Client) LastHealthCheck() time.Time {
 }
 
 // SetLastHealthCheck set the time when HDS performed the latest healthcheck.
+//
+// When a state store is set, the health check time is persisted at most every
+// 30 seconds.
 func (c *Client) SetLastHealthCheck(t time.Time) {
 	c.mutex.Lock()
-	defer c.mutex.Unlock()
 	c.lastHealthCheck = t
+	c.mutex.Unlock()
+
+	c.saveHealthCheckState()
 }
 
 func (c *Client) setRegistrationState(v string) {
@@ -131,9 +190,42 @@ func (c *Client) GetRegistrationState() string {
 
 func (c *Client) setRegistrationStatus(v RegistrationStatus) {
 	c.mutex.Lock()
-	defer c.mutex.Unlock()
+	previous := c.registrationStatus
+	c.registrationStatus = v
+	serverID := c.serverID
+	c.mutex.Unlock()
+
+	if previous != v {
+		c.emit(Event{
+			Type:           EventTypeRegistrationStatusChanged,
+			Status:         v,
+			PreviousStatus: previous,
+			ServerID:       serverID,
+		})
+	}
+}
 
+// compareAndSetRegistrationStatus sets the registration status to v when the
+// current status is old.
+func (c *Client) compareAndSetRegistrationStatus(old, v RegistrationStatus) bool {
+	c.mutex.Lock()
+	if c.registrationStatus != old {
+		c.mutex.Unlock()
+		return false
+	}
 	c.registrationStatus = v
+	serverID := c.serverID
+	c.mutex.Unlock()
+
+	if old != v {
+		c.emit(Event{
+			Type:           EventTypeRegistrationStatusChanged,
+			Status:         v,
+			PreviousStatus: old,
+			ServerID:       serverID,
+		})
+	}
+	return true
 }
 
 // GetRegistrationStatus returns current registration status.
@@ -145,43 +237,57 @@ func (c *Client) GetRegistrationStatus() RegistrationStatus {
 
 // UserAuth auhenticates a user to a given server.
 func (c *Client) UserAuth(ctx context.Context, in UserAuthIn) (UserAuthResponse, error) {
-	body, err := c.Encode(in)
+	req, err := c.newRequestWithBody(ctx, http.MethodPost, c.HDSEndpoint+"/auth", in)
 	if err != nil {
-		return UserAuthResponse{}, errors.New("encoding body failed").Wrap(err)
+		return UserAuthResponse{}, err
 	}
-
-	req, err := http.NewRequestWithContext(ctx,
-		http.MethodPost,
-		c.HDSEndpoint+"/auth",
-		bytes.NewReader(body),
-	)
+	req.SetBasicAuth(in.AppKey, in.AppSecret)
 
 	if c.clientID != "" {
 		req.Header.Set(httpcmn.HeaderPosemeshClientID, c.clientID)
 	}
 
-	if err != nil {
-		return UserAuthResponse{}, errors.New("creating request failed").Wrap(err)
-	}
-	req.SetBasicAuth(in.AppKey, in.AppSecret)
-	req.Header.Set("Content-Type", "application/json")
-
 	var resp UserAuthResponse
 	err = c.do(req, &resp)
 	return resp, err
 }
 
 // VerifyUserAuth verifies a user's identity.
+//
+// When several HDS endpoints are set, tokens issued by any of the endpoints
+// the server is registered with are accepted.
 func (c *Client) VerifyUserAuth(token string) error {
-	secret := c.Secret()
-	if secret == "" {
+	secrets := c.secrets()
+	if len(secrets) == 0 {
 		return errors.New("hagall server is not registered")
 	}
 
-	if err := httpcmn.VerifyHagallUserAccessToken(token, secret); err != nil {
-		return errors.New("verifying access token failed").Wrap(err)
+	var err error
+	for _, secret := range secrets {
+		if err = httpcmn.VerifyHagallUserAccessToken(token, secret); err == nil {
+			return nil
+		}
 	}
-	return nil
+	return errors.New("verifying access token failed").Wrap(err)
+}
+
+// secrets returns the client secret followed by the secrets attributed by
+// the other HDS endpoints.
+func (c *Client) secrets() []string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	var secrets []string
+	if c.secret != "" {
+		secrets = append(secrets, c.secret)
+	}
+
+	for _, reg := range c.registrations {
+		if reg.secret != "" && reg.secret != c.secret {
+			secrets = append(secrets, reg.secret)
+		}
+	}
+	return secrets
 }
 
 // PostServer registers a server to HDS.
@@ -195,8 +301,12 @@ func (c *Client) PostServer(ctx context.Context, in PostServerIn) error {
 		in.Endpoint = c.HagallEndpoint
 	}
 
+	c.mutex.Lock()
+	c.registrationEndpoint = in.Endpoint
+	c.mutex.Unlock()
+
 	if err := c.Post(ctx, "/servers", in); err != nil {
-		if errors.Tag(err, "status_code") == "402" {
+		if errors.Is(err, ErrNotStaked) {
 			return errors.New("Please make sure you have staked the right amount of tokens from the supplied wallet before registering your server").Wrap(err)
 		}
 		return err
@@ -212,6 +322,9 @@ func (c *Client) PostServer(ctx context.Context, in PostServerIn) error {
 // Once the secret is transmitted, further calls to this handler result in a
 // FORBIDDEN response.
 //
+// When several HDS endpoints are set, each of them transmits its own secret
+// and the registration is matched with the registration state.
+//
 // This handler is meant to be used by a Hagall server under the /registrations
 // path.
 func (c *Client) HandleServerRegistration(w http.ResponseWriter, r *http.Request) {
@@ -220,6 +333,11 @@ func (c *Client) HandleServerRegistration(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	if c.multiHDS() {
+		c.handleEndpointRegistration(w, r)
+		return
+	}
+
 	if c.Secret() != "" {
 		httpcmn.Forbidden(w, errors.New("server registration failed").
 			WithTag("reason", "server is already registered").
@@ -256,8 +374,13 @@ func (c *Client) HandleServerRegistration(w http.ResponseWriter, r *http.Request
 		return
 	}
 	c.SetServerData(id, secret)
-	c.SetLastHealthCheck(time.Now())
+	c.SetLastHealthCheck(c.now())
 	c.setRegistrationStatus(RegistrationStatusRegistered)
+	c.emit(Event{
+		Type:     EventTypeSecretRotated,
+		Status:   RegistrationStatusRegistered,
+		ServerID: id,
+	})
 
 	httpcmn.OK(w)
 
@@ -268,6 +391,17 @@ func (c *Client) HandleServerRegistration(w http.ResponseWriter, r *http.Request
 
 // HandleHealthCheck handles Hagall server health checks.
 //
+// When several HDS endpoints are set, the HDS endpoint performing the health
+// check is identified by a bearer token in the Authorization header, made of
+// the server endpoint signed with the secret it attributed (see
+// http.SignIdentity). This token is a proposed HDS API: HDS versions that do
+// not send it perform unidentified health checks, which are answered with the
+// client secret and refresh the registration with every HDS endpoint.
+//
+// When a health reporter is set or when the server is draining, the response
+// carries the server health report as a JSON body, signed along with the
+// identity in the Authorization header.
+//
 // This handler is meant to be used by a Hagall server under the /health path.
 func (c *Client) HandleHealthCheck(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
@@ -275,16 +409,58 @@ func (c *Client) HandleHealthCheck(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	token, err := httpcmn.SignIdentity(c.HagallEndpoint, c.Secret())
+	secret := c.Secret()
+	serverID := c.ServerID()
+	endpoint, matched := c.registrationByIdentity(r)
+	if matched {
+		c.mutex.RLock()
+		reg := c.registrations[endpoint]
+		secret = reg.secret
+		serverID = reg.serverID
+		c.mutex.RUnlock()
+	}
+
+	body := c.healthReportBody(r.Context())
+
+	var token string
+	var err error
+	if body != nil {
+		token, err = httpcmn.SignIdentityWithBody(c.HagallEndpoint, secret, body)
+	} else {
+		token, err = httpcmn.SignIdentity(c.HagallEndpoint, secret)
+	}
 	if err != nil {
 		httpcmn.InternalServerError(w, errors.New("signing response failed").Wrap(err))
 		return
 	}
 
 	w.Header().Set("Authorization", httpcmn.MakeAuthorizationHeader(token))
-	httpcmn.OK(w)
+	if body != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(body)
+	} else {
+		httpcmn.OK(w)
+	}
+
+	now := c.now()
+	c.SetLastHealthCheck(now)
 
-	c.SetLastHealthCheck(time.Now())
+	c.mutex.Lock()
+	for e, reg := range c.registrations {
+		if reg.status == RegistrationStatusRegistered && (!matched || e == endpoint) {
+			reg.lastHealthCheck = now
+		}
+	}
+	c.mutex.Unlock()
+
+	c.emit(Event{
+		Type:        EventTypeHealthCheck,
+		Time:        now,
+		Status:      c.GetRegistrationStatus(),
+		ServerID:    serverID,
+		HDSEndpoint: endpoint,
+	})
 	logs.Debug("health check ok")
 }
 
@@ -336,6 +512,53 @@ func (c *Client) PostSession(ctx context.Context, in PostSessionIn) error {
 	return c.Post(ctx, "/sessions", in)
 }
 
+// GetSession returns the session with the given id from HDS, including the
+// server that hosts it.
+func (c *Client) GetSession(ctx context.Context, in GetSessionIn) (SessionResponse, error) {
+	if in.ID == "" {
+		return SessionResponse{}, errors.New("session id is empty")
+	}
+
+	var s SessionResponse
+	path := "/sessions/" + url.PathEscape(in.ID)
+	if in.AppKey != "" {
+		err := c.GetWithAuth(ctx, path, in.AppKey, in.AppSecret, nil, &s)
+		return s, err
+	}
+
+	err := c.Get(ctx, path, &s)
+	return s, err
+}
+
+// ListSessions returns the sessions registered to HDS for a server.
+func (c *Client) ListSessions(ctx context.Context, in ListSessionsIn) (ListSessionsResponse, error) {
+	queries := make(map[string]string)
+	if in.ServerID != "" {
+		queries["server_id"] = in.ServerID
+	}
+
+	var sessions ListSessionsResponse
+	if in.AppKey != "" {
+		err := c.GetWithAuth(ctx, "/sessions", in.AppKey, in.AppSecret, queries, &sessions)
+		return sessions, err
+	}
+
+	path := "/sessions"
+	if in.ServerID != "" {
+		path += "?server_id=" + url.QueryEscape(in.ServerID)
+	}
+	err := c.Get(ctx, path, &sessions)
+	return sessions, err
+}
+
+// DeleteSession unregisters a session from HDS.
+func (c *Client) DeleteSession(ctx context.Context, in DeleteSessionIn) error {
+	if in.ID == "" {
+		return errors.New("session id is empty")
+	}
+	return c.Delete(ctx, "/sessions/"+url.PathEscape(in.ID))
+}
+
 // Get sends a GET request to the given path and stores result in the given
 // output.
 func (c *Client) Get(ctx context.Context, path string, out interface{}) error {
@@ -388,20 +611,10 @@ func (c *Client) GetWithAuth(
 
 // Post sends a POST request to the given path with the given input.
 func (c *Client) Post(ctx context.Context, path string, in interface{}) error {
-	body, err := c.Encode(in)
+	req, err := c.newRequestWithBody(ctx, http.MethodPost, c.HDSEndpoint+path, in)
 	if err != nil {
-		return errors.New("encoding body failed").Wrap(err)
-	}
-
-	req, err := http.NewRequestWithContext(ctx,
-		http.MethodPost,
-		c.HDSEndpoint+path,
-		bytes.NewReader(body),
-	)
-	if err != nil {
-		return errors.New("creating request failed").Wrap(err)
+		return err
 	}
-	req.Header.Set("Content-Type", "application/json")
 
 	if len(c.RemoteAddr) > 0 {
 		req.Header.Set(httpcmn.XForwardedForHeaderKey, c.RemoteAddr)
@@ -430,6 +643,16 @@ func (c *Client) SendSmokeTestResult(ctx context.Context, results hsmoketest.Smo
 }
 
 func (c *Client) do(req *http.Request, out interface{}) error {
+	return c.doWithTransport(req, c.Transport, out)
+}
+
+func (c *Client) doWithTransport(req *http.Request, transport http.RoundTripper, out interface{}) error {
+	c.setNegotiationHeaders(req, out)
+
+	if c.multiHDS() {
+		return c.doWithFailover(req, transport, out)
+	}
+
 	secret := c.Secret()
 	authorization := req.Header.Get("Authorization")
 	if authorization == "" && secret != "" {
@@ -440,194 +663,220 @@ func (c *Client) do(req *http.Request, out interface{}) error {
 		req.Header.Set("Authorization", httpcmn.MakeAuthorizationHeader(token))
 	}
 
-	res, err := c.Transport.RoundTrip(req)
+	return c.doWithRetry(req, func(req *http.Request) error {
+		return c.roundTrip(req, transport, out)
+	})
+}
+
+func (c *Client) roundTrip(req *http.Request, transport http.RoundTripper, out interface{}) error {
+	res, err := transport.RoundTrip(req)
 	if err != nil {
 		return errors.New("request failed").Wrap(err)
 	}
 	defer res.Body.Close()
 
-	var body []byte
-	if res.Body != nil {
-		body, err = io.ReadAll(res.Body)
-		if err != nil {
-			return errors.New("reading response failed").Wrap(err)
-		}
+	body, err := readBody(res)
+	if err != nil {
+		return errors.New("reading response failed").Wrap(err)
 	}
 
 	if res.StatusCode >= 400 {
-		return errors.New("request failed").
-			WithTag("status", res.Status).
-			WithTag("status_code", res.StatusCode).
-			WithTag("message", string(body))
+		return newAPIError(res, body)
 	}
 
 	if out == nil {
 		return nil
 	}
 
-	if err = c.Decode(body, out); err != nil {
+	if err = c.decode(res.Header.Get("Content-Type"), body, out); err != nil {
 		return errors.New("decoding response failed").Wrap(err)
 	}
 	return nil
 }
 
 // Pair pairs the client with HDS, registering an endpoint when necessary.
+//
+// When a state store is set, Pair resumes the server identity persisted by a
+// previous run if HDS health checked it within the health check TTL.
+//
+// Pair runs a Supervisor that gives up once the registration retries are
+// exhausted. Use a Supervisor directly to keep retrying instead.
+//
+// When several HDS endpoints are set, Pair registers the server with each of
+// them and fails once the quorum cannot be reached anymore. A state store
+// cannot be used with several HDS endpoints: Pair then returns
+// ErrStateStoreWithHDSEndpoints.
 func (c *Client) Pair(ctx context.Context, in PairIn) error {
-	// run register right after function starts
-	registrationTimer := time.NewTimer(1 * time.Millisecond)
-	defer registrationTimer.Stop()
-
-	var registrationCount int
-	retried := 1
-
-	retryInterval := in.RegistrationInterval
-	register := func() error {
-		defer func() {
-			// schedule next registration check
-			status := c.GetRegistrationStatus()
-			switch status {
-			case RegistrationStatusRegistered:
-				retried = 0
-				// wait for hds registration callback back, in heathcheck TTL
-				retryInterval = in.HealthCheckTTL
-			default:
-				retryInterval = time.Duration(retried * int(in.RegistrationInterval))
-				retried++
-			}
-			logs.WithTag("retry_interval", retryInterval.Seconds()).
-				WithTag("retry_count", retried).
-				WithTag("status", status).
-				Debug("checking registration")
-			registrationTimer.Reset(retryInterval)
-		}()
-
-		if time.Since(c.lastHealthCheck) <= in.HealthCheckTTL {
-			return nil
-		}
+	if err := c.checkStateStore(); err != nil {
+		return err
+	}
 
-		c.setRegistrationStatus(RegistrationStatusRegistering)
-		c.SetServerData("", "")
-		registrationCount++
+	if c.multiHDS() {
+		return c.pairAll(ctx, in)
+	}
 
-		var endpointSignature, timestamp string
+	s := NewSupervisor(c, in, WithGiveUpBehavior(GiveUpFail))
+	if err := s.Start(ctx); err != nil {
+		return err
+	}
+	return s.Wait()
+}
 
-		if c.privateKey != nil {
-			sig, ts, err := crypt.SignWithTimestamp(c.privateKey, in.Endpoint)
-			if err != nil {
-				return errors.New("error signing endpoint").Wrap(err)
-			}
-			endpointSignature = sig
-			timestamp = ts
-		}
+// Unpair deregisters Hagall from HDS. It is a shortcut to UnpairWithOptions
+// with default options.
+func (c *Client) Unpair(ctx context.Context) error {
+	return c.UnpairWithOptions(ctx, UnpairOptions{})
+}
 
-		logs.WithTag("registration_count", registrationCount).
-			WithTag("endpoint", in.Endpoint).
-			WithTag("version", in.Version).
-			WithTag("modules", in.Modules).
-			WithTag("feature_flags", in.FeatureFlags).
-			WithTag("endpoint_signature", endpointSignature).
-			WithTag("timestamp", timestamp).
-			Debug("registering hagall to hds")
-
-		if err := c.PostServer(ctx, PostServerIn{
-			Endpoint:          in.Endpoint,
-			Version:           in.Version,
-			Modules:           in.Modules,
-			FeatureFlags:      in.FeatureFlags,
-			EndpointSignature: endpointSignature,
-			Timestamp:         timestamp,
-		}); err != nil {
-			if retried >= in.RegistrationRetries {
-				c.setRegistrationStatus(RegistrationStatusFailed)
-				return errors.New("registering hagall to hds failed").
-					WithTag("registration_count", registrationCount).
-					WithTag("endpoint", in.Endpoint).
-					WithTag("version", in.Version).
-					WithTag("modules", in.Modules).
-					WithTag("feature_flags", in.FeatureFlags).
-					WithTag("retry_count", retried).
-					Wrap(err)
-			}
-
-			logs.Error(err)
-			return nil
-		}
+// UnpairWithOptions deregisters Hagall from HDS.
+//
+// A running Pair is stopped and returns ErrUnpaired before the server is
+// deleted from HDS. A Pair started while unpairing returns ErrUnpaired without
+// registering. It is safe to call concurrently with Pair.
+func (c *Client) UnpairWithOptions(ctx context.Context, opts UnpairOptions) error {
+	opts = opts.withDefaults()
 
-		logs.WithTag("registration_count", registrationCount).
-			WithTag("endpoint", in.Endpoint).
-			WithTag("version", in.Version).
-			WithTag("modules", in.Modules).
-			WithTag("feature_flags", in.FeatureFlags).
-			WithTag("retry_count", retried).
-			WithTag("status", c.GetRegistrationStatus()).
-			Info("hagall is successfully registered to hds")
+	ctx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
 
-		return nil
-	}
+	c.mutex.Lock()
+	c.unpairing++
+	c.mutex.Unlock()
 
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
+	defer func() {
+		c.mutex.Lock()
+		c.unpairing--
+		c.mutex.Unlock()
+	}()
 
-		case <-registrationTimer.C:
-			if err := register(); err != nil {
-				return err
-			}
-		}
+	if err := c.stopPairing(ctx); err != nil {
+		return errors.New("stopping pairing failed").Wrap(err)
+	}
+
+	if c.multiHDS() {
+		return c.unpairAll(ctx, opts)
 	}
-}
 
-// Unpair deregisters Hagall from HDS.
-func (c *Client) Unpair() error {
 	logs.WithTag("status", c.GetRegistrationStatus()).
 		Debug("unpairing server")
 	if c.GetRegistrationStatus() != RegistrationStatusRegistered {
 		return nil
 	}
 
-	dialer := &net.Dialer{
-		Timeout: 3 * time.Second,
+	req, err := http.NewRequestWithContext(ctx,
+		http.MethodDelete,
+		c.HDSEndpoint+"/servers",
+		nil,
+	)
+	if err != nil {
+		return errors.New("creating request failed").Wrap(err)
 	}
 
-	// update transport with shorter timeout
-	transport := http.DefaultTransport.(*http.Transport)
-	transport.DialContext = dialer.DialContext
-
-	c.Transport = transport
-
-	// create a new context with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	if err := c.DeleteServer(ctx); err != nil {
+	if err := c.doWithTransport(req, c.unpairTransport(opts), nil); err != nil {
 		return errors.New("delete server failed").Wrap(err)
 	}
 
 	c.setRegistrationStatus(RegistrationStatusInit)
+	if c.stateStore != nil {
+		if err := c.stateStore.Save(ServerState{}); err != nil {
+			logs.Error(errors.New("clearing server state failed").Wrap(err))
+		}
+	}
 	logs.Info("unpair succeed")
 
 	return nil
 }
 
-// isRetryableError returns false for error with status code in between 400 and 499.
-func isRetryableError(err error) bool {
-	rErr, ok := err.(errors.Error)
+// unpairTransport returns a private copy of the client transport that uses the
+// unpair dial timeout. When interceptors are set, the copy is made from the
+// transport they wrap and is wrapped by them again. Transports that are not a
+// *http.Transport are returned as is.
+func (c *Client) unpairTransport(opts UnpairOptions) http.RoundTripper {
+	base := c.Transport
+	if len(c.interceptors) != 0 {
+		base = c.baseTransport
+	}
+
+	transport, ok := base.(*http.Transport)
 	if !ok {
-		return true
+		return c.Transport
 	}
 
-	if rErr.Tags()["status_code"] == "" {
-		return true
+	dialer := &net.Dialer{
+		Timeout: opts.DialTimeout,
 	}
 
-	statusCodeStr := rErr.Tags()["status_code"]
-	statusCode, err := strconv.Atoi(statusCodeStr)
-	if err != nil {
-		logs.WithTag("status_code", statusCodeStr).
-			Warn("failed to convert status code")
-		return true
+	transport = transport.Clone()
+	transport.DialContext = dialer.DialContext
+	return httpcmn.ChainInterceptors(transport, c.interceptors...)
+}
+
+// startPairing registers a running Pair so it can be stopped by Unpair. It
+// must be called before the Pair performs any request. The returned context
+// is canceled with ErrUnpaired when an Unpair is in progress, and the returned
+// function must be called when Pair returns.
+func (c *Client) startPairing(ctx context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	p := &pairing{
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	c.mutex.Lock()
+	c.pairing = p
+	if c.unpairing != 0 {
+		cancel(ErrUnpaired)
 	}
+	c.mutex.Unlock()
 
-	return !(statusCode >= 400 && statusCode < 500)
+	return ctx, func() {
+		cancel(nil)
+
+		c.mutex.Lock()
+		if c.pairing == p {
+			c.pairing = nil
+		}
+		c.mutex.Unlock()
+
+		close(p.done)
+	}
+}
+
+// stopPairing stops the running Pair and waits for it to return.
+func (c *Client) stopPairing(ctx context.Context) error {
+	c.mutex.RLock()
+	p := c.pairing
+	c.mutex.RUnlock()
+
+	if p == nil {
+		return nil
+	}
+	p.cancel(ErrUnpaired)
+
+	select {
+	case <-p.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type pairing struct {
+	cancel context.CancelCauseFunc
+	done   chan struct{}
+}
+
+// isRetryableError returns false for context errors and for HDS errors with a
+// status code in between 400 and 499, except 429.
+func isRetryableError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Temporary() ||
+			!(apiErr.StatusCode >= 400 && apiErr.StatusCode < 500)
+	}
+	return true
 }
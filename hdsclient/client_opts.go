@@ -4,6 +4,7 @@ import (
 	"crypto/ecdsa"
 	"net/http"
 
+	"github.com/aukilabs/hagall-common/crypt"
 	httpcmn "github.com/aukilabs/hagall-common/http"
 )
 
@@ -21,12 +22,35 @@ func WithHDSEndpoint(v string) ClientOpts {
 	}
 }
 
+// WithHDSEndpoints sets several Hagall Discovery Service endpoints, in order
+// of preference. Requests are routed to the first healthy endpoint and fail
+// over to the next ones on network errors and 5xx status codes. Pair
+// registers the server with each of them. Registrations to several HDS are
+// not persisted: see WithStateStore.
+func WithHDSEndpoints(v ...string) ClientOpts {
+	return func(c *Client) {
+		c.endpoints = nil
+		for _, endpoint := range v {
+			c.endpoints = append(c.endpoints, &hdsEndpoint{
+				url:     httpcmn.NormalizeEndpoint(endpoint),
+				healthy: true,
+			})
+		}
+
+		if len(c.endpoints) != 0 {
+			c.HDSEndpoint = c.endpoints[0].url
+		}
+	}
+}
+
+// Deprecated: Use WithCodecs instead.
 func WithEncoder(v Encoder) ClientOpts {
 	return func(c *Client) {
 		c.Encode = v
 	}
 }
 
+// Deprecated: Use WithCodecs instead.
 func WithDecoder(v Decoder) ClientOpts {
 	return func(c *Client) {
 		c.Decode = v
@@ -63,8 +87,92 @@ func WithClientID(v string) ClientOpts {
 	}
 }
 
+// WithPrivateKey sets the wallet key used to sign the endpoint on
+// registration. Use WithSigner to keep the key out of the process.
 func WithPrivateKey(v *ecdsa.PrivateKey) ClientOpts {
 	return func(c *Client) {
-		c.privateKey = v
+		c.signer = nil
+		if v != nil {
+			c.signer = crypt.NewPrivateKeySigner(v)
+		}
+	}
+}
+
+// WithSigner sets the signer used to sign the endpoint on registration.
+// Remote signers require a scheme other than the default raw Keccak256 one,
+// set with WithSignatureScheme.
+func WithSigner(v crypt.Signer) ClientOpts {
+	return func(c *Client) {
+		c.signer = v
+	}
+}
+
+// WithSignatureScheme sets the scheme used to sign the endpoint with the
+// private key on registration. EIP-712 signatures are bound to the
+// hagall-registration purpose and the given chain ID. Defaults to raw
+// Keccak256 signatures.
+func WithSignatureScheme(scheme crypt.SignatureScheme, chainID int64) ClientOpts {
+	return func(c *Client) {
+		c.signatureScheme = scheme
+		c.chainID = chainID
+	}
+}
+
+func WithRetryPolicy(v RetryPolicy) ClientOpts {
+	return func(c *Client) {
+		c.RetryPolicy = v
+	}
+}
+
+// WithStateStore sets the store where the server identity is persisted so
+// that Pair can resume it after a restart. It cannot be combined with several
+// HDS endpoints set with WithHDSEndpoints.
+func WithStateStore(v StateStore) ClientOpts {
+	return func(c *Client) {
+		c.stateStore = v
+	}
+}
+
+// WithInterceptors sets interceptors that wrap the client transport. They are
+// applied, in order, once all the other options are set.
+func WithInterceptors(v ...httpcmn.Interceptor) ClientOpts {
+	return func(c *Client) {
+		c.interceptors = append(c.interceptors, v...)
+	}
+}
+
+// WithClock sets the clock used to stamp health checks and to schedule
+// registrations. Defaults to the system clock.
+func WithClock(v Clock) ClientOpts {
+	return func(c *Client) {
+		c.clock = v
+	}
+}
+
+// WithHealthReporter sets the reporter used to send the server load and
+// capacity to HDS on health checks.
+func WithHealthReporter(v HealthReporter) ClientOpts {
+	return func(c *Client) {
+		c.healthReporter = v
+	}
+}
+
+// WithCodecs sets the codecs used to encode request bodies and decode
+// response bodies, in order of preference. Request bodies are encoded with
+// the first codec that supports them and responses are decoded with the codec
+// that matches their Content-Type. Defaults to JSONCodec.
+func WithCodecs(v ...Codec) ClientOpts {
+	return func(c *Client) {
+		c.codecs = v
+	}
+}
+
+// WithCompression enables gzip compression. Request bodies that are at least
+// threshold bytes long are compressed and HDS is allowed to compress
+// responses.
+func WithCompression(threshold int) ClientOpts {
+	return func(c *Client) {
+		c.compression = true
+		c.compressionThreshold = threshold
 	}
 }
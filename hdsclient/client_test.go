@@ -6,6 +6,9 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -386,6 +389,8 @@ func TestClientRegistration(t *testing.T) {
 }
 
 func TestUnpair(t *testing.T) {
+	setupTestLog(t)
+
 	t.Run("unpair", func(t *testing.T) {
 		var unpaired bool
 		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
@@ -401,7 +406,7 @@ func TestUnpair(t *testing.T) {
 			WithTransport(http.DefaultTransport))
 		client.setRegistrationStatus(RegistrationStatusRegistered)
 
-		err := client.Unpair()
+		err := client.Unpair(context.Background())
 		require.NoError(t, err)
 
 		require.True(t, unpaired)
@@ -432,13 +437,253 @@ func TestUnpair(t *testing.T) {
 		defer func() {
 			// unpair on panic
 			if r := recover(); r != nil {
-				err := client.Unpair()
+				err := client.Unpair(context.Background())
 				require.NoError(t, err)
 				require.True(t, unpaired)
 			}
 		}()
 		panic("test panic")
 	})
+
+	t.Run("unpair stops pair before deleting the server", func(t *testing.T) {
+		var client *Client
+		registeredCh := make(chan struct{}, 1)
+		deletedCh := make(chan struct{}, 1)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			switch req.Method {
+			case http.MethodPost:
+				vw := httptest.NewRecorder()
+				vr := httptest.NewRequest(http.MethodPost, "/registrations", nil)
+				vr.Header.Set(httpcmn.HeaderHagallIDKey, "0x1")
+				vr.Header.Set(httpcmn.HeaderHagallJWTSecretHeaderKey, httpcmn.MakeJWTSecret())
+				vr.Header.Set(httpcmn.HeaderHagallRegistrationStateKey, client.GetRegistrationState())
+				client.HandleServerRegistration(vw, vr)
+				registeredCh <- struct{}{}
+
+			case http.MethodDelete:
+				require.NotEmpty(t, req.Header.Get("Authorization"))
+				deletedCh <- struct{}{}
+			}
+		}))
+		defer server.Close()
+
+		client = NewClient(WithHagallEndpoint("http://test"), WithHDSEndpoint(server.URL))
+
+		pairCh := make(chan error, 1)
+		go func() {
+			pairCh <- client.Pair(context.Background(), PairIn{
+				HealthCheckTTL:       time.Minute,
+				RegistrationInterval: 10 * time.Millisecond,
+				RegistrationRetries:  1,
+			})
+		}()
+		<-registeredCh
+
+		err := client.Unpair(context.Background())
+		require.NoError(t, err)
+
+		select {
+		case err := <-pairCh:
+			require.ErrorIs(t, err, ErrUnpaired)
+		default:
+			t.Fatal("pair is still running after unpair")
+		}
+
+		<-deletedCh
+		require.Equal(t, RegistrationStatusInit, client.GetRegistrationStatus())
+	})
+
+	t.Run("pair started while unpairing does not register", func(t *testing.T) {
+		var posts int32
+		deletingCh := make(chan struct{})
+		resumeCh := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			switch req.Method {
+			case http.MethodPost:
+				atomic.AddInt32(&posts, 1)
+
+			case http.MethodDelete:
+				close(deletingCh)
+				<-resumeCh
+			}
+		}))
+		defer server.Close()
+
+		client := NewClient(WithHagallEndpoint("http://test"), WithHDSEndpoint(server.URL))
+		client.setRegistrationStatus(RegistrationStatusRegistered)
+
+		unpairCh := make(chan error, 1)
+		go func() {
+			unpairCh <- client.Unpair(context.Background())
+		}()
+		<-deletingCh
+
+		err := client.Pair(context.Background(), PairIn{
+			HealthCheckTTL:       time.Minute,
+			RegistrationInterval: 10 * time.Millisecond,
+			RegistrationRetries:  1,
+		})
+		require.ErrorIs(t, err, ErrUnpaired)
+
+		close(resumeCh)
+		require.NoError(t, <-unpairCh)
+		require.Zero(t, atomic.LoadInt32(&posts))
+		require.Equal(t, RegistrationStatusInit, client.GetRegistrationStatus())
+	})
+
+	t.Run("unpair respects context", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			<-req.Context().Done()
+		}))
+		defer server.Close()
+
+		client := NewClient(WithHagallEndpoint("http://test"), WithHDSEndpoint(server.URL))
+		client.setRegistrationStatus(RegistrationStatusRegistered)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		err := client.UnpairWithOptions(ctx, UnpairOptions{Timeout: time.Minute})
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		require.Less(t, time.Since(start), time.Second)
+		require.Equal(t, RegistrationStatusRegistered, client.GetRegistrationStatus())
+	})
+
+	t.Run("unpair does not modify the default transport", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+		defer server.Close()
+
+		defaultTransport := http.DefaultTransport.(*http.Transport)
+		dialContext := defaultTransport.DialContext
+
+		client := NewClient(WithHagallEndpoint("http://test"), WithHDSEndpoint(server.URL))
+		client.setRegistrationStatus(RegistrationStatusRegistered)
+
+		err := client.UnpairWithOptions(context.Background(), UnpairOptions{DialTimeout: time.Second})
+		require.NoError(t, err)
+		require.Equal(t, http.DefaultTransport, client.Transport)
+		require.Equal(t,
+			reflect.ValueOf(dialContext).Pointer(),
+			reflect.ValueOf(defaultTransport.DialContext).Pointer(),
+		)
+	})
+
+	t.Run("unpair uses a transport copy with interceptors", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+		defer server.Close()
+
+		base := &http.Transport{}
+
+		var mutex sync.Mutex
+		var wrapped []http.RoundTripper
+		var intercepted int
+		interceptor := func(next http.RoundTripper) http.RoundTripper {
+			mutex.Lock()
+			wrapped = append(wrapped, next)
+			mutex.Unlock()
+
+			return httpcmn.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				mutex.Lock()
+				intercepted++
+				mutex.Unlock()
+				return next.RoundTrip(req)
+			})
+		}
+
+		client := NewClient(
+			WithHagallEndpoint("http://test"),
+			WithHDSEndpoint(server.URL),
+			WithTransport(base),
+			WithInterceptors(interceptor),
+		)
+		client.setRegistrationStatus(RegistrationStatusRegistered)
+
+		err := client.UnpairWithOptions(context.Background(), UnpairOptions{DialTimeout: time.Second})
+		require.NoError(t, err)
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		require.Len(t, wrapped, 2)
+		require.Same(t, base, wrapped[0])
+
+		unpairTransport, ok := wrapped[1].(*http.Transport)
+		require.True(t, ok)
+		require.NotSame(t, base, unpairTransport)
+		require.NotNil(t, unpairTransport.DialContext)
+		require.Nil(t, base.DialContext)
+		require.Equal(t, 1, intercepted)
+	})
+}
+
+func TestClientSessions(t *testing.T) {
+	setupTestLog(t)
+
+	session := SessionResponse{
+		ID:             "0x1a",
+		ServerID:       "0x1",
+		ServerEndpoint: "http://hagall",
+		CreatedAt:      time.Now().UTC().Truncate(time.Second),
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.Method == http.MethodGet && req.URL.Path == "/sessions/0x1a":
+			appKey, _, _ := req.BasicAuth()
+			require.Equal(t, "key", appKey)
+			httpcmn.OKWithJSON(w, session)
+
+		case req.Method == http.MethodGet && req.URL.Path == "/sessions":
+			require.NotEmpty(t, req.Header.Get("Authorization"))
+			require.Equal(t, "0x1", req.URL.Query().Get("server_id"))
+			httpcmn.OKWithJSON(w, ListSessionsResponse{session})
+
+		case req.Method == http.MethodDelete && req.URL.Path == "/sessions/0x1a":
+			require.NotEmpty(t, req.Header.Get("Authorization"))
+			httpcmn.OK(w)
+
+		default:
+			httpcmn.NotFound(w)
+		}
+	}))
+	defer server.Close()
+
+	client := NewClient(
+		WithHagallEndpoint("http://hagall"),
+		WithHDSEndpoint(server.URL),
+		WithSecret("secret"),
+	)
+
+	t.Run("get session", func(t *testing.T) {
+		s, err := client.GetSession(context.Background(), GetSessionIn{
+			ID:        "0x1a",
+			AppKey:    "key",
+			AppSecret: "secret",
+		})
+		require.NoError(t, err)
+		require.Equal(t, session, s)
+	})
+
+	t.Run("get unknown session", func(t *testing.T) {
+		_, err := client.GetSession(context.Background(), GetSessionIn{ID: "0x2a"})
+		require.ErrorIs(t, err, ErrSessionNotFound)
+	})
+
+	t.Run("get session without id", func(t *testing.T) {
+		_, err := client.GetSession(context.Background(), GetSessionIn{})
+		require.Error(t, err)
+	})
+
+	t.Run("list sessions", func(t *testing.T) {
+		sessions, err := client.ListSessions(context.Background(), ListSessionsIn{ServerID: "0x1"})
+		require.NoError(t, err)
+		require.Equal(t, ListSessionsResponse{session}, sessions)
+	})
+
+	t.Run("delete session", func(t *testing.T) {
+		err := client.DeleteSession(context.Background(), DeleteSessionIn{ID: "0x1a"})
+		require.NoError(t, err)
+	})
 }
 
 func setupTestLog(tb testing.TB) {
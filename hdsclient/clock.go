@@ -0,0 +1,57 @@
+package hdsclient
+
+import (
+	"time"
+)
+
+// Clock is the source of time used by a client to stamp health checks and to
+// schedule registrations.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// NewTimer creates a timer that fires after the given duration.
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is a timer created by a Clock.
+type Timer interface {
+	// C returns the channel on which the time is delivered when the timer
+	// fires.
+	C() <-chan time.Time
+
+	// Reset changes the timer to fire after the given duration.
+	Reset(d time.Duration) bool
+
+	// Stop prevents the timer from firing.
+	Stop() bool
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{Timer: time.NewTimer(d)}
+}
+
+type systemTimer struct {
+	*time.Timer
+}
+
+func (t systemTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+func (c *Client) getClock() Clock {
+	if c.clock == nil {
+		return systemClock{}
+	}
+	return c.clock
+}
+
+func (c *Client) now() time.Time {
+	return c.getClock().Now()
+}
@@ -0,0 +1,263 @@
+package hdsclient
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/aukilabs/go-tooling/pkg/errors"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	ContentTypeJSON     = "application/json"
+	ContentTypeProtobuf = "application/x-protobuf"
+)
+
+var (
+	// ErrUnsupportedCodecType is returned by a codec that cannot encode or
+	// decode the given value. The client then tries the next codec.
+	ErrUnsupportedCodecType = errors.New("type not supported by codec")
+)
+
+// Codec is the interface that encodes request bodies and decodes response
+// bodies with a given media type.
+type Codec interface {
+	// The media type of the encoded data, set in the Content-Type and Accept
+	// headers.
+	ContentType() string
+
+	// Supports reports whether values of the type of the given value can be
+	// encoded and decoded. It is used to only accept the media types that
+	// the response value supports.
+	Supports(v interface{}) bool
+
+	// Marshal encodes the given value. It returns an error that wraps
+	// ErrUnsupportedCodecType when the value type is not supported.
+	Marshal(v interface{}) ([]byte, error)
+
+	// Unmarshal decodes the given data into the given value. It returns an
+	// error that wraps ErrUnsupportedCodecType when the value type is not
+	// supported.
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// JSONCodec is a codec that encodes values in JSON.
+type JSONCodec struct{}
+
+// ContentType satisfies the Codec interface.
+func (JSONCodec) ContentType() string {
+	return ContentTypeJSON
+}
+
+// Supports satisfies the Codec interface.
+func (JSONCodec) Supports(v interface{}) bool {
+	return true
+}
+
+// Marshal satisfies the Codec interface.
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal satisfies the Codec interface.
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// ProtobufCodec is a codec that encodes protocol buffer messages in their
+// binary wire format. Values that are not a proto.Message are not supported.
+type ProtobufCodec struct{}
+
+// ContentType satisfies the Codec interface.
+func (ProtobufCodec) ContentType() string {
+	return ContentTypeProtobuf
+}
+
+// Supports satisfies the Codec interface.
+func (ProtobufCodec) Supports(v interface{}) bool {
+	_, ok := v.(proto.Message)
+	return ok
+}
+
+// Marshal satisfies the Codec interface.
+func (ProtobufCodec) Marshal(v interface{}) ([]byte, error) {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return nil, errors.New("marshaling protobuf failed").
+			WithTag("type", fmt.Sprintf("%T", v)).
+			Wrap(ErrUnsupportedCodecType)
+	}
+	return proto.Marshal(msg)
+}
+
+// Unmarshal satisfies the Codec interface.
+func (ProtobufCodec) Unmarshal(data []byte, v interface{}) error {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return errors.New("unmarshaling protobuf failed").
+			WithTag("type", fmt.Sprintf("%T", v)).
+			Wrap(ErrUnsupportedCodecType)
+	}
+	return proto.Unmarshal(data, msg)
+}
+
+// encode encodes the given value with the first codec that supports it and
+// returns the encoded body with its media type. A deprecated Encode function
+// takes precedence over the codecs and is assumed to produce JSON.
+func (c *Client) encode(v interface{}) ([]byte, string, error) {
+	if c.Encode != nil {
+		body, err := c.Encode(v)
+		return body, ContentTypeJSON, err
+	}
+
+	var err error
+	for _, codec := range c.codecs {
+		var body []byte
+		body, err = codec.Marshal(v)
+		if errors.Is(err, ErrUnsupportedCodecType) {
+			continue
+		}
+		return body, codec.ContentType(), err
+	}
+	return nil, "", err
+}
+
+// decode decodes the given body with the codec that matches the given
+// content type, falling back to the codecs that support the output in order
+// of preference when none matches or when the matching one does not support
+// the output. A deprecated Decode function takes precedence over the codecs.
+func (c *Client) decode(contentType string, body []byte, out interface{}) error {
+	if c.Decode != nil {
+		return c.Decode(body, out)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	for _, codec := range c.codecs {
+		if codec.ContentType() != mediaType {
+			continue
+		}
+		if err := codec.Unmarshal(body, out); !errors.Is(err, ErrUnsupportedCodecType) {
+			return err
+		}
+		break
+	}
+
+	var err error
+	for _, codec := range c.codecs {
+		err = codec.Unmarshal(body, out)
+		if !errors.Is(err, ErrUnsupportedCodecType) {
+			return err
+		}
+	}
+	return err
+}
+
+// accept returns the Accept header value that lists the media types of the
+// codecs that support the given response value, in order of preference. All
+// the codecs are listed when the response value is nil.
+func (c *Client) accept(out interface{}) string {
+	if c.Decode != nil {
+		return ContentTypeJSON
+	}
+
+	types := make([]string, 0, len(c.codecs))
+	for _, codec := range c.codecs {
+		if out != nil && !codec.Supports(out) {
+			continue
+		}
+
+		i := len(types)
+		if i == 0 {
+			types = append(types, codec.ContentType())
+			continue
+		}
+
+		q := 1 - float64(i)/10
+		if q < 0.1 {
+			q = 0.1
+		}
+		types = append(types, fmt.Sprintf("%s;q=%.1f", codec.ContentType(), q))
+	}
+	return strings.Join(types, ", ")
+}
+
+// newRequestWithBody creates a request with the given value encoded as the
+// body. The body is compressed with gzip when compression is enabled and the
+// body is at least as large as the compression threshold.
+func (c *Client) newRequestWithBody(ctx context.Context, method, url string, in interface{}) (*http.Request, error) {
+	body, contentType, err := c.encode(in)
+	if err != nil {
+		return nil, errors.New("encoding body failed").Wrap(err)
+	}
+
+	compressed := c.compression && len(body) >= c.compressionThreshold
+	if compressed {
+		if body, err = gzipBytes(body); err != nil {
+			return nil, errors.New("compressing body failed").Wrap(err)
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.New("creating request failed").Wrap(err)
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	if compressed {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	return req, nil
+}
+
+// setNegotiationHeaders sets the headers that tell HDS which media types and
+// encodings the client accepts for the given response value.
+func (c *Client) setNegotiationHeaders(req *http.Request, out interface{}) {
+	if accept := c.accept(out); accept != "" && req.Header.Get("Accept") == "" {
+		req.Header.Set("Accept", accept)
+	}
+
+	if c.compression && req.Header.Get("Accept-Encoding") == "" {
+		req.Header.Set("Accept-Encoding", "gzip")
+	}
+}
+
+// readBody reads the given response body, decompressing it when it is
+// encoded with gzip.
+func readBody(res *http.Response) ([]byte, error) {
+	if res.Body == nil {
+		return nil, nil
+	}
+
+	if !strings.EqualFold(res.Header.Get("Content-Encoding"), "gzip") {
+		return io.ReadAll(res.Body)
+	}
+
+	r, err := gzip.NewReader(res.Body)
+	if err != nil {
+		if err == io.EOF {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func gzipBytes(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,230 @@
+package hdsclient
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	httpcmn "github.com/aukilabs/hagall-common/http"
+	"github.com/aukilabs/hagall-common/messages/hagallpb"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestClientCodecs(t *testing.T) {
+	setupTestLog(t)
+
+	t.Run("json is negotiated by default", func(t *testing.T) {
+		hds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			require.Equal(t, ContentTypeJSON, r.Header.Get("Accept"))
+			require.Equal(t, ContentTypeJSON, r.Header.Get("Content-Type"))
+
+			var in PostSessionIn
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&in))
+			require.Equal(t, "s1", in.ID)
+		}))
+		defer hds.Close()
+
+		client := NewClient(WithHDSEndpoint(hds.URL))
+		require.NoError(t, client.PostSession(context.Background(), PostSessionIn{ID: "s1"}))
+	})
+
+	t.Run("protobuf messages are sent with the protobuf codec", func(t *testing.T) {
+		hds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			require.Equal(t, ContentTypeProtobuf+", "+ContentTypeJSON+";q=0.9", r.Header.Get("Accept"))
+
+			body, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+
+			switch r.Header.Get("Content-Type") {
+			case ContentTypeProtobuf:
+				var in hagallpb.Participant
+				require.NoError(t, proto.Unmarshal(body, &in))
+				require.Equal(t, uint32(42), in.Id)
+
+			default:
+				require.Equal(t, ContentTypeJSON, r.Header.Get("Content-Type"))
+			}
+		}))
+		defer hds.Close()
+
+		client := NewClient(
+			WithHDSEndpoint(hds.URL),
+			WithCodecs(ProtobufCodec{}, JSONCodec{}),
+		)
+		require.NoError(t, client.Post(context.Background(), "/participants", &hagallpb.Participant{Id: 42}))
+		require.NoError(t, client.PostSession(context.Background(), PostSessionIn{ID: "s1"}))
+	})
+
+	t.Run("responses are decoded with the codec matching their content type", func(t *testing.T) {
+		hds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, err := proto.Marshal(&hagallpb.Participant{Id: 7})
+			require.NoError(t, err)
+
+			w.Header().Set("Content-Type", ContentTypeProtobuf)
+			w.Write(body)
+		}))
+		defer hds.Close()
+
+		client := NewClient(
+			WithHDSEndpoint(hds.URL),
+			WithCodecs(JSONCodec{}, ProtobufCodec{}),
+		)
+
+		var out hagallpb.Participant
+		require.NoError(t, client.Get(context.Background(), "/participants/7", &out))
+		require.Equal(t, uint32(7), out.Id)
+	})
+
+	t.Run("only codecs supporting the response are accepted", func(t *testing.T) {
+		servers := GetServersResponse{{ID: "0x1", Endpoint: "http://hagall-1"}}
+
+		hds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/servers":
+				require.Equal(t, ContentTypeJSON, r.Header.Get("Accept"))
+				w.Header().Set("Content-Type", ContentTypeJSON)
+				json.NewEncoder(w).Encode(servers)
+
+			default:
+				require.Equal(t, ContentTypeProtobuf+", "+ContentTypeJSON+";q=0.9", r.Header.Get("Accept"))
+				body, err := proto.Marshal(&hagallpb.Participant{Id: 7})
+				require.NoError(t, err)
+				w.Header().Set("Content-Type", ContentTypeProtobuf)
+				w.Write(body)
+			}
+		}))
+		defer hds.Close()
+
+		client := NewClient(
+			WithHDSEndpoint(hds.URL),
+			WithCodecs(ProtobufCodec{}, JSONCodec{}),
+		)
+
+		res, err := client.GetServers(context.Background(), GetServersIn{})
+		require.NoError(t, err)
+		require.Equal(t, servers, res)
+
+		var out hagallpb.Participant
+		require.NoError(t, client.Get(context.Background(), "/participants/7", &out))
+		require.Equal(t, uint32(7), out.Id)
+	})
+
+	t.Run("responses fall back to the codecs supporting the output", func(t *testing.T) {
+		hds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", ContentTypeProtobuf)
+			json.NewEncoder(w).Encode(GetServersResponse{{ID: "0x1"}})
+		}))
+		defer hds.Close()
+
+		client := NewClient(
+			WithHDSEndpoint(hds.URL),
+			WithCodecs(ProtobufCodec{}, JSONCodec{}),
+		)
+
+		res, err := client.GetServers(context.Background(), GetServersIn{})
+		require.NoError(t, err)
+		require.Equal(t, GetServersResponse{{ID: "0x1"}}, res)
+	})
+
+	t.Run("unsupported types are reported", func(t *testing.T) {
+		client := NewClient(WithCodecs(ProtobufCodec{}))
+		err := client.Post(context.Background(), "/sessions", PostSessionIn{ID: "s1"})
+		require.ErrorIs(t, err, ErrUnsupportedCodecType)
+	})
+
+	t.Run("deprecated encoder sends json", func(t *testing.T) {
+		hds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			require.Equal(t, ContentTypeJSON, r.Header.Get("Content-Type"))
+
+			body, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+			require.Equal(t, `"custom"`, string(body))
+		}))
+		defer hds.Close()
+
+		client := NewClient(
+			WithHDSEndpoint(hds.URL),
+			WithEncoder(func(interface{}) ([]byte, error) {
+				return []byte(`"custom"`), nil
+			}),
+		)
+		require.NoError(t, client.PostSession(context.Background(), PostSessionIn{ID: "s1"}))
+	})
+}
+
+func TestClientCompression(t *testing.T) {
+	setupTestLog(t)
+
+	servers := GetServersResponse{
+		{ID: "0x1", Endpoint: "http://hagall-1"},
+		{ID: "0x2", Endpoint: "http://hagall-2"},
+	}
+
+	hds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "gzip", r.Header.Get("Accept-Encoding"))
+
+		if r.Method == http.MethodPost {
+			var in PostSessionIn
+			body := io.Reader(r.Body)
+
+			if r.Header.Get("Content-Encoding") == "gzip" {
+				gr, err := gzip.NewReader(r.Body)
+				require.NoError(t, err)
+				defer gr.Close()
+				body = gr
+			}
+			require.NoError(t, json.NewDecoder(body).Decode(&in))
+			w.Header().Set("X-Compressed", r.Header.Get("Content-Encoding"))
+			return
+		}
+
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		require.NoError(t, json.NewEncoder(gw).Encode(servers))
+		require.NoError(t, gw.Close())
+
+		w.Header().Set("Content-Type", ContentTypeJSON)
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(buf.Bytes())
+	}))
+	defer hds.Close()
+
+	t.Run("large request bodies are compressed", func(t *testing.T) {
+		var compressed []string
+		client := NewClient(
+			WithHDSEndpoint(hds.URL),
+			WithCompression(32),
+			WithInterceptors(func(next http.RoundTripper) http.RoundTripper {
+				return httpcmn.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+					res, err := next.RoundTrip(r)
+					if err == nil {
+						compressed = append(compressed, res.Header.Get("X-Compressed"))
+					}
+					return res, err
+				})
+			}),
+		)
+
+		ctx := context.Background()
+		require.NoError(t, client.PostSession(ctx, PostSessionIn{ID: "s1"}))
+		require.NoError(t, client.PostSession(ctx, PostSessionIn{ID: "a-session-id-long-enough-to-be-compressed"}))
+		require.Equal(t, []string{"", "gzip"}, compressed)
+	})
+
+	t.Run("compressed responses are decoded", func(t *testing.T) {
+		client := NewClient(
+			WithHDSEndpoint(hds.URL),
+			WithCompression(0),
+		)
+
+		res, err := client.GetServers(context.Background(), GetServersIn{})
+		require.NoError(t, err)
+		require.Equal(t, servers, res)
+	})
+}
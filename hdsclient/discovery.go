@@ -0,0 +1,470 @@
+package hdsclient
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aukilabs/go-tooling/pkg/errors"
+	"github.com/aukilabs/go-tooling/pkg/logs"
+	hsmoketest "github.com/aukilabs/hagall-common/smoketest"
+)
+
+const (
+	defaultDiscoveryTTL     = time.Minute
+	defaultFailureCooldown  = 30 * time.Second
+	defaultProbeTimeout     = 2 * time.Second
+	defaultSmokeTestTimeout = 5 * time.Second
+)
+
+var (
+	// Error returned by a Discoverer when no server matches the requirements
+	// or when all of them failed.
+	ErrNoServerAvailable = errors.New("no server available")
+)
+
+// LatencyProber is a function that measures the latency to a server.
+type LatencyProber func(ctx context.Context, server ServerResponse) (time.Duration, error)
+
+// Candidate represents a server returned by a Discoverer.
+type Candidate struct {
+	// The server as returned by HDS.
+	Server ServerResponse
+
+	// The measured latency to the server.
+	Latency time.Duration
+
+	// The error returned when measuring the latency. Unreachable candidates are
+	// ranked last.
+	ProbeErr error
+}
+
+type DiscovererOpts func(*Discoverer)
+
+// WithDiscoveryTTL sets the duration during which the ranked servers are
+// cached. Defaults to 1 minute.
+func WithDiscoveryTTL(v time.Duration) DiscovererOpts {
+	return func(d *Discoverer) {
+		d.ttl = v
+	}
+}
+
+// WithLatencyProber sets the function used to measure the latency to servers.
+// Defaults to DialProber.
+func WithLatencyProber(v LatencyProber) DiscovererOpts {
+	return func(d *Discoverer) {
+		d.prober = v
+	}
+}
+
+// WithProbeTimeout sets the maximum duration of a latency measure. Defaults to
+// 2 seconds.
+func WithProbeTimeout(v time.Duration) DiscovererOpts {
+	return func(d *Discoverer) {
+		d.probeTimeout = v
+	}
+}
+
+// WithFailureCooldown sets the duration during which a failed server is not
+// handed out. Defaults to 30 seconds.
+func WithFailureCooldown(v time.Duration) DiscovererOpts {
+	return func(d *Discoverer) {
+		d.failureCooldown = v
+	}
+}
+
+// Discoverer selects the best Hagall servers returned by HDS.
+//
+// Draining servers are skipped and the others are filtered by minimum
+// version, modules and feature flags, then ranked by measured latency.
+// Results are cached and servers reported as failed are skipped until their
+// cooldown expires.
+type Discoverer struct {
+	client          *Client
+	in              GetServersIn
+	prober          LatencyProber
+	ttl             time.Duration
+	probeTimeout    time.Duration
+	failureCooldown time.Duration
+
+	mutex      sync.Mutex
+	candidates []Candidate
+	fetchedAt  time.Time
+	failures   map[string]time.Time
+}
+
+// NewDiscoverer creates a discoverer that retrieves servers with the given
+// client and input.
+func NewDiscoverer(client *Client, in GetServersIn, opts ...DiscovererOpts) *Discoverer {
+	d := &Discoverer{
+		client:   client,
+		in:       in,
+		failures: make(map[string]time.Time),
+	}
+
+	for _, opt := range opts {
+		opt(d)
+	}
+
+	if d.prober == nil {
+		d.prober = DialProber(nil)
+	}
+
+	if d.ttl <= 0 {
+		d.ttl = defaultDiscoveryTTL
+	}
+
+	if d.probeTimeout <= 0 {
+		d.probeTimeout = defaultProbeTimeout
+	}
+
+	if d.failureCooldown <= 0 {
+		d.failureCooldown = defaultFailureCooldown
+	}
+	return d
+}
+
+// Servers returns the ranked servers, fetching them from HDS when the cache is
+// expired.
+func (d *Discoverer) Servers(ctx context.Context) ([]Candidate, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if err := d.refreshIfExpired(ctx); err != nil {
+		return nil, err
+	}
+	return append([]Candidate(nil), d.candidates...), nil
+}
+
+// Next returns the best ranked server that did not fail recently.
+//
+// When all the servers failed, the servers are fetched again from HDS. Servers
+// still in their failure cooldown are not handed out, even after a refresh.
+func (d *Discoverer) Next(ctx context.Context) (ServerResponse, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if err := d.refreshIfExpired(ctx); err != nil {
+		return ServerResponse{}, err
+	}
+
+	if c, ok := d.next(); ok {
+		return c.Server, nil
+	}
+
+	if err := d.refresh(ctx); err != nil {
+		return ServerResponse{}, err
+	}
+
+	if c, ok := d.next(); ok {
+		return c.Server, nil
+	}
+	return ServerResponse{}, ErrNoServerAvailable
+}
+
+// ReportFailure marks the server with the given endpoint as failed. It is not
+// handed out by Next until the failure cooldown expires.
+func (d *Discoverer) ReportFailure(endpoint string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.failures[endpoint] = time.Now()
+}
+
+// Refresh fetches and ranks servers from HDS, regardless of the cache.
+func (d *Discoverer) Refresh(ctx context.Context) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.refresh(ctx)
+}
+
+func (d *Discoverer) next() (Candidate, bool) {
+	for _, c := range d.candidates {
+		failedAt, failed := d.failures[c.Server.Endpoint]
+		if failed && time.Since(failedAt) < d.failureCooldown {
+			continue
+		}
+		delete(d.failures, c.Server.Endpoint)
+		return c, true
+	}
+	return Candidate{}, false
+}
+
+func (d *Discoverer) refreshIfExpired(ctx context.Context) error {
+	if !d.fetchedAt.IsZero() && time.Since(d.fetchedAt) < d.ttl {
+		return nil
+	}
+	return d.refresh(ctx)
+}
+
+func (d *Discoverer) refresh(ctx context.Context) error {
+	servers, err := d.client.GetServers(ctx, d.in)
+	if err != nil {
+		return errors.New("getting servers failed").Wrap(err)
+	}
+
+	var filtered []ServerResponse
+	for _, s := range servers {
+		if MatchServer(s, d.in) {
+			filtered = append(filtered, s)
+		}
+	}
+
+	candidates := d.probe(ctx, filtered)
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if (a.ProbeErr == nil) != (b.ProbeErr == nil) {
+			return a.ProbeErr == nil
+		}
+		return a.Latency < b.Latency
+	})
+
+	d.candidates = candidates
+	d.fetchedAt = time.Now()
+
+	for endpoint, failedAt := range d.failures {
+		if time.Since(failedAt) >= d.failureCooldown {
+			delete(d.failures, endpoint)
+		}
+	}
+
+	logs.WithTag("servers", len(servers)).
+		WithTag("candidates", len(candidates)).
+		Debug("hagall servers discovered")
+
+	if len(candidates) == 0 {
+		return ErrNoServerAvailable
+	}
+	return nil
+}
+
+func (d *Discoverer) probe(ctx context.Context, servers []ServerResponse) []Candidate {
+	candidates := make([]Candidate, len(servers))
+
+	var wg sync.WaitGroup
+	for i, s := range servers {
+		wg.Add(1)
+		go func(i int, s ServerResponse) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(ctx, d.probeTimeout)
+			defer cancel()
+
+			latency, err := d.prober(ctx, s)
+			candidates[i] = Candidate{
+				Server:   s,
+				Latency:  latency,
+				ProbeErr: err,
+			}
+		}(i, s)
+	}
+	wg.Wait()
+
+	return candidates
+}
+
+// DialProber returns a latency prober that measures the time to establish a
+// TCP connection with a server. A nil dialer uses a default net.Dialer.
+func DialProber(dialer *net.Dialer) LatencyProber {
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+
+	return func(ctx context.Context, server ServerResponse) (time.Duration, error) {
+		address, err := endpointAddress(server.Endpoint)
+		if err != nil {
+			return 0, err
+		}
+
+		start := time.Now()
+		conn, err := dialer.DialContext(ctx, "tcp", address)
+		if err != nil {
+			return 0, errors.New("dialing server failed").
+				WithTag("endpoint", server.Endpoint).
+				Wrap(err)
+		}
+		latency := time.Since(start)
+		conn.Close()
+		return latency, nil
+	}
+}
+
+// SmokeTestProber returns a latency prober that measures the latency of the
+// smoke test handshake with a server. It requires servers to be retrieved with
+// an access token.
+func SmokeTestProber(userAgent string, maxSessionIDLength int) LatencyProber {
+	return func(ctx context.Context, server ServerResponse) (time.Duration, error) {
+		timeout := defaultSmokeTestTimeout
+		if deadline, ok := ctx.Deadline(); ok {
+			timeout = time.Until(deadline)
+		}
+
+		res, err := hsmoketest.RunSmokeTest(ctx, hsmoketest.RunSmokeTestOptions{
+			ToEndpoint:         server.Endpoint,
+			ToEndpointToken:    server.AccessToken,
+			Timeout:            timeout,
+			MaxSessionIDLength: maxSessionIDLength,
+			UserAgent:          userAgent,
+		})
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(res.LatencyMilliSec * float64(time.Millisecond)), nil
+	}
+}
+
+// MatchServer reports whether a server satisfies the minimum version, modules
+// and feature flags of the given input. Draining servers never match.
+func MatchServer(s ServerResponse, in GetServersIn) bool {
+	if s.Health != nil && s.Health.Draining {
+		return false
+	}
+
+	if in.MinVersion != "" && compareVersions(s.Version, in.MinVersion) < 0 {
+		return false
+	}
+	return containsAll(s.Modules, in.Modules) &&
+		containsAll(s.FeatureFlags, in.FeatureFlags)
+}
+
+func containsAll(values, required []string) bool {
+	for _, r := range required {
+		found := false
+		for _, v := range values {
+			if v == r {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// compareVersions compares two semantic versions, with or without a "v"
+// prefix. It returns -1 when a < b, 0 when a == b and 1 when a > b. Build
+// metadata is ignored and pre-release versions are lower than their release.
+// Pre-release versions are compared identifier by identifier, numerically for
+// numeric identifiers.
+func compareVersions(a, b string) int {
+	aCore, aPre := splitVersion(a)
+	bCore, bPre := splitVersion(b)
+
+	for i := 0; i < 3; i++ {
+		if aCore[i] != bCore[i] {
+			if aCore[i] < bCore[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+
+	switch {
+	case aPre == bPre:
+		return 0
+	case aPre == "":
+		return 1
+	case bPre == "":
+		return -1
+	default:
+		return comparePreReleases(aPre, bPre)
+	}
+}
+
+// comparePreReleases compares two pre-release versions following the semantic
+// versioning precedence rules.
+func comparePreReleases(a, b string) int {
+	aIDs := strings.Split(a, ".")
+	bIDs := strings.Split(b, ".")
+
+	for i := 0; i < len(aIDs) && i < len(bIDs); i++ {
+		aID, bID := aIDs[i], bIDs[i]
+		if aID == bID {
+			continue
+		}
+
+		aNum, aErr := strconv.ParseUint(aID, 10, 64)
+		bNum, bErr := strconv.ParseUint(bID, 10, 64)
+		switch {
+		case aErr == nil && bErr == nil:
+			if aNum < bNum {
+				return -1
+			}
+			return 1
+
+		// Numeric identifiers have a lower precedence than alphanumeric ones.
+		case aErr == nil:
+			return -1
+		case bErr == nil:
+			return 1
+
+		case aID < bID:
+			return -1
+		default:
+			return 1
+		}
+	}
+
+	switch {
+	case len(aIDs) < len(bIDs):
+		return -1
+	case len(aIDs) > len(bIDs):
+		return 1
+	default:
+		return 0
+	}
+}
+
+func splitVersion(v string) ([3]int, string) {
+	v = strings.TrimPrefix(strings.TrimSpace(v), "v")
+
+	if i := strings.IndexByte(v, '+'); i >= 0 {
+		v = v[:i]
+	}
+
+	var pre string
+	if i := strings.IndexByte(v, '-'); i >= 0 {
+		v, pre = v[:i], v[i+1:]
+	}
+
+	var core [3]int
+	for i, part := range strings.SplitN(v, ".", 3) {
+		core[i], _ = strconv.Atoi(part)
+	}
+	return core, pre
+}
+
+// endpointAddress returns the host:port address of an endpoint URL.
+func endpointAddress(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", errors.New("parsing endpoint failed").
+			WithTag("endpoint", endpoint).
+			Wrap(err)
+	}
+
+	if u.Host == "" {
+		return "", errors.New("endpoint has no host").
+			WithTag("endpoint", endpoint)
+	}
+
+	if u.Port() != "" {
+		return u.Host, nil
+	}
+
+	switch u.Scheme {
+	case "https", "wss":
+		return net.JoinHostPort(u.Hostname(), "443"), nil
+	default:
+		return net.JoinHostPort(u.Hostname(), "80"), nil
+	}
+}
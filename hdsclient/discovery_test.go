@@ -0,0 +1,219 @@
+package hdsclient
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aukilabs/go-tooling/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiscoverer(t *testing.T) {
+	setupTestLog(t)
+
+	servers := GetServersResponse{
+		{ID: "old", Endpoint: "http://old", Version: "v0.4.9", Modules: []string{"vikja"}},
+		{ID: "far", Endpoint: "http://far", Version: "v0.5.0", Modules: []string{"vikja", "odal"}},
+		{ID: "near", Endpoint: "http://near", Version: "v0.5.1", Modules: []string{"vikja"}},
+		{ID: "down", Endpoint: "http://down", Version: "v1.0.0", Modules: []string{"vikja"}},
+		{ID: "nomodule", Endpoint: "http://nomodule", Version: "v1.0.0"},
+		{ID: "draining", Endpoint: "http://draining", Version: "v1.0.0", Modules: []string{"vikja"}, Health: &HealthReport{Draining: true}},
+	}
+
+	latencies := map[string]time.Duration{
+		"http://old":      time.Millisecond,
+		"http://far":      100 * time.Millisecond,
+		"http://near":     10 * time.Millisecond,
+		"http://nomodule": time.Millisecond,
+		"http://draining": time.Millisecond,
+	}
+
+	prober := func(ctx context.Context, s ServerResponse) (time.Duration, error) {
+		latency, ok := latencies[s.Endpoint]
+		if !ok {
+			return 0, errors.New("unreachable")
+		}
+		return latency, nil
+	}
+
+	newHDS := func(calls *int32) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(calls, 1)
+			require.Equal(t, "v0.5.0", r.URL.Query().Get("min_version"))
+			json.NewEncoder(w).Encode(servers)
+		}))
+	}
+
+	in := GetServersIn{
+		AppKey:     "key",
+		AppSecret:  "secret",
+		MinVersion: "v0.5.0",
+		Modules:    []string{"vikja"},
+	}
+
+	t.Run("servers are filtered and ranked by latency", func(t *testing.T) {
+		var calls int32
+		hds := newHDS(&calls)
+		defer hds.Close()
+
+		d := NewDiscoverer(NewClient(WithHDSEndpoint(hds.URL)), in, WithLatencyProber(prober))
+		candidates, err := d.Servers(context.Background())
+		require.NoError(t, err)
+		require.Len(t, candidates, 3)
+		require.Equal(t, "near", candidates[0].Server.ID)
+		require.Equal(t, "far", candidates[1].Server.ID)
+		require.Equal(t, "down", candidates[2].Server.ID)
+		require.Error(t, candidates[2].ProbeErr)
+
+		_, err = d.Servers(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	})
+
+	t.Run("next hands out the next best server on failure", func(t *testing.T) {
+		var calls int32
+		hds := newHDS(&calls)
+		defer hds.Close()
+
+		d := NewDiscoverer(NewClient(WithHDSEndpoint(hds.URL)), in, WithLatencyProber(prober))
+
+		s, err := d.Next(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, "near", s.ID)
+
+		d.ReportFailure(s.Endpoint)
+		s, err = d.Next(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, "far", s.ID)
+
+		d.ReportFailure(s.Endpoint)
+		s, err = d.Next(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, "down", s.ID)
+		require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+		d.ReportFailure(s.Endpoint)
+		_, err = d.Next(context.Background())
+		require.ErrorIs(t, err, ErrNoServerAvailable)
+		require.Equal(t, int32(2), atomic.LoadInt32(&calls))
+	})
+
+	t.Run("failures are kept when the cache expires", func(t *testing.T) {
+		var calls int32
+		hds := newHDS(&calls)
+		defer hds.Close()
+
+		d := NewDiscoverer(NewClient(WithHDSEndpoint(hds.URL)), in,
+			WithLatencyProber(prober),
+			WithDiscoveryTTL(10*time.Millisecond),
+		)
+
+		s, err := d.Next(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, "near", s.ID)
+		d.ReportFailure(s.Endpoint)
+
+		time.Sleep(20 * time.Millisecond)
+		s, err = d.Next(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, "far", s.ID)
+		require.Equal(t, int32(2), atomic.LoadInt32(&calls))
+	})
+
+	t.Run("failed servers are handed out again after cooldown", func(t *testing.T) {
+		var calls int32
+		hds := newHDS(&calls)
+		defer hds.Close()
+
+		d := NewDiscoverer(NewClient(WithHDSEndpoint(hds.URL)), in,
+			WithLatencyProber(prober),
+			WithFailureCooldown(10*time.Millisecond),
+		)
+
+		s, err := d.Next(context.Background())
+		require.NoError(t, err)
+		d.ReportFailure(s.Endpoint)
+
+		time.Sleep(20 * time.Millisecond)
+		s, err = d.Next(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, "near", s.ID)
+	})
+
+	t.Run("cache expires", func(t *testing.T) {
+		var calls int32
+		hds := newHDS(&calls)
+		defer hds.Close()
+
+		d := NewDiscoverer(NewClient(WithHDSEndpoint(hds.URL)), in,
+			WithLatencyProber(prober),
+			WithDiscoveryTTL(10*time.Millisecond),
+		)
+
+		_, err := d.Next(context.Background())
+		require.NoError(t, err)
+
+		time.Sleep(20 * time.Millisecond)
+		_, err = d.Next(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, int32(2), atomic.LoadInt32(&calls))
+	})
+
+	t.Run("no matching server", func(t *testing.T) {
+		var calls int32
+		hds := newHDS(&calls)
+		defer hds.Close()
+
+		in := in
+		in.FeatureFlags = []string{"unknown"}
+
+		d := NewDiscoverer(NewClient(WithHDSEndpoint(hds.URL)), in, WithLatencyProber(prober))
+		_, err := d.Next(context.Background())
+		require.ErrorIs(t, err, ErrNoServerAvailable)
+	})
+}
+
+func TestDialProber(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	latency, err := DialProber(nil)(context.Background(), ServerResponse{Endpoint: server.URL})
+	require.NoError(t, err)
+	require.Greater(t, latency, time.Duration(0))
+
+	_, err = DialProber(nil)(context.Background(), ServerResponse{Endpoint: "not an url"})
+	require.Error(t, err)
+}
+
+func TestCompareVersions(t *testing.T) {
+	utests := []struct {
+		a        string
+		b        string
+		expected int
+	}{
+		{a: "v1.0.0", b: "1.0.0", expected: 0},
+		{a: "v1.0.0", b: "v1.0.1", expected: -1},
+		{a: "v1.10.0", b: "v1.9.0", expected: 1},
+		{a: "v2", b: "v1.9.9", expected: 1},
+		{a: "v1.0.0-rc1", b: "v1.0.0", expected: -1},
+		{a: "v1.0.0", b: "v1.0.0-rc1", expected: 1},
+		{a: "v1.0.0-rc2", b: "v1.0.0-rc1", expected: 1},
+		{a: "v1.0.0-rc.10", b: "v1.0.0-rc.9", expected: 1},
+		{a: "v1.0.0-rc.9", b: "v1.0.0-rc.10", expected: -1},
+		{a: "v1.0.0-1", b: "v1.0.0-alpha", expected: -1},
+		{a: "v1.0.0-alpha", b: "v1.0.0-alpha.1", expected: -1},
+		{a: "v1.0.0-alpha.beta", b: "v1.0.0-alpha.1", expected: 1},
+		{a: "v1.0.0+build", b: "v1.0.0", expected: 0},
+	}
+
+	for _, u := range utests {
+		t.Run(u.a+" "+u.b, func(t *testing.T) {
+			require.Equal(t, u.expected, compareVersions(u.a, u.b))
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package hdsclient
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/aukilabs/go-tooling/pkg/errors"
+	"github.com/aukilabs/go-tooling/pkg/logs"
+)
+
+// Drain marks the server as draining: HDS stops sending new sessions to the
+// server while existing sessions keep running.
+//
+// The draining state is advertised on health checks, even when notifying HDS
+// fails.
+//
+// HDS is notified with POST /servers/drain, and DELETE /servers/drain on
+// Undrain. These routes are a proposed HDS API: HDS versions that do not serve
+// them respond with a 404, which is ignored since they learn the draining
+// state from the health checks.
+func (c *Client) Drain(ctx context.Context) error {
+	c.setDraining(true)
+
+	if err := c.notifyDraining(ctx, true); err != nil {
+		return errors.New("draining server failed").Wrap(err)
+	}
+
+	logs.WithTag("server_id", c.ServerID()).Info("server is draining")
+	return nil
+}
+
+// Undrain cancels a previous Drain. HDS sends new sessions to the server
+// again.
+func (c *Client) Undrain(ctx context.Context) error {
+	c.setDraining(false)
+
+	if err := c.notifyDraining(ctx, false); err != nil {
+		return errors.New("undraining server failed").Wrap(err)
+	}
+
+	logs.WithTag("server_id", c.ServerID()).Info("server is not draining anymore")
+	return nil
+}
+
+// IsDraining reports whether the server is draining.
+func (c *Client) IsDraining() bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.draining
+}
+
+// DrainAndUnpair drains the server, waits for waitIdle to return and then
+// unpairs the server from HDS.
+//
+// waitIdle is meant to block until the active sessions ended. The server is
+// not unpaired when it returns an error.
+func (c *Client) DrainAndUnpair(ctx context.Context, waitIdle func(ctx context.Context) error) error {
+	if err := c.Drain(ctx); err != nil {
+		return err
+	}
+
+	if waitIdle != nil {
+		if err := waitIdle(ctx); err != nil {
+			return errors.New("waiting for active sessions failed").Wrap(err)
+		}
+	}
+	return c.Unpair(ctx)
+}
+
+func (c *Client) setDraining(v bool) {
+	c.mutex.Lock()
+	previous := c.draining
+	c.draining = v
+	c.mutex.Unlock()
+
+	if previous != v {
+		c.emit(Event{
+			Type:     EventTypeDrainingChanged,
+			Status:   c.GetRegistrationStatus(),
+			ServerID: c.ServerID(),
+			Draining: v,
+		})
+	}
+}
+
+// notifyDraining tells each HDS endpoint the server is registered with
+// whether the server is draining. Unregistered servers learn it from the
+// health checks once registered.
+func (c *Client) notifyDraining(ctx context.Context, draining bool) error {
+	notify := func(ctx context.Context) error {
+		var err error
+		if draining {
+			err = c.Post(ctx, "/servers/drain", nil)
+		} else {
+			err = c.Delete(ctx, "/servers/drain")
+		}
+
+		var apiErr *APIError
+		if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+			logs.WithTag("draining", draining).
+				Debug("hds does not support drain notifications")
+			return nil
+		}
+		return err
+	}
+
+	if !c.multiHDS() {
+		if c.GetRegistrationStatus() != RegistrationStatusRegistered {
+			return nil
+		}
+		return notify(ctx)
+	}
+
+	var err error
+	for _, e := range c.endpoints {
+		if c.registrationStatusFor(e.url) != RegistrationStatusRegistered {
+			continue
+		}
+
+		if nerr := notify(withHDSEndpoint(ctx, e.url)); nerr != nil {
+			err = errors.New("notifying hds failed").
+				WithTag("hds_endpoint", e.url).
+				Wrap(nerr)
+			logs.Error(err)
+		}
+	}
+	return err
+}
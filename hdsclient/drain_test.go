@@ -0,0 +1,133 @@
+package hdsclient
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aukilabs/go-tooling/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientDrain(t *testing.T) {
+	setupTestLog(t)
+
+	newHDS := func(requests *[]string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			*requests = append(*requests, r.Method+" "+r.URL.Path)
+		}))
+	}
+
+	t.Run("drain notifies hds and is advertised on health checks", func(t *testing.T) {
+		var requests []string
+		hds := newHDS(&requests)
+		defer hds.Close()
+
+		client := NewClient(
+			WithHagallEndpoint("http://test"),
+			WithHDSEndpoint(hds.URL),
+			WithSecret("secret"),
+		)
+		client.setRegistrationStatus(RegistrationStatusRegistered)
+
+		events, unsubscribe := client.Subscribe(0)
+		defer unsubscribe()
+
+		ctx := context.Background()
+		require.NoError(t, client.Drain(ctx))
+		require.True(t, client.IsDraining())
+		require.Equal(t, []string{"POST /servers/drain"}, requests)
+
+		e := <-events
+		require.Equal(t, EventTypeDrainingChanged, e.Type)
+		require.True(t, e.Draining)
+
+		res := httptest.NewRecorder()
+		client.HandleHealthCheck(res, httptest.NewRequest(http.MethodGet, "/health", nil))
+		require.Equal(t, http.StatusOK, res.Code)
+
+		var report HealthReport
+		require.NoError(t, json.Unmarshal(res.Body.Bytes(), &report))
+		require.True(t, report.Draining)
+
+		require.NoError(t, client.Undrain(ctx))
+		require.False(t, client.IsDraining())
+		require.Equal(t, []string{"POST /servers/drain", "DELETE /servers/drain"}, requests)
+
+		res = httptest.NewRecorder()
+		client.HandleHealthCheck(res, httptest.NewRequest(http.MethodGet, "/health", nil))
+		require.Empty(t, res.Body.Bytes())
+	})
+
+	t.Run("drain ignores hds without drain notifications", func(t *testing.T) {
+		hds := httptest.NewServer(http.NotFoundHandler())
+		defer hds.Close()
+
+		client := NewClient(
+			WithHagallEndpoint("http://test"),
+			WithHDSEndpoint(hds.URL),
+			WithSecret("secret"),
+		)
+		client.setRegistrationStatus(RegistrationStatusRegistered)
+
+		require.NoError(t, client.Drain(context.Background()))
+		require.True(t, client.IsDraining())
+		require.NoError(t, client.Undrain(context.Background()))
+		require.False(t, client.IsDraining())
+	})
+
+	t.Run("unregistered server drains locally", func(t *testing.T) {
+		var requests []string
+		hds := newHDS(&requests)
+		defer hds.Close()
+
+		client := NewClient(WithHDSEndpoint(hds.URL))
+		require.NoError(t, client.Drain(context.Background()))
+		require.True(t, client.IsDraining())
+		require.Empty(t, requests)
+	})
+
+	t.Run("drain and unpair waits for idle", func(t *testing.T) {
+		var requests []string
+		hds := newHDS(&requests)
+		defer hds.Close()
+
+		client := NewClient(
+			WithHagallEndpoint("http://test"),
+			WithHDSEndpoint(hds.URL),
+			WithSecret("secret"),
+		)
+		client.setRegistrationStatus(RegistrationStatusRegistered)
+
+		err := client.DrainAndUnpair(context.Background(), func(ctx context.Context) error {
+			require.Equal(t, []string{"POST /servers/drain"}, requests)
+			return nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, []string{"POST /servers/drain", "DELETE /servers"}, requests)
+		require.Equal(t, RegistrationStatusInit, client.GetRegistrationStatus())
+	})
+
+	t.Run("drain and unpair keeps the server registered when waiting fails", func(t *testing.T) {
+		var requests []string
+		hds := newHDS(&requests)
+		defer hds.Close()
+
+		client := NewClient(
+			WithHagallEndpoint("http://test"),
+			WithHDSEndpoint(hds.URL),
+			WithSecret("secret"),
+		)
+		client.setRegistrationStatus(RegistrationStatusRegistered)
+
+		waitErr := errors.New("sessions still active")
+		err := client.DrainAndUnpair(context.Background(), func(ctx context.Context) error {
+			return waitErr
+		})
+		require.ErrorIs(t, err, waitErr)
+		require.Equal(t, []string{"POST /servers/drain"}, requests)
+		require.Equal(t, RegistrationStatusRegistered, client.GetRegistrationStatus())
+	})
+}
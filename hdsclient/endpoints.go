@@ -0,0 +1,266 @@
+package hdsclient
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aukilabs/go-tooling/pkg/errors"
+	"github.com/aukilabs/go-tooling/pkg/logs"
+	httpcmn "github.com/aukilabs/hagall-common/http"
+)
+
+const (
+	defaultHDSEndpointCheckTimeout = 5 * time.Second
+)
+
+// HDSEndpointStatus describes the state of a Hagall Discovery Service
+// endpoint set with WithHDSEndpoints.
+type HDSEndpointStatus struct {
+	// The HDS endpoint.
+	Endpoint string
+
+	// Reports whether the endpoint is considered healthy. Requests are routed
+	// to the first healthy endpoint.
+	Healthy bool
+
+	// The error that made the endpoint unhealthy.
+	LastError error
+
+	// The time when the endpoint health was last updated.
+	CheckedAt time.Time
+
+	// The registration status of the server with this endpoint.
+	RegistrationStatus RegistrationStatus
+
+	// The server ID attributed by this endpoint.
+	ServerID string
+}
+
+type hdsEndpoint struct {
+	url       string
+	healthy   bool
+	lastErr   error
+	checkedAt time.Time
+}
+
+type hdsEndpointContextKey struct{}
+
+// HDSEndpoints returns the state of the HDS endpoints set with
+// WithHDSEndpoints, in order of preference.
+func (c *Client) HDSEndpoints() []HDSEndpointStatus {
+	c.endpointMutex.RLock()
+	statuses := make([]HDSEndpointStatus, 0, len(c.endpoints))
+	for _, e := range c.endpoints {
+		statuses = append(statuses, HDSEndpointStatus{
+			Endpoint:  e.url,
+			Healthy:   e.healthy,
+			LastError: e.lastErr,
+			CheckedAt: e.checkedAt,
+		})
+	}
+	c.endpointMutex.RUnlock()
+
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	for i, s := range statuses {
+		if reg, ok := c.registrations[s.Endpoint]; ok {
+			statuses[i].RegistrationStatus = reg.status
+			statuses[i].ServerID = reg.serverID
+		}
+	}
+	return statuses
+}
+
+// CheckHDSEndpoints requests the /health path of each HDS endpoint set with
+// WithHDSEndpoints and updates their health.
+func (c *Client) CheckHDSEndpoints(ctx context.Context) {
+	c.endpointMutex.RLock()
+	endpoints := append([]*hdsEndpoint(nil), c.endpoints...)
+	c.endpointMutex.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, e := range endpoints {
+		wg.Add(1)
+		go func(e *hdsEndpoint) {
+			defer wg.Done()
+			c.setEndpointHealth(e, c.checkHDSEndpoint(ctx, e))
+		}(e)
+	}
+	wg.Wait()
+}
+
+// MonitorHDSEndpoints checks the health of the HDS endpoints at the given
+// interval until the context is canceled.
+func (c *Client) MonitorHDSEndpoints(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		c.CheckHDSEndpoints(ctx)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *Client) checkHDSEndpoint(ctx context.Context, e *hdsEndpoint) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultHDSEndpointCheckTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, e.url+"/health", nil)
+	if err != nil {
+		return errors.New("creating request failed").Wrap(err)
+	}
+
+	res, err := c.Transport.RoundTrip(req)
+	if err != nil {
+		return errors.New("request failed").Wrap(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 400 {
+		return newAPIError(res, nil)
+	}
+	return nil
+}
+
+// multiHDS reports whether requests are routed between several HDS
+// endpoints.
+func (c *Client) multiHDS() bool {
+	return len(c.endpoints) > 1
+}
+
+func (c *Client) setEndpointHealth(e *hdsEndpoint, err error) {
+	c.endpointMutex.Lock()
+	defer c.endpointMutex.Unlock()
+
+	if e.healthy && err != nil {
+		logs.WithTag("hds_endpoint", e.url).
+			Warn(errors.New("hds endpoint is unhealthy").Wrap(err))
+	}
+
+	e.healthy = err == nil
+	e.lastErr = err
+	e.checkedAt = c.now()
+}
+
+// routeEndpoints returns the endpoints a request is sent to, in order. A
+// request pinned to an endpoint is only sent to that endpoint. Otherwise
+// healthy endpoints come first, in order of preference.
+func (c *Client) routeEndpoints(ctx context.Context) []*hdsEndpoint {
+	c.endpointMutex.RLock()
+	defer c.endpointMutex.RUnlock()
+
+	if pinned, ok := ctx.Value(hdsEndpointContextKey{}).(string); ok {
+		for _, e := range c.endpoints {
+			if e.url == pinned {
+				return []*hdsEndpoint{e}
+			}
+		}
+		return []*hdsEndpoint{{url: pinned}}
+	}
+
+	endpoints := make([]*hdsEndpoint, 0, len(c.endpoints))
+	for _, e := range c.endpoints {
+		if e.healthy {
+			endpoints = append(endpoints, e)
+		}
+	}
+	for _, e := range c.endpoints {
+		if !e.healthy {
+			endpoints = append(endpoints, e)
+		}
+	}
+	return endpoints
+}
+
+// doWithFailover sends the request to the routed HDS endpoints until one of
+// them does not fail with a network error or a 5xx status code.
+func (c *Client) doWithFailover(req *http.Request, transport http.RoundTripper, out interface{}) error {
+	sign := req.Header.Get("Authorization") == ""
+
+	return c.doWithRetry(req, func(req *http.Request) error {
+		var err error
+		for _, e := range c.routeEndpoints(req.Context()) {
+			r, rerr := c.retarget(req, e.url)
+			if rerr != nil {
+				return rerr
+			}
+
+			if secret := c.secretFor(e.url); sign && secret != "" {
+				token, serr := httpcmn.SignIdentity(c.HagallEndpoint, secret)
+				if serr != nil {
+					return errors.New("signing request failed").Wrap(serr)
+				}
+				r.Header.Set("Authorization", httpcmn.MakeAuthorizationHeader(token))
+			}
+
+			err = c.roundTrip(r, transport, out)
+			if !isFailoverError(err) {
+				c.setEndpointHealth(e, nil)
+				return err
+			}
+			c.setEndpointHealth(e, err)
+
+			logs.WithTag("hds_endpoint", e.url).
+				WithTag("method", req.Method).
+				WithTag("path", req.URL.Path).
+				WithTag("error", err).
+				Debug("hds request failed, trying next endpoint")
+		}
+		return err
+	})
+}
+
+// retarget returns a copy of the given request, built with the primary HDS
+// endpoint, that is sent to the given endpoint.
+func (c *Client) retarget(req *http.Request, endpoint string) (*http.Request, error) {
+	r, err := rewindRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	target := req.URL.String()
+	if !strings.HasPrefix(target, c.HDSEndpoint) {
+		return r, nil
+	}
+
+	u, err := r.URL.Parse(endpoint + strings.TrimPrefix(target, c.HDSEndpoint))
+	if err != nil {
+		return nil, errors.New("parsing hds endpoint failed").
+			WithTag("hds_endpoint", endpoint).
+			Wrap(err)
+	}
+	r.URL = u
+	r.Host = u.Host
+	return r, nil
+}
+
+// isFailoverError reports whether a request that failed with the given error
+// should be sent to another HDS endpoint.
+func isFailoverError(err error) bool {
+	if err == nil ||
+		errors.Is(err, context.Canceled) ||
+		errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode >= 500
+	}
+	return true
+}
+
+// withHDSEndpoint returns a context that pins the requests to the given HDS
+// endpoint.
+func withHDSEndpoint(ctx context.Context, endpoint string) context.Context {
+	return context.WithValue(ctx, hdsEndpointContextKey{}, endpoint)
+}
@@ -0,0 +1,226 @@
+package hdsclient
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	httpcmn "github.com/aukilabs/hagall-common/http"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientHDSEndpoints(t *testing.T) {
+	setupTestLog(t)
+
+	newHDS := func(calls *int32, status int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/health" {
+				return
+			}
+			atomic.AddInt32(calls, 1)
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(ServerResponse{ID: r.Host})
+		}))
+	}
+
+	t.Run("requests fail over to the next endpoint", func(t *testing.T) {
+		var downCalls, upCalls int32
+		down := newHDS(&downCalls, http.StatusServiceUnavailable)
+		defer down.Close()
+		up := newHDS(&upCalls, http.StatusOK)
+		defer up.Close()
+
+		client := NewClient(WithHDSEndpoints(down.URL, up.URL))
+		require.Equal(t, down.URL, client.HDSEndpoint)
+
+		s, err := client.GetServerByID(context.Background(), GetServerByIDIn{ServerID: "0x1"})
+		require.NoError(t, err)
+		require.Equal(t, strings.TrimPrefix(up.URL, "http://"), s.ID)
+
+		_, err = client.GetServerByID(context.Background(), GetServerByIDIn{ServerID: "0x1"})
+		require.NoError(t, err)
+		require.Equal(t, int32(1), atomic.LoadInt32(&downCalls))
+		require.Equal(t, int32(2), atomic.LoadInt32(&upCalls))
+
+		endpoints := client.HDSEndpoints()
+		require.Len(t, endpoints, 2)
+		require.False(t, endpoints[0].Healthy)
+		require.Error(t, endpoints[0].LastError)
+		require.True(t, endpoints[1].Healthy)
+	})
+
+	t.Run("client errors do not fail over", func(t *testing.T) {
+		var notFoundCalls, upCalls int32
+		notFound := newHDS(&notFoundCalls, http.StatusNotFound)
+		defer notFound.Close()
+		up := newHDS(&upCalls, http.StatusOK)
+		defer up.Close()
+
+		client := NewClient(WithHDSEndpoints(notFound.URL, up.URL))
+
+		_, err := client.GetServerByID(context.Background(), GetServerByIDIn{ServerID: "0x1"})
+		require.ErrorIs(t, err, ErrServerNotFound)
+		require.Zero(t, atomic.LoadInt32(&upCalls))
+	})
+
+	t.Run("health checks restore the preferred endpoint", func(t *testing.T) {
+		var healthy atomic.Bool
+		var preferredCalls, upCalls int32
+		preferred := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !healthy.Load() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			if r.URL.Path != "/health" {
+				atomic.AddInt32(&preferredCalls, 1)
+			}
+		}))
+		defer preferred.Close()
+		up := newHDS(&upCalls, http.StatusOK)
+		defer up.Close()
+
+		client := NewClient(WithHDSEndpoints(preferred.URL, up.URL))
+
+		client.CheckHDSEndpoints(context.Background())
+		require.False(t, client.HDSEndpoints()[0].Healthy)
+
+		require.NoError(t, client.PostSession(context.Background(), PostSessionIn{ID: "s1"}))
+		require.Zero(t, atomic.LoadInt32(&preferredCalls))
+		require.Equal(t, int32(1), atomic.LoadInt32(&upCalls))
+
+		healthy.Store(true)
+		client.CheckHDSEndpoints(context.Background())
+		require.True(t, client.HDSEndpoints()[0].Healthy)
+
+		require.NoError(t, client.PostSession(context.Background(), PostSessionIn{ID: "s2"}))
+		require.Equal(t, int32(1), atomic.LoadInt32(&preferredCalls))
+	})
+
+	t.Run("pair registers with each endpoint", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		var client *Client
+		newRegisteringHDS := func(id string) *httptest.Server {
+			return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodPost {
+					return
+				}
+
+				var in PostServerIn
+				require.NoError(t, json.NewDecoder(r.Body).Decode(&in))
+
+				vw := httptest.NewRecorder()
+				vr := httptest.NewRequest(http.MethodPost, "/registrations", nil)
+				vr.Header.Set(httpcmn.HeaderHagallIDKey, id)
+				vr.Header.Set(httpcmn.HeaderHagallJWTSecretHeaderKey, "secret-"+id)
+				vr.Header.Set(httpcmn.HeaderHagallRegistrationStateKey, in.State)
+				client.HandleServerRegistration(vw, vr)
+				require.Equal(t, http.StatusOK, vw.Code)
+			}))
+		}
+
+		hds1 := newRegisteringHDS("0x1")
+		defer hds1.Close()
+		hds2 := newRegisteringHDS("0x2")
+		defer hds2.Close()
+
+		client = NewClient(
+			WithHagallEndpoint("http://test"),
+			WithHDSEndpoints(hds1.URL, hds2.URL),
+		)
+
+		pairCh := make(chan error, 1)
+		go func() {
+			pairCh <- client.Pair(ctx, PairIn{
+				HealthCheckTTL:       time.Minute,
+				RegistrationInterval: 10 * time.Millisecond,
+				RegistrationRetries:  1,
+			})
+		}()
+
+		require.Eventually(t, func() bool {
+			return client.GetRegistrationStatus() == RegistrationStatusRegistered
+		}, time.Second, time.Millisecond)
+
+		endpoints := client.HDSEndpoints()
+		require.Equal(t, "0x1", endpoints[0].ServerID)
+		require.Equal(t, RegistrationStatusRegistered, endpoints[0].RegistrationStatus)
+		require.Equal(t, "0x2", endpoints[1].ServerID)
+		require.Equal(t, RegistrationStatusRegistered, endpoints[1].RegistrationStatus)
+		require.Equal(t, "0x1", client.ServerID())
+
+		token, err := httpcmn.GenerateHagallUserAccessToken("key", "secret-0x2", time.Minute)
+		require.NoError(t, err)
+		require.NoError(t, client.VerifyUserAuth(token))
+
+		lastHealthChecks := func() (time.Time, time.Time) {
+			client.mutex.RLock()
+			defer client.mutex.RUnlock()
+			return client.registrations[hds1.URL].lastHealthCheck, client.registrations[hds2.URL].lastHealthCheck
+		}
+		lastHealthCheck1, lastHealthCheck2 := lastHealthChecks()
+
+		identity, err := httpcmn.SignIdentity("http://test", "secret-0x2")
+		require.NoError(t, err)
+
+		req := httptest.NewRequest(http.MethodGet, "/health", nil)
+		req.Header.Set("Authorization", httpcmn.MakeAuthorizationHeader(identity))
+		res := httptest.NewRecorder()
+		client.HandleHealthCheck(res, req)
+		require.Equal(t, http.StatusOK, res.Code)
+		require.Equal(t, httpcmn.MakeAuthorizationHeader(identity), res.Header().Get("Authorization"))
+
+		checked1, checked2 := lastHealthChecks()
+		require.Equal(t, lastHealthCheck1, checked1)
+		require.True(t, checked2.After(lastHealthCheck2))
+
+		req = httptest.NewRequest(http.MethodGet, "/health", nil)
+		res = httptest.NewRecorder()
+		client.HandleHealthCheck(res, req)
+		require.Equal(t, http.StatusOK, res.Code)
+
+		expected, err := httpcmn.SignIdentity("http://test", "secret-0x1")
+		require.NoError(t, err)
+		require.Equal(t, httpcmn.MakeAuthorizationHeader(expected), res.Header().Get("Authorization"))
+
+		unidentified1, unidentified2 := lastHealthChecks()
+		require.True(t, unidentified1.After(checked1))
+		require.True(t, unidentified2.After(checked2))
+
+		require.NoError(t, client.Unpair(context.Background()))
+		require.ErrorIs(t, <-pairCh, ErrUnpaired)
+		require.Equal(t, RegistrationStatusInit, client.GetRegistrationStatus())
+	})
+
+	t.Run("pair fails when the quorum cannot be reached", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		var calls1, calls2 int32
+		hds1 := newHDS(&calls1, http.StatusInternalServerError)
+		defer hds1.Close()
+		hds2 := newHDS(&calls2, http.StatusInternalServerError)
+		defer hds2.Close()
+
+		client := NewClient(
+			WithHagallEndpoint("http://test"),
+			WithHDSEndpoints(hds1.URL, hds2.URL),
+		)
+
+		err := client.Pair(ctx, PairIn{
+			HealthCheckTTL:       time.Minute,
+			RegistrationInterval: 10 * time.Millisecond,
+			RegistrationRetries:  1,
+			Quorum:               1,
+		})
+		require.Error(t, err)
+		require.NotErrorIs(t, err, context.DeadlineExceeded)
+		require.Equal(t, RegistrationStatusFailed, client.GetRegistrationStatus())
+	})
+}
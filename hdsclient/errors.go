@@ -0,0 +1,228 @@
+package hdsclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aukilabs/go-tooling/pkg/errors"
+	httpcmn "github.com/aukilabs/hagall-common/http"
+)
+
+var (
+	// Error matched by an APIError when the wallet used to register a server
+	// does not have the required amount of tokens staked.
+	ErrNotStaked = errors.New("wallet is not staked")
+
+	// Error matched by an APIError when HDS rejects the request credentials.
+	ErrUnauthorized = errors.New("unauthorized")
+
+	// Error matched by an APIError when the requested server does not exist.
+	// Responses without error code match it when they answer a /servers
+	// request with a 404 status code.
+	ErrServerNotFound = errors.New("server not found")
+
+	// Error matched by an APIError when the requested session does not exist.
+	// Responses without error code match it when they answer a /sessions
+	// request with a 404 status code.
+	ErrSessionNotFound = errors.New("session not found")
+
+	// Error matched by an APIError when the wallet address is already
+	// registered for another endpoint.
+	ErrDuplicatedWalletAddress = httpcmn.ErrDuplicatedWalletAddress
+
+	// Error returned by Pair when it is stopped by Unpair.
+	ErrUnpaired = errors.New("client unpaired")
+)
+
+const (
+	errorCodeNotStaked               = "not_staked"
+	errorCodeUnauthorized            = "unauthorized"
+	errorCodeServerNotFound          = "server_not_found"
+	errorCodeSessionNotFound         = "session_not_found"
+	errorCodeDuplicatedWalletAddress = "duplicated_wallet_address"
+)
+
+const (
+	routeServers  = "servers"
+	routeSessions = "sessions"
+
+	// A part of the message returned by HDS when a wallet is already
+	// registered. See httpcmn.GetErrorMessage.
+	duplicatedWalletAddressMessage = "wallet already registered"
+
+	maxAPIErrorMessageLength = 1024
+)
+
+// APIError is the error returned when the Hagall Discovery Service responds
+// with a status code greater or equal to 400.
+//
+// It can be matched against ErrNotStaked, ErrUnauthorized, ErrServerNotFound,
+// ErrSessionNotFound and ErrDuplicatedWalletAddress with errors.Is.
+type APIError struct {
+	// The HTTP status code.
+	StatusCode int
+
+	// The HTTP status text.
+	Status string
+
+	// The HDS error code, when the response body carries one.
+	Code string
+
+	// The error message returned by HDS.
+	Message string
+
+	// The request ID, taken from the response X-Request-Id header or body.
+	RequestID string
+
+	// The delay suggested by HDS before retrying the request, taken from the
+	// Retry-After header on 429 and 503 responses.
+	RetryAfter time.Duration
+
+	// The path of the request that caused the error.
+	path string
+}
+
+// Error satisfies the error interface.
+func (e *APIError) Error() string {
+	var b strings.Builder
+	b.WriteString("hds request failed: ")
+	b.WriteString(e.Status)
+	if e.Status == "" {
+		b.WriteString(strconv.Itoa(e.StatusCode))
+	}
+
+	if e.Code != "" {
+		fmt.Fprintf(&b, " (%s)", e.Code)
+	}
+
+	if e.Message != "" {
+		b.WriteString(": ")
+		b.WriteString(e.Message)
+	}
+	return b.String()
+}
+
+// Is reports whether the error matches one of the package sentinel errors.
+func (e *APIError) Is(target error) bool {
+	switch {
+	case errors.Is(target, ErrNotStaked):
+		return e.StatusCode == http.StatusPaymentRequired ||
+			e.Code == errorCodeNotStaked
+
+	case errors.Is(target, ErrUnauthorized):
+		return e.StatusCode == http.StatusUnauthorized ||
+			e.Code == errorCodeUnauthorized
+
+	case errors.Is(target, ErrServerNotFound):
+		return e.isNotFound(errorCodeServerNotFound, routeServers)
+
+	case errors.Is(target, ErrSessionNotFound):
+		return e.isNotFound(errorCodeSessionNotFound, routeSessions)
+
+	case errors.Is(target, ErrDuplicatedWalletAddress):
+		return e.Code == errorCodeDuplicatedWalletAddress ||
+			strings.Contains(strings.ToLower(e.Message), duplicatedWalletAddressMessage)
+
+	default:
+		return false
+	}
+}
+
+// isNotFound reports whether the error is a not found error with the given
+// code. Without a not found code, it is deduced from the route of the request.
+func (e *APIError) isNotFound(code, route string) bool {
+	switch e.Code {
+	case errorCodeServerNotFound, errorCodeSessionNotFound:
+		return e.Code == code
+	}
+	return e.StatusCode == http.StatusNotFound && requestRoute(e.path) == route
+}
+
+// requestRoute returns the HDS resource targeted by a request path, or an
+// empty string when it is neither servers nor sessions.
+func requestRoute(path string) string {
+	segments := strings.Split(path, "/")
+	for i := len(segments) - 1; i >= 0; i-- {
+		switch segments[i] {
+		case routeServers, routeSessions:
+			return segments[i]
+		}
+	}
+	return ""
+}
+
+// Tag returns the error tags previously set on HDS request errors. It keeps
+// errors.Tag(err, "status_code") working for existing callers.
+func (e *APIError) Tag(k string) string {
+	switch k {
+	case "status":
+		return e.Status
+	case "status_code":
+		return strconv.Itoa(e.StatusCode)
+	case "message":
+		return e.Message
+	case "code":
+		return e.Code
+	case "request_id":
+		return e.RequestID
+	case "retry_after":
+		if e.RetryAfter > 0 {
+			return e.RetryAfter.String()
+		}
+	}
+	return ""
+}
+
+// Temporary reports whether the request that caused the error can be retried.
+func (e *APIError) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// newAPIError creates an APIError from a HDS response and its body.
+func newAPIError(res *http.Response, body []byte) *APIError {
+	err := &APIError{
+		StatusCode: res.StatusCode,
+		Status:     res.Status,
+		RequestID:  res.Header.Get(httpcmn.XRequestIDHeaderKey),
+	}
+
+	if res.Request != nil {
+		err.path = res.Request.URL.Path
+	}
+
+	var payload struct {
+		Code      string `json:"code"`
+		Message   string `json:"message"`
+		Error     string `json:"error"`
+		RequestID string `json:"request_id"`
+	}
+
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) > 0 && trimmed[0] == '{' && json.Unmarshal(trimmed, &payload) == nil {
+		err.Code = payload.Code
+		err.Message = payload.Message
+		if err.Message == "" {
+			err.Message = payload.Error
+		}
+		if err.RequestID == "" {
+			err.RequestID = payload.RequestID
+		}
+	} else {
+		err.Message = string(trimmed)
+	}
+
+	if len(err.Message) > maxAPIErrorMessageLength {
+		err.Message = err.Message[:maxAPIErrorMessageLength]
+	}
+
+	switch res.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		err.RetryAfter = parseRetryAfter(res.Header.Get("Retry-After"))
+	}
+	return err
+}
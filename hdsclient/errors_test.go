@@ -0,0 +1,185 @@
+package hdsclient
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aukilabs/go-tooling/pkg/errors"
+	httpcmn "github.com/aukilabs/hagall-common/http"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPIError(t *testing.T) {
+	utests := []struct {
+		scenario     string
+		path         string
+		status       int
+		header       http.Header
+		body         string
+		expected     APIError
+		expectedErrs []error
+	}{
+		{
+			scenario: "not staked",
+			status:   http.StatusPaymentRequired,
+			body:     "Payment Required",
+			expected: APIError{
+				StatusCode: http.StatusPaymentRequired,
+				Message:    "Payment Required",
+			},
+			expectedErrs: []error{ErrNotStaked},
+		},
+		{
+			scenario: "unauthorized with json body",
+			status:   http.StatusUnauthorized,
+			body:     `{"code":"invalid_app_key","message":"invalid app key","request_id":"42"}`,
+			expected: APIError{
+				StatusCode: http.StatusUnauthorized,
+				Code:       "invalid_app_key",
+				Message:    "invalid app key",
+				RequestID:  "42",
+			},
+			expectedErrs: []error{ErrUnauthorized},
+		},
+		{
+			scenario: "server not found with request id header",
+			status:   http.StatusNotFound,
+			header:   http.Header{httpcmn.XRequestIDHeaderKey: []string{"21"}},
+			body:     `{"error":"not found"}`,
+			expected: APIError{
+				StatusCode: http.StatusNotFound,
+				Message:    "not found",
+				RequestID:  "21",
+			},
+			expectedErrs: []error{ErrServerNotFound},
+		},
+		{
+			scenario: "session not found",
+			path:     "/sessions/s1",
+			status:   http.StatusNotFound,
+			body:     `{"error":"not found"}`,
+			expected: APIError{
+				StatusCode: http.StatusNotFound,
+				Message:    "not found",
+			},
+			expectedErrs: []error{ErrSessionNotFound},
+		},
+		{
+			scenario: "session not found code",
+			status:   http.StatusNotFound,
+			body:     `{"code":"session_not_found"}`,
+			expected: APIError{
+				StatusCode: http.StatusNotFound,
+				Code:       errorCodeSessionNotFound,
+			},
+			expectedErrs: []error{ErrSessionNotFound},
+		},
+		{
+			scenario: "not found on another route",
+			path:     "/auth",
+			status:   http.StatusNotFound,
+			expected: APIError{
+				StatusCode: http.StatusNotFound,
+			},
+		},
+		{
+			scenario: "duplicated wallet address",
+			status:   http.StatusConflict,
+			body:     httpcmn.GetErrorMessage(httpcmn.ErrDuplicatedWalletAddress),
+			expected: APIError{
+				StatusCode: http.StatusConflict,
+				Message:    httpcmn.GetErrorMessage(httpcmn.ErrDuplicatedWalletAddress),
+			},
+			expectedErrs: []error{ErrDuplicatedWalletAddress},
+		},
+		{
+			scenario: "duplicated wallet address code",
+			status:   http.StatusBadRequest,
+			body:     `{"code":"duplicated_wallet_address"}`,
+			expected: APIError{
+				StatusCode: http.StatusBadRequest,
+				Code:       errorCodeDuplicatedWalletAddress,
+			},
+			expectedErrs: []error{ErrDuplicatedWalletAddress},
+		},
+		{
+			scenario: "service unavailable with retry hint",
+			status:   http.StatusServiceUnavailable,
+			header:   http.Header{"Retry-After": []string{"2"}},
+			expected: APIError{
+				StatusCode: http.StatusServiceUnavailable,
+				RetryAfter: 2 * time.Second,
+			},
+		},
+	}
+
+	for _, u := range utests {
+		t.Run(u.scenario, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				for k, v := range u.header {
+					w.Header()[k] = v
+				}
+				w.WriteHeader(u.status)
+				w.Write([]byte(u.body))
+			}))
+			defer server.Close()
+
+			path := u.path
+			if path == "" {
+				path = "/servers"
+			}
+
+			client := NewClient(WithHDSEndpoint(server.URL))
+			err := client.Get(context.Background(), path, nil)
+			require.Error(t, err)
+
+			var apiErr *APIError
+			require.True(t, errors.As(err, &apiErr))
+			require.Equal(t, u.expected.StatusCode, apiErr.StatusCode)
+			require.Equal(t, u.expected.Code, apiErr.Code)
+			require.Equal(t, u.expected.Message, apiErr.Message)
+			require.Equal(t, u.expected.RequestID, apiErr.RequestID)
+			require.Equal(t, u.expected.RetryAfter, apiErr.RetryAfter)
+
+			for _, sentinel := range []error{
+				ErrNotStaked,
+				ErrUnauthorized,
+				ErrServerNotFound,
+				ErrSessionNotFound,
+				ErrDuplicatedWalletAddress,
+			} {
+				expected := false
+				for _, expectedErr := range u.expectedErrs {
+					expected = expected || errors.Is(sentinel, expectedErr)
+				}
+				require.Equal(t, expected, errors.Is(err, sentinel))
+			}
+		})
+	}
+}
+
+func TestAPIErrorTags(t *testing.T) {
+	err := errors.New("wrapped").Wrap(&APIError{
+		StatusCode: http.StatusPaymentRequired,
+		Status:     "402 Payment Required",
+	})
+
+	require.Equal(t, "402", errors.Tag(err, "status_code"))
+	require.Equal(t, "402 Payment Required", errors.Tag(err, "status"))
+}
+
+func TestPostServerNotStaked(t *testing.T) {
+	setupTestLog(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusPaymentRequired)
+	}))
+	defer server.Close()
+
+	client := NewClient(WithHDSEndpoint(server.URL), WithHagallEndpoint("http://test"))
+	err := client.PostServer(context.Background(), PostServerIn{})
+	require.ErrorIs(t, err, ErrNotStaked)
+}
@@ -0,0 +1,125 @@
+package hdsclient
+
+import (
+	"time"
+)
+
+const (
+	defaultEventBufferSize = 16
+)
+
+// EventType represents the type of an event emitted by a client.
+type EventType int
+
+const (
+	// Event emitted when the registration status changes.
+	EventTypeRegistrationStatusChanged EventType = iota + 1
+
+	// Event emitted when HDS performs a health check.
+	EventTypeHealthCheck
+
+	// Event emitted when HDS attributes a new server ID and secret.
+	EventTypeSecretRotated
+
+	// Event emitted when a registration attempt fails.
+	EventTypeRegistrationFailed
+
+	// Event emitted when the server starts or stops draining.
+	EventTypeDrainingChanged
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventTypeRegistrationStatusChanged:
+		return "registration_status_changed"
+	case EventTypeHealthCheck:
+		return "health_check"
+	case EventTypeSecretRotated:
+		return "secret_rotated"
+	case EventTypeRegistrationFailed:
+		return "registration_failed"
+	case EventTypeDrainingChanged:
+		return "draining_changed"
+	default:
+		return "unknown"
+	}
+}
+
+// Event represents something that happened during the lifecycle of a client
+// registration.
+type Event struct {
+	// The event type.
+	Type EventType
+
+	// The time when the event occurred.
+	Time time.Time
+
+	// The registration status at the time of the event.
+	Status RegistrationStatus
+
+	// The registration status before the event. Only set with
+	// EventTypeRegistrationStatusChanged.
+	PreviousStatus RegistrationStatus
+
+	// The server ID attributed by HDS at the time of the event.
+	ServerID string
+
+	// The HDS endpoint the event relates to when several endpoints are set
+	// with WithHDSEndpoints. Empty for events about the client as a whole.
+	HDSEndpoint string
+
+	// The error that caused the event. Only set with
+	// EventTypeRegistrationFailed.
+	Err error
+
+	// Reports whether the server is draining. Only set with
+	// EventTypeDrainingChanged.
+	Draining bool
+}
+
+// Subscribe returns a channel that receives the client events and a function
+// to stop the subscription.
+//
+// Events are delivered without blocking the client: when the channel buffer is
+// full, new events are dropped for this subscriber. bufferSize defaults to 16
+// when lower than 1.
+func (c *Client) Subscribe(bufferSize int) (<-chan Event, func()) {
+	if bufferSize < 1 {
+		bufferSize = defaultEventBufferSize
+	}
+	ch := make(chan Event, bufferSize)
+
+	c.eventMutex.Lock()
+	if c.subscribers == nil {
+		c.subscribers = make(map[chan Event]struct{})
+	}
+	c.subscribers[ch] = struct{}{}
+	c.eventMutex.Unlock()
+
+	unsubscribe := func() {
+		c.eventMutex.Lock()
+		defer c.eventMutex.Unlock()
+
+		if _, ok := c.subscribers[ch]; ok {
+			delete(c.subscribers, ch)
+			close(ch)
+		}
+	}
+	return ch, unsubscribe
+}
+
+func (c *Client) emit(e Event) {
+	if e.Time.IsZero() {
+		e.Time = c.now()
+	}
+
+	c.eventMutex.RLock()
+	defer c.eventMutex.RUnlock()
+
+	for ch := range c.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package hdsclient
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	httpcmn "github.com/aukilabs/hagall-common/http"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientSubscribe(t *testing.T) {
+	setupTestLog(t)
+
+	t.Run("registration events", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		var client *Client
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			body, err := io.ReadAll(req.Body)
+			require.NoError(t, err)
+
+			var postBody PostServerIn
+			require.NoError(t, json.Unmarshal(body, &postBody))
+
+			vw := httptest.NewRecorder()
+			vr := httptest.NewRequest(http.MethodPost, "/registrations", nil)
+			vr.Header.Set(httpcmn.HeaderHagallIDKey, "0x1")
+			vr.Header.Set(httpcmn.HeaderHagallJWTSecretHeaderKey, httpcmn.MakeJWTSecret())
+			vr.Header.Set(httpcmn.HeaderHagallRegistrationStateKey, postBody.State)
+			client.HandleServerRegistration(vw, vr)
+			require.Equal(t, http.StatusOK, vw.Code)
+		}))
+		defer server.Close()
+
+		client = NewClient(WithHagallEndpoint("http://test"), WithHDSEndpoint(server.URL))
+		events, unsubscribe := client.Subscribe(0)
+		defer unsubscribe()
+
+		pairCh := make(chan error)
+		go func() {
+			pairCh <- client.Pair(ctx, PairIn{
+				Endpoint:             "http://test",
+				HealthCheckTTL:       time.Minute,
+				RegistrationInterval: 100 * time.Millisecond,
+				RegistrationRetries:  1,
+			})
+		}()
+
+		e := <-events
+		require.Equal(t, EventTypeRegistrationStatusChanged, e.Type)
+		require.Equal(t, RegistrationStatusInit, e.PreviousStatus)
+		require.Equal(t, RegistrationStatusRegistering, e.Status)
+
+		e = <-events
+		require.Equal(t, EventTypeRegistrationStatusChanged, e.Type)
+		require.Equal(t, RegistrationStatusRegistering, e.PreviousStatus)
+		require.Equal(t, RegistrationStatusRegistered, e.Status)
+		require.Equal(t, "0x1", e.ServerID)
+
+		e = <-events
+		require.Equal(t, EventTypeSecretRotated, e.Type)
+		require.Equal(t, "0x1", e.ServerID)
+
+		client.HandleHealthCheck(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/health", nil))
+		e = <-events
+		require.Equal(t, EventTypeHealthCheck, e.Type)
+		require.Equal(t, RegistrationStatusRegistered, e.Status)
+
+		cancel()
+		require.ErrorIs(t, <-pairCh, context.Canceled)
+	})
+
+	t.Run("registration failure and pending verification", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		calls := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			calls++
+			if calls == 1 {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		}))
+		defer server.Close()
+
+		client := NewClient(WithHagallEndpoint("http://test"), WithHDSEndpoint(server.URL))
+		events, unsubscribe := client.Subscribe(0)
+		defer unsubscribe()
+
+		pairCh := make(chan error)
+		go func() {
+			pairCh <- client.Pair(ctx, PairIn{
+				Endpoint:             "http://test",
+				HealthCheckTTL:       time.Minute,
+				RegistrationInterval: 10 * time.Millisecond,
+				RegistrationRetries:  3,
+			})
+		}()
+
+		e := <-events
+		require.Equal(t, EventTypeRegistrationStatusChanged, e.Type)
+		require.Equal(t, RegistrationStatusRegistering, e.Status)
+
+		e = <-events
+		require.Equal(t, EventTypeRegistrationFailed, e.Type)
+		require.Error(t, e.Err)
+
+		e = <-events
+		require.Equal(t, EventTypeRegistrationStatusChanged, e.Type)
+		require.Equal(t, RegistrationStatusPendingVerification, e.Status)
+		require.Equal(t, RegistrationStatusRegistering, e.PreviousStatus)
+
+		cancel()
+		<-pairCh
+	})
+
+	t.Run("unsubscribe closes the channel", func(t *testing.T) {
+		client := NewClient()
+		events, unsubscribe := client.Subscribe(1)
+		unsubscribe()
+		unsubscribe()
+
+		_, ok := <-events
+		require.False(t, ok)
+
+		client.setRegistrationStatus(RegistrationStatusRegistered)
+	})
+
+	t.Run("full subscribers do not block", func(t *testing.T) {
+		client := NewClient()
+		events, unsubscribe := client.Subscribe(1)
+		defer unsubscribe()
+
+		client.setRegistrationStatus(RegistrationStatusRegistering)
+		client.setRegistrationStatus(RegistrationStatusRegistered)
+
+		e := <-events
+		require.Equal(t, RegistrationStatusRegistering, e.Status)
+		require.Len(t, events, 0)
+	})
+}
@@ -0,0 +1,114 @@
+package hdstest
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/aukilabs/go-tooling/pkg/errors"
+	httpcmn "github.com/aukilabs/hagall-common/http"
+)
+
+// Fault describes how the fake HDS misbehaves on matching requests.
+type Fault struct {
+	// The request method to match. Matches all the methods when empty.
+	Method string
+
+	// The request path to match, such as /servers. Matches all the paths when
+	// empty.
+	Path string
+
+	// The delay before the request is handled.
+	Latency time.Duration
+
+	// The status code returned instead of handling the request, such as 402
+	// to reject a registration from a wallet that is not staked. The request
+	// is handled normally when 0.
+	StatusCode int
+
+	// Skips the /registrations callback when registering a server. The
+	// server is still registered but never receives its ID and secret.
+	DropCallback bool
+
+	// The number of requests affected by the fault. The fault affects all the
+	// matching requests until ClearFaults is called when 0.
+	Count int
+}
+
+type fault struct {
+	Fault
+	hits int
+}
+
+func (f *fault) match(r *http.Request) bool {
+	return (f.Method == "" || f.Method == r.Method) &&
+		(f.Path == "" || f.Path == r.URL.Path) &&
+		(f.Count <= 0 || f.hits < f.Count)
+}
+
+type dropCallbackKey struct{}
+
+// InjectFault adds a fault that affects the matching requests. When several
+// faults match a request, their latencies add up and the first one with a
+// status code wins.
+func (s *Server) InjectFault(f Fault) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.faults = append(s.faults, &fault{Fault: f})
+}
+
+// ClearFaults removes all the injected faults.
+func (s *Server) ClearFaults() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.faults = nil
+}
+
+func (s *Server) withFaults(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var latency time.Duration
+		var statusCode int
+		var drop bool
+
+		s.mutex.Lock()
+		s.requests[r.Method+" "+r.URL.Path]++
+		for _, f := range s.faults {
+			if !f.match(r) {
+				continue
+			}
+			f.hits++
+
+			latency += f.Latency
+			drop = drop || f.DropCallback
+			if statusCode == 0 {
+				statusCode = f.StatusCode
+			}
+		}
+		s.mutex.Unlock()
+
+		if latency > 0 {
+			select {
+			case <-time.After(latency):
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		if statusCode != 0 {
+			httpcmn.HTTPError(w, statusCode, errors.New("injected fault").
+				WithTag("method", r.Method).
+				WithTag("path", r.URL.Path))
+			return
+		}
+
+		if drop {
+			r = r.WithContext(context.WithValue(r.Context(), dropCallbackKey{}, true))
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func dropCallback(ctx context.Context) bool {
+	drop, _ := ctx.Value(dropCallbackKey{}).(bool)
+	return drop
+}
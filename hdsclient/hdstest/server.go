@@ -0,0 +1,807 @@
+// Package hdstest provides an in-process fake Hagall Discovery Service for
+// integration tests.
+package hdstest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aukilabs/go-tooling/pkg/errors"
+	"github.com/aukilabs/go-tooling/pkg/logs"
+	"github.com/aukilabs/hagall-common/hdsclient"
+	httpcmn "github.com/aukilabs/hagall-common/http"
+	hsmoketest "github.com/aukilabs/hagall-common/smoketest"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	defaultAccessTokenTTL  = 10 * time.Minute
+	defaultCallbackTimeout = 5 * time.Second
+)
+
+// RegisteredServer represents a Hagall server registered to the fake HDS.
+type RegisteredServer struct {
+	ID                string
+	Secret            string
+	Endpoint          string
+	EndpointSignature string
+	Timestamp         string
+	Version           string
+	Modules           []string
+	FeatureFlags      []string
+	WalletAddress     string
+	RegisteredAt      time.Time
+	LastHealthCheck   time.Time
+
+	// The health report sent with the latest health check. Nil when the
+	// server does not report it.
+	Health *hdsclient.HealthReport
+
+	// Reports whether the server is draining. Draining servers are not
+	// listed to apps looking for a server.
+	Draining bool
+}
+
+// Session represents a session registered to the fake HDS.
+type Session struct {
+	ID             string    `json:"id"`
+	ServerID       string    `json:"server_id"`
+	ServerEndpoint string    `json:"server_endpoint"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+type ServerOpts func(*Server)
+
+// WithApp registers an app allowed to authenticate with basic
+// authentication. When no app is registered, any app key and secret are
+// accepted.
+func WithApp(appKey, appSecret string) ServerOpts {
+	return func(s *Server) {
+		s.apps[appKey] = appSecret
+	}
+}
+
+// WithAccessTokenTTL sets the lifetime of the issued user access tokens.
+// Defaults to 10 minutes.
+func WithAccessTokenTTL(v time.Duration) ServerOpts {
+	return func(s *Server) {
+		s.accessTokenTTL = v
+	}
+}
+
+// WithHealthCheckInterval sets the interval between the /health probes of the
+// registered servers. Probes are disabled by default.
+func WithHealthCheckInterval(v time.Duration) ServerOpts {
+	return func(s *Server) {
+		s.healthCheckInterval = v
+	}
+}
+
+// WithHTTPClient sets the client used to call the registered servers back.
+// Defaults to a client with a 5 seconds timeout.
+func WithHTTPClient(v *http.Client) ServerOpts {
+	return func(s *Server) {
+		s.httpClient = v
+	}
+}
+
+// WithRegistrationVerification requires server registrations to be signed by
+// a wallet, verifying them with hdsclient.VerifyPostServerIn. Registrations
+// are not verified by default.
+func WithRegistrationVerification(v hdsclient.VerifyOptions) ServerOpts {
+	return func(s *Server) {
+		s.verifyOptions = &v
+	}
+}
+
+// WithHealthCheckIdentity makes health checks carry the server endpoint
+// signed with the server secret as a bearer token, which identifies the HDS to
+// servers registered with several HDS endpoints. This is a proposed HDS API:
+// like HDS, health checks do not carry it by default.
+func WithHealthCheckIdentity() ServerOpts {
+	return func(s *Server) {
+		s.healthCheckIdentity = true
+	}
+}
+
+// Server is a stateful fake Hagall Discovery Service.
+//
+// It registers servers by calling their /registrations endpoint back, issues
+// user access tokens signed with the server secrets, stores sessions and
+// smoke test results, and probes the registered servers /health endpoint.
+type Server struct {
+	// The base URL of the fake HDS, in the form http://ipaddr:port.
+	URL string
+
+	httpServer          *httptest.Server
+	httpClient          *http.Client
+	apps                map[string]string
+	accessTokenTTL      time.Duration
+	healthCheckInterval time.Duration
+	healthCheckIdentity bool
+	verifyOptions       *hdsclient.VerifyOptions
+
+	mutex            sync.RWMutex
+	servers          map[string]*RegisteredServer
+	sessions         map[string]Session
+	smokeTestResults []hsmoketest.SmokeTestResults
+	faults           []*fault
+	requests         map[string]int
+	serverCount      int
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewServer starts a fake HDS. It must be closed with Close.
+func NewServer(opts ...ServerOpts) *Server {
+	s := &Server{
+		apps:     make(map[string]string),
+		servers:  make(map[string]*RegisteredServer),
+		sessions: make(map[string]Session),
+		requests: make(map[string]int),
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if s.httpClient == nil {
+		s.httpClient = &http.Client{Timeout: defaultCallbackTimeout}
+	}
+
+	if s.accessTokenTTL <= 0 {
+		s.accessTokenTTL = defaultAccessTokenTTL
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /servers", s.handlePostServer)
+	mux.HandleFunc("GET /servers", s.handleGetServers)
+	mux.HandleFunc("GET /servers/{id}", s.handleGetServer)
+	mux.HandleFunc("DELETE /servers", s.handleDeleteServer)
+
+	// The drain routes are not part of the HDS API yet. They implement the
+	// API proposed by hdsclient.Client.Drain.
+	mux.HandleFunc("POST /servers/drain", s.handleDrainServer)
+	mux.HandleFunc("DELETE /servers/drain", s.handleUndrainServer)
+
+	mux.HandleFunc("POST /auth", s.handleAuth)
+	mux.HandleFunc("POST /sessions", s.handlePostSession)
+	mux.HandleFunc("GET /sessions", s.handleListSessions)
+	mux.HandleFunc("GET /sessions/{id}", s.handleGetSession)
+	mux.HandleFunc("DELETE /sessions/{id}", s.handleDeleteSession)
+	mux.HandleFunc("POST /smoke-test-results", s.handleSmokeTestResults)
+
+	s.httpServer = httptest.NewServer(s.withFaults(s.withCompression(mux)))
+	s.URL = s.httpServer.URL
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+
+	if s.healthCheckInterval > 0 {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.runHealthChecks(ctx)
+		}()
+	}
+	return s
+}
+
+// Close stops the health check probes and shuts the fake HDS down.
+func (s *Server) Close() {
+	s.cancel()
+	s.wg.Wait()
+	s.httpServer.Close()
+}
+
+// Servers returns the registered servers, sorted by ID.
+func (s *Server) Servers() []RegisteredServer {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	servers := make([]RegisteredServer, 0, len(s.servers))
+	for _, srv := range s.servers {
+		servers = append(servers, *srv)
+	}
+
+	sort.Slice(servers, func(i, j int) bool {
+		return servers[i].ID < servers[j].ID
+	})
+	return servers
+}
+
+// Server returns the registered server with the given ID.
+func (s *Server) Server(id string) (RegisteredServer, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	srv, ok := s.servers[id]
+	if !ok {
+		return RegisteredServer{}, false
+	}
+	return *srv, true
+}
+
+// Sessions returns the registered sessions, sorted by ID.
+func (s *Server) Sessions() []Session {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	sessions := make([]Session, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].ID < sessions[j].ID
+	})
+	return sessions
+}
+
+// SmokeTestResults returns the received smoke test results.
+func (s *Server) SmokeTestResults() []hsmoketest.SmokeTestResults {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return append([]hsmoketest.SmokeTestResults(nil), s.smokeTestResults...)
+}
+
+// RequestCount returns the number of requests received with the given method
+// and path, including the ones affected by a fault.
+func (s *Server) RequestCount(method, path string) int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.requests[method+" "+path]
+}
+
+// CheckHealth probes the /health endpoint of the registered server with the
+// given ID and records the health check when it succeeds.
+func (s *Server) CheckHealth(ctx context.Context, id string) error {
+	srv, ok := s.Server(id)
+	if !ok {
+		return errors.New("server not found").WithTag("server_id", id)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.Endpoint+"/health", nil)
+	if err != nil {
+		return errors.New("creating health check request failed").Wrap(err)
+	}
+
+	if s.healthCheckIdentity {
+		identity, err := httpcmn.SignIdentity(srv.Endpoint, srv.Secret)
+		if err != nil {
+			return errors.New("signing health check request failed").Wrap(err)
+		}
+		req.Header.Set("Authorization", httpcmn.MakeAuthorizationHeader(identity))
+	}
+
+	res, err := s.httpClient.Do(req)
+	if err != nil {
+		return errors.New("health check request failed").
+			WithTag("server_id", id).
+			Wrap(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return errors.New("health check failed").
+			WithTag("server_id", id).
+			WithTag("status_code", res.StatusCode)
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return errors.New("reading health check response failed").Wrap(err)
+	}
+
+	token := strings.TrimPrefix(res.Header.Get("Authorization"), "Bearer ")
+	var health *hdsclient.HealthReport
+	if len(body) == 0 {
+		err = verifyIdentity(token, srv.Endpoint, srv.Secret)
+	} else {
+		health, err = verifyHealthReport(token, srv, body)
+	}
+	if err != nil {
+		return errors.New("verifying health check identity failed").
+			WithTag("server_id", id).
+			Wrap(err)
+	}
+
+	s.mutex.Lock()
+	if current, ok := s.servers[id]; ok {
+		current.LastHealthCheck = time.Now()
+		current.Health = health
+		current.Draining = health != nil && health.Draining
+	}
+	s.mutex.Unlock()
+	return nil
+}
+
+// verifyHealthReport verifies that the health report was signed by the given
+// server and decodes it.
+func verifyHealthReport(token string, srv RegisteredServer, body []byte) (*hdsclient.HealthReport, error) {
+	endpoint, err := httpcmn.VerifyIdentityWithBody(token, srv.Secret, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if httpcmn.NormalizeEndpoint(endpoint) != srv.Endpoint {
+		return nil, errors.New("identity endpoint mismatch").
+			WithTag("endpoint", endpoint).
+			WithTag("expected_endpoint", srv.Endpoint)
+	}
+
+	var report hdsclient.HealthReport
+	if err := json.Unmarshal(body, &report); err != nil {
+		return nil, errors.New("decoding health report failed").Wrap(err)
+	}
+	return &report, nil
+}
+
+func (s *Server) runHealthChecks(ctx context.Context) {
+	ticker := time.NewTicker(s.healthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			for _, srv := range s.Servers() {
+				if err := s.CheckHealth(ctx, srv.ID); err != nil && ctx.Err() == nil {
+					logs.Warn(err)
+				}
+			}
+		}
+	}
+}
+
+func (s *Server) handlePostServer(w http.ResponseWriter, r *http.Request) {
+	var in hdsclient.PostServerIn
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		httpcmn.BadRequest(w, httpcmn.ErrBadRequest)
+		return
+	}
+
+	if in.Endpoint == "" {
+		httpcmn.BadRequest(w, errors.New("endpoint is empty"))
+		return
+	}
+
+	var walletAddress string
+	if s.verifyOptions != nil {
+		address, err := hdsclient.VerifyPostServerIn(in, *s.verifyOptions)
+		if err != nil {
+			httpcmn.Unauthorized(w, err)
+			return
+		}
+		walletAddress = address.Hex()
+	}
+
+	s.mutex.Lock()
+	s.serverCount++
+	srv := &RegisteredServer{
+		ID:                fmt.Sprintf("0x%x", s.serverCount),
+		Secret:            httpcmn.MakeJWTSecret(),
+		Endpoint:          httpcmn.NormalizeEndpoint(in.Endpoint),
+		EndpointSignature: in.EndpointSignature,
+		Timestamp:         in.Timestamp,
+		Version:           in.Version,
+		Modules:           in.Modules,
+		FeatureFlags:      in.FeatureFlags,
+		WalletAddress:     walletAddress,
+		RegisteredAt:      time.Now(),
+	}
+	s.mutex.Unlock()
+
+	if !dropCallback(r.Context()) {
+		if err := s.verifyServer(r.Context(), srv, in.State); err != nil {
+			httpcmn.Forbidden(w, err)
+			return
+		}
+	}
+
+	s.mutex.Lock()
+	for id, existing := range s.servers {
+		if existing.Endpoint == srv.Endpoint {
+			delete(s.servers, id)
+		}
+	}
+	s.servers[srv.ID] = srv
+	s.mutex.Unlock()
+
+	httpcmn.OK(w)
+}
+
+// verifyServer calls the server /registrations endpoint back to transmit its
+// ID and secret.
+func (s *Server) verifyServer(ctx context.Context, srv *RegisteredServer, state string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, srv.Endpoint+"/registrations", nil)
+	if err != nil {
+		return errors.New("creating registration request failed").Wrap(err)
+	}
+	req.Header.Set(httpcmn.HeaderHagallIDKey, srv.ID)
+	req.Header.Set(httpcmn.HeaderHagallJWTSecretHeaderKey, srv.Secret)
+	req.Header.Set(httpcmn.HeaderHagallRegistrationStateKey, state)
+
+	res, err := s.httpClient.Do(req)
+	if err != nil {
+		return errors.New("registration callback failed").
+			WithTag("endpoint", srv.Endpoint).
+			Wrap(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return errors.New("server verification failed").
+			WithTag("endpoint", srv.Endpoint).
+			WithTag("status_code", res.StatusCode)
+	}
+	return nil
+}
+
+func (s *Server) handleGetServers(w http.ResponseWriter, r *http.Request) {
+	appKey, ok := s.authenticateApp(r)
+	if !ok {
+		httpcmn.Unauthorized(w, nil)
+		return
+	}
+
+	query := r.URL.Query()
+	if endpoint := query.Get("endpoint"); endpoint != "" {
+		srv, ok := s.serverByEndpoint(endpoint)
+		if !ok {
+			httpcmn.NotFound(w)
+			return
+		}
+		s.writeServer(w, appKey, srv)
+		return
+	}
+
+	in := hdsclient.GetServersIn{
+		MinVersion:   query.Get("min_version"),
+		Modules:      splitQuery(query.Get("modules")),
+		FeatureFlags: splitQuery(query.Get("feature_flags")),
+	}
+
+	servers := make(hdsclient.GetServersResponse, 0)
+	for _, srv := range s.Servers() {
+		if srv.Draining {
+			continue
+		}
+
+		match := hdsclient.MatchServer(hdsclient.ServerResponse{
+			Version:      srv.Version,
+			Modules:      srv.Modules,
+			FeatureFlags: srv.FeatureFlags,
+		}, in)
+		if !match {
+			continue
+		}
+
+		res, err := s.serverResponse(appKey, srv)
+		if err != nil {
+			httpcmn.InternalServerError(w, err)
+			return
+		}
+		servers = append(servers, res)
+	}
+	httpcmn.OKWithJSON(w, servers)
+}
+
+func (s *Server) handleGetServer(w http.ResponseWriter, r *http.Request) {
+	appKey, ok := s.authenticateApp(r)
+	if !ok {
+		httpcmn.Unauthorized(w, nil)
+		return
+	}
+
+	srv, ok := s.Server(r.PathValue("id"))
+	if !ok {
+		httpcmn.NotFound(w)
+		return
+	}
+	s.writeServer(w, appKey, srv)
+}
+
+func (s *Server) handleDeleteServer(w http.ResponseWriter, r *http.Request) {
+	srv, ok := s.authenticateServer(r)
+	if !ok {
+		httpcmn.Unauthorized(w, nil)
+		return
+	}
+
+	s.mutex.Lock()
+	delete(s.servers, srv.ID)
+	for id, session := range s.sessions {
+		if session.ServerID == srv.ID {
+			delete(s.sessions, id)
+		}
+	}
+	s.mutex.Unlock()
+
+	httpcmn.OK(w)
+}
+
+func (s *Server) handleDrainServer(w http.ResponseWriter, r *http.Request) {
+	s.setDraining(w, r, true)
+}
+
+func (s *Server) handleUndrainServer(w http.ResponseWriter, r *http.Request) {
+	s.setDraining(w, r, false)
+}
+
+func (s *Server) setDraining(w http.ResponseWriter, r *http.Request, draining bool) {
+	srv, ok := s.authenticateServer(r)
+	if !ok {
+		httpcmn.Unauthorized(w, nil)
+		return
+	}
+
+	s.mutex.Lock()
+	if current, ok := s.servers[srv.ID]; ok {
+		current.Draining = draining
+	}
+	s.mutex.Unlock()
+
+	httpcmn.OK(w)
+}
+
+func (s *Server) handleAuth(w http.ResponseWriter, r *http.Request) {
+	appKey, ok := s.authenticateApp(r)
+	if !ok {
+		httpcmn.Unauthorized(w, nil)
+		return
+	}
+
+	var in struct {
+		Endpoint string `json:"endpoint"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		httpcmn.BadRequest(w, httpcmn.ErrBadRequest)
+		return
+	}
+
+	srv, ok := s.serverByEndpoint(in.Endpoint)
+	if !ok {
+		httpcmn.NotFound(w)
+		return
+	}
+
+	token, err := httpcmn.GenerateHagallUserAccessToken(appKey, srv.Secret, s.accessTokenTTL)
+	if err != nil {
+		httpcmn.InternalServerError(w, errors.New("generating access token failed").Wrap(err))
+		return
+	}
+
+	httpcmn.OKWithJSON(w, struct {
+		AccessToken string `json:"access_token"`
+	}{
+		AccessToken: token,
+	})
+}
+
+func (s *Server) handlePostSession(w http.ResponseWriter, r *http.Request) {
+	srv, ok := s.authenticateServer(r)
+	if !ok {
+		httpcmn.Unauthorized(w, nil)
+		return
+	}
+
+	var in struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil || in.ID == "" {
+		httpcmn.BadRequest(w, httpcmn.ErrBadRequest)
+		return
+	}
+
+	s.mutex.Lock()
+	s.sessions[in.ID] = Session{
+		ID:             in.ID,
+		ServerID:       srv.ID,
+		ServerEndpoint: srv.Endpoint,
+		CreatedAt:      time.Now().UTC(),
+	}
+	s.mutex.Unlock()
+
+	httpcmn.OK(w)
+}
+
+func (s *Server) handleListSessions(w http.ResponseWriter, r *http.Request) {
+	serverID := r.URL.Query().Get("server_id")
+
+	if _, ok := s.authenticateApp(r); !ok {
+		srv, ok := s.authenticateServer(r)
+		if !ok {
+			httpcmn.Unauthorized(w, nil)
+			return
+		}
+
+		if serverID == "" {
+			serverID = srv.ID
+		}
+	}
+
+	sessions := make([]Session, 0)
+	for _, session := range s.Sessions() {
+		if serverID == "" || session.ServerID == serverID {
+			sessions = append(sessions, session)
+		}
+	}
+	httpcmn.OKWithJSON(w, sessions)
+}
+
+func (s *Server) handleGetSession(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.authenticateApp(r); !ok {
+		if _, ok := s.authenticateServer(r); !ok {
+			httpcmn.Unauthorized(w, nil)
+			return
+		}
+	}
+
+	s.mutex.RLock()
+	session, ok := s.sessions[r.PathValue("id")]
+	s.mutex.RUnlock()
+
+	if !ok {
+		httpcmn.NotFound(w)
+		return
+	}
+	httpcmn.OKWithJSON(w, session)
+}
+
+func (s *Server) handleDeleteSession(w http.ResponseWriter, r *http.Request) {
+	srv, ok := s.authenticateServer(r)
+	if !ok {
+		httpcmn.Unauthorized(w, nil)
+		return
+	}
+
+	id := r.PathValue("id")
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	session, ok := s.sessions[id]
+	if !ok || session.ServerID != srv.ID {
+		httpcmn.NotFound(w)
+		return
+	}
+	delete(s.sessions, id)
+
+	httpcmn.OK(w)
+}
+
+func (s *Server) handleSmokeTestResults(w http.ResponseWriter, r *http.Request) {
+	var results hsmoketest.SmokeTestResults
+	if err := json.NewDecoder(r.Body).Decode(&results); err != nil {
+		httpcmn.BadRequest(w, httpcmn.ErrBadRequest)
+		return
+	}
+
+	s.mutex.Lock()
+	s.smokeTestResults = append(s.smokeTestResults, results)
+	s.mutex.Unlock()
+
+	httpcmn.OK(w)
+}
+
+// authenticateApp returns the app key of a request authenticated with basic
+// authentication.
+func (s *Server) authenticateApp(r *http.Request) (string, bool) {
+	appKey, appSecret, ok := r.BasicAuth()
+	if !ok {
+		return "", false
+	}
+
+	if len(s.apps) == 0 {
+		return appKey, true
+	}
+
+	expected, ok := s.apps[appKey]
+	return appKey, ok && expected == appSecret
+}
+
+// authenticateServer returns the registered server that signed the request
+// Authorization header with its secret.
+func (s *Server) authenticateServer(r *http.Request) (RegisteredServer, bool) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return RegisteredServer{}, false
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+
+	var claims jwt.MapClaims
+	if _, _, err := jwt.NewParser().ParseUnverified(token, &claims); err != nil {
+		return RegisteredServer{}, false
+	}
+
+	endpoint, _ := claims["endpoint"].(string)
+	srv, ok := s.serverByEndpoint(endpoint)
+	if !ok {
+		return RegisteredServer{}, false
+	}
+
+	if err := verifyIdentity(token, srv.Endpoint, srv.Secret); err != nil {
+		return RegisteredServer{}, false
+	}
+	return srv, true
+}
+
+func (s *Server) serverByEndpoint(endpoint string) (RegisteredServer, bool) {
+	endpoint = httpcmn.NormalizeEndpoint(endpoint)
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	for _, srv := range s.servers {
+		if srv.Endpoint == endpoint {
+			return *srv, true
+		}
+	}
+	return RegisteredServer{}, false
+}
+
+func (s *Server) serverResponse(appKey string, srv RegisteredServer) (hdsclient.ServerResponse, error) {
+	token, err := httpcmn.GenerateHagallUserAccessToken(appKey, srv.Secret, s.accessTokenTTL)
+	if err != nil {
+		return hdsclient.ServerResponse{}, errors.New("generating access token failed").Wrap(err)
+	}
+
+	return hdsclient.ServerResponse{
+		ID:            srv.ID,
+		Endpoint:      srv.Endpoint,
+		AccessToken:   token,
+		Version:       srv.Version,
+		Modules:       srv.Modules,
+		FeatureFlags:  srv.FeatureFlags,
+		WalletAddress: srv.WalletAddress,
+		Health:        srv.Health,
+	}, nil
+}
+
+func (s *Server) writeServer(w http.ResponseWriter, appKey string, srv RegisteredServer) {
+	res, err := s.serverResponse(appKey, srv)
+	if err != nil {
+		httpcmn.InternalServerError(w, err)
+		return
+	}
+	httpcmn.OKWithJSON(w, res)
+}
+
+// verifyIdentity verifies that the token is an identity signed by
+// httpcmn.SignIdentity with the given endpoint and secret.
+func verifyIdentity(token, endpoint, secret string) error {
+	var claims jwt.MapClaims
+	_, err := jwt.ParseWithClaims(token, &claims, func(t *jwt.Token) (interface{}, error) {
+		return []byte(secret), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil {
+		return errors.New("parsing identity token failed").Wrap(err)
+	}
+
+	claimedEndpoint, _ := claims["endpoint"].(string)
+	if httpcmn.NormalizeEndpoint(claimedEndpoint) != endpoint {
+		return errors.New("identity endpoint mismatch").
+			WithTag("endpoint", claimedEndpoint).
+			WithTag("expected_endpoint", endpoint)
+	}
+	return nil
+}
+
+func splitQuery(v string) []string {
+	if v == "" {
+		return nil
+	}
+	return strings.Split(v, ",")
+}
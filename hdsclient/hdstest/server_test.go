@@ -0,0 +1,430 @@
+package hdstest_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aukilabs/hagall-common/crypt"
+	"github.com/aukilabs/hagall-common/hdsclient"
+	"github.com/aukilabs/hagall-common/hdsclient/hdstest"
+	httpcmn "github.com/aukilabs/hagall-common/http"
+	hsmoketest "github.com/aukilabs/hagall-common/smoketest"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer(t *testing.T) {
+	t.Run("registration and sessions", func(t *testing.T) {
+		hds := hdstest.NewServer(hdstest.WithApp("key", "secret"))
+		defer hds.Close()
+
+		client, hagall := newHagall(t, hds)
+		defer hagall.Close()
+
+		ctx := context.Background()
+		require.NoError(t, client.PostServer(ctx, hdsclient.PostServerIn{
+			Version: "v1.0.0",
+			Modules: []string{"vikja"},
+		}))
+		require.Equal(t, hdsclient.RegistrationStatusRegistered, client.GetRegistrationStatus())
+
+		servers := hds.Servers()
+		require.Len(t, servers, 1)
+		require.Equal(t, client.ServerID(), servers[0].ID)
+		require.Equal(t, client.Secret(), servers[0].Secret)
+		require.Equal(t, hagall.URL, servers[0].Endpoint)
+
+		listed, err := client.GetServers(ctx, hdsclient.GetServersIn{
+			AppKey:    "key",
+			AppSecret: "secret",
+			Modules:   []string{"vikja"},
+		})
+		require.NoError(t, err)
+		require.Len(t, listed, 1)
+		require.NoError(t, client.VerifyUserAuth(listed[0].AccessToken))
+
+		_, err = client.GetServers(ctx, hdsclient.GetServersIn{
+			AppKey:    "key",
+			AppSecret: "wrong",
+		})
+		require.ErrorIs(t, err, hdsclient.ErrUnauthorized)
+
+		auth, err := client.UserAuth(ctx, hdsclient.UserAuthIn{
+			Endpoint:  hagall.URL,
+			AppKey:    "key",
+			AppSecret: "secret",
+		})
+		require.NoError(t, err)
+		require.NoError(t, client.VerifyUserAuth(auth.AccessToken))
+		require.Equal(t, "key", httpcmn.GetAppKeyFromHagallUserToken(auth.AccessToken))
+
+		require.NoError(t, client.PostSession(ctx, hdsclient.PostSessionIn{ID: "s1"}))
+		session, err := client.GetSession(ctx, hdsclient.GetSessionIn{ID: "s1"})
+		require.NoError(t, err)
+		require.Equal(t, client.ServerID(), session.ServerID)
+		require.Equal(t, hagall.URL, session.ServerEndpoint)
+
+		sessions, err := client.ListSessions(ctx, hdsclient.ListSessionsIn{})
+		require.NoError(t, err)
+		require.Len(t, sessions, 1)
+
+		require.NoError(t, client.DeleteSession(ctx, hdsclient.DeleteSessionIn{ID: "s1"}))
+		_, err = client.GetSession(ctx, hdsclient.GetSessionIn{ID: "s1"})
+		require.ErrorIs(t, err, hdsclient.ErrSessionNotFound)
+
+		require.NoError(t, client.SendSmokeTestResult(ctx, hsmoketest.SmokeTestResults{
+			FromEndpoint: hagall.URL,
+			Status:       hsmoketest.StatusSuccess,
+		}))
+		require.Len(t, hds.SmokeTestResults(), 1)
+
+		require.NoError(t, client.Unpair(ctx))
+		require.Empty(t, hds.Servers())
+	})
+
+	t.Run("health checks", func(t *testing.T) {
+		hds := hdstest.NewServer(hdstest.WithHealthCheckInterval(10 * time.Millisecond))
+		defer hds.Close()
+
+		client, hagall := newHagall(t, hds)
+		defer hagall.Close()
+
+		require.NoError(t, client.PostServer(context.Background(), hdsclient.PostServerIn{}))
+		require.Eventually(t, func() bool {
+			srv, ok := hds.Server(client.ServerID())
+			return ok && !srv.LastHealthCheck.IsZero()
+		}, time.Second, time.Millisecond)
+	})
+
+	t.Run("health checks from several hds", func(t *testing.T) {
+		hds1 := hdstest.NewServer(hdstest.WithHealthCheckIdentity())
+		defer hds1.Close()
+		hds2 := hdstest.NewServer(hdstest.WithHealthCheckIdentity())
+		defer hds2.Close()
+
+		client, hagall := newHagall(t, hds1, hdsclient.WithHDSEndpoints(hds1.URL, hds2.URL))
+		defer hagall.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		pairCh := make(chan error, 1)
+		go func() {
+			pairCh <- client.Pair(ctx, hdsclient.PairIn{
+				HealthCheckTTL:       time.Minute,
+				RegistrationInterval: 10 * time.Millisecond,
+				RegistrationRetries:  1,
+			})
+		}()
+
+		require.Eventually(t, func() bool {
+			return client.GetRegistrationStatus() == hdsclient.RegistrationStatusRegistered &&
+				len(hds1.Servers()) == 1 &&
+				len(hds2.Servers()) == 1
+		}, time.Second, time.Millisecond)
+
+		events, unsubscribe := client.Subscribe(16)
+		defer unsubscribe()
+
+		for _, hds := range []*hdstest.Server{hds1, hds2} {
+			servers := hds.Servers()
+			require.NoError(t, hds.CheckHealth(ctx, servers[0].ID))
+
+			e := <-events
+			for e.Type != hdsclient.EventTypeHealthCheck {
+				e = <-events
+			}
+			require.Equal(t, hds.URL, e.HDSEndpoint)
+			require.Equal(t, servers[0].ID, e.ServerID)
+		}
+
+		require.NoError(t, client.Unpair(context.Background()))
+		require.ErrorIs(t, <-pairCh, hdsclient.ErrUnpaired)
+	})
+
+	t.Run("servers are filtered by min version", func(t *testing.T) {
+		hds := hdstest.NewServer(hdstest.WithApp("key", "secret"))
+		defer hds.Close()
+
+		client, hagall := newHagall(t, hds)
+		defer hagall.Close()
+
+		ctx := context.Background()
+		require.NoError(t, client.PostServer(ctx, hdsclient.PostServerIn{
+			Version: "v1.2.0-rc.10",
+		}))
+
+		for minVersion, expected := range map[string]int{
+			"":            1,
+			"v1.2.0-rc.9": 1,
+			"v1.2.0":      0,
+			"v1.3.0":      0,
+		} {
+			servers, err := client.GetServers(ctx, hdsclient.GetServersIn{
+				AppKey:     "key",
+				AppSecret:  "secret",
+				MinVersion: minVersion,
+			})
+			require.NoError(t, err)
+			require.Len(t, servers, expected, "min version %q", minVersion)
+		}
+	})
+
+	t.Run("unidentified health checks from several hds", func(t *testing.T) {
+		hds1 := hdstest.NewServer()
+		defer hds1.Close()
+		hds2 := hdstest.NewServer()
+		defer hds2.Close()
+
+		client, hagall := newHagall(t, hds1, hdsclient.WithHDSEndpoints(hds1.URL, hds2.URL))
+		defer hagall.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		pairCh := make(chan error, 1)
+		go func() {
+			pairCh <- client.Pair(ctx, hdsclient.PairIn{
+				HealthCheckTTL:       200 * time.Millisecond,
+				RegistrationInterval: 10 * time.Millisecond,
+				RegistrationRetries:  1,
+			})
+		}()
+
+		require.Eventually(t, func() bool {
+			return client.GetRegistrationStatus() == hdsclient.RegistrationStatusRegistered &&
+				len(hds1.Servers()) == 1 &&
+				len(hds2.Servers()) == 1
+		}, time.Second, time.Millisecond)
+		registrations := hds2.RequestCount(http.MethodPost, "/servers")
+
+		for i := 0; i < 30; i++ {
+			require.NoError(t, hds1.CheckHealth(ctx, hds1.Servers()[0].ID))
+			time.Sleep(20 * time.Millisecond)
+		}
+		require.Equal(t, registrations, hds2.RequestCount(http.MethodPost, "/servers"))
+
+		require.NoError(t, client.Unpair(context.Background()))
+		require.ErrorIs(t, <-pairCh, hdsclient.ErrUnpaired)
+	})
+
+	t.Run("health reports", func(t *testing.T) {
+		hds := hdstest.NewServer()
+		defer hds.Close()
+
+		report := hdsclient.HealthReport{
+			SessionCount:     2,
+			ParticipantCount: 5,
+			CPUUsage:         0.5,
+			MemoryUsage:      0.25,
+			Modules:          []string{"vikja"},
+		}
+		client, hagall := newHagall(t, hds, hdsclient.WithHealthReporter(
+			hdsclient.HealthReporterFunc(func(ctx context.Context) (hdsclient.HealthReport, error) {
+				return report, nil
+			}),
+		))
+		defer hagall.Close()
+
+		ctx := context.Background()
+		require.NoError(t, client.PostServer(ctx, hdsclient.PostServerIn{}))
+		require.NoError(t, hds.CheckHealth(ctx, client.ServerID()))
+
+		servers, err := client.GetServers(ctx, hdsclient.GetServersIn{
+			AppKey:    "key",
+			AppSecret: "secret",
+		})
+		require.NoError(t, err)
+		require.Len(t, servers, 1)
+		require.Equal(t, &report, servers[0].Health)
+	})
+
+	t.Run("draining", func(t *testing.T) {
+		hds := hdstest.NewServer()
+		defer hds.Close()
+
+		client, hagall := newHagall(t, hds)
+		defer hagall.Close()
+
+		ctx := context.Background()
+		in := hdsclient.GetServersIn{AppKey: "key", AppSecret: "secret"}
+		require.NoError(t, client.PostServer(ctx, hdsclient.PostServerIn{}))
+
+		require.NoError(t, client.Drain(ctx))
+		srv, ok := hds.Server(client.ServerID())
+		require.True(t, ok)
+		require.True(t, srv.Draining)
+
+		servers, err := client.GetServers(ctx, in)
+		require.NoError(t, err)
+		require.Empty(t, servers)
+
+		require.NoError(t, hds.CheckHealth(ctx, client.ServerID()))
+		srv, _ = hds.Server(client.ServerID())
+		require.True(t, srv.Draining)
+		require.True(t, srv.Health.Draining)
+
+		require.NoError(t, client.Undrain(ctx))
+		servers, err = client.GetServers(ctx, in)
+		require.NoError(t, err)
+		require.Len(t, servers, 1)
+
+		require.NoError(t, hds.CheckHealth(ctx, client.ServerID()))
+		srv, _ = hds.Server(client.ServerID())
+		require.False(t, srv.Draining)
+		require.Nil(t, srv.Health)
+	})
+
+	t.Run("compression", func(t *testing.T) {
+		hds := hdstest.NewServer()
+		defer hds.Close()
+
+		client, hagall := newHagall(t, hds, hdsclient.WithCompression(0))
+		defer hagall.Close()
+
+		ctx := context.Background()
+		require.NoError(t, client.PostServer(ctx, hdsclient.PostServerIn{Modules: []string{"vikja"}}))
+
+		servers, err := client.GetServers(ctx, hdsclient.GetServersIn{
+			AppKey:    "key",
+			AppSecret: "secret",
+		})
+		require.NoError(t, err)
+		require.Len(t, servers, 1)
+		require.Equal(t, []string{"vikja"}, servers[0].Modules)
+
+		require.NoError(t, client.SendSmokeTestResult(ctx, hsmoketest.SmokeTestResults{
+			FromEndpoint: hagall.URL,
+			Status:       hsmoketest.StatusSuccess,
+		}))
+		require.Len(t, hds.SmokeTestResults(), 1)
+	})
+
+	t.Run("wallet signed registration", func(t *testing.T) {
+		hds := hdstest.NewServer(hdstest.WithRegistrationVerification(hdsclient.VerifyOptions{
+			NonceStore: hdsclient.NewMemoryNonceStore(),
+		}))
+		defer hds.Close()
+
+		client, hagall := newHagall(t, hds)
+		defer hagall.Close()
+
+		ctx := context.Background()
+		err := client.PostServer(ctx, hdsclient.PostServerIn{})
+		require.ErrorIs(t, err, hdsclient.ErrUnauthorized)
+
+		privateKey, err := crypto.GenerateKey()
+		require.NoError(t, err)
+
+		signature, timestamp, err := crypt.SignWithTimestamp(privateKey, hagall.URL)
+		require.NoError(t, err)
+
+		in := hdsclient.PostServerIn{
+			EndpointSignature: signature,
+			Timestamp:         timestamp,
+		}
+		require.NoError(t, client.PostServer(ctx, in))
+
+		servers := hds.Servers()
+		require.Len(t, servers, 1)
+		require.Equal(t, crypto.PubkeyToAddress(privateKey.PublicKey).Hex(), servers[0].WalletAddress)
+
+		err = client.PostServer(ctx, in)
+		require.ErrorIs(t, err, hdsclient.ErrUnauthorized)
+	})
+
+	t.Run("not staked", func(t *testing.T) {
+		hds := hdstest.NewServer()
+		defer hds.Close()
+
+		hds.InjectFault(hdstest.Fault{
+			Method:     http.MethodPost,
+			Path:       "/servers",
+			StatusCode: http.StatusPaymentRequired,
+		})
+
+		client, hagall := newHagall(t, hds)
+		defer hagall.Close()
+
+		err := client.PostServer(context.Background(), hdsclient.PostServerIn{})
+		require.ErrorIs(t, err, hdsclient.ErrNotStaked)
+		require.Empty(t, hds.Servers())
+	})
+
+	t.Run("temporary failure", func(t *testing.T) {
+		hds := hdstest.NewServer()
+		defer hds.Close()
+
+		hds.InjectFault(hdstest.Fault{
+			Path:       "/servers",
+			StatusCode: http.StatusServiceUnavailable,
+			Count:      1,
+		})
+
+		client, hagall := newHagall(t, hds, hdsclient.WithRetryPolicy(hdsclient.RetryPolicy{
+			MaxAttempts:     2,
+			InitialInterval: time.Millisecond,
+		}))
+		defer hagall.Close()
+
+		require.NoError(t, client.PostServer(context.Background(), hdsclient.PostServerIn{}))
+		require.Equal(t, 2, hds.RequestCount(http.MethodPost, "/servers"))
+	})
+
+	t.Run("dropped callback", func(t *testing.T) {
+		hds := hdstest.NewServer()
+		defer hds.Close()
+
+		hds.InjectFault(hdstest.Fault{DropCallback: true})
+
+		client, hagall := newHagall(t, hds)
+		defer hagall.Close()
+
+		require.NoError(t, client.PostServer(context.Background(), hdsclient.PostServerIn{}))
+		require.Empty(t, client.Secret())
+		require.Len(t, hds.Servers(), 1)
+	})
+
+	t.Run("latency", func(t *testing.T) {
+		hds := hdstest.NewServer()
+		defer hds.Close()
+
+		hds.InjectFault(hdstest.Fault{Latency: time.Second})
+
+		client, hagall := newHagall(t, hds)
+		defer hagall.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		err := client.PostServer(ctx, hdsclient.PostServerIn{})
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+
+		hds.ClearFaults()
+		require.NoError(t, client.PostServer(context.Background(), hdsclient.PostServerIn{}))
+	})
+}
+
+// newHagall starts a Hagall server that handles the HDS registration callback
+// and health checks with a client connected to the given fake HDS.
+func newHagall(t *testing.T, hds *hdstest.Server, opts ...hdsclient.ClientOpts) (*hdsclient.Client, *httptest.Server) {
+	var client *hdsclient.Client
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/registrations", func(w http.ResponseWriter, r *http.Request) {
+		client.HandleServerRegistration(w, r)
+	})
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		client.HandleHealthCheck(w, r)
+	})
+	hagall := httptest.NewServer(mux)
+
+	client = hdsclient.NewClient(append([]hdsclient.ClientOpts{
+		hdsclient.WithHagallEndpoint(hagall.URL),
+		hdsclient.WithHDSEndpoint(hds.URL),
+	}, opts...)...)
+	return client, hagall
+}
@@ -0,0 +1,80 @@
+package hdsclient
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/aukilabs/go-tooling/pkg/errors"
+	"github.com/aukilabs/go-tooling/pkg/logs"
+)
+
+// HealthReport describes the load and capacity of a Hagall server. It is sent
+// to HDS in the health check response body.
+type HealthReport struct {
+	// The number of sessions hosted by the server.
+	SessionCount int `json:"session_count"`
+
+	// The number of participants connected to the server.
+	ParticipantCount int `json:"participant_count"`
+
+	// The CPU pressure, between 0 and 1.
+	CPUUsage float64 `json:"cpu_usage"`
+
+	// The memory pressure, between 0 and 1.
+	MemoryUsage float64 `json:"memory_usage"`
+
+	// The modules the server accepts new sessions for.
+	Modules []string `json:"modules,omitempty"`
+
+	// Reports whether the server stopped accepting new sessions.
+	Draining bool `json:"draining"`
+}
+
+// HealthReporter is the interface that reports the load and capacity of a
+// Hagall server on health checks.
+type HealthReporter interface {
+	HealthReport(ctx context.Context) (HealthReport, error)
+}
+
+// HealthReporterFunc is a function that satisfies the HealthReporter
+// interface.
+type HealthReporterFunc func(ctx context.Context) (HealthReport, error)
+
+// HealthReport satisfies the HealthReporter interface.
+func (f HealthReporterFunc) HealthReport(ctx context.Context) (HealthReport, error) {
+	return f(ctx)
+}
+
+// healthReport returns the health report advertised on health checks, or
+// false when there is nothing to report.
+func (c *Client) healthReport(ctx context.Context) (HealthReport, bool) {
+	draining := c.IsDraining()
+	if c.healthReporter == nil {
+		return HealthReport{Draining: draining}, draining
+	}
+
+	report, err := c.healthReporter.HealthReport(ctx)
+	if err != nil {
+		logs.Warn(errors.New("getting health report failed").Wrap(err))
+		return HealthReport{Draining: draining}, draining
+	}
+
+	report.Draining = report.Draining || draining
+	return report, true
+}
+
+// healthReportBody returns the encoded health report, or nil when there is
+// nothing to report.
+func (c *Client) healthReportBody(ctx context.Context) []byte {
+	report, ok := c.healthReport(ctx)
+	if !ok {
+		return nil
+	}
+
+	body, err := json.Marshal(report)
+	if err != nil {
+		logs.Warn(errors.New("encoding health report failed").Wrap(err))
+		return nil
+	}
+	return body
+}
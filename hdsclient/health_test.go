@@ -0,0 +1,70 @@
+package hdsclient
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aukilabs/go-tooling/pkg/errors"
+	httpcmn "github.com/aukilabs/hagall-common/http"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientHandleHealthCheckWithReporter(t *testing.T) {
+	setupTestLog(t)
+
+	t.Run("health report is signed in the response body", func(t *testing.T) {
+		report := HealthReport{
+			SessionCount:     3,
+			ParticipantCount: 12,
+			CPUUsage:         0.75,
+			MemoryUsage:      0.5,
+			Modules:          []string{"vikja", "odal"},
+			Draining:         true,
+		}
+
+		client := NewClient(
+			WithHagallEndpoint("http://test"),
+			WithSecret("secret"),
+			WithHealthReporter(HealthReporterFunc(func(ctx context.Context) (HealthReport, error) {
+				return report, nil
+			})),
+		)
+
+		res := httptest.NewRecorder()
+		client.HandleHealthCheck(res, httptest.NewRequest(http.MethodGet, "/health", nil))
+		require.Equal(t, http.StatusOK, res.Code)
+		require.Equal(t, "application/json", res.Header().Get("Content-Type"))
+
+		token := strings.TrimPrefix(res.Header().Get("Authorization"), "Bearer ")
+		endpoint, err := httpcmn.VerifyIdentityWithBody(token, "secret", res.Body.Bytes())
+		require.NoError(t, err)
+		require.Equal(t, "http://test", endpoint)
+
+		var received HealthReport
+		require.NoError(t, json.Unmarshal(res.Body.Bytes(), &received))
+		require.Equal(t, report, received)
+	})
+
+	t.Run("reporter errors fall back to the identity", func(t *testing.T) {
+		client := NewClient(
+			WithHagallEndpoint("http://test"),
+			WithSecret("secret"),
+			WithHealthReporter(HealthReporterFunc(func(ctx context.Context) (HealthReport, error) {
+				return HealthReport{}, errors.New("unavailable")
+			})),
+		)
+
+		res := httptest.NewRecorder()
+		client.HandleHealthCheck(res, httptest.NewRequest(http.MethodGet, "/health", nil))
+		require.Equal(t, http.StatusOK, res.Code)
+		require.Empty(t, res.Body.Bytes())
+
+		expected, err := httpcmn.SignIdentity("http://test", "secret")
+		require.NoError(t, err)
+		require.Equal(t, httpcmn.MakeAuthorizationHeader(expected), res.Header().Get("Authorization"))
+	})
+}
@@ -1,6 +1,10 @@
 package hdsclient
 
-import "time"
+import (
+	"time"
+
+	"github.com/aukilabs/hagall-common/crypt"
+)
 
 // GetServersIn is the input to get a list of the closest servers.
 type GetServersIn struct {
@@ -19,6 +23,10 @@ type ServerResponse struct {
 	Modules       []string `json:"modules"`
 	FeatureFlags  []string `json:"feature_flags"`
 	WalletAddress string   `json:"wallet_address"`
+
+	// The server load and capacity reported on the latest health check. Nil
+	// when the server does not report it.
+	Health *HealthReport `json:"health,omitempty"`
 }
 
 type GetServersResponse []ServerResponse
@@ -47,6 +55,13 @@ type PostServerIn struct {
 
 	// The timestamp when endpoint signature was signed.
 	Timestamp string `json:"timestamp"`
+
+	// The scheme used to sign the endpoint. Empty for raw Keccak256
+	// signatures.
+	SignatureScheme crypt.SignatureScheme `json:"signature_scheme,omitempty"`
+
+	// The chain ID bound to EIP-712 endpoint signatures.
+	ChainID int64 `json:"chain_id,omitempty"`
 }
 
 // UserAuthIn represents the input to authenticate to a Hagall server.
@@ -70,6 +85,23 @@ const (
 	RegistrationStatusFailed              RegistrationStatus = 4
 )
 
+func (s RegistrationStatus) String() string {
+	switch s {
+	case RegistrationStatusInit:
+		return "init"
+	case RegistrationStatusRegistering:
+		return "registering"
+	case RegistrationStatusPendingVerification:
+		return "pending_verification"
+	case RegistrationStatusRegistered:
+		return "registered"
+	case RegistrationStatusFailed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
 // GetServerByIDIn is the input to retrieve a server by it's id from HDS.
 type GetServerByIDIn struct {
 	ServerID  string `json:"-"`
@@ -92,8 +124,40 @@ type PostSessionIn struct {
 // GetSessionIn is the input to get a session from HDS.
 type GetSessionIn struct {
 	ID string
+
+	// The app key and secret used to authenticate. When empty, the request is
+	// authenticated with the Hagall server identity.
+	AppKey    string `json:"-"`
+	AppSecret string `json:"-"`
 }
 
+// ListSessionsIn is the input to list the sessions registered to HDS.
+type ListSessionsIn struct {
+	// The ID of the server hosting the sessions. When empty, HDS returns the
+	// sessions of the authenticated Hagall server.
+	ServerID string `json:"-"`
+
+	// The app key and secret used to authenticate. When empty, the request is
+	// authenticated with the Hagall server identity.
+	AppKey    string `json:"-"`
+	AppSecret string `json:"-"`
+}
+
+// DeleteSessionIn is the input to unregister a session from HDS.
+type DeleteSessionIn struct {
+	ID string `json:"-"`
+}
+
+// SessionResponse represents a session registered to HDS.
+type SessionResponse struct {
+	ID             string    `json:"id"`
+	ServerID       string    `json:"server_id"`
+	ServerEndpoint string    `json:"server_endpoint"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+type ListSessionsResponse []SessionResponse
+
 // PairIn is the input to pair the client with HDS.
 type PairIn struct {
 	// The Hagall server endpoint. Optional.
@@ -115,6 +179,32 @@ type PairIn struct {
 	// registration.
 	HealthCheckTTL time.Duration
 
-	// The number of retries before returning with error.
+	// The number of retries before returning with error. Ignored by a
+	// Supervisor that uses GiveUpRetry.
 	RegistrationRetries int
+
+	// The number of HDS endpoints the server must be registered with when
+	// several are set with WithHDSEndpoints. Defaults to all of them.
+	Quorum int
+}
+
+// UnpairOptions are the options to unpair the client from HDS.
+type UnpairOptions struct {
+	// The maximum duration of the unpairing, including stopping Pair and
+	// deleting the server from HDS. Defaults to 3 seconds.
+	Timeout time.Duration
+
+	// The timeout to establish a connection with HDS. Defaults to Timeout.
+	DialTimeout time.Duration
+}
+
+func (o UnpairOptions) withDefaults() UnpairOptions {
+	if o.Timeout <= 0 {
+		o.Timeout = defaultUnpairTimeout
+	}
+
+	if o.DialTimeout <= 0 {
+		o.DialTimeout = o.Timeout
+	}
+	return o
 }
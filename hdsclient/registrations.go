@@ -0,0 +1,367 @@
+package hdsclient
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aukilabs/go-tooling/pkg/errors"
+	"github.com/aukilabs/go-tooling/pkg/logs"
+	httpcmn "github.com/aukilabs/hagall-common/http"
+)
+
+// hdsRegistration is the registration of the server with one of the HDS
+// endpoints set with WithHDSEndpoints.
+type hdsRegistration struct {
+	endpoint        string
+	state           string
+	serverID        string
+	secret          string
+	status          RegistrationStatus
+	lastHealthCheck time.Time
+}
+
+// secretFor returns the secret attributed by the given HDS endpoint, or the
+// client secret when the endpoint did not attribute one.
+func (c *Client) secretFor(endpoint string) string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if reg, ok := c.registrations[endpoint]; ok && reg.secret != "" {
+		return reg.secret
+	}
+	return c.secret
+}
+
+// registrationStatusFor returns the registration status with the given HDS
+// endpoint. An empty endpoint refers to the client registration status.
+func (c *Client) registrationStatusFor(endpoint string) RegistrationStatus {
+	if endpoint == "" {
+		return c.GetRegistrationStatus()
+	}
+
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.registrations[endpoint].status
+}
+
+// setRegistrationStatusFor sets the registration status with the given HDS
+// endpoint and updates the client registration status accordingly.
+func (c *Client) setRegistrationStatusFor(endpoint string, v RegistrationStatus) {
+	if endpoint == "" {
+		c.setRegistrationStatus(v)
+		return
+	}
+	c.swapRegistrationStatusFor(endpoint, nil, v)
+}
+
+// compareAndSetRegistrationStatusFor sets the registration status with the
+// given HDS endpoint to v when the current status is old.
+func (c *Client) compareAndSetRegistrationStatusFor(endpoint string, old, v RegistrationStatus) bool {
+	if endpoint == "" {
+		return c.compareAndSetRegistrationStatus(old, v)
+	}
+	return c.swapRegistrationStatusFor(endpoint, &old, v)
+}
+
+// swapRegistrationStatusFor sets the registration status with the given HDS
+// endpoint to v when old is nil or matches the current status.
+func (c *Client) swapRegistrationStatusFor(endpoint string, old *RegistrationStatus, v RegistrationStatus) bool {
+	c.mutex.Lock()
+	reg := c.registrations[endpoint]
+	previous := reg.status
+	if old != nil && previous != *old {
+		c.mutex.Unlock()
+		return false
+	}
+	reg.status = v
+	serverID := reg.serverID
+	c.mutex.Unlock()
+
+	if previous != v {
+		c.emit(Event{
+			Type:           EventTypeRegistrationStatusChanged,
+			Status:         v,
+			PreviousStatus: previous,
+			ServerID:       serverID,
+			HDSEndpoint:    endpoint,
+		})
+	}
+	c.updateRegistrationQuorum()
+	return true
+}
+
+// resetServerDataFor clears the server ID and secret attributed by the given
+// HDS endpoint.
+func (c *Client) resetServerDataFor(endpoint string) {
+	if endpoint == "" {
+		c.SetServerData("", "")
+		return
+	}
+
+	c.mutex.Lock()
+	reg := c.registrations[endpoint]
+	reg.serverID = ""
+	reg.secret = ""
+	c.mutex.Unlock()
+}
+
+// lastHealthCheckFor returns the time of the latest health check performed by
+// the given HDS endpoint.
+func (c *Client) lastHealthCheckFor(endpoint string) time.Time {
+	if endpoint == "" {
+		return c.LastHealthCheck()
+	}
+
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.registrations[endpoint].lastHealthCheck
+}
+
+// postServerTo registers the server to the given HDS endpoint.
+func (c *Client) postServerTo(ctx context.Context, endpoint string, in PostServerIn) error {
+	if endpoint == "" {
+		return c.PostServer(ctx, in)
+	}
+
+	if in.State == "" {
+		in.State = httpcmn.MakeJWTSecret()
+	}
+
+	c.mutex.Lock()
+	c.registrations[endpoint].state = in.State
+	c.mutex.Unlock()
+
+	return c.PostServer(withHDSEndpoint(ctx, endpoint), in)
+}
+
+// updateRegistrationQuorum updates the client registration status and
+// identity from the registrations with each HDS endpoint.
+func (c *Client) updateRegistrationQuorum() {
+	c.mutex.Lock()
+	quorum := c.quorum
+	if quorum <= 0 || quorum > len(c.registrations) {
+		quorum = len(c.registrations)
+	}
+
+	var registered, failed, pending, registering int
+	var serverID, secret string
+	for _, e := range c.endpoints {
+		reg := c.registrations[e.url]
+		switch reg.status {
+		case RegistrationStatusRegistered:
+			if registered == 0 {
+				serverID = reg.serverID
+				secret = reg.secret
+			}
+			registered++
+		case RegistrationStatusFailed:
+			failed++
+		case RegistrationStatusPendingVerification:
+			pending++
+		case RegistrationStatusRegistering:
+			registering++
+		}
+	}
+	c.serverID = serverID
+	c.secret = secret
+	c.mutex.Unlock()
+
+	switch {
+	case registered >= quorum:
+		c.setRegistrationStatus(RegistrationStatusRegistered)
+	case len(c.registrations)-failed < quorum:
+		c.setRegistrationStatus(RegistrationStatusFailed)
+	case pending != 0:
+		c.setRegistrationStatus(RegistrationStatusPendingVerification)
+	case registering != 0:
+		c.setRegistrationStatus(RegistrationStatusRegistering)
+	default:
+		c.setRegistrationStatus(RegistrationStatusInit)
+	}
+}
+
+// registrationByState returns the HDS endpoint whose registration was
+// initiated with the given state.
+func (c *Client) registrationByState(state string) (string, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	for endpoint, reg := range c.registrations {
+		if state != "" && reg.state == state {
+			return endpoint, true
+		}
+	}
+	return "", false
+}
+
+// registrationByIdentity returns the HDS endpoint that performed the given
+// request. HDS endpoints are identified by the Authorization header, which
+// carries the server endpoint signed with the secret they attributed. This
+// header is a proposed HDS API that HDS does not send yet.
+func (c *Client) registrationByIdentity(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return "", false
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	for endpoint, reg := range c.registrations {
+		if reg.secret == "" {
+			continue
+		}
+
+		signedEndpoint, err := httpcmn.VerifyIdentity(token, reg.secret)
+		if err == nil && httpcmn.NormalizeEndpoint(signedEndpoint) == c.HagallEndpoint {
+			return endpoint, true
+		}
+	}
+	return "", false
+}
+
+// handleEndpointRegistration handles the registration callback of one of the
+// HDS endpoints set with WithHDSEndpoints.
+func (c *Client) handleEndpointRegistration(w http.ResponseWriter, r *http.Request) {
+	state := r.Header.Get(httpcmn.HeaderHagallRegistrationStateKey)
+	endpoint, ok := c.registrationByState(state)
+	if !ok {
+		httpcmn.Forbidden(w, errors.New("non initiated server registration").
+			WithTag("warning", "Did you or someone else just try to register the same address from another Hagall instance?"))
+		return
+	}
+
+	c.mutex.RLock()
+	registered := c.registrations[endpoint].secret != ""
+	c.mutex.RUnlock()
+
+	if registered {
+		httpcmn.Forbidden(w, errors.New("server registration failed").
+			WithTag("hds_endpoint", endpoint).
+			WithTag("reason", "server is already registered").
+			WithTag("warning", "Did you or someone else just try to register the same address from another Hagall instance?"))
+		return
+	}
+
+	id := r.Header.Get(httpcmn.HeaderHagallIDKey)
+	secret := r.Header.Get(httpcmn.HeaderHagallJWTSecretHeaderKey)
+	if id == "" || secret == "" {
+		httpcmn.BadRequest(w, errors.New("server registration failed").
+			WithTag("hds_endpoint", endpoint).
+			WithTag("server_id", id))
+		return
+	}
+
+	now := c.now()
+	c.mutex.Lock()
+	reg := c.registrations[endpoint]
+	reg.serverID = id
+	reg.secret = secret
+	reg.lastHealthCheck = now
+	c.mutex.Unlock()
+
+	c.SetLastHealthCheck(now)
+	c.setRegistrationStatusFor(endpoint, RegistrationStatusRegistered)
+	c.emit(Event{
+		Type:        EventTypeSecretRotated,
+		Status:      RegistrationStatusRegistered,
+		ServerID:    id,
+		HDSEndpoint: endpoint,
+	})
+
+	httpcmn.OK(w)
+
+	logs.WithTag("server_id", id).
+		WithTag("hds_endpoint", endpoint).
+		WithTag("status", c.GetRegistrationStatus()).
+		Info("hagall verification completed")
+}
+
+// pairAll registers the server with each HDS endpoint.
+func (c *Client) pairAll(ctx context.Context, in PairIn) error {
+	ctx, stop := c.startPairing(ctx)
+	defer stop()
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	c.mutex.Lock()
+	c.quorum = in.Quorum
+	c.mutex.Unlock()
+
+	quorum := in.Quorum
+	if quorum <= 0 || quorum > len(c.endpoints) {
+		quorum = len(c.endpoints)
+	}
+
+	errs := make(chan error, len(c.endpoints))
+	for _, e := range c.endpoints {
+		s := NewSupervisor(c, in, WithGiveUpBehavior(GiveUpFail))
+		s.endpoint = e.url
+		if err := s.Start(ctx); err != nil {
+			return err
+		}
+
+		go func() {
+			errs <- s.Wait()
+		}()
+	}
+
+	failed := 0
+	for range c.endpoints {
+		err := <-errs
+		if ctx.Err() != nil {
+			continue
+		}
+
+		failed++
+		if len(c.endpoints)-failed < quorum {
+			cancel(errors.New("registering hagall to hds quorum failed").
+				WithTag("quorum", quorum).
+				WithTag("failed", failed).
+				Wrap(err))
+			continue
+		}
+		logs.Error(err)
+	}
+	return context.Cause(ctx)
+}
+
+// unpairAll deletes the server from each HDS endpoint it is registered with.
+func (c *Client) unpairAll(ctx context.Context, opts UnpairOptions) error {
+	transport := c.unpairTransport(opts)
+
+	var err error
+	for _, e := range c.endpoints {
+		if c.registrationStatusFor(e.url) != RegistrationStatusRegistered {
+			continue
+		}
+
+		req, rerr := http.NewRequestWithContext(withHDSEndpoint(ctx, e.url),
+			http.MethodDelete,
+			c.HDSEndpoint+"/servers",
+			nil,
+		)
+		if rerr != nil {
+			return errors.New("creating request failed").Wrap(rerr)
+		}
+
+		if derr := c.doWithTransport(req, transport, nil); derr != nil {
+			err = errors.New("delete server failed").
+				WithTag("hds_endpoint", e.url).
+				Wrap(derr)
+			logs.Error(err)
+			continue
+		}
+		c.setRegistrationStatusFor(e.url, RegistrationStatusInit)
+	}
+
+	if err != nil {
+		return err
+	}
+	logs.Info("unpair succeed")
+	return nil
+}
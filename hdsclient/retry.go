@@ -0,0 +1,188 @@
+package hdsclient
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aukilabs/go-tooling/pkg/errors"
+	"github.com/aukilabs/go-tooling/pkg/logs"
+)
+
+// RetryPolicy describes how requests to the Hagall Discovery Service are
+// retried when they fail with a network error, a 429 or a 5xx status code.
+//
+// The zero value disables retries.
+type RetryPolicy struct {
+	// The maximum number of attempts, including the first one. Values lower
+	// than 2 disable retries.
+	MaxAttempts int
+
+	// The delay before the first retry.
+	InitialInterval time.Duration
+
+	// The upper bound of the delay between two attempts. Optional.
+	MaxInterval time.Duration
+
+	// The factor applied to the delay after each attempt. Defaults to 2.
+	Multiplier float64
+
+	// The randomization factor, between 0 and 1, applied to each delay.
+	Jitter float64
+
+	// The maximum time spent retrying a request, starting from the first
+	// attempt. Optional.
+	MaxElapsedTime time.Duration
+}
+
+// DefaultRetryPolicy returns a retry policy suited to ride out short HDS
+// unavailabilities.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:     5,
+		InitialInterval: 200 * time.Millisecond,
+		MaxInterval:     5 * time.Second,
+		Multiplier:      2,
+		Jitter:          0.2,
+		MaxElapsedTime:  30 * time.Second,
+	}
+}
+
+func (p RetryPolicy) enabled() bool {
+	return p.MaxAttempts > 1
+}
+
+// backoff returns the delay to wait after the given failed attempt. attempt
+// starts at 1.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier <= 0 {
+		multiplier = 2
+	}
+
+	delay := float64(p.InitialInterval) * math.Pow(multiplier, float64(attempt-1))
+	if p.MaxInterval > 0 && delay > float64(p.MaxInterval) {
+		delay = float64(p.MaxInterval)
+	}
+
+	if p.Jitter > 0 {
+		jitter := math.Min(p.Jitter, 1)
+		delay += delay * jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(delay)
+}
+
+// retryDelay returns how long to wait before sending the request again, or
+// false when the request should not be retried.
+func (p RetryPolicy) retryDelay(attempt int, start time.Time, err error) (time.Duration, bool) {
+	if attempt >= p.MaxAttempts || !isRetryableError(err) {
+		return 0, false
+	}
+
+	delay := p.backoff(attempt)
+	if retryAfter := retryAfterFromError(err); retryAfter > delay {
+		delay = retryAfter
+	}
+
+	if p.MaxElapsedTime > 0 && time.Since(start)+delay > p.MaxElapsedTime {
+		return 0, false
+	}
+	return delay, true
+}
+
+// doWithRetry calls fn until it succeeds or until the retry policy gives up.
+func (c *Client) doWithRetry(req *http.Request, fn func(*http.Request) error) error {
+	start := time.Now()
+
+	for attempt := 1; ; attempt++ {
+		err := fn(req)
+		if err == nil || !c.RetryPolicy.enabled() {
+			return err
+		}
+
+		delay, ok := c.RetryPolicy.retryDelay(attempt, start, err)
+		if !ok {
+			return err
+		}
+
+		if req, err = rewindRequest(req); err != nil {
+			return err
+		}
+
+		logs.WithTag("method", req.Method).
+			WithTag("path", req.URL.Path).
+			WithTag("attempt", attempt).
+			WithTag("delay", delay).
+			Debug("retrying hds request")
+
+		if err := sleep(req.Context(), delay); err != nil {
+			return err
+		}
+	}
+}
+
+// rewindRequest returns a copy of the given request with a fresh body.
+func rewindRequest(req *http.Request) (*http.Request, error) {
+	r := req.Clone(req.Context())
+	if req.Body == nil || req.Body == http.NoBody {
+		return r, nil
+	}
+
+	if req.GetBody == nil {
+		return nil, errors.New("request body cannot be rewound").
+			WithTag("method", req.Method).
+			WithTag("path", req.URL.Path)
+	}
+
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, errors.New("rewinding request body failed").Wrap(err)
+	}
+	r.Body = body
+	return r, nil
+}
+
+// parseRetryAfter parses a Retry-After header value, expressed either in
+// seconds or as an HTTP date.
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(v); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+func retryAfterFromError(err error) time.Duration {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.RetryAfter
+	}
+	return 0
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
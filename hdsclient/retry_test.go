@@ -0,0 +1,196 @@
+package hdsclient
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	hsmoketest "github.com/aukilabs/hagall-common/smoketest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientRetryPolicy(t *testing.T) {
+	setupTestLog(t)
+
+	policy := RetryPolicy{
+		MaxAttempts:     3,
+		InitialInterval: 10 * time.Millisecond,
+		MaxInterval:     50 * time.Millisecond,
+	}
+
+	t.Run("retries are disabled by default", func(t *testing.T) {
+		var calls int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer server.Close()
+
+		client := NewClient(WithHDSEndpoint(server.URL))
+		err := client.Get(context.Background(), "/servers", nil)
+		require.Error(t, err)
+		require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	})
+
+	t.Run("retries server errors until success", func(t *testing.T) {
+		var calls int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&calls, 1) < 3 {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			w.Write([]byte(`[{"id":"0x1"}]`))
+		}))
+		defer server.Close()
+
+		client := NewClient(WithHDSEndpoint(server.URL), WithRetryPolicy(policy))
+
+		var servers GetServersResponse
+		err := client.Get(context.Background(), "/servers", &servers)
+		require.NoError(t, err)
+		require.Equal(t, int32(3), atomic.LoadInt32(&calls))
+		require.Len(t, servers, 1)
+	})
+
+	t.Run("request body is sent again on retry", func(t *testing.T) {
+		var calls int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+
+			var res hsmoketest.SmokeTestResults
+			require.NoError(t, json.Unmarshal(body, &res))
+			require.Equal(t, "http://to", res.ToEndpoint)
+
+			if atomic.AddInt32(&calls, 1) == 1 {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		}))
+		defer server.Close()
+
+		client := NewClient(WithHDSEndpoint(server.URL), WithRetryPolicy(policy))
+		err := client.SendSmokeTestResult(context.Background(), hsmoketest.SmokeTestResults{
+			ToEndpoint: "http://to",
+		})
+		require.NoError(t, err)
+		require.Equal(t, int32(2), atomic.LoadInt32(&calls))
+	})
+
+	t.Run("client errors are not retried", func(t *testing.T) {
+		var calls int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+			w.WriteHeader(http.StatusBadRequest)
+		}))
+		defer server.Close()
+
+		client := NewClient(WithHDSEndpoint(server.URL), WithRetryPolicy(policy))
+		err := client.Delete(context.Background(), "/servers")
+		require.Error(t, err)
+		require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	})
+
+	t.Run("gives up after max attempts", func(t *testing.T) {
+		var calls int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer server.Close()
+
+		client := NewClient(WithHDSEndpoint(server.URL), WithRetryPolicy(policy))
+		err := client.Post(context.Background(), "/sessions", PostSessionIn{ID: "42"})
+		require.Error(t, err)
+		require.Equal(t, int32(3), atomic.LoadInt32(&calls))
+	})
+
+	t.Run("retry after header is honored", func(t *testing.T) {
+		var calls int32
+		var firstCall time.Time
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&calls, 1) == 1 {
+				firstCall = time.Now()
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			require.GreaterOrEqual(t, time.Since(firstCall), time.Second)
+		}))
+		defer server.Close()
+
+		client := NewClient(WithHDSEndpoint(server.URL), WithRetryPolicy(policy))
+		err := client.GetWithAuth(context.Background(), "/servers", "key", "secret", nil, nil)
+		require.NoError(t, err)
+		require.Equal(t, int32(2), atomic.LoadInt32(&calls))
+	})
+
+	t.Run("max elapsed time stops retries", func(t *testing.T) {
+		var calls int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+			w.Header().Set("Retry-After", "10")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer server.Close()
+
+		p := policy
+		p.MaxElapsedTime = time.Second
+
+		client := NewClient(WithHDSEndpoint(server.URL), WithRetryPolicy(p))
+		err := client.Get(context.Background(), "/servers", nil)
+		require.Error(t, err)
+		require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	})
+
+	t.Run("context cancellation stops retries", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer server.Close()
+
+		p := policy
+		p.InitialInterval = time.Minute
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		client := NewClient(WithHDSEndpoint(server.URL), WithRetryPolicy(p))
+		err := client.Get(ctx, "/servers", nil)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := RetryPolicy{
+		InitialInterval: 100 * time.Millisecond,
+		MaxInterval:     time.Second,
+		Multiplier:      2,
+	}
+
+	require.Equal(t, 100*time.Millisecond, p.backoff(1))
+	require.Equal(t, 200*time.Millisecond, p.backoff(2))
+	require.Equal(t, 400*time.Millisecond, p.backoff(3))
+	require.Equal(t, time.Second, p.backoff(10))
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		d := p.backoff(1)
+		require.GreaterOrEqual(t, d, 50*time.Millisecond)
+		require.LessOrEqual(t, d, 150*time.Millisecond)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	require.Equal(t, time.Duration(0), parseRetryAfter(""))
+	require.Equal(t, time.Duration(0), parseRetryAfter("-1"))
+	require.Equal(t, 3*time.Second, parseRetryAfter("3"))
+
+	date := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	d := parseRetryAfter(date)
+	require.Greater(t, d, 59*time.Minute)
+}
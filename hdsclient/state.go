@@ -0,0 +1,271 @@
+package hdsclient
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/aukilabs/go-tooling/pkg/errors"
+	"github.com/aukilabs/go-tooling/pkg/logs"
+	"github.com/aukilabs/hagall-common/crypt"
+)
+
+const (
+	// The minimum interval between two saves of the server state caused by
+	// health checks only. Identity changes are always saved.
+	stateSaveInterval = 30 * time.Second
+)
+
+var (
+	// Error returned by a StateStore when there is no persisted state.
+	ErrStateNotFound = errors.New("server state not found")
+
+	// Error returned by Pair and Supervisor.Start when a state store is set
+	// along with several HDS endpoints. Registrations to several HDS are not
+	// persisted.
+	ErrStateStoreWithHDSEndpoints = errors.New("state store is not supported with several hds endpoints")
+)
+
+// ServerState represents the identity attributed by HDS to a Hagall server.
+type ServerState struct {
+	// The server ID attributed by HDS.
+	ServerID string `json:"server_id"`
+
+	// The JWT secret attributed by HDS.
+	Secret string `json:"secret"`
+
+	// The endpoint the server was registered with.
+	Endpoint string `json:"endpoint"`
+
+	// The time when HDS performed the latest health check.
+	LastHealthCheck time.Time `json:"last_health_check"`
+}
+
+// resumable reports whether the state can be used at the given time to resume
+// a registration to the given endpoint without registering again.
+func (s ServerState) resumable(endpoint string, healthCheckTTL time.Duration, now time.Time) bool {
+	return s.ServerID != "" &&
+		s.Secret != "" &&
+		s.Endpoint == endpoint &&
+		now.Sub(s.LastHealthCheck) <= healthCheckTTL
+}
+
+// StateStore is the interface that describes a storage for the server state.
+type StateStore interface {
+	// Returns the persisted state. Returns ErrStateNotFound when no state was
+	// persisted.
+	Load() (ServerState, error)
+
+	// Persists the given state.
+	Save(ServerState) error
+}
+
+// FileStateStore is a StateStore that persists the server state in a file.
+//
+// Writes are atomic: the state is written to a temporary file that replaces the
+// previous one once fully written.
+type FileStateStore struct {
+	path  string
+	key   []byte
+	mutex sync.Mutex
+}
+
+// NewFileStateStore returns a state store that persists the server state at
+// the given path. When key is not empty, the state is encrypted with
+// crypt.Encrypt and key must be a valid AES key (16, 24 or 32 bytes).
+func NewFileStateStore(path string, key []byte) *FileStateStore {
+	return &FileStateStore{
+		path: path,
+		key:  key,
+	}
+}
+
+// Load satisfies the StateStore interface.
+func (s *FileStateStore) Load() (ServerState, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	b, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return ServerState{}, ErrStateNotFound
+	}
+	if err != nil {
+		return ServerState{}, errors.New("reading server state failed").
+			WithTag("path", s.path).
+			Wrap(err)
+	}
+
+	if len(s.key) != 0 {
+		if b, err = crypt.Decrypt(b, s.key); err != nil {
+			return ServerState{}, errors.New("decrypting server state failed").
+				WithTag("path", s.path).
+				Wrap(err)
+		}
+	}
+
+	var state ServerState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return ServerState{}, errors.New("decoding server state failed").
+			WithTag("path", s.path).
+			Wrap(err)
+	}
+	return state, nil
+}
+
+// Save satisfies the StateStore interface.
+func (s *FileStateStore) Save(state ServerState) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	b, err := json.Marshal(state)
+	if err != nil {
+		return errors.New("encoding server state failed").Wrap(err)
+	}
+
+	if len(s.key) != 0 {
+		if b, err = crypt.Encrypt(b, s.key); err != nil {
+			return errors.New("encrypting server state failed").Wrap(err)
+		}
+	}
+
+	dir := filepath.Dir(s.path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errors.New("creating server state directory failed").
+			WithTag("dir", dir).
+			Wrap(err)
+	}
+
+	f, err := os.CreateTemp(dir, filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return errors.New("creating temporary server state file failed").
+			WithTag("dir", dir).
+			Wrap(err)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return errors.New("writing server state failed").
+			WithTag("path", f.Name()).
+			Wrap(err)
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return errors.New("syncing server state failed").
+			WithTag("path", f.Name()).
+			Wrap(err)
+	}
+
+	if err := f.Close(); err != nil {
+		return errors.New("closing server state file failed").
+			WithTag("path", f.Name()).
+			Wrap(err)
+	}
+
+	if err := os.Rename(f.Name(), s.path); err != nil {
+		return errors.New("replacing server state failed").
+			WithTag("path", s.path).
+			Wrap(err)
+	}
+	return nil
+}
+
+// State returns the current server state.
+func (c *Client) State() ServerState {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return ServerState{
+		ServerID:        c.serverID,
+		Secret:          c.secret,
+		Endpoint:        c.registrationEndpoint,
+		LastHealthCheck: c.lastHealthCheck,
+	}
+}
+
+// checkStateStore returns an error when the state store cannot be used with
+// the client endpoints.
+func (c *Client) checkStateStore() error {
+	if c.stateStore != nil && c.multiHDS() {
+		return ErrStateStoreWithHDSEndpoints
+	}
+	return nil
+}
+
+// saveState persists the current server state when a state store is set.
+func (c *Client) saveState() {
+	if c.stateStore == nil {
+		return
+	}
+
+	state := c.State()
+	if err := c.stateStore.Save(state); err != nil {
+		logs.Error(errors.New("saving server state failed").Wrap(err))
+		return
+	}
+
+	c.mutex.Lock()
+	c.stateSavedAt = state.LastHealthCheck
+	c.mutex.Unlock()
+}
+
+// saveHealthCheckState persists the current server state after a health check
+// when the persisted health check time is older than stateSaveInterval.
+func (c *Client) saveHealthCheckState() {
+	if c.stateStore == nil {
+		return
+	}
+
+	c.mutex.RLock()
+	save := c.lastHealthCheck.Sub(c.stateSavedAt) >= stateSaveInterval
+	c.mutex.RUnlock()
+
+	if save {
+		c.saveState()
+	}
+}
+
+// restoreState restores the server state persisted in the state store when it
+// is still valid for the given endpoint. It returns true when the state is
+// restored.
+func (c *Client) restoreState(endpoint string, healthCheckTTL time.Duration) bool {
+	if c.stateStore == nil {
+		return false
+	}
+
+	state, err := c.stateStore.Load()
+	if errors.Is(err, ErrStateNotFound) {
+		return false
+	}
+	if err != nil {
+		logs.Warn(errors.New("loading server state failed").Wrap(err))
+		return false
+	}
+
+	if !state.resumable(endpoint, healthCheckTTL, c.now()) {
+		logs.WithTag("server_id", state.ServerID).
+			WithTag("endpoint", state.Endpoint).
+			WithTag("last_health_check", state.LastHealthCheck).
+			Debug("persisted server state is expired")
+		return false
+	}
+
+	c.mutex.Lock()
+	c.serverID = state.ServerID
+	c.secret = state.Secret
+	c.registrationEndpoint = state.Endpoint
+	c.lastHealthCheck = state.LastHealthCheck
+	c.stateSavedAt = state.LastHealthCheck
+	c.mutex.Unlock()
+
+	c.setRegistrationStatus(RegistrationStatusRegistered)
+
+	logs.WithTag("server_id", state.ServerID).
+		WithTag("endpoint", state.Endpoint).
+		WithTag("last_health_check", state.LastHealthCheck).
+		Info("hagall server state restored")
+	return true
+}
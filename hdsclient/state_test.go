@@ -0,0 +1,286 @@
+package hdsclient
+
+import (
+	"context"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	httpcmn "github.com/aukilabs/hagall-common/http"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileStateStore(t *testing.T) {
+	state := ServerState{
+		ServerID:        "0x1",
+		Secret:          httpcmn.MakeJWTSecret(),
+		Endpoint:        "http://test",
+		LastHealthCheck: time.Now().UTC().Truncate(time.Second),
+	}
+
+	t.Run("load without state returns not found", func(t *testing.T) {
+		store := NewFileStateStore(filepath.Join(t.TempDir(), "state.json"), nil)
+		_, err := store.Load()
+		require.ErrorIs(t, err, ErrStateNotFound)
+	})
+
+	t.Run("save and load", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "hagall", "state.json")
+		store := NewFileStateStore(path, nil)
+		require.NoError(t, store.Save(state))
+
+		loaded, err := store.Load()
+		require.NoError(t, err)
+		require.Equal(t, state, loaded)
+
+		entries, err := os.ReadDir(filepath.Dir(path))
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+	})
+
+	t.Run("save and load encrypted", func(t *testing.T) {
+		key := make([]byte, 32)
+		_, err := rand.Read(key)
+		require.NoError(t, err)
+
+		path := filepath.Join(t.TempDir(), "state")
+		store := NewFileStateStore(path, key)
+		require.NoError(t, store.Save(state))
+
+		b, err := os.ReadFile(path)
+		require.NoError(t, err)
+		require.NotContains(t, string(b), state.Secret)
+
+		loaded, err := store.Load()
+		require.NoError(t, err)
+		require.Equal(t, state, loaded)
+
+		_, err = NewFileStateStore(path, make([]byte, 32)).Load()
+		require.Error(t, err)
+	})
+}
+
+func TestClientPairWithStateStore(t *testing.T) {
+	setupTestLog(t)
+
+	t.Run("pair resumes persisted identity", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+
+		var calls int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+		}))
+		defer server.Close()
+
+		store := NewFileStateStore(filepath.Join(t.TempDir(), "state.json"), nil)
+		require.NoError(t, store.Save(ServerState{
+			ServerID:        "0x1",
+			Secret:          "secret",
+			Endpoint:        "http://test",
+			LastHealthCheck: time.Now(),
+		}))
+
+		client := NewClient(
+			WithHagallEndpoint("http://test"),
+			WithHDSEndpoint(server.URL),
+			WithStateStore(store),
+		)
+
+		err := client.Pair(ctx, PairIn{
+			HealthCheckTTL:       time.Minute,
+			RegistrationInterval: 10 * time.Millisecond,
+			RegistrationRetries:  1,
+		})
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		require.Zero(t, atomic.LoadInt32(&calls))
+		require.Equal(t, RegistrationStatusRegistered, client.GetRegistrationStatus())
+		require.Equal(t, "0x1", client.ServerID())
+		require.Equal(t, "secret", client.Secret())
+	})
+
+	t.Run("pair resumes persisted identity with the client clock", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+
+		var calls int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+		}))
+		defer server.Close()
+
+		clock := newFakeClock()
+		store := NewFileStateStore(filepath.Join(t.TempDir(), "state.json"), nil)
+		require.NoError(t, store.Save(ServerState{
+			ServerID:        "0x1",
+			Secret:          "secret",
+			Endpoint:        "http://test",
+			LastHealthCheck: clock.Now().Add(-30 * time.Second),
+		}))
+
+		client := NewClient(
+			WithHagallEndpoint("http://test"),
+			WithHDSEndpoint(server.URL),
+			WithStateStore(store),
+			WithClock(clock),
+		)
+
+		err := client.Pair(ctx, PairIn{
+			HealthCheckTTL:       time.Minute,
+			RegistrationInterval: 10 * time.Millisecond,
+			RegistrationRetries:  1,
+		})
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		require.Zero(t, atomic.LoadInt32(&calls))
+		require.Equal(t, RegistrationStatusRegistered, client.GetRegistrationStatus())
+		require.Equal(t, "0x1", client.ServerID())
+	})
+
+	t.Run("pair registers when persisted identity is expired", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		var client *Client
+		registeredCh := make(chan struct{}, 1)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			vw := httptest.NewRecorder()
+			vr := httptest.NewRequest(http.MethodPost, "/registrations", nil)
+			vr.Header.Set(httpcmn.HeaderHagallIDKey, "0x2")
+			vr.Header.Set(httpcmn.HeaderHagallJWTSecretHeaderKey, "new-secret")
+			vr.Header.Set(httpcmn.HeaderHagallRegistrationStateKey, client.GetRegistrationState())
+			client.HandleServerRegistration(vw, vr)
+			require.Equal(t, http.StatusOK, vw.Code)
+			registeredCh <- struct{}{}
+		}))
+		defer server.Close()
+
+		store := NewFileStateStore(filepath.Join(t.TempDir(), "state.json"), nil)
+		require.NoError(t, store.Save(ServerState{
+			ServerID:        "0x1",
+			Secret:          "secret",
+			Endpoint:        "http://test",
+			LastHealthCheck: time.Now().Add(-time.Hour),
+		}))
+
+		client = NewClient(
+			WithHagallEndpoint("http://test"),
+			WithHDSEndpoint(server.URL),
+			WithStateStore(store),
+		)
+
+		pairCh := make(chan error)
+		go func() {
+			pairCh <- client.Pair(ctx, PairIn{
+				HealthCheckTTL:       time.Minute,
+				RegistrationInterval: 10 * time.Millisecond,
+				RegistrationRetries:  1,
+			})
+		}()
+		<-registeredCh
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+		require.ErrorIs(t, <-pairCh, context.Canceled)
+
+		state, err := store.Load()
+		require.NoError(t, err)
+		require.Equal(t, "0x2", state.ServerID)
+		require.Equal(t, "new-secret", state.Secret)
+		require.Equal(t, "http://test", state.Endpoint)
+		require.WithinDuration(t, time.Now(), state.LastHealthCheck, time.Second)
+	})
+
+	t.Run("state store is rejected with several hds endpoints", func(t *testing.T) {
+		var calls int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+		}))
+		defer server.Close()
+
+		client := NewClient(
+			WithHagallEndpoint("http://test"),
+			WithHDSEndpoints(server.URL, server.URL+"/hds2"),
+			WithStateStore(&countingStateStore{}),
+		)
+
+		err := client.Pair(context.Background(), PairIn{
+			HealthCheckTTL:       time.Minute,
+			RegistrationInterval: 10 * time.Millisecond,
+			RegistrationRetries:  1,
+		})
+		require.ErrorIs(t, err, ErrStateStoreWithHDSEndpoints)
+
+		err = NewSupervisor(client, PairIn{}).Start(context.Background())
+		require.ErrorIs(t, err, ErrStateStoreWithHDSEndpoints)
+		require.Zero(t, atomic.LoadInt32(&calls))
+	})
+}
+
+func TestClientSaveState(t *testing.T) {
+	setupTestLog(t)
+
+	store := &countingStateStore{}
+	clock := newFakeClock()
+	client := NewClient(
+		WithHagallEndpoint("http://test"),
+		WithStateStore(store),
+		WithClock(clock),
+	)
+
+	client.SetServerData("0x1", "secret")
+	require.Equal(t, 1, store.Saves())
+
+	client.SetLastHealthCheck(clock.Now())
+	require.Equal(t, 2, store.Saves())
+
+	for i := 0; i < 5; i++ {
+		clock.Advance(5 * time.Second)
+		client.SetLastHealthCheck(clock.Now())
+	}
+	require.Equal(t, 2, store.Saves())
+
+	clock.Advance(5 * time.Second)
+	client.SetLastHealthCheck(clock.Now())
+	require.Equal(t, 3, store.Saves())
+	require.Equal(t, clock.Now(), store.State().LastHealthCheck)
+
+	client.SetServerData("0x2", "new-secret")
+	require.Equal(t, 4, store.Saves())
+	require.Equal(t, "0x2", store.State().ServerID)
+}
+
+type countingStateStore struct {
+	mutex sync.Mutex
+	state ServerState
+	saves int
+}
+
+func (s *countingStateStore) Load() (ServerState, error) {
+	return ServerState{}, ErrStateNotFound
+}
+
+func (s *countingStateStore) Save(state ServerState) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.state = state
+	s.saves++
+	return nil
+}
+
+func (s *countingStateStore) Saves() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.saves
+}
+
+func (s *countingStateStore) State() ServerState {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.state
+}
@@ -0,0 +1,454 @@
+package hdsclient
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/aukilabs/go-tooling/pkg/errors"
+	"github.com/aukilabs/go-tooling/pkg/logs"
+	"github.com/aukilabs/hagall-common/crypt"
+)
+
+const (
+	defaultMaxRegistrationBackoff = time.Minute
+)
+
+var (
+	errSupervisorStopped = errors.New("supervisor stopped")
+)
+
+// GiveUpBehavior describes what a supervisor does once the registration
+// retries are exhausted.
+type GiveUpBehavior int
+
+const (
+	// The supervisor fails once RegistrationRetries consecutive registration
+	// attempts failed. Failing to sign the endpoint counts as a failed
+	// attempt.
+	GiveUpFail GiveUpBehavior = iota
+
+	// The supervisor keeps retrying to register, waiting at most the maximum
+	// backoff between two attempts.
+	GiveUpRetry
+)
+
+// SupervisorState represents the state of a supervisor.
+type SupervisorState int
+
+const (
+	SupervisorStateIdle SupervisorState = iota
+	SupervisorStateRegistering
+	SupervisorStatePendingVerification
+	SupervisorStateRegistered
+	SupervisorStateBackoff
+	SupervisorStateStopped
+	SupervisorStateFailed
+)
+
+func (s SupervisorState) String() string {
+	switch s {
+	case SupervisorStateIdle:
+		return "idle"
+	case SupervisorStateRegistering:
+		return "registering"
+	case SupervisorStatePendingVerification:
+		return "pending_verification"
+	case SupervisorStateRegistered:
+		return "registered"
+	case SupervisorStateBackoff:
+		return "backoff"
+	case SupervisorStateStopped:
+		return "stopped"
+	case SupervisorStateFailed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
+type SupervisorOpts func(*Supervisor)
+
+// WithGiveUpBehavior sets what the supervisor does once the registration
+// retries are exhausted. Defaults to GiveUpFail.
+func WithGiveUpBehavior(v GiveUpBehavior) SupervisorOpts {
+	return func(s *Supervisor) {
+		s.giveUp = v
+	}
+}
+
+// WithMaxBackoff sets the maximum delay between two registration attempts.
+// Defaults to 1 minute.
+func WithMaxBackoff(v time.Duration) SupervisorOpts {
+	return func(s *Supervisor) {
+		s.maxBackoff = v
+	}
+}
+
+// Supervisor keeps a Hagall server registered to HDS.
+//
+// It registers the server, waits for HDS to verify it and then runs a
+// watchdog that registers the server again when health checks stop arriving
+// within the health check TTL. Failed registrations are retried with a linear
+// backoff capped by the maximum backoff.
+type Supervisor struct {
+	client     *Client
+	in         PairIn
+	endpoint   string
+	giveUp     GiveUpBehavior
+	maxBackoff time.Duration
+
+	mutex   sync.RWMutex
+	state   SupervisorState
+	started bool
+	cancel  context.CancelCauseFunc
+	done    chan struct{}
+	err     error
+
+	// Only accessed by the run loop.
+	registration  Timer
+	watchdog      Timer
+	attempts      int
+	registrations int
+}
+
+// NewSupervisor creates a supervisor that registers the client to HDS with
+// the given input.
+func NewSupervisor(client *Client, in PairIn, opts ...SupervisorOpts) *Supervisor {
+	if in.Endpoint == "" {
+		in.Endpoint = client.HagallEndpoint
+	}
+
+	s := &Supervisor{
+		client: client,
+		in:     in,
+		done:   make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if s.maxBackoff <= 0 {
+		s.maxBackoff = defaultMaxRegistrationBackoff
+	}
+	return s
+}
+
+// Start starts supervising the client registration in the background. The
+// supervision runs until the given context is canceled, Stop or Unpair is
+// called, or the registration fails.
+func (s *Supervisor) Start(ctx context.Context) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.started {
+		return errors.New("supervisor is already started")
+	}
+	if err := s.client.checkStateStore(); err != nil {
+		return err
+	}
+	s.started = true
+
+	stopPairing := func() {}
+	if s.endpoint == "" {
+		ctx, stopPairing = s.client.startPairing(ctx)
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	s.cancel = cancel
+
+	go func() {
+		err := s.run(ctx)
+		cancel(nil)
+		stopPairing()
+
+		s.mutex.Lock()
+		s.err = err
+		if s.state != SupervisorStateFailed {
+			s.state = SupervisorStateStopped
+		}
+		s.mutex.Unlock()
+
+		close(s.done)
+	}()
+	return nil
+}
+
+// Stop stops the supervision and waits for it to return.
+func (s *Supervisor) Stop() {
+	s.mutex.RLock()
+	cancel := s.cancel
+	s.mutex.RUnlock()
+
+	if cancel == nil {
+		return
+	}
+	cancel(errSupervisorStopped)
+	<-s.done
+}
+
+// Wait waits for the supervision to return. It returns nil when stopped by
+// Stop, the cause of the context cancellation, ErrUnpaired when stopped by
+// Unpair, or the registration error when the registration failed.
+func (s *Supervisor) Wait() error {
+	s.mutex.RLock()
+	started := s.started
+	s.mutex.RUnlock()
+
+	if !started {
+		return errors.New("supervisor is not started")
+	}
+	<-s.done
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if errors.Is(s.err, errSupervisorStopped) {
+		return nil
+	}
+	return s.err
+}
+
+// State returns the current supervisor state.
+func (s *Supervisor) State() SupervisorState {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.state
+}
+
+func (s *Supervisor) setState(v SupervisorState) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.state = v
+}
+
+func (s *Supervisor) run(ctx context.Context) error {
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+
+	c := s.client
+	clock := c.getClock()
+
+	events, unsubscribe := c.Subscribe(0)
+	defer unsubscribe()
+
+	s.registration = clock.NewTimer(0)
+	defer s.registration.Stop()
+
+	s.watchdog = clock.NewTimer(s.in.HealthCheckTTL)
+	s.watchdog.Stop()
+	defer s.watchdog.Stop()
+
+	if s.endpoint == "" && c.restoreState(s.in.Endpoint, s.in.HealthCheckTTL) {
+		s.registered()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return context.Cause(ctx)
+
+		case <-s.registration.C():
+			if err := s.register(ctx); err != nil {
+				return err
+			}
+
+		case <-s.watchdog.C():
+			if !s.healthy() {
+				logs.WithTag("last_health_check", c.lastHealthCheckFor(s.endpoint)).
+					WithTag("hds_endpoint", s.endpoint).
+					WithTag("health_check_ttl", s.in.HealthCheckTTL).
+					Warn("hds health checks stopped, registering hagall again")
+
+				s.registration.Stop()
+				if err := s.register(ctx); err != nil {
+					return err
+				}
+				continue
+			}
+			s.armWatchdog()
+
+		case e := <-events:
+			if e.HDSEndpoint != s.endpoint {
+				continue
+			}
+
+			switch e.Type {
+			case EventTypeSecretRotated:
+				s.registered()
+
+			case EventTypeHealthCheck:
+				if s.State() == SupervisorStateRegistered {
+					s.armWatchdog()
+				}
+			}
+		}
+	}
+}
+
+// register registers the server to HDS, unless it is registered and health
+// checked within the health check TTL.
+func (s *Supervisor) register(ctx context.Context) error {
+	c := s.client
+	in := s.in
+
+	if c.registrationStatusFor(s.endpoint) == RegistrationStatusRegistered && s.healthy() {
+		s.registered()
+		return nil
+	}
+
+	s.setState(SupervisorStateRegistering)
+	c.setRegistrationStatusFor(s.endpoint, RegistrationStatusRegistering)
+	c.resetServerDataFor(s.endpoint)
+	s.registrations++
+
+	var endpointSignature, timestamp string
+
+	if c.signer != nil {
+		sig, ts, err := crypt.SignMessageWithTimestampAndSigner(
+			ctx,
+			c.signer,
+			c.signatureScheme,
+			crypt.NewTypedDataDomain(crypt.PurposeHagallRegistration, c.chainID),
+			in.Endpoint,
+		)
+		if err != nil {
+			return s.registrationFailed(ctx, errors.New("error signing endpoint").Wrap(err))
+		}
+		endpointSignature = sig
+		timestamp = ts
+	}
+
+	logs.WithTag("registration_count", s.registrations).
+		WithTag("endpoint", in.Endpoint).
+		WithTag("version", in.Version).
+		WithTag("modules", in.Modules).
+		WithTag("feature_flags", in.FeatureFlags).
+		WithTag("endpoint_signature", endpointSignature).
+		WithTag("timestamp", timestamp).
+		WithTag("hds_endpoint", s.endpoint).
+		Debug("registering hagall to hds")
+
+	if err := c.postServerTo(ctx, s.endpoint, PostServerIn{
+		Endpoint:          in.Endpoint,
+		Version:           in.Version,
+		Modules:           in.Modules,
+		FeatureFlags:      in.FeatureFlags,
+		EndpointSignature: endpointSignature,
+		Timestamp:         timestamp,
+		SignatureScheme:   c.signatureScheme,
+		ChainID:           c.chainID,
+	}); err != nil {
+		return s.registrationFailed(ctx, err)
+	}
+
+	// HDS accepted the registration but did not call the /registrations
+	// endpoint back yet.
+	if !c.compareAndSetRegistrationStatusFor(s.endpoint, RegistrationStatusRegistering, RegistrationStatusPendingVerification) &&
+		c.registrationStatusFor(s.endpoint) == RegistrationStatusRegistered {
+		s.registered()
+	} else {
+		s.attempts++
+		s.scheduleRegistration(SupervisorStatePendingVerification)
+	}
+
+	logs.WithTag("registration_count", s.registrations).
+		WithTag("endpoint", in.Endpoint).
+		WithTag("version", in.Version).
+		WithTag("modules", in.Modules).
+		WithTag("feature_flags", in.FeatureFlags).
+		WithTag("retry_count", s.attempts).
+		WithTag("hds_endpoint", s.endpoint).
+		WithTag("status", c.registrationStatusFor(s.endpoint)).
+		Info("hagall is successfully registered to hds")
+	return nil
+}
+
+// registrationFailed handles a failed registration attempt, whether signing
+// the endpoint or posting it to HDS failed. The registration is retried with
+// a backoff until the retries are exhausted, or forever with GiveUpRetry.
+func (s *Supervisor) registrationFailed(ctx context.Context, err error) error {
+	c := s.client
+	in := s.in
+
+	if ctx.Err() != nil {
+		// Supervision is stopping.
+		return nil
+	}
+
+	c.emit(Event{
+		Type:        EventTypeRegistrationFailed,
+		Status:      c.registrationStatusFor(s.endpoint),
+		Err:         err,
+		HDSEndpoint: s.endpoint,
+	})
+	s.attempts++
+
+	if s.giveUp == GiveUpFail && s.attempts >= in.RegistrationRetries {
+		c.setRegistrationStatusFor(s.endpoint, RegistrationStatusFailed)
+		s.setState(SupervisorStateFailed)
+		return errors.New("registering hagall to hds failed").
+			WithTag("registration_count", s.registrations).
+			WithTag("endpoint", in.Endpoint).
+			WithTag("version", in.Version).
+			WithTag("modules", in.Modules).
+			WithTag("feature_flags", in.FeatureFlags).
+			WithTag("retry_count", s.attempts).
+			WithTag("hds_endpoint", s.endpoint).
+			Wrap(err)
+	}
+
+	logs.Error(err)
+	s.scheduleRegistration(SupervisorStateBackoff)
+	return nil
+}
+
+// registered stops pending registrations and arms the watchdog.
+func (s *Supervisor) registered() {
+	s.attempts = 0
+	s.registration.Stop()
+	s.armWatchdog()
+	s.setState(SupervisorStateRegistered)
+}
+
+// scheduleRegistration schedules the next registration attempt and moves to
+// the given state.
+func (s *Supervisor) scheduleRegistration(state SupervisorState) {
+	delay := s.backoff()
+	s.watchdog.Stop()
+	s.registration.Reset(delay)
+	s.setState(state)
+
+	logs.WithTag("retry_interval", delay.Seconds()).
+		WithTag("retry_count", s.attempts).
+		WithTag("state", state).
+		Debug("checking registration")
+}
+
+// armWatchdog schedules the watchdog to fire when the last health check
+// expires.
+func (s *Supervisor) armWatchdog() {
+	c := s.client
+	delay := c.lastHealthCheckFor(s.endpoint).Add(s.in.HealthCheckTTL).Sub(c.now())
+	if delay < 0 {
+		delay = 0
+	}
+	s.watchdog.Reset(delay)
+}
+
+// healthy reports whether HDS health checked the server within the health
+// check TTL.
+func (s *Supervisor) healthy() bool {
+	c := s.client
+	return c.now().Sub(c.lastHealthCheckFor(s.endpoint)) <= s.in.HealthCheckTTL
+}
+
+// backoff returns the delay before the next registration attempt.
+func (s *Supervisor) backoff() time.Duration {
+	delay := time.Duration(s.attempts) * s.in.RegistrationInterval
+	if delay > s.maxBackoff {
+		delay = s.maxBackoff
+	}
+	return delay
+}
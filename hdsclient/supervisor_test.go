@@ -0,0 +1,371 @@
+package hdsclient
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aukilabs/go-tooling/pkg/errors"
+	"github.com/aukilabs/hagall-common/crypt"
+	httpcmn "github.com/aukilabs/hagall-common/http"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSupervisor(t *testing.T) {
+	setupTestLog(t)
+
+	t.Run("watchdog registers again when health checks stop", func(t *testing.T) {
+		clock := newFakeClock()
+
+		var client *Client
+		var calls int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+
+			body, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+
+			var postBody PostServerIn
+			require.NoError(t, json.Unmarshal(body, &postBody))
+
+			vw := httptest.NewRecorder()
+			vr := httptest.NewRequest(http.MethodPost, "/registrations", nil)
+			vr.Header.Set(httpcmn.HeaderHagallIDKey, "0x1")
+			vr.Header.Set(httpcmn.HeaderHagallJWTSecretHeaderKey, httpcmn.MakeJWTSecret())
+			vr.Header.Set(httpcmn.HeaderHagallRegistrationStateKey, postBody.State)
+			client.HandleServerRegistration(vw, vr)
+			require.Equal(t, http.StatusOK, vw.Code)
+		}))
+		defer server.Close()
+
+		client = NewClient(
+			WithHagallEndpoint("http://test"),
+			WithHDSEndpoint(server.URL),
+			WithClock(clock),
+		)
+
+		s := NewSupervisor(client, PairIn{
+			HealthCheckTTL:       time.Minute,
+			RegistrationInterval: time.Second,
+			RegistrationRetries:  1,
+		})
+		require.NoError(t, s.Start(context.Background()))
+		defer s.Stop()
+
+		waitSupervisorState(t, s, SupervisorStateRegistered)
+		require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+		clock.Advance(30 * time.Second)
+		client.HandleHealthCheck(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/health", nil))
+
+		clock.Advance(45 * time.Second)
+		require.Equal(t, SupervisorStateRegistered, s.State())
+		require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+		clock.Advance(30 * time.Second)
+		require.Eventually(t, func() bool {
+			return atomic.LoadInt32(&calls) == 2
+		}, time.Second, time.Millisecond)
+		waitSupervisorState(t, s, SupervisorStateRegistered)
+	})
+
+	t.Run("keep retrying with capped backoff", func(t *testing.T) {
+		clock := newFakeClock()
+
+		var calls int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+		defer server.Close()
+
+		client := NewClient(
+			WithHagallEndpoint("http://test"),
+			WithHDSEndpoint(server.URL),
+			WithClock(clock),
+		)
+
+		s := NewSupervisor(client,
+			PairIn{
+				HealthCheckTTL:       time.Minute,
+				RegistrationInterval: time.Second,
+				RegistrationRetries:  1,
+			},
+			WithGiveUpBehavior(GiveUpRetry),
+			WithMaxBackoff(2*time.Second),
+		)
+		require.NoError(t, s.Start(context.Background()))
+
+		for i, delay := range []time.Duration{
+			time.Second,
+			2 * time.Second,
+			2 * time.Second,
+		} {
+			waitRegistrationAttempts(t, s, &calls, int32(i+1))
+
+			clock.Advance(delay - time.Millisecond)
+			require.Equal(t, int32(i+1), atomic.LoadInt32(&calls))
+			clock.Advance(time.Millisecond)
+		}
+		waitRegistrationAttempts(t, s, &calls, 4)
+
+		s.Stop()
+		require.NoError(t, s.Wait())
+		require.Equal(t, SupervisorStateStopped, s.State())
+	})
+
+	t.Run("fail when retries are exhausted", func(t *testing.T) {
+		clock := newFakeClock()
+
+		var calls int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+		defer server.Close()
+
+		client := NewClient(
+			WithHagallEndpoint("http://test"),
+			WithHDSEndpoint(server.URL),
+			WithClock(clock),
+		)
+
+		s := NewSupervisor(client, PairIn{
+			HealthCheckTTL:       time.Minute,
+			RegistrationInterval: time.Second,
+			RegistrationRetries:  2,
+		})
+		require.NoError(t, s.Start(context.Background()))
+
+		waitRegistrationAttempts(t, s, &calls, 1)
+		clock.Advance(time.Second)
+
+		require.Error(t, s.Wait())
+		require.Equal(t, int32(2), atomic.LoadInt32(&calls))
+		require.Equal(t, SupervisorStateFailed, s.State())
+		require.Equal(t, RegistrationStatusFailed, client.GetRegistrationStatus())
+	})
+
+	t.Run("keep retrying when signing fails", func(t *testing.T) {
+		clock := newFakeClock()
+
+		var client *Client
+		var calls int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+
+			var postBody PostServerIn
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&postBody))
+			require.NotEmpty(t, postBody.EndpointSignature)
+
+			vw := httptest.NewRecorder()
+			vr := httptest.NewRequest(http.MethodPost, "/registrations", nil)
+			vr.Header.Set(httpcmn.HeaderHagallIDKey, "0x1")
+			vr.Header.Set(httpcmn.HeaderHagallJWTSecretHeaderKey, httpcmn.MakeJWTSecret())
+			vr.Header.Set(httpcmn.HeaderHagallRegistrationStateKey, postBody.State)
+			client.HandleServerRegistration(vw, vr)
+			require.Equal(t, http.StatusOK, vw.Code)
+		}))
+		defer server.Close()
+
+		privateKey, err := crypto.GenerateKey()
+		require.NoError(t, err)
+		signer := &unavailableSigner{Signer: crypt.NewPrivateKeySigner(privateKey)}
+		signer.unavailable.Store(true)
+
+		client = NewClient(
+			WithHagallEndpoint("http://test"),
+			WithHDSEndpoint(server.URL),
+			WithSigner(signer),
+			WithClock(clock),
+		)
+
+		events, unsubscribe := client.Subscribe(16)
+		defer unsubscribe()
+
+		s := NewSupervisor(client,
+			PairIn{
+				HealthCheckTTL:       time.Minute,
+				RegistrationInterval: time.Second,
+				RegistrationRetries:  1,
+			},
+			WithGiveUpBehavior(GiveUpRetry),
+		)
+		require.NoError(t, s.Start(context.Background()))
+		defer s.Stop()
+
+		waitSupervisorState(t, s, SupervisorStateBackoff)
+		e := <-events
+		for e.Type != EventTypeRegistrationFailed {
+			e = <-events
+		}
+		require.Error(t, e.Err)
+		require.Equal(t, int32(0), atomic.LoadInt32(&calls))
+
+		signer.unavailable.Store(false)
+		clock.Advance(time.Second)
+		waitSupervisorState(t, s, SupervisorStateRegistered)
+		require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	})
+
+	t.Run("unpair stops the supervisor", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+		defer server.Close()
+
+		client := NewClient(
+			WithHagallEndpoint("http://test"),
+			WithHDSEndpoint(server.URL),
+			WithClock(newFakeClock()),
+		)
+
+		s := NewSupervisor(client,
+			PairIn{
+				HealthCheckTTL:       time.Minute,
+				RegistrationInterval: time.Second,
+			},
+			WithGiveUpBehavior(GiveUpRetry),
+		)
+		require.NoError(t, s.Start(context.Background()))
+		require.Error(t, s.Start(context.Background()))
+
+		require.NoError(t, client.Unpair(context.Background()))
+		require.ErrorIs(t, s.Wait(), ErrUnpaired)
+		require.Equal(t, SupervisorStateStopped, s.State())
+	})
+
+	t.Run("wait without start returns an error", func(t *testing.T) {
+		s := NewSupervisor(NewClient(), PairIn{})
+		require.Error(t, s.Wait())
+		s.Stop()
+	})
+}
+
+func waitSupervisorState(t *testing.T, s *Supervisor, state SupervisorState) {
+	require.Eventually(t, func() bool {
+		return s.State() == state
+	}, time.Second, time.Millisecond)
+}
+
+// waitRegistrationAttempts waits until the supervisor scheduled a new
+// registration after the given number of failed attempts.
+func waitRegistrationAttempts(t *testing.T, s *Supervisor, calls *int32, n int32) {
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(calls) == n && s.State() == SupervisorStateBackoff
+	}, time.Second, time.Millisecond)
+}
+
+// unavailableSigner is a signer that fails while it is unavailable.
+type unavailableSigner struct {
+	crypt.Signer
+	unavailable atomic.Bool
+}
+
+func (s *unavailableSigner) SignHash(ctx context.Context, hash []byte) ([]byte, error) {
+	if s.unavailable.Load() {
+		return nil, errors.New("signer is unavailable")
+	}
+	return s.Signer.SignHash(ctx, hash)
+}
+
+type fakeClock struct {
+	mutex  sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{
+		now: time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC),
+	}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) Timer {
+	t := &fakeTimer{
+		clock: c,
+		c:     make(chan time.Time, 1),
+	}
+	t.Reset(d)
+
+	c.mutex.Lock()
+	c.timers = append(c.timers, t)
+	c.mutex.Unlock()
+	return t
+}
+
+// Advance moves the clock forward and fires the expired timers.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.now = c.now.Add(d)
+	for _, t := range c.timers {
+		if t.active && !t.deadline.After(c.now) {
+			t.fire(c.now)
+		}
+	}
+}
+
+type fakeTimer struct {
+	clock    *fakeClock
+	c        chan time.Time
+	deadline time.Time
+	active   bool
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+
+	active := t.active
+	t.drain()
+	t.deadline = t.clock.now.Add(d)
+	t.active = true
+	if d <= 0 {
+		t.fire(t.clock.now)
+	}
+	return active
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+
+	active := t.active
+	t.active = false
+	t.drain()
+	return active
+}
+
+func (t *fakeTimer) fire(now time.Time) {
+	t.active = false
+	select {
+	case t.c <- now:
+	default:
+	}
+}
+
+func (t *fakeTimer) drain() {
+	select {
+	case <-t.c:
+	default:
+	}
+}
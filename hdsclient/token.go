@@ -0,0 +1,290 @@
+package hdsclient
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/aukilabs/go-tooling/pkg/errors"
+	"github.com/aukilabs/go-tooling/pkg/logs"
+	httpcmn "github.com/aukilabs/hagall-common/http"
+	hwebsocket "github.com/aukilabs/hagall-common/websocket"
+)
+
+const (
+	defaultTokenRefreshBefore = time.Minute
+	defaultTokenExpiryLeeway  = 5 * time.Second
+	defaultTokenFetchTimeout  = 30 * time.Second
+
+	// The minimum delay between two background refreshes of a token.
+	minTokenRefreshDelay = time.Second
+)
+
+// Token represents a cached user access token.
+type Token struct {
+	AccessToken string
+	ExpiresAt   time.Time
+}
+
+// Expired reports whether the token is expired at the given time.
+func (t Token) Expired(now time.Time) bool {
+	return t.AccessToken == "" || !now.Before(t.ExpiresAt)
+}
+
+type TokenSourceOpts func(*TokenSource)
+
+// WithTokenRefreshBefore sets the duration before expiry at which a token is
+// refreshed in the background. Defaults to 1 minute.
+func WithTokenRefreshBefore(v time.Duration) TokenSourceOpts {
+	return func(s *TokenSource) {
+		s.refreshBefore = v
+	}
+}
+
+// WithTokenExpiryLeeway sets the duration before expiry from which a token is
+// not handed out anymore. Defaults to 5 seconds.
+func WithTokenExpiryLeeway(v time.Duration) TokenSourceOpts {
+	return func(s *TokenSource) {
+		s.expiryLeeway = v
+	}
+}
+
+// WithTokenFetchTimeout sets the maximum duration of a token fetch. Defaults to
+// 30 seconds.
+func WithTokenFetchTimeout(v time.Duration) TokenSourceOpts {
+	return func(s *TokenSource) {
+		s.fetchTimeout = v
+	}
+}
+
+// TokenSource caches user access tokens by app key and Hagall endpoint.
+//
+// Cached tokens are refreshed in the background before they expire, as long as
+// they were requested since their last refresh, until they are invalidated or
+// the token source is closed. Tokens that were not requested since their last
+// refresh are evicted instead. The cached token is handed out while it is
+// refreshed. Concurrent fetches for the same key are deduplicated.
+type TokenSource struct {
+	client        *Client
+	refreshBefore time.Duration
+	expiryLeeway  time.Duration
+	fetchTimeout  time.Duration
+
+	mutex     sync.Mutex
+	tokens    map[tokenKey]Token
+	calls     map[tokenKey]*tokenCall
+	refreshes map[tokenKey]*time.Timer
+	used      map[tokenKey]bool
+	closed    bool
+}
+
+type tokenKey struct {
+	appKey   string
+	endpoint string
+}
+
+type tokenCall struct {
+	done  chan struct{}
+	token Token
+	err   error
+}
+
+// NewTokenSource creates a token source that authenticates users with the
+// given client.
+func NewTokenSource(client *Client, opts ...TokenSourceOpts) *TokenSource {
+	s := &TokenSource{
+		client:    client,
+		tokens:    make(map[tokenKey]Token),
+		calls:     make(map[tokenKey]*tokenCall),
+		refreshes: make(map[tokenKey]*time.Timer),
+		used:      make(map[tokenKey]bool),
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if s.refreshBefore <= 0 {
+		s.refreshBefore = defaultTokenRefreshBefore
+	}
+
+	if s.expiryLeeway <= 0 {
+		s.expiryLeeway = defaultTokenExpiryLeeway
+	}
+
+	if s.fetchTimeout <= 0 {
+		s.fetchTimeout = defaultTokenFetchTimeout
+	}
+	return s
+}
+
+// Token returns a valid access token for the given input, authenticating to
+// HDS only when the cached token is missing or about to expire.
+func (s *TokenSource) Token(ctx context.Context, in UserAuthIn) (Token, error) {
+	key := tokenKey{appKey: in.AppKey, endpoint: in.Endpoint}
+	now := time.Now()
+
+	s.mutex.Lock()
+	s.used[key] = true
+	token, ok := s.tokens[key]
+	if ok && !token.Expired(now.Add(s.expiryLeeway)) {
+		if token.Expired(now.Add(s.refreshBefore)) {
+			s.fetch(key, in)
+		}
+		s.mutex.Unlock()
+		return token, nil
+	}
+	call := s.fetch(key, in)
+	s.mutex.Unlock()
+
+	select {
+	case <-call.done:
+		return call.token, call.err
+
+	case <-ctx.Done():
+		return Token{}, ctx.Err()
+	}
+}
+
+// TokenFunc returns a function that returns the access token for the given
+// input. It is meant to be used with the websocket package dial helpers.
+func (s *TokenSource) TokenFunc(in UserAuthIn) hwebsocket.TokenFunc {
+	return func(ctx context.Context) (string, error) {
+		token, err := s.Token(ctx, in)
+		return token.AccessToken, err
+	}
+}
+
+// Invalidate removes the cached token for the given input, i.e. when a Hagall
+// server rejected it, and stops refreshing it.
+func (s *TokenSource) Invalidate(in UserAuthIn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := tokenKey{appKey: in.AppKey, endpoint: in.Endpoint}
+	delete(s.tokens, key)
+	delete(s.used, key)
+	s.stopRefresh(key)
+}
+
+// Close stops the background refreshes. Cached tokens can still be retrieved
+// with Token.
+func (s *TokenSource) Close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.closed = true
+	for key := range s.refreshes {
+		s.stopRefresh(key)
+	}
+}
+
+// fetch starts authenticating to HDS in the background, unless it is already
+// in progress for the given key. The mutex must be held by the caller.
+func (s *TokenSource) fetch(key tokenKey, in UserAuthIn) *tokenCall {
+	if call, ok := s.calls[key]; ok {
+		return call
+	}
+
+	call := &tokenCall{done: make(chan struct{})}
+	s.calls[key] = call
+
+	go func() {
+		// The fetch outlives the caller context since its result is shared
+		// with other callers.
+		ctx, cancel := context.WithTimeout(context.Background(), s.fetchTimeout)
+		defer cancel()
+		call.token, call.err = s.authenticate(ctx, in)
+
+		s.mutex.Lock()
+		delete(s.calls, key)
+		if call.err == nil {
+			s.tokens[key] = call.token
+		}
+		if token, ok := s.tokens[key]; ok {
+			s.scheduleRefresh(key, in, token)
+		} else {
+			delete(s.used, key)
+		}
+		s.mutex.Unlock()
+
+		close(call.done)
+	}()
+
+	return call
+}
+
+// scheduleRefresh arms the background refresh of the given token, replacing
+// the previous one for the same key. The token is refreshed refreshBefore its
+// expiry, or halfway to it for short-lived tokens and failed refreshes. Tokens
+// that were not requested since the last refresh, or that expire too soon to
+// be refreshed, are evicted instead. The mutex must be held by the caller.
+func (s *TokenSource) scheduleRefresh(key tokenKey, in UserAuthIn, token Token) {
+	s.stopRefresh(key)
+	if s.closed {
+		return
+	}
+
+	lifetime := time.Until(token.ExpiresAt)
+	delay := max(lifetime-s.refreshBefore, lifetime/2, minTokenRefreshDelay)
+	evict := delay >= lifetime
+	if evict {
+		delay = max(lifetime, 0)
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+
+		if s.closed || s.refreshes[key] != timer {
+			return
+		}
+		delete(s.refreshes, key)
+
+		if evict || !s.used[key] {
+			delete(s.tokens, key)
+			delete(s.used, key)
+			return
+		}
+		delete(s.used, key)
+		s.fetch(key, in)
+	})
+	s.refreshes[key] = timer
+}
+
+// stopRefresh stops the background refresh of the token with the given key.
+// The mutex must be held by the caller.
+func (s *TokenSource) stopRefresh(key tokenKey) {
+	if timer, ok := s.refreshes[key]; ok {
+		timer.Stop()
+		delete(s.refreshes, key)
+	}
+}
+
+func (s *TokenSource) authenticate(ctx context.Context, in UserAuthIn) (Token, error) {
+	res, err := s.client.UserAuth(ctx, in)
+	if err != nil {
+		logs.WithTag("app_key", in.AppKey).
+			WithTag("endpoint", in.Endpoint).
+			WithTag("error", err).
+			Warn("fetching user access token failed")
+		return Token{}, errors.New("fetching user access token failed").Wrap(err)
+	}
+
+	claims, err := httpcmn.ParseHagallUserToken(res.AccessToken)
+	if err != nil {
+		return Token{}, err
+	}
+
+	if claims.ExpiresAt == nil {
+		return Token{}, errors.New("user access token has no expiration").
+			WithTag("app_key", in.AppKey).
+			WithTag("endpoint", in.Endpoint)
+	}
+
+	return Token{
+		AccessToken: res.AccessToken,
+		ExpiresAt:   claims.ExpiresAt.Time,
+	}, nil
+}
@@ -0,0 +1,204 @@
+package hdsclient
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	httpcmn "github.com/aukilabs/hagall-common/http"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenSource(t *testing.T) {
+	setupTestLog(t)
+
+	newHDS := func(calls *int32, ttl time.Duration) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(calls, 1)
+			time.Sleep(10 * time.Millisecond)
+
+			appKey, _, _ := r.BasicAuth()
+			token, err := httpcmn.GenerateHagallUserAccessToken(appKey, "secret", ttl)
+			require.NoError(t, err)
+			json.NewEncoder(w).Encode(UserAuthResponse{AccessToken: token})
+		}))
+	}
+
+	in := UserAuthIn{
+		Endpoint:  "http://hagall",
+		AppKey:    "key",
+		AppSecret: "secret",
+	}
+
+	t.Run("tokens are cached", func(t *testing.T) {
+		var calls int32
+		hds := newHDS(&calls, time.Hour)
+		defer hds.Close()
+
+		s := NewTokenSource(NewClient(WithHDSEndpoint(hds.URL)))
+		defer s.Close()
+
+		token, err := s.Token(context.Background(), in)
+		require.NoError(t, err)
+		require.NotEmpty(t, token.AccessToken)
+		require.WithinDuration(t, time.Now().Add(time.Hour), token.ExpiresAt, 2*time.Second)
+		require.Equal(t, httpcmn.GetAppKeyFromHagallUserToken(token.AccessToken), "key")
+
+		cached, err := s.Token(context.Background(), in)
+		require.NoError(t, err)
+		require.Equal(t, token, cached)
+		require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+		otherIn := in
+		otherIn.Endpoint = "http://other-hagall"
+		_, err = s.Token(context.Background(), otherIn)
+		require.NoError(t, err)
+		require.Equal(t, int32(2), atomic.LoadInt32(&calls))
+
+		s.Invalidate(in)
+		_, err = s.Token(context.Background(), in)
+		require.NoError(t, err)
+		require.Equal(t, int32(3), atomic.LoadInt32(&calls))
+	})
+
+	t.Run("concurrent fetches are deduplicated", func(t *testing.T) {
+		var calls int32
+		hds := newHDS(&calls, time.Hour)
+		defer hds.Close()
+
+		s := NewTokenSource(NewClient(WithHDSEndpoint(hds.URL)))
+		defer s.Close()
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := s.Token(context.Background(), in)
+				require.NoError(t, err)
+			}()
+		}
+		wg.Wait()
+
+		require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	})
+
+	t.Run("tokens close to expiry are refreshed in background", func(t *testing.T) {
+		var calls int32
+		hds := newHDS(&calls, 2*time.Minute)
+		defer hds.Close()
+
+		s := NewTokenSource(NewClient(WithHDSEndpoint(hds.URL)),
+			WithTokenRefreshBefore(3*time.Minute),
+		)
+		defer s.Close()
+
+		token, err := s.Token(context.Background(), in)
+		require.NoError(t, err)
+
+		cached, err := s.Token(context.Background(), in)
+		require.NoError(t, err)
+		require.Equal(t, token, cached)
+
+		require.Eventually(t, func() bool {
+			return atomic.LoadInt32(&calls) == 2
+		}, time.Second, 5*time.Millisecond)
+	})
+
+	t.Run("tokens are refreshed before expiry without being read", func(t *testing.T) {
+		var calls int32
+		hds := newHDS(&calls, 3*time.Second)
+		defer hds.Close()
+
+		s := NewTokenSource(NewClient(WithHDSEndpoint(hds.URL)),
+			WithTokenRefreshBefore(2*time.Second),
+		)
+		defer s.Close()
+
+		token, err := s.Token(context.Background(), in)
+		require.NoError(t, err)
+
+		require.Eventually(t, func() bool {
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+
+			refreshed := s.tokens[tokenKey{appKey: in.AppKey, endpoint: in.Endpoint}]
+			return refreshed.ExpiresAt.After(token.ExpiresAt)
+		}, 3*time.Second, 10*time.Millisecond)
+		require.Equal(t, int32(2), atomic.LoadInt32(&calls))
+
+		s.Invalidate(in)
+		s.mutex.Lock()
+		require.Empty(t, s.refreshes)
+		s.mutex.Unlock()
+	})
+
+	t.Run("idle tokens are evicted instead of refreshed", func(t *testing.T) {
+		var calls int32
+		hds := newHDS(&calls, 3*time.Second)
+		defer hds.Close()
+
+		s := NewTokenSource(NewClient(WithHDSEndpoint(hds.URL)),
+			WithTokenRefreshBefore(2*time.Second),
+		)
+		defer s.Close()
+
+		_, err := s.Token(context.Background(), in)
+		require.NoError(t, err)
+
+		require.Eventually(t, func() bool {
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+			return len(s.tokens) == 0 && len(s.refreshes) == 0 && len(s.used) == 0
+		}, 5*time.Second, 10*time.Millisecond)
+		require.Equal(t, int32(2), atomic.LoadInt32(&calls))
+	})
+
+	t.Run("expired tokens are not handed out", func(t *testing.T) {
+		var calls int32
+		hds := newHDS(&calls, time.Second)
+		defer hds.Close()
+
+		s := NewTokenSource(NewClient(WithHDSEndpoint(hds.URL)),
+			WithTokenExpiryLeeway(2*time.Second),
+		)
+		defer s.Close()
+
+		token, err := s.Token(context.Background(), in)
+		require.NoError(t, err)
+
+		refreshed, err := s.Token(context.Background(), in)
+		require.NoError(t, err)
+		require.NotEqual(t, token.AccessToken, refreshed.AccessToken)
+		require.Equal(t, int32(2), atomic.LoadInt32(&calls))
+	})
+
+	t.Run("fetch error", func(t *testing.T) {
+		hds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusUnauthorized)
+		}))
+		defer hds.Close()
+
+		s := NewTokenSource(NewClient(WithHDSEndpoint(hds.URL)))
+		defer s.Close()
+		_, err := s.Token(context.Background(), in)
+		require.ErrorIs(t, err, ErrUnauthorized)
+	})
+
+	t.Run("token func", func(t *testing.T) {
+		var calls int32
+		hds := newHDS(&calls, time.Hour)
+		defer hds.Close()
+
+		s := NewTokenSource(NewClient(WithHDSEndpoint(hds.URL)))
+		defer s.Close()
+		token, err := s.TokenFunc(in)(context.Background())
+		require.NoError(t, err)
+		require.NotEmpty(t, token)
+	})
+}
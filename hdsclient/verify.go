@@ -0,0 +1,209 @@
+package hdsclient
+
+import (
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/aukilabs/go-tooling/pkg/errors"
+	"github.com/aukilabs/hagall-common/crypt"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+const (
+	defaultSignatureMaxAge       = 5 * time.Minute
+	defaultSignatureMaxClockSkew = 30 * time.Second
+)
+
+var (
+	// Error returned by VerifyPostServerIn when the registration is not
+	// signed.
+	ErrMissingEndpointSignature = errors.New("endpoint signature is missing")
+
+	// Error returned by VerifyPostServerIn when the endpoint signature or its
+	// timestamp cannot be decoded.
+	ErrInvalidEndpointSignature = errors.New("endpoint signature is invalid")
+
+	// Error returned by VerifyPostServerIn when the endpoint signature
+	// timestamp is outside of the freshness window.
+	ErrExpiredEndpointSignature = errors.New("endpoint signature is expired")
+
+	// Error returned by VerifyPostServerIn when the endpoint signature was
+	// already used by a previous registration.
+	ErrReplayedEndpointSignature = errors.New("endpoint signature was already used")
+)
+
+// NonceStore records the endpoint signatures used to register servers in
+// order to reject replays.
+type NonceStore interface {
+	// Use records the given nonce until its expiration. It returns false when
+	// the nonce is already recorded.
+	Use(nonce string, expiresAt time.Time) (bool, error)
+}
+
+// MemoryNonceStore is a NonceStore that keeps nonces in memory.
+type MemoryNonceStore struct {
+	mutex  sync.Mutex
+	nonces map[string]time.Time
+	clock  Clock
+}
+
+// NewMemoryNonceStore creates a nonce store that keeps nonces in memory.
+func NewMemoryNonceStore() *MemoryNonceStore {
+	return &MemoryNonceStore{
+		nonces: make(map[string]time.Time),
+		clock:  systemClock{},
+	}
+}
+
+// Use satisfies the NonceStore interface.
+func (s *MemoryNonceStore) Use(nonce string, expiresAt time.Time) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := s.clock.Now()
+	for n, exp := range s.nonces {
+		if !exp.After(now) {
+			delete(s.nonces, n)
+		}
+	}
+
+	if _, ok := s.nonces[nonce]; ok {
+		return false, nil
+	}
+	s.nonces[nonce] = expiresAt
+	return true, nil
+}
+
+// VerifyOptions are the options to verify a server registration.
+type VerifyOptions struct {
+	// The maximum age of an endpoint signature. Defaults to 5 minutes.
+	MaxAge time.Duration
+
+	// The maximum duration an endpoint signature timestamp can be in the
+	// future, to tolerate clock differences. Defaults to 30 seconds.
+	MaxClockSkew time.Duration
+
+	// The store used to reject replayed signatures. Replays are not checked
+	// when nil.
+	NonceStore NonceStore
+
+	// The clock used to check the signature freshness. Defaults to the system
+	// clock.
+	Clock Clock
+
+	// The chain ID EIP-712 endpoint signatures must be bound to. Registrations
+	// signed for another chain are rejected. Any chain is accepted when zero.
+	ChainID int64
+}
+
+func (o VerifyOptions) withDefaults() VerifyOptions {
+	if o.MaxAge <= 0 {
+		o.MaxAge = defaultSignatureMaxAge
+	}
+
+	if o.MaxClockSkew <= 0 {
+		o.MaxClockSkew = defaultSignatureMaxClockSkew
+	}
+
+	if o.Clock == nil {
+		o.Clock = systemClock{}
+	}
+	return o
+}
+
+// VerifyPostServerIn verifies the wallet signature of a server registration
+// and returns the address of the wallet that signed it.
+//
+// It is the counterpart of the signature sent by Pair when the client has a
+// private key, with any of the crypt signature schemes. Errors can be matched
+// against ErrMissingEndpointSignature, ErrInvalidEndpointSignature,
+// ErrExpiredEndpointSignature and ErrReplayedEndpointSignature with
+// errors.Is.
+func VerifyPostServerIn(in PostServerIn, opts VerifyOptions) (common.Address, error) {
+	opts = opts.withDefaults()
+
+	if in.EndpointSignature == "" || in.Timestamp == "" {
+		return common.Address{}, errors.New("verifying registration failed").
+			WithTag("endpoint", in.Endpoint).
+			Wrap(ErrMissingEndpointSignature)
+	}
+
+	timestamp, err := time.Parse(time.RFC3339Nano, in.Timestamp)
+	if err != nil {
+		return common.Address{}, errors.New("parsing endpoint signature timestamp failed").
+			WithTag("endpoint", in.Endpoint).
+			WithTag("timestamp", in.Timestamp).
+			Wrap(ErrInvalidEndpointSignature)
+	}
+
+	now := opts.Clock.Now()
+	if now.Sub(timestamp) > opts.MaxAge || timestamp.Sub(now) > opts.MaxClockSkew {
+		return common.Address{}, errors.New("verifying registration failed").
+			WithTag("endpoint", in.Endpoint).
+			WithTag("timestamp", in.Timestamp).
+			WithTag("max_age", opts.MaxAge).
+			Wrap(ErrExpiredEndpointSignature)
+	}
+
+	if opts.ChainID != 0 && in.SignatureScheme == crypt.SignatureSchemeTypedData && in.ChainID != opts.ChainID {
+		return common.Address{}, errors.New("verifying registration failed").
+			WithTag("endpoint", in.Endpoint).
+			WithTag("chain_id", in.ChainID).
+			WithTag("expected_chain_id", opts.ChainID).
+			Wrap(ErrInvalidEndpointSignature)
+	}
+
+	address, err := crypt.RecoverMessageSigner(
+		in.SignatureScheme,
+		crypt.NewTypedDataDomain(crypt.PurposeHagallRegistration, in.ChainID),
+		in.Endpoint+in.Timestamp,
+		in.EndpointSignature,
+	)
+	if err != nil {
+		return common.Address{}, errors.New("recovering wallet address failed").
+			WithTag("endpoint", in.Endpoint).
+			WithTag("reason", err.Error()).
+			Wrap(ErrInvalidEndpointSignature)
+	}
+
+	if opts.NonceStore != nil {
+		nonce, err := signatureNonce(in.EndpointSignature)
+		if err != nil {
+			return common.Address{}, errors.New("verifying registration failed").
+				WithTag("endpoint", in.Endpoint).
+				WithTag("reason", err.Error()).
+				Wrap(ErrInvalidEndpointSignature)
+		}
+
+		ok, err := opts.NonceStore.Use(nonce, timestamp.Add(opts.MaxAge))
+		if err != nil {
+			return common.Address{}, errors.New("recording endpoint signature failed").Wrap(err)
+		}
+		if !ok {
+			return common.Address{}, errors.New("verifying registration failed").
+				WithTag("endpoint", in.Endpoint).
+				WithTag("wallet_address", address.Hex()).
+				Wrap(ErrReplayedEndpointSignature)
+		}
+	}
+	return address, nil
+}
+
+// signatureNonce returns the nonce that identifies the given signature for
+// replay detection. It is made of the R and S values only, as the recovery ID
+// can be encoded in several ways for the same signature.
+func signatureNonce(signature string) (string, error) {
+	sig, err := hexutil.Decode(signature)
+	if err != nil {
+		return "", err
+	}
+
+	if len(sig) != crypto.SignatureLength {
+		return "", errors.New("invalid signature length").
+			WithTag("length", len(sig))
+	}
+	return hex.EncodeToString(sig[:crypto.RecoveryIDOffset]), nil
+}
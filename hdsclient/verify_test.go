@@ -0,0 +1,170 @@
+package hdsclient
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aukilabs/hagall-common/crypt"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyPostServerIn(t *testing.T) {
+	privateKey, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	address := crypto.PubkeyToAddress(privateKey.PublicKey)
+
+	clock := newFakeClock()
+
+	sign := func(t *testing.T, endpoint string, at time.Time) PostServerIn {
+		timestamp := at.Format(time.RFC3339Nano)
+		signature, err := crypt.Sign(privateKey, endpoint+timestamp)
+		require.NoError(t, err)
+
+		return PostServerIn{
+			Endpoint:          endpoint,
+			EndpointSignature: signature,
+			Timestamp:         timestamp,
+		}
+	}
+
+	t.Run("valid signature returns the wallet address", func(t *testing.T) {
+		in := sign(t, "https://hagall.test", clock.Now())
+
+		addr, err := VerifyPostServerIn(in, VerifyOptions{Clock: clock})
+		require.NoError(t, err)
+		require.Equal(t, address, addr)
+	})
+
+	t.Run("typed data signature returns the wallet address", func(t *testing.T) {
+		in := sign(t, "https://hagall.test", clock.Now())
+		in.SignatureScheme = crypt.SignatureSchemeTypedData
+		in.ChainID = 1
+		in.EndpointSignature, err = crypt.SignMessage(
+			privateKey,
+			in.SignatureScheme,
+			crypt.NewTypedDataDomain(crypt.PurposeHagallRegistration, in.ChainID),
+			in.Endpoint+in.Timestamp,
+		)
+		require.NoError(t, err)
+
+		addr, err := VerifyPostServerIn(in, VerifyOptions{Clock: clock, ChainID: 1})
+		require.NoError(t, err)
+		require.Equal(t, address, addr)
+
+		_, err = VerifyPostServerIn(in, VerifyOptions{Clock: clock, ChainID: 5})
+		require.ErrorIs(t, err, ErrInvalidEndpointSignature)
+
+		in.ChainID = 5
+		addr, err = VerifyPostServerIn(in, VerifyOptions{Clock: clock, ChainID: 5})
+		require.NoError(t, err)
+		require.NotEqual(t, address, addr)
+	})
+
+	t.Run("missing signature", func(t *testing.T) {
+		_, err := VerifyPostServerIn(PostServerIn{Endpoint: "https://hagall.test"}, VerifyOptions{Clock: clock})
+		require.ErrorIs(t, err, ErrMissingEndpointSignature)
+	})
+
+	t.Run("invalid timestamp", func(t *testing.T) {
+		in := sign(t, "https://hagall.test", clock.Now())
+		in.Timestamp = "yesterday"
+
+		_, err := VerifyPostServerIn(in, VerifyOptions{Clock: clock})
+		require.ErrorIs(t, err, ErrInvalidEndpointSignature)
+	})
+
+	t.Run("invalid signature", func(t *testing.T) {
+		in := sign(t, "https://hagall.test", clock.Now())
+		in.EndpointSignature = "0x1234"
+
+		_, err := VerifyPostServerIn(in, VerifyOptions{Clock: clock})
+		require.ErrorIs(t, err, ErrInvalidEndpointSignature)
+	})
+
+	t.Run("signature for another endpoint recovers another address", func(t *testing.T) {
+		in := sign(t, "https://hagall.test", clock.Now())
+		in.Endpoint = "https://evil.test"
+
+		addr, err := VerifyPostServerIn(in, VerifyOptions{Clock: clock})
+		require.NoError(t, err)
+		require.NotEqual(t, address, addr)
+	})
+
+	t.Run("expired signature", func(t *testing.T) {
+		in := sign(t, "https://hagall.test", clock.Now().Add(-2*time.Minute))
+
+		_, err := VerifyPostServerIn(in, VerifyOptions{
+			MaxAge: time.Minute,
+			Clock:  clock,
+		})
+		require.ErrorIs(t, err, ErrExpiredEndpointSignature)
+	})
+
+	t.Run("signature from the future", func(t *testing.T) {
+		in := sign(t, "https://hagall.test", clock.Now().Add(time.Minute))
+
+		_, err := VerifyPostServerIn(in, VerifyOptions{Clock: clock})
+		require.ErrorIs(t, err, ErrExpiredEndpointSignature)
+	})
+
+	t.Run("replayed signature", func(t *testing.T) {
+		store := NewMemoryNonceStore()
+		store.clock = clock
+
+		opts := VerifyOptions{
+			NonceStore: store,
+			Clock:      clock,
+		}
+		in := sign(t, "https://hagall.test", clock.Now())
+
+		_, err := VerifyPostServerIn(in, opts)
+		require.NoError(t, err)
+
+		_, err = VerifyPostServerIn(in, opts)
+		require.ErrorIs(t, err, ErrReplayedEndpointSignature)
+	})
+
+	t.Run("replayed signature with another recovery id encoding", func(t *testing.T) {
+		store := NewMemoryNonceStore()
+		store.clock = clock
+
+		opts := VerifyOptions{
+			NonceStore: store,
+			Clock:      clock,
+		}
+		in := sign(t, "https://hagall.test", clock.Now())
+
+		addr, err := VerifyPostServerIn(in, opts)
+		require.NoError(t, err)
+		require.Equal(t, address, addr)
+
+		sig := common.FromHex(in.EndpointSignature)
+		sig[crypto.RecoveryIDOffset] += 27
+		in.EndpointSignature = hexutil.Encode(sig)
+
+		_, err = VerifyPostServerIn(in, opts)
+		require.ErrorIs(t, err, ErrReplayedEndpointSignature)
+	})
+}
+
+func TestMemoryNonceStore(t *testing.T) {
+	clock := newFakeClock()
+	store := NewMemoryNonceStore()
+	store.clock = clock
+
+	ok, err := store.Use("nonce", clock.Now().Add(time.Minute))
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	ok, err = store.Use("nonce", clock.Now().Add(time.Minute))
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	clock.Advance(time.Minute)
+	ok, err = store.Use("nonce", clock.Now().Add(time.Minute))
+	require.NoError(t, err)
+	require.True(t, ok)
+}
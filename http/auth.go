@@ -1,7 +1,9 @@
 package http
 
 import (
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"net/http"
 	"strings"
 	"time"
@@ -34,6 +36,61 @@ func SignIdentity(endpoint, secret string) (string, error) {
 	return token.SignedString([]byte(secret))
 }
 
+// SignIdentityWithBody signs endpoint and the SHA-256 digest of body with
+// secret.
+func SignIdentityWithBody(endpoint, secret string, body []byte) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"endpoint":    endpoint,
+		"body_sha256": bodyDigest(body),
+	})
+	return token.SignedString([]byte(secret))
+}
+
+// VerifyIdentity verifies that the token was created by SignIdentity with the
+// given secret, and returns the signed endpoint.
+func VerifyIdentity(token, secret string) (string, error) {
+	claims, err := parseIdentity(token, secret)
+	if err != nil {
+		return "", err
+	}
+
+	endpoint, _ := claims["endpoint"].(string)
+	return endpoint, nil
+}
+
+// VerifyIdentityWithBody verifies that the token was created by
+// SignIdentityWithBody with the given secret and body, and returns the signed
+// endpoint.
+func VerifyIdentityWithBody(token, secret string, body []byte) (string, error) {
+	claims, err := parseIdentity(token, secret)
+	if err != nil {
+		return "", err
+	}
+
+	if digest, _ := claims["body_sha256"].(string); digest != bodyDigest(body) {
+		return "", errors.New("body digest mismatch")
+	}
+
+	endpoint, _ := claims["endpoint"].(string)
+	return endpoint, nil
+}
+
+func parseIdentity(token, secret string) (jwt.MapClaims, error) {
+	var claims jwt.MapClaims
+	_, err := jwt.ParseWithClaims(token, &claims, func(t *jwt.Token) (interface{}, error) {
+		return []byte(secret), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil {
+		return nil, errors.New("parsing identity token failed").Wrap(err)
+	}
+	return claims, nil
+}
+
+func bodyDigest(body []byte) string {
+	digest := sha256.Sum256(body)
+	return hex.EncodeToString(digest[:])
+}
+
 // VerifyHagallUserAccessToken verifies that the token was signed by the secret.
 func VerifyHagallUserAccessToken(token, secret string) error {
 	var claims HagallUserClaim
@@ -102,6 +159,16 @@ func GetAppKeyFromHagallUserToken(token string) string {
 	return claims.AppKey
 }
 
+// ParseHagallUserToken parses the claims of a Hagall user token without
+// verifying its signature.
+func ParseHagallUserToken(token string) (HagallUserClaim, error) {
+	var claims HagallUserClaim
+	if _, _, err := jwt.NewParser().ParseUnverified(token, &claims); err != nil {
+		return HagallUserClaim{}, errors.New("parsing token failed").Wrap(err)
+	}
+	return claims, nil
+}
+
 // Returns the Hagall user token from a HTTP request.
 func GetUserTokenFromHTTPRequest(r *http.Request) string {
 	var token string
@@ -185,6 +185,23 @@ func TestGetAppKeyFromHagallUserToken(t *testing.T) {
 	require.Equal(t, "0xTED", appKey)
 }
 
+func TestParseHagallUserToken(t *testing.T) {
+	token, err := GenerateHagallUserAccessToken(
+		"0xTED",
+		MakeJWTSecret(),
+		-time.Minute,
+	)
+	require.NoError(t, err)
+
+	claims, err := ParseHagallUserToken(token)
+	require.NoError(t, err)
+	require.Equal(t, "0xTED", claims.AppKey)
+	require.True(t, claims.ExpiresAt.Before(time.Now()))
+
+	_, err = ParseHagallUserToken("not a token")
+	require.Error(t, err)
+}
+
 func TestGetAppKeyFromHTTPRequest(t *testing.T) {
 	utests := []struct {
 		scenario       string
@@ -238,3 +255,32 @@ func verifyLegacyHagallUserAccessToken(token, secret string) error {
 	})
 	return err
 }
+
+func TestSignIdentity(t *testing.T) {
+	token, err := SignIdentity("http://hagall.test", "secret")
+	require.NoError(t, err)
+
+	endpoint, err := VerifyIdentity(token, "secret")
+	require.NoError(t, err)
+	require.Equal(t, "http://hagall.test", endpoint)
+
+	_, err = VerifyIdentity(token, "other")
+	require.Error(t, err)
+}
+
+func TestSignIdentityWithBody(t *testing.T) {
+	body := []byte(`{"session_count":2}`)
+
+	token, err := SignIdentityWithBody("http://hagall.test", "secret", body)
+	require.NoError(t, err)
+
+	endpoint, err := VerifyIdentityWithBody(token, "secret", body)
+	require.NoError(t, err)
+	require.Equal(t, "http://hagall.test", endpoint)
+
+	_, err = VerifyIdentityWithBody(token, "secret", []byte(`{"session_count":3}`))
+	require.Error(t, err)
+
+	_, err = VerifyIdentityWithBody(token, "other", body)
+	require.Error(t, err)
+}
@@ -13,6 +13,7 @@ const (
 	CloudFrontViewerAddressHeaderKey = "CloudFront-Viewer-Address"
 
 	XForwardedForHeaderKey = "X-Forwarded-For"
+	XRequestIDHeaderKey    = "X-Request-Id"
 )
 
 type ClientIDContextValue string
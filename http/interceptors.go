@@ -0,0 +1,250 @@
+package http
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aukilabs/go-tooling/pkg/errors"
+	"github.com/aukilabs/go-tooling/pkg/logs"
+	"github.com/google/uuid"
+)
+
+const (
+	redactedValue = "[REDACTED]"
+)
+
+var (
+	// The headers which values are redacted by LoggingInterceptor.
+	RedactedHeaders = []string{
+		"Authorization",
+		"Proxy-Authorization",
+		"Cookie",
+		"Set-Cookie",
+		HeaderHagallJWTSecretHeaderKey,
+		HeaderHagallJWTChallengeSolutionHeaderKey,
+	}
+
+	// The query parameters which values are redacted by LoggingInterceptor.
+	RedactedQueryParams = []string{
+		"access_token",
+		"token",
+		"secret",
+		"app_secret",
+	}
+)
+
+// Interceptor is a function that wraps a http.RoundTripper to intercept
+// outgoing requests and their responses.
+//
+// Interceptors must not modify the request they receive and should clone it
+// instead, as required by the http.RoundTripper interface.
+type Interceptor func(http.RoundTripper) http.RoundTripper
+
+// RoundTripperFunc is an adapter to use ordinary functions as
+// http.RoundTripper.
+type RoundTripperFunc func(*http.Request) (*http.Response, error)
+
+// RoundTrip satisfies the http.RoundTripper interface.
+func (f RoundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// ChainInterceptors returns a http.RoundTripper that passes requests through
+// the given interceptors, in order, before sending them with transport. A nil
+// transport uses http.DefaultTransport.
+func ChainInterceptors(transport http.RoundTripper, interceptors ...Interceptor) http.RoundTripper {
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		transport = interceptors[i](transport)
+	}
+	return transport
+}
+
+// RequestIDInterceptor returns an interceptor that sets an X-Request-Id header
+// to requests that do not have one. A nil generator uses random UUIDs.
+func RequestIDInterceptor(generate func() string) Interceptor {
+	if generate == nil {
+		generate = uuid.NewString
+	}
+
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			if r.Header.Get(XRequestIDHeaderKey) != "" {
+				return next.RoundTrip(r)
+			}
+
+			r = r.Clone(r.Context())
+			r.Header.Set(XRequestIDHeaderKey, generate())
+			return next.RoundTrip(r)
+		})
+	}
+}
+
+// UserAgentInterceptor returns an interceptor that sets the User-Agent header
+// of requests.
+func UserAgentInterceptor(userAgent string) Interceptor {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			r = r.Clone(r.Context())
+			r.Header.Set("User-Agent", userAgent)
+			return next.RoundTrip(r)
+		})
+	}
+}
+
+// LoggingInterceptor returns an interceptor that logs requests and their
+// responses. Secrets from RedactedHeaders and RedactedQueryParams are
+// redacted.
+//
+// Successful requests are logged at debug level and failed ones at warning
+// level.
+func LoggingInterceptor() Interceptor {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			start := time.Now()
+			res, err := next.RoundTrip(r)
+
+			entry := logs.WithTag("method", r.Method).
+				WithTag("url", RedactURL(r.URL)).
+				WithTag("request_id", r.Header.Get(XRequestIDHeaderKey)).
+				WithTag("request_headers", RedactHeader(r.Header)).
+				WithTag("duration", time.Since(start))
+
+			if err != nil {
+				entry.WithTag("error", err).Warn("http request failed")
+				return res, err
+			}
+
+			entry = entry.WithTag("status_code", res.StatusCode).
+				WithTag("response_headers", RedactHeader(res.Header))
+			if res.StatusCode >= 400 {
+				entry.Warn("http request returned an error")
+			} else {
+				entry.Debug("http request")
+			}
+			return res, err
+		})
+	}
+}
+
+// RequestMetrics represents the measures of a request sent through a
+// TimingInterceptor.
+type RequestMetrics struct {
+	Method     string
+	Host       string
+	Path       string
+	StatusCode int
+	Duration   time.Duration
+	Err        error
+}
+
+// TimingInterceptor returns an interceptor that measures the duration of
+// requests and reports them with observe.
+func TimingInterceptor(observe func(RequestMetrics)) Interceptor {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			start := time.Now()
+			res, err := next.RoundTrip(r)
+
+			m := RequestMetrics{
+				Method:   r.Method,
+				Host:     r.URL.Host,
+				Path:     r.URL.Path,
+				Duration: time.Since(start),
+				Err:      err,
+			}
+			if res != nil {
+				m.StatusCode = res.StatusCode
+			}
+			observe(m)
+
+			return res, err
+		})
+	}
+}
+
+// DeadlineInterceptor returns an interceptor that cancels requests that are not
+// completed within the given timeout, including reading the response body.
+// Requests with an earlier deadline keep it.
+func DeadlineInterceptor(timeout time.Duration) Interceptor {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			if timeout <= 0 {
+				return next.RoundTrip(r)
+			}
+
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			res, err := next.RoundTrip(r.WithContext(ctx))
+			if err != nil {
+				cancel()
+				if errors.Is(err, context.DeadlineExceeded) {
+					return nil, errors.New("request deadline exceeded").
+						WithTag("timeout", timeout).
+						Wrap(err)
+				}
+				return nil, err
+			}
+
+			res.Body = cancelOnClose{
+				ReadCloser: res.Body,
+				cancel:     cancel,
+			}
+			return res, nil
+		})
+	}
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
+
+// RedactHeader returns a copy of the given header where the values of
+// RedactedHeaders are redacted.
+func RedactHeader(h http.Header) http.Header {
+	redacted := h.Clone()
+	for _, k := range RedactedHeaders {
+		if len(redacted.Values(k)) != 0 {
+			redacted.Set(k, redactedValue)
+		}
+	}
+	return redacted
+}
+
+// RedactURL returns the given URL as a string where the values of
+// RedactedQueryParams and the user password are redacted.
+func RedactURL(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+
+	redacted := *u
+	if _, ok := redacted.User.Password(); ok {
+		redacted.User = url.UserPassword(redacted.User.Username(), redactedValue)
+	}
+
+	if redacted.RawQuery != "" {
+		query := redacted.Query()
+		for k := range query {
+			for _, p := range RedactedQueryParams {
+				if strings.EqualFold(k, p) {
+					query.Set(k, redactedValue)
+				}
+			}
+		}
+		redacted.RawQuery = query.Encode()
+	}
+	return redacted.String()
+}
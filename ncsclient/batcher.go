@@ -0,0 +1,455 @@
+package ncsclient
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/aukilabs/go-tooling/pkg/errors"
+	"github.com/aukilabs/go-tooling/pkg/logs"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultReceiptBatchSize      = 100
+	defaultReceiptFlushInterval  = 10 * time.Second
+	defaultReceiptMaxAttempts    = 5
+	defaultReceiptInitialBackoff = time.Second
+	defaultReceiptMaxBackoff     = 30 * time.Second
+)
+
+var (
+	// Error returned when adding receipts to a closed batcher.
+	ErrReceiptBatcherClosed = errors.New("receipt batcher is closed")
+)
+
+type ReceiptBatcherOpts func(*ReceiptBatcher)
+
+// WithBatchSize sets the number of buffered receipts that triggers a flush.
+// Defaults to 100.
+func WithBatchSize(v int) ReceiptBatcherOpts {
+	return func(b *ReceiptBatcher) {
+		b.batchSize = v
+	}
+}
+
+// WithFlushInterval sets the interval between two flushes of the buffered
+// receipts and two replays of the queued receipts. Defaults to 10 seconds.
+func WithFlushInterval(v time.Duration) ReceiptBatcherOpts {
+	return func(b *ReceiptBatcher) {
+		b.flushInterval = v
+	}
+}
+
+// WithMaxAttempts sets the number of attempts, including the first one, made
+// to send a batch before it is spilled to the queue. Defaults to 5.
+func WithMaxAttempts(v int) ReceiptBatcherOpts {
+	return func(b *ReceiptBatcher) {
+		b.maxAttempts = v
+	}
+}
+
+// WithBackoff sets the delay before the first retry and its upper bound. The
+// delay doubles after each attempt. Defaults to 1 second and 30 seconds.
+func WithBackoff(initial, max time.Duration) ReceiptBatcherOpts {
+	return func(b *ReceiptBatcher) {
+		b.initialBackoff = initial
+		b.maxBackoff = max
+	}
+}
+
+// WithReceiptQueue sets the queue where the batches that could not be sent
+// are spilled. Use a FileReceiptQueue to keep them across restarts. Defaults
+// to a MemoryReceiptQueue.
+func WithReceiptQueue(v ReceiptQueue) ReceiptBatcherOpts {
+	return func(b *ReceiptBatcher) {
+		b.queue = v
+	}
+}
+
+// WithDeadLetterQueue sets the queue where the batches rejected by NCS with a
+// 4xx status code other than 429 are moved. When not set, rejected batches
+// are kept in the receipt queue and replayed at each flush interval, which
+// blocks the replay of the batches queued after them.
+func WithDeadLetterQueue(v ReceiptQueue) ReceiptBatcherOpts {
+	return func(b *ReceiptBatcher) {
+		b.deadLetter = v
+	}
+}
+
+// ReceiptBatcher buffers receipts and sends them to NCS in batches.
+//
+// Buffered receipts are flushed once the batch size is reached and at each
+// flush interval. Each batch has an ID sent to NCS so that it is ingested only
+// once when it is sent several times. Batches that fail with a network error,
+// a 429 or a 5xx status code are retried with an exponential backoff, then
+// spilled to the receipt queue. Queued batches are replayed on Start and at
+// each flush interval. Batches rejected by NCS are never dropped: they are
+// moved to the dead letter queue, or kept in the receipt queue.
+type ReceiptBatcher struct {
+	client         *NCSClient
+	batchSize      int
+	flushInterval  time.Duration
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	queue          ReceiptQueue
+	deadLetter     ReceiptQueue
+
+	mutex    sync.Mutex
+	pending  []ReceiptPayload
+	retained []ReceiptBatch
+	started  bool
+	closed   bool
+	cancel   context.CancelFunc
+	stop     chan struct{}
+	done     chan struct{}
+	flushCh  chan struct{}
+}
+
+// NewReceiptBatcher creates a receipt batcher that sends the receipts with the
+// given client.
+func NewReceiptBatcher(client *NCSClient, opts ...ReceiptBatcherOpts) *ReceiptBatcher {
+	b := &ReceiptBatcher{
+		client:  client,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+		flushCh: make(chan struct{}, 1),
+	}
+
+	for _, opt := range opts {
+		opt(b)
+	}
+
+	if b.batchSize <= 0 {
+		b.batchSize = defaultReceiptBatchSize
+	}
+
+	if b.flushInterval <= 0 {
+		b.flushInterval = defaultReceiptFlushInterval
+	}
+
+	if b.maxAttempts <= 0 {
+		b.maxAttempts = defaultReceiptMaxAttempts
+	}
+
+	if b.initialBackoff <= 0 {
+		b.initialBackoff = defaultReceiptInitialBackoff
+	}
+
+	if b.maxBackoff <= 0 {
+		b.maxBackoff = defaultReceiptMaxBackoff
+	}
+
+	if b.queue == nil {
+		b.queue = NewMemoryReceiptQueue()
+	}
+	return b
+}
+
+// Start replays the queued receipts and flushes the buffered receipts in the
+// background until the given context is canceled or Close is called.
+func (b *ReceiptBatcher) Start(ctx context.Context) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.closed {
+		return ErrReceiptBatcherClosed
+	}
+
+	if b.started {
+		return errors.New("receipt batcher is already started")
+	}
+	b.started = true
+
+	ctx, cancel := context.WithCancel(ctx)
+	b.cancel = cancel
+
+	go func() {
+		defer close(b.done)
+		b.run(ctx)
+	}()
+	return nil
+}
+
+// Add buffers the given receipt. It does not block on the network.
+func (b *ReceiptBatcher) Add(payload ReceiptPayload) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.closed {
+		return ErrReceiptBatcherClosed
+	}
+
+	b.pending = append(b.pending, payload)
+	if len(b.pending) >= b.batchSize {
+		select {
+		case b.flushCh <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Flush sends the buffered receipts. Receipts that cannot be sent or that are
+// rejected by NCS are spilled to the receipt queue, or to the dead letter
+// queue, and the send error is returned.
+func (b *ReceiptBatcher) Flush(ctx context.Context) error {
+	return b.flushBatches(ctx, nil)
+}
+
+// Close stops the background flushes and flushes the buffered receipts. A
+// flush or a replay in progress is completed first, unless the given context
+// is done. Receipts that cannot be sent before the given context is done are
+// spilled to the receipt queue.
+func (b *ReceiptBatcher) Close(ctx context.Context) error {
+	b.mutex.Lock()
+	if b.closed {
+		b.mutex.Unlock()
+		return nil
+	}
+	b.closed = true
+	close(b.stop)
+	started := b.started
+	cancel := b.cancel
+	b.mutex.Unlock()
+
+	if started {
+		select {
+		case <-b.done:
+		case <-ctx.Done():
+			cancel()
+			<-b.done
+		}
+		cancel()
+	}
+
+	if err := b.Flush(ctx); err != nil && !isRetryableError(err) {
+		return err
+	}
+	return b.spillRetained()
+}
+
+func (b *ReceiptBatcher) run(ctx context.Context) {
+	ticker := time.NewTicker(b.flushInterval)
+	defer ticker.Stop()
+
+	b.replay(ctx, b.stop)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-b.stop:
+			return
+
+		case <-b.flushCh:
+			b.flush(ctx)
+
+		case <-ticker.C:
+			b.flush(ctx)
+			b.replay(ctx, b.stop)
+		}
+	}
+}
+
+func (b *ReceiptBatcher) flush(ctx context.Context) {
+	if err := b.flushBatches(ctx, b.stop); err != nil && ctx.Err() == nil {
+		logs.Error(errors.New("flushing receipts failed").Wrap(err))
+	}
+}
+
+// flushBatches sends the batches retained after a queue failure and the
+// buffered receipts. Retries stop when the given channel is closed.
+func (b *ReceiptBatcher) flushBatches(ctx context.Context, stop <-chan struct{}) error {
+	b.mutex.Lock()
+	batches := b.retained
+	b.retained = nil
+	if len(b.pending) != 0 {
+		batches = append(batches, ReceiptBatch{
+			ID:       uuid.NewString(),
+			Receipts: b.pending,
+		})
+		b.pending = nil
+	}
+	b.mutex.Unlock()
+
+	var err error
+	for _, batch := range batches {
+		serr := b.send(ctx, stop, batch)
+		if serr == nil {
+			continue
+		}
+
+		if qerr := b.spill(batch, serr); qerr != nil {
+			serr = qerr
+		}
+		if err == nil {
+			err = serr
+		}
+	}
+	return err
+}
+
+// replay sends the queued batches, oldest first, until the queue is empty, a
+// batch fails or the given channel is closed. A batch is removed from the
+// queue as soon as it is delivered.
+func (b *ReceiptBatcher) replay(ctx context.Context, stop <-chan struct{}) {
+	for ctx.Err() == nil && !isClosed(stop) {
+		batch, ok, err := b.queue.Peek()
+		if err != nil {
+			logs.Error(errors.New("reading receipt queue failed").Wrap(err))
+			return
+		}
+		if !ok {
+			return
+		}
+
+		err = b.send(ctx, stop, batch)
+		if err != nil && (isRetryableError(err) || b.deadLetter == nil) {
+			if ctx.Err() == nil {
+				logs.WithTag("batch_id", batch.ID).
+					WithTag("count", len(batch.Receipts)).
+					Warn(errors.New("replaying queued receipts failed").Wrap(err))
+			}
+			return
+		}
+
+		if err != nil {
+			if err := b.deadLetter.Push(batch); err != nil {
+				logs.Error(errors.New("moving rejected receipts to dead letter queue failed").
+					WithTag("batch_id", batch.ID).
+					Wrap(err))
+				return
+			}
+
+			logs.WithTag("batch_id", batch.ID).
+				WithTag("count", len(batch.Receipts)).
+				Error(errors.New("ncs rejected queued receipts, moved to dead letter queue").Wrap(err))
+		}
+
+		if err := b.queue.Remove(batch.ID); err != nil {
+			logs.Error(errors.New("removing queued receipts failed").
+				WithTag("batch_id", batch.ID).
+				Wrap(err))
+			return
+		}
+	}
+}
+
+// send sends the given batch, retrying on network errors, 429 and 5xx status
+// codes until the maximum number of attempts is reached, the context is done
+// or the given channel is closed.
+func (b *ReceiptBatcher) send(ctx context.Context, stop <-chan struct{}, batch ReceiptBatch) error {
+	delay := b.initialBackoff
+
+	for attempt := 1; ; attempt++ {
+		err := b.client.PostReceiptBatch(ctx, batch.ID, batch.Receipts)
+		if err == nil {
+			logs.WithTag("batch_id", batch.ID).
+				WithTag("count", len(batch.Receipts)).
+				WithTag("attempt", attempt).
+				Debug("receipts sent to ncs")
+			return nil
+		}
+
+		if !isRetryableError(err) {
+			return err
+		}
+
+		if attempt >= b.maxAttempts || ctx.Err() != nil {
+			return err
+		}
+
+		logs.WithTag("batch_id", batch.ID).
+			WithTag("count", len(batch.Receipts)).
+			WithTag("attempt", attempt).
+			WithTag("delay", delay).
+			WithTag("error", err).
+			Debug("retrying receipts")
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-stop:
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+
+		if delay *= 2; delay > b.maxBackoff {
+			delay = b.maxBackoff
+		}
+	}
+}
+
+// spill pushes the given batch that failed with the given error to the dead
+// letter queue when NCS rejected it, or to the receipt queue otherwise. When
+// the queue fails, the batch is retained in memory to be sent with the next
+// flush.
+func (b *ReceiptBatcher) spill(batch ReceiptBatch, sendErr error) error {
+	queue := b.queue
+	msg := "receipts could not be sent to ncs, spilled to queue"
+	if !isRetryableError(sendErr) {
+		msg = "ncs rejected receipts, kept in queue"
+		if b.deadLetter != nil {
+			queue = b.deadLetter
+			msg = "ncs rejected receipts, moved to dead letter queue"
+		}
+	}
+
+	if err := queue.Push(batch); err != nil {
+		b.mutex.Lock()
+		b.retained = append(b.retained, batch)
+		b.mutex.Unlock()
+
+		return errors.New("spilling receipts to queue failed").
+			WithTag("batch_id", batch.ID).
+			WithTag("count", len(batch.Receipts)).
+			Wrap(err)
+	}
+
+	logs.WithTag("batch_id", batch.ID).
+		WithTag("count", len(batch.Receipts)).
+		Warn(errors.New(msg).Wrap(sendErr))
+	return nil
+}
+
+// spillRetained pushes the batches retained in memory and the buffered
+// receipts to the receipt queue.
+func (b *ReceiptBatcher) spillRetained() error {
+	b.mutex.Lock()
+	batches := b.retained
+	b.retained = nil
+	if len(b.pending) != 0 {
+		batches = append(batches, ReceiptBatch{
+			ID:       uuid.NewString(),
+			Receipts: b.pending,
+		})
+		b.pending = nil
+	}
+	b.mutex.Unlock()
+
+	var err error
+	for _, batch := range batches {
+		if qerr := b.queue.Push(batch); qerr != nil && err == nil {
+			err = errors.New("spilling receipts to queue failed").
+				WithTag("batch_id", batch.ID).
+				WithTag("count", len(batch.Receipts)).
+				Wrap(qerr)
+		}
+	}
+	return err
+}
+
+func isClosed(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
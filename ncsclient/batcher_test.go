@@ -0,0 +1,382 @@
+package ncsclient
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aukilabs/go-tooling/pkg/errors"
+	"github.com/aukilabs/go-tooling/pkg/logs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReceiptBatcher(t *testing.T) {
+	setupTestLog(t)
+
+	type ncs struct {
+		*httptest.Server
+		mutex    sync.Mutex
+		batches  [][]ReceiptPayload
+		batchIDs []string
+		failures int32
+	}
+
+	newNCS := func(failures int32) *ncs {
+		n := &ncs{failures: failures}
+		n.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			require.Equal(t, "/receipts", r.URL.Path)
+
+			n.mutex.Lock()
+			n.batchIDs = append(n.batchIDs, r.Header.Get("Idempotency-Key"))
+			n.mutex.Unlock()
+
+			if atomic.AddInt32(&n.failures, -1) >= 0 {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			var batch []ReceiptPayload
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&batch))
+
+			n.mutex.Lock()
+			n.batches = append(n.batches, batch)
+			n.mutex.Unlock()
+		}))
+		return n
+	}
+
+	received := func(n *ncs) [][]ReceiptPayload {
+		n.mutex.Lock()
+		defer n.mutex.Unlock()
+		return append([][]ReceiptPayload(nil), n.batches...)
+	}
+
+	receipt := func(id string) ReceiptPayload {
+		return NewReceiptPayloadFromParams(id, []byte("hash"), []byte("signature"))
+	}
+
+	t.Run("receipts are flushed once the batch size is reached", func(t *testing.T) {
+		n := newNCS(0)
+		defer n.Close()
+
+		client := NewNCSClient(n.URL, nil)
+		batcher := NewReceiptBatcher(&client,
+			WithBatchSize(2),
+			WithFlushInterval(time.Hour),
+		)
+		require.NoError(t, batcher.Start(context.Background()))
+
+		require.NoError(t, batcher.Add(receipt("r1")))
+		require.NoError(t, batcher.Add(receipt("r2")))
+		require.Eventually(t, func() bool {
+			return len(received(n)) == 1
+		}, time.Second, time.Millisecond)
+		require.Equal(t, []ReceiptPayload{receipt("r1"), receipt("r2")}, received(n)[0])
+
+		require.NoError(t, batcher.Add(receipt("r3")))
+		require.NoError(t, batcher.Close(context.Background()))
+		require.Len(t, received(n), 2)
+		require.ErrorIs(t, batcher.Add(receipt("r4")), ErrReceiptBatcherClosed)
+	})
+
+	t.Run("failed batches are retried", func(t *testing.T) {
+		n := newNCS(1)
+		defer n.Close()
+
+		client := NewNCSClient(n.URL, nil)
+		batcher := NewReceiptBatcher(&client,
+			WithMaxAttempts(2),
+			WithBackoff(time.Millisecond, time.Millisecond),
+		)
+
+		require.NoError(t, batcher.Add(receipt("r1")))
+		require.NoError(t, batcher.Flush(context.Background()))
+		require.Len(t, received(n), 1)
+
+		n.mutex.Lock()
+		defer n.mutex.Unlock()
+		require.Len(t, n.batchIDs, 2)
+		require.NotEmpty(t, n.batchIDs[0])
+		require.Equal(t, n.batchIDs[0], n.batchIDs[1])
+	})
+
+	t.Run("rejected batches are kept in the queue", func(t *testing.T) {
+		var calls int32
+		n := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+			w.WriteHeader(http.StatusUnauthorized)
+		}))
+		defer n.Close()
+
+		queue := NewMemoryReceiptQueue()
+		client := NewNCSClient(n.URL, nil)
+		batcher := NewReceiptBatcher(&client,
+			WithMaxAttempts(3),
+			WithBackoff(time.Millisecond, time.Millisecond),
+			WithReceiptQueue(queue),
+		)
+
+		require.NoError(t, batcher.Add(receipt("r1")))
+
+		var apiErr *APIError
+		require.True(t, errors.As(batcher.Flush(context.Background()), &apiErr))
+		require.Equal(t, http.StatusUnauthorized, apiErr.StatusCode)
+		require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+		require.Equal(t, 1, queue.Len())
+
+		batcher.replay(context.Background(), nil)
+		require.Equal(t, int32(2), atomic.LoadInt32(&calls))
+		require.Equal(t, 1, queue.Len())
+	})
+
+	t.Run("rejected batches are moved to the dead letter queue", func(t *testing.T) {
+		n := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+		}))
+		defer n.Close()
+
+		queue := NewMemoryReceiptQueue()
+		require.NoError(t, queue.Push(ReceiptBatch{ID: "queued", Receipts: []ReceiptPayload{receipt("r1")}}))
+
+		deadLetter := NewMemoryReceiptQueue()
+		client := NewNCSClient(n.URL, nil)
+		batcher := NewReceiptBatcher(&client,
+			WithReceiptQueue(queue),
+			WithDeadLetterQueue(deadLetter),
+		)
+
+		require.NoError(t, batcher.Add(receipt("r2")))
+		require.Error(t, batcher.Flush(context.Background()))
+		require.Equal(t, 1, queue.Len())
+		require.Equal(t, 1, deadLetter.Len())
+
+		batcher.replay(context.Background(), nil)
+		require.Zero(t, queue.Len())
+		require.Equal(t, 2, deadLetter.Len())
+
+		batch, ok, err := deadLetter.Peek()
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, []ReceiptPayload{receipt("r2")}, batch.Receipts)
+	})
+
+	t.Run("unsent batches are spilled and replayed on restart", func(t *testing.T) {
+		dir := t.TempDir()
+
+		queue, err := NewFileReceiptQueue(dir)
+		require.NoError(t, err)
+
+		down := httptest.NewServer(http.NotFoundHandler())
+		down.Close()
+
+		client := NewNCSClient(down.URL, nil)
+		batcher := NewReceiptBatcher(&client,
+			WithMaxAttempts(1),
+			WithReceiptQueue(queue),
+		)
+		require.NoError(t, batcher.Add(receipt("r1")))
+		require.NoError(t, batcher.Add(receipt("r2")))
+		require.Error(t, batcher.Flush(context.Background()))
+		require.NoError(t, batcher.Add(receipt("r3")))
+		require.NoError(t, batcher.Close(context.Background()))
+
+		count, err := queue.Len()
+		require.NoError(t, err)
+		require.Equal(t, 2, count)
+
+		n := newNCS(0)
+		defer n.Close()
+
+		queue, err = NewFileReceiptQueue(dir)
+		require.NoError(t, err)
+
+		client = NewNCSClient(n.URL, nil)
+		batcher = NewReceiptBatcher(&client, WithReceiptQueue(queue))
+		batcher.replay(context.Background(), nil)
+
+		batches := received(n)
+		require.Len(t, batches, 2)
+		require.Equal(t, []ReceiptPayload{receipt("r1"), receipt("r2")}, batches[0])
+		require.Equal(t, []ReceiptPayload{receipt("r3")}, batches[1])
+
+		count, err = queue.Len()
+		require.NoError(t, err)
+		require.Zero(t, count)
+	})
+
+	t.Run("close waits for the replay in flight", func(t *testing.T) {
+		arrived := make(chan struct{})
+		release := make(chan struct{})
+
+		var calls int32
+		n := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&calls, 1) == 1 {
+				close(arrived)
+				<-release
+			}
+		}))
+		defer n.Close()
+
+		queue := NewMemoryReceiptQueue()
+		require.NoError(t, queue.Push(ReceiptBatch{ID: "b1", Receipts: []ReceiptPayload{receipt("r1")}}))
+		require.NoError(t, queue.Push(ReceiptBatch{ID: "b2", Receipts: []ReceiptPayload{receipt("r2")}}))
+
+		client := NewNCSClient(n.URL, nil)
+		batcher := NewReceiptBatcher(&client, WithReceiptQueue(queue))
+		require.NoError(t, batcher.Start(context.Background()))
+		<-arrived
+
+		closed := make(chan error)
+		go func() {
+			closed <- batcher.Close(context.Background())
+		}()
+
+		// Close must not return before the request in flight completes.
+		select {
+		case err := <-closed:
+			t.Fatalf("close returned before the replay completed: %v", err)
+		default:
+		}
+
+		close(release)
+		require.NoError(t, <-closed)
+
+		// The delivered batch is removed and the replay stops before the next.
+		require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+		require.Equal(t, 1, queue.Len())
+
+		batch, ok, err := queue.Peek()
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, "b2", batch.ID)
+	})
+}
+
+func TestFileReceiptQueue(t *testing.T) {
+	setupTestLog(t)
+
+	dir := t.TempDir()
+	queue, err := NewFileReceiptQueue(dir)
+	require.NoError(t, err)
+
+	require.NoError(t, queue.Push(ReceiptBatch{ID: "b1"}))
+	require.NoError(t, queue.Push(ReceiptBatch{ID: "b2"}))
+
+	names, err := queue.names()
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, names[0]), []byte("{not json"), 0600))
+
+	batch, ok, err := queue.Peek()
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "b2", batch.ID)
+
+	corrupt, err := filepath.Glob(filepath.Join(dir, "*.corrupt"))
+	require.NoError(t, err)
+	require.Len(t, corrupt, 1)
+
+	require.NoError(t, queue.Remove("b2"))
+	count, err := queue.Len()
+	require.NoError(t, err)
+	require.Zero(t, count)
+
+	t.Run("remove matches the exact batch id", func(t *testing.T) {
+		queue, err := NewFileReceiptQueue(t.TempDir())
+		require.NoError(t, err)
+
+		require.NoError(t, queue.Push(ReceiptBatch{ID: "x-b"}))
+		require.NoError(t, queue.Push(ReceiptBatch{ID: "b"}))
+
+		require.NoError(t, queue.Remove("b"))
+		batch, ok, err := queue.Peek()
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, "x-b", batch.ID)
+
+		count, err := queue.Len()
+		require.NoError(t, err)
+		require.Equal(t, 1, count)
+	})
+}
+
+func TestNCSClientPostReceipt(t *testing.T) {
+	setupTestLog(t)
+
+	ncs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ncs.Close()
+
+	client := NewNCSClient(ncs.URL, nil)
+	err := client.PostReceipt(context.Background(), NewReceiptPayloadFromParams("r1", nil, nil))
+
+	var apiErr *APIError
+	require.True(t, errors.As(err, &apiErr))
+	require.Equal(t, http.StatusInternalServerError, apiErr.StatusCode)
+	require.True(t, apiErr.Temporary())
+}
+
+func TestNCSClientPostReceiptBatch(t *testing.T) {
+	setupTestLog(t)
+
+	t.Run("receipts are posted one by one when batches are not supported", func(t *testing.T) {
+		var mutex sync.Mutex
+		var receipts []string
+		ncs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/receipt" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			var payload ReceiptPayload
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+
+			mutex.Lock()
+			receipts = append(receipts, payload.Receipt)
+			mutex.Unlock()
+		}))
+		defer ncs.Close()
+
+		client := NewNCSClient(ncs.URL, nil)
+		require.NoError(t, client.PostReceiptBatch(context.Background(), "b1", []ReceiptPayload{
+			NewReceiptPayloadFromParams("r1", nil, nil),
+			NewReceiptPayloadFromParams("r2", nil, nil),
+		}))
+		require.Equal(t, []string{"r1", "r2"}, receipts)
+	})
+
+	t.Run("fallback errors are reported", func(t *testing.T) {
+		ncs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/receipt" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer ncs.Close()
+
+		client := NewNCSClient(ncs.URL, nil)
+		err := client.PostReceiptBatch(context.Background(), "b1", []ReceiptPayload{
+			NewReceiptPayloadFromParams("r1", nil, nil),
+		})
+
+		var apiErr *APIError
+		require.True(t, errors.As(err, &apiErr))
+		require.Equal(t, http.StatusServiceUnavailable, apiErr.StatusCode)
+		require.True(t, apiErr.Temporary())
+	})
+}
+
+func setupTestLog(tb testing.TB) {
+	logs.SetLogger(func(e logs.Entry) { tb.Log(e) })
+	logs.Encoder = func(v any) ([]byte, error) {
+		return json.MarshalIndent(v, "", "  ")
+	}
+}
@@ -4,63 +4,124 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"io"
 	"net/http"
 
 	"github.com/aukilabs/go-tooling/pkg/errors"
+	"github.com/aukilabs/hagall-common/crypt"
 	httpcmn "github.com/aukilabs/hagall-common/http"
-	"github.com/ethereum/go-ethereum/crypto"
+)
+
+const (
+	idempotencyKeyHeader = "Idempotency-Key"
 )
 
 // NCSClient is the Network Credit Service client.
 type NCSClient struct {
 	Endpoint  string
 	Transport http.RoundTripper
+
+	interceptors []httpcmn.Interceptor
 }
 
 // NewNCSClient returns a new NCS client with the NCS endpoint and
 // a HTTP roundtripper.
-func NewNCSClient(endpoint string, transport http.RoundTripper) NCSClient {
+func NewNCSClient(endpoint string, transport http.RoundTripper, opts ...NCSClientOpts) NCSClient {
 	if transport == nil {
 		transport = http.DefaultTransport
 	}
 
-	return NCSClient{
+	c := NCSClient{
 		Endpoint:  httpcmn.NormalizeEndpoint(endpoint),
 		Transport: transport,
 	}
+
+	for _, opt := range opts {
+		opt(&c)
+	}
+
+	if len(c.interceptors) != 0 {
+		c.Transport = httpcmn.ChainInterceptors(c.Transport, c.interceptors...)
+	}
+	return c
 }
 
 type ReceiptPayload struct {
 	Receipt   string `json:"receipt"`
 	Hash      []byte `json:"hash"`
 	Signature []byte `json:"signature"`
+
+	// The scheme used to hash the receipt. Empty for raw Keccak256 hashes.
+	Scheme crypt.SignatureScheme `json:"scheme,omitempty"`
+
+	// The chain ID bound to EIP-712 receipt signatures.
+	ChainID int64 `json:"chain_id,omitempty"`
 }
 
 // NewReceiptPayload returns a receipt payload signed with privateKeyString.
 func NewReceiptPayload(receipt Receipt, privateKeyString string) (ReceiptPayload, error) {
-	privateKey, err := crypto.HexToECDSA(privateKeyString)
+	return NewReceiptPayloadWithScheme(receipt, privateKeyString, crypt.SignatureSchemeRaw, 0)
+}
+
+// NewReceiptPayloadWithScheme returns a receipt payload signed with
+// privateKeyString and the given scheme. EIP-712 signatures are bound to the
+// ncs-receipt purpose and the given chain ID.
+func NewReceiptPayloadWithScheme(receipt Receipt, privateKeyString string, scheme crypt.SignatureScheme, chainID int64) (ReceiptPayload, error) {
+	signer, err := crypt.NewHexKeySigner(privateKeyString)
 	if err != nil {
 		return ReceiptPayload{}, errors.New("hex to ecdsa error").Wrap(err)
 	}
+	return NewReceiptPayloadWithSigner(context.Background(), receipt, DefaultReceiptVersion, signer, scheme, chainID)
+}
 
-	receiptJSON, err := EncodeReceipt(receipt)
+// NewReceiptPayloadWithSigner returns a receipt payload encoded with the given
+// receipt version and signed with the given signer and scheme. EIP-712
+// signatures are bound to the ncs-receipt purpose and the given chain ID.
+//
+// Use ReceiptVersion1 to sign the canonical receipt encoding, whose signature
+// does not depend on the receipt time zones and field order.
+func NewReceiptPayloadWithSigner(ctx context.Context, receipt Receipt, version int, signer crypt.Signer, scheme crypt.SignatureScheme, chainID int64) (ReceiptPayload, error) {
+	receiptJSON, err := EncodeReceiptVersion(receipt, version)
 	if err != nil {
 		return ReceiptPayload{}, errors.New("error encoding receipt").Wrap(err)
 	}
 
-	hash := crypto.Keccak256Hash([]byte(receiptJSON))
-	signature, err := crypto.Sign(hash.Bytes(), privateKey)
+	hash, err := receiptHash(scheme, chainID, receiptJSON)
+	if err != nil {
+		return ReceiptPayload{}, errors.New("error hashing receipt").Wrap(err)
+	}
+
+	signature, err := crypt.SignMessageBytes(
+		ctx,
+		signer,
+		scheme,
+		receiptDomain(chainID),
+		receiptJSON,
+	)
 	if err != nil {
 		return ReceiptPayload{}, errors.New("ecdsa sign error").Wrap(err)
 	}
 
 	return ReceiptPayload{
 		Receipt:   receiptJSON,
-		Hash:      hash.Bytes(),
+		Hash:      hash,
 		Signature: signature,
+		Scheme:    scheme,
+		ChainID:   chainID,
 	}, nil
 }
 
+// receiptHash returns the hash of the given encoded receipt signed with the
+// given scheme.
+func receiptHash(scheme crypt.SignatureScheme, chainID int64, receipt string) ([]byte, error) {
+	return crypt.MessageHash(scheme, receiptDomain(chainID), receipt)
+}
+
+// receiptDomain returns the EIP-712 domain receipts are signed in.
+func receiptDomain(chainID int64) crypt.TypedDataDomain {
+	return crypt.NewTypedDataDomain(crypt.PurposeNCSReceipt, chainID)
+}
+
 func NewReceiptPayloadFromParams(receipt string, hash []byte, signature []byte) ReceiptPayload {
 	return ReceiptPayload{
 		Receipt:   receipt,
@@ -70,32 +131,107 @@ func NewReceiptPayloadFromParams(receipt string, hash []byte, signature []byte)
 }
 
 // PostReceipt sends receipts to Network Credit Service /receipt endpoint.
+//
+// It returns an APIError when NCS responds with a status code greater or
+// equal to 400.
 func (c *NCSClient) PostReceipt(ctx context.Context, payload ReceiptPayload) error {
-	path := "/receipt"
+	if err := c.post(ctx, "/receipt", payload, nil); err != nil {
+		return errors.New("posting receipt failed").Wrap(err)
+	}
+	return nil
+}
+
+// PostReceipts sends a batch of receipts to Network Credit Service /receipts
+// endpoint.
+//
+// It returns an APIError when NCS responds with a status code greater or
+// equal to 400.
+func (c *NCSClient) PostReceipts(ctx context.Context, payloads []ReceiptPayload) error {
+	return c.PostReceiptBatch(ctx, "", payloads)
+}
+
+// PostReceiptBatch sends a batch of receipts to Network Credit Service
+// /receipts endpoint. The batch ID is sent in the Idempotency-Key header so
+// that NCS ingests a batch only once when it is sent several times.
+//
+// POST /receipts is a proposed NCS API: NCS versions that do not serve it
+// respond with a 404, in which case the receipts are sent one by one with
+// PostReceipt. Those are not idempotent, so a batch that fails halfway sends
+// its first receipts again when it is retried.
+//
+// It returns an APIError when NCS responds with a status code greater or
+// equal to 400.
+func (c *NCSClient) PostReceiptBatch(ctx context.Context, batchID string, payloads []ReceiptPayload) error {
+	var header http.Header
+	if batchID != "" {
+		header = http.Header{idempotencyKeyHeader: {batchID}}
+	}
+
+	err := c.post(ctx, "/receipts", payloads, header)
+
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+		err = c.postReceiptsOneByOne(ctx, payloads)
+	}
 
-	body, err := json.Marshal(payload)
 	if err != nil {
-		return errors.New("marshalling receipt failed").Wrap(err)
+		return errors.New("posting receipts failed").
+			WithTag("batch_id", batchID).
+			WithTag("count", len(payloads)).
+			Wrap(err)
+	}
+	return nil
+}
+
+// postReceiptsOneByOne sends the given receipts to the /receipt endpoint,
+// stopping at the first failure.
+func (c *NCSClient) postReceiptsOneByOne(ctx context.Context, payloads []ReceiptPayload) error {
+	for i, payload := range payloads {
+		if err := c.PostReceipt(ctx, payload); err != nil {
+			return errors.New("posting receipts one by one failed").
+				WithTag("index", i).
+				Wrap(err)
+		}
+	}
+	return nil
+}
+
+func (c *NCSClient) post(ctx context.Context, path string, in interface{}, header http.Header) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return errors.New("marshalling body failed").Wrap(err)
 	}
 
-	url := c.Endpoint + path
 	req, err := http.NewRequestWithContext(ctx,
 		http.MethodPost,
-		url,
+		c.Endpoint+path,
 		bytes.NewReader(body),
 	)
 	if err != nil {
 		return errors.New("creating request failed").Wrap(err)
 	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range header {
+		req.Header[k] = v
+	}
 
 	httpcli := http.Client{
 		Transport: c.Transport,
 	}
 
-	_, err = httpcli.Do(req)
+	res, err := httpcli.Do(req)
 	if err != nil {
-		return errors.New("posting receipt failed").Wrap(err)
+		return errors.New("request failed").Wrap(err)
 	}
+	defer res.Body.Close()
 
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return errors.New("reading response failed").Wrap(err)
+	}
+
+	if res.StatusCode >= 400 {
+		return newAPIError(res, resBody)
+	}
 	return nil
 }
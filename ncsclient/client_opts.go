@@ -0,0 +1,15 @@
+package ncsclient
+
+import (
+	httpcmn "github.com/aukilabs/hagall-common/http"
+)
+
+type NCSClientOpts func(*NCSClient)
+
+// WithInterceptors sets interceptors that wrap the client transport. They are
+// applied, in order, once all the other options are set.
+func WithInterceptors(v ...httpcmn.Interceptor) NCSClientOpts {
+	return func(c *NCSClient) {
+		c.interceptors = append(c.interceptors, v...)
+	}
+}
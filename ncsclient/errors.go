@@ -0,0 +1,72 @@
+package ncsclient
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/aukilabs/go-tooling/pkg/errors"
+)
+
+const (
+	maxAPIErrorMessageLength = 1024
+)
+
+// APIError is the error returned when the Network Credit Service responds
+// with a status code greater or equal to 400.
+type APIError struct {
+	// The HTTP status code.
+	StatusCode int
+
+	// The HTTP status text.
+	Status string
+
+	// The error message returned by NCS.
+	Message string
+}
+
+// Error satisfies the error interface.
+func (e *APIError) Error() string {
+	var b strings.Builder
+	b.WriteString("ncs request failed: ")
+	b.WriteString(e.Status)
+	if e.Status == "" {
+		b.WriteString(strconv.Itoa(e.StatusCode))
+	}
+
+	if e.Message != "" {
+		b.WriteString(": ")
+		b.WriteString(e.Message)
+	}
+	return b.String()
+}
+
+// Temporary reports whether the request that caused the error can be retried.
+func (e *APIError) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// newAPIError creates an APIError from a NCS response and its body.
+func newAPIError(res *http.Response, body []byte) *APIError {
+	message := string(bytes.TrimSpace(body))
+	if len(message) > maxAPIErrorMessageLength {
+		message = message[:maxAPIErrorMessageLength]
+	}
+
+	return &APIError{
+		StatusCode: res.StatusCode,
+		Status:     res.Status,
+		Message:    message,
+	}
+}
+
+// isRetryableError reports whether a request that failed with the given error
+// can be sent again.
+func isRetryableError(err error) bool {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Temporary()
+	}
+	return err != nil
+}
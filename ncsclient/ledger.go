@@ -0,0 +1,411 @@
+package ncsclient
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aukilabs/go-tooling/pkg/errors"
+)
+
+var (
+	// Error returned when ingesting a receipt that was already ingested.
+	ErrDuplicateReceipt = errors.New("duplicate receipt")
+
+	// Error returned when ingesting a receipt whose participant stay overlaps
+	// another stay of an ingested receipt, or that reports a different usage
+	// than an ingested receipt for the same stay and creation time.
+	ErrOverlappingReceipt = errors.New("overlapping receipt")
+)
+
+// UsageGrouping describes the receipt fields usage is aggregated by. Values
+// can be combined with a bitwise OR.
+type UsageGrouping int
+
+const (
+	GroupByApp UsageGrouping = 1 << iota
+	GroupByClient
+	GroupBySession
+	GroupByWallet
+
+	GroupByAll = GroupByApp | GroupByClient | GroupBySession | GroupByWallet
+)
+
+// UsageSummary is the usage aggregated over a time window. Fields that are not
+// part of the grouping are empty.
+type UsageSummary struct {
+	AppID            string    `json:"app_id,omitempty"`
+	ClientID         string    `json:"client_id,omitempty"`
+	SessionID        string    `json:"session_id,omitempty"`
+	HagallWalletAddr string    `json:"hagall_wallet_addr,omitempty"`
+	WindowStart      time.Time `json:"window_start"`
+	WindowEnd        time.Time `json:"window_end"`
+
+	// The number of participant stays reported in the window. The cumulative
+	// receipts of a stay count once per window.
+	ReceiptCount int `json:"receipt_count"`
+
+	// The number of distinct participants.
+	ParticipantCount int `json:"participant_count"`
+
+	BytesSent     int64 `json:"bytes_sent"`
+	BytesReceived int64 `json:"bytes_received"`
+
+	// The cumulated time participants spent in sessions during the window, as
+	// reported by the receipts created in it.
+	ConnectedSeconds float64 `json:"connected_seconds"`
+}
+
+// UsageSummaries is a list of usage summaries.
+type UsageSummaries []UsageSummary
+
+var usageCSVHeader = []string{
+	"app_id",
+	"client_id",
+	"session_id",
+	"hagall_wallet_addr",
+	"window_start",
+	"window_end",
+	"receipt_count",
+	"participant_count",
+	"bytes_sent",
+	"bytes_received",
+	"connected_seconds",
+}
+
+// WriteJSON writes the summaries as a JSON array.
+func (s UsageSummaries) WriteJSON(w io.Writer) error {
+	if s == nil {
+		s = UsageSummaries{}
+	}
+
+	if err := json.NewEncoder(w).Encode(s); err != nil {
+		return errors.New("encoding usage summaries failed").Wrap(err)
+	}
+	return nil
+}
+
+// WriteCSV writes the summaries as CSV, with a header row. Times are formatted
+// with RFC 3339.
+func (s UsageSummaries) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(usageCSVHeader); err != nil {
+		return errors.New("writing csv header failed").Wrap(err)
+	}
+
+	for _, u := range s {
+		err := cw.Write([]string{
+			u.AppID,
+			u.ClientID,
+			u.SessionID,
+			u.HagallWalletAddr,
+			formatWindowTime(u.WindowStart),
+			formatWindowTime(u.WindowEnd),
+			strconv.Itoa(u.ReceiptCount),
+			strconv.Itoa(u.ParticipantCount),
+			strconv.FormatInt(u.BytesSent, 10),
+			strconv.FormatInt(u.BytesReceived, 10),
+			strconv.FormatFloat(u.ConnectedSeconds, 'f', -1, 64),
+		})
+		if err != nil {
+			return errors.New("writing csv row failed").Wrap(err)
+		}
+	}
+
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return errors.New("flushing csv failed").Wrap(err)
+	}
+	return nil
+}
+
+func formatWindowTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+// ReceiptConflict describes a receipt rejected by a UsageLedger.
+type ReceiptConflict struct {
+	// The rejected receipt.
+	Receipt Receipt
+
+	// The ingested receipt it conflicts with.
+	Existing Receipt
+
+	// ErrDuplicateReceipt or ErrOverlappingReceipt.
+	Err error
+}
+
+// UsageLedger aggregates the usage reported by receipts.
+//
+// A receipt covers the stay of a participant in a session, from the time it
+// joined to the receipt creation. Receipts are cumulative: Hagall can send
+// several receipts for the same stay, with the same join time, each one
+// reporting the usage since the join. A receipt accounts for the usage and
+// connected time since the previous receipt of its stay, in the window of its
+// creation time, so that stays spanning several windows are split between
+// them.
+//
+// Receipts that are duplicated, that disagree with an ingested receipt for the
+// same stay and creation time, or whose stay overlaps another stay of the same
+// session and participant, are rejected and recorded as conflicts.
+type UsageLedger struct {
+	window time.Duration
+
+	mutex     sync.Mutex
+	receipts  []Receipt
+	stays     map[participantKey][]int
+	conflicts []ReceiptConflict
+}
+
+type participantKey struct {
+	sessionID     string
+	participantID int
+}
+
+// NewUsageLedger creates a ledger that aggregates usage over time windows of
+// the given duration, aligned on the Unix epoch. Receipts belong to the window
+// of their creation time. A zero window aggregates all the receipts together.
+func NewUsageLedger(window time.Duration) *UsageLedger {
+	return &UsageLedger{
+		window: window,
+		stays:  make(map[participantKey][]int),
+	}
+}
+
+// Ingest adds the given receipts to the ledger. It returns an error that
+// wraps ErrDuplicateReceipt or ErrOverlappingReceipt for the first rejected
+// receipt. Receipts that are not rejected are ingested regardless.
+func (l *UsageLedger) Ingest(receipts ...Receipt) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var err error
+	for _, r := range receipts {
+		if ierr := l.ingest(r); ierr != nil && err == nil {
+			err = ierr
+		}
+	}
+	return err
+}
+
+func (l *UsageLedger) ingest(r Receipt) error {
+	key := participantKey{
+		sessionID:     r.SessionID,
+		participantID: r.ParticipantID,
+	}
+
+	for _, i := range l.stays[key] {
+		existing := l.receipts[i]
+
+		var conflict error
+		switch {
+		case sameReceipt(existing, r):
+			conflict = ErrDuplicateReceipt
+
+		case r.SessionJoinedAt.Equal(existing.SessionJoinedAt):
+			if !r.CreatedAt.Equal(existing.CreatedAt) {
+				// Another cumulative receipt of the same stay.
+				continue
+			}
+			conflict = ErrOverlappingReceipt
+
+		case r.SessionJoinedAt.Before(existing.CreatedAt) && existing.SessionJoinedAt.Before(r.CreatedAt):
+			conflict = ErrOverlappingReceipt
+
+		default:
+			continue
+		}
+
+		l.conflicts = append(l.conflicts, ReceiptConflict{
+			Receipt:  r,
+			Existing: existing,
+			Err:      conflict,
+		})
+		return errors.New("ingesting receipt failed").
+			WithTag("session_id", r.SessionID).
+			WithTag("participant_id", r.ParticipantID).
+			WithTag("created_at", r.CreatedAt).
+			Wrap(conflict)
+	}
+
+	l.stays[key] = append(l.stays[key], len(l.receipts))
+	l.receipts = append(l.receipts, r)
+	return nil
+}
+
+// Conflicts returns the rejected receipts, in the order they were ingested.
+func (l *UsageLedger) Conflicts() []ReceiptConflict {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return append([]ReceiptConflict(nil), l.conflicts...)
+}
+
+// Summaries returns the usage aggregated by the given grouping and by time
+// window, sorted by window then by grouping fields.
+func (l *UsageLedger) Summaries(by UsageGrouping) UsageSummaries {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	type summaryKey struct {
+		appID       string
+		clientID    string
+		sessionID   string
+		walletAddr  string
+		windowStart time.Time
+	}
+
+	summaries := make(map[summaryKey]*UsageSummary)
+	participants := make(map[summaryKey]map[participantKey]struct{})
+	connected := make(map[summaryKey]time.Duration)
+
+	for _, stay := range l.stayReceipts() {
+		var previous Receipt
+		for i, r := range stay {
+			var key summaryKey
+			if by&GroupByApp != 0 {
+				key.appID = r.AppID
+			}
+			if by&GroupByClient != 0 {
+				key.clientID = r.ClientID
+			}
+			if by&GroupBySession != 0 {
+				key.sessionID = r.SessionID
+			}
+			if by&GroupByWallet != 0 {
+				key.walletAddr = r.HagallWalletAddr
+			}
+			key.windowStart = l.windowStart(r.CreatedAt)
+
+			s, ok := summaries[key]
+			if !ok {
+				s = &UsageSummary{
+					AppID:            key.appID,
+					ClientID:         key.clientID,
+					SessionID:        key.sessionID,
+					HagallWalletAddr: key.walletAddr,
+				}
+				if l.window > 0 {
+					s.WindowStart = key.windowStart
+					s.WindowEnd = key.windowStart.Add(l.window)
+				}
+				summaries[key] = s
+				participants[key] = make(map[participantKey]struct{})
+			}
+
+			// The usage reported since the previous receipt of the stay.
+			since := r.SessionJoinedAt
+			if i > 0 {
+				since = previous.CreatedAt
+				s.BytesSent -= previous.BytesSent
+				s.BytesReceived -= previous.BytesReceived
+			}
+			if i == 0 || !l.windowStart(previous.CreatedAt).Equal(key.windowStart) {
+				s.ReceiptCount++
+			}
+			s.BytesSent += r.BytesSent
+			s.BytesReceived += r.BytesReceived
+			if d := r.CreatedAt.Sub(since); d > 0 {
+				connected[key] += d
+			}
+
+			participants[key][participantKey{
+				sessionID:     r.SessionID,
+				participantID: r.ParticipantID,
+			}] = struct{}{}
+			s.ParticipantCount = len(participants[key])
+			previous = r
+		}
+	}
+
+	res := make(UsageSummaries, 0, len(summaries))
+	for key, s := range summaries {
+		s.ConnectedSeconds = connected[key].Seconds()
+		res = append(res, *s)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		a, b := res[i], res[j]
+		switch {
+		case !a.WindowStart.Equal(b.WindowStart):
+			return a.WindowStart.Before(b.WindowStart)
+		case a.AppID != b.AppID:
+			return a.AppID < b.AppID
+		case a.ClientID != b.ClientID:
+			return a.ClientID < b.ClientID
+		case a.SessionID != b.SessionID:
+			return a.SessionID < b.SessionID
+		default:
+			return a.HagallWalletAddr < b.HagallWalletAddr
+		}
+	})
+	return res
+}
+
+// stayReceipts returns the ingested receipts grouped by participant stay,
+// sorted by creation time.
+func (l *UsageLedger) stayReceipts() [][]Receipt {
+	type stayKey struct {
+		participantKey
+		joinedAt int64
+	}
+
+	var stays [][]Receipt
+	indexes := make(map[stayKey]int)
+	for _, r := range l.receipts {
+		key := stayKey{
+			participantKey: participantKey{
+				sessionID:     r.SessionID,
+				participantID: r.ParticipantID,
+			},
+			joinedAt: r.SessionJoinedAt.UnixNano(),
+		}
+
+		i, ok := indexes[key]
+		if !ok {
+			i = len(stays)
+			indexes[key] = i
+			stays = append(stays, nil)
+		}
+		stays[i] = append(stays[i], r)
+	}
+
+	for _, stay := range stays {
+		sort.Slice(stay, func(i, j int) bool {
+			return stay[i].CreatedAt.Before(stay[j].CreatedAt)
+		})
+	}
+	return stays
+}
+
+func (l *UsageLedger) windowStart(t time.Time) time.Time {
+	if l.window <= 0 {
+		return time.Time{}
+	}
+
+	epoch := time.Unix(0, 0).UTC()
+	elapsed := t.Sub(epoch)
+	start := elapsed - elapsed%l.window
+	if elapsed < 0 && start != elapsed {
+		start -= l.window
+	}
+	return epoch.Add(start)
+}
+
+func sameReceipt(a, b Receipt) bool {
+	return a.AppID == b.AppID &&
+		a.ClientID == b.ClientID &&
+		a.SessionID == b.SessionID &&
+		a.HagallWalletAddr == b.HagallWalletAddr &&
+		a.ParticipantID == b.ParticipantID &&
+		a.CreatedAt.Equal(b.CreatedAt) &&
+		a.SessionJoinedAt.Equal(b.SessionJoinedAt) &&
+		a.BytesSent == b.BytesSent &&
+		a.BytesReceived == b.BytesReceived
+}
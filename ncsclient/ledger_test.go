@@ -0,0 +1,173 @@
+package ncsclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUsageLedger(t *testing.T) {
+	start := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	newReceipt := func(sessionID string, participantID int, joinedAt, createdAt time.Duration) Receipt {
+		return Receipt{
+			AppID:            "app",
+			ClientID:         "client-" + sessionID,
+			SessionID:        sessionID,
+			HagallWalletAddr: "0xwallet",
+			ParticipantID:    participantID,
+			SessionJoinedAt:  start.Add(joinedAt),
+			CreatedAt:        start.Add(createdAt),
+			BytesSent:        100,
+			BytesReceived:    200,
+		}
+	}
+
+	t.Run("usage is aggregated by grouping and window", func(t *testing.T) {
+		ledger := NewUsageLedger(time.Hour)
+		require.NoError(t, ledger.Ingest(
+			newReceipt("s1", 1, 0, 10*time.Minute),
+			newReceipt("s1", 1, 10*time.Minute, 20*time.Minute),
+			newReceipt("s1", 2, 0, 30*time.Minute),
+			newReceipt("s2", 1, 50*time.Minute, 70*time.Minute),
+		))
+
+		summaries := ledger.Summaries(GroupBySession)
+		require.Len(t, summaries, 2)
+
+		s1 := summaries[0]
+		require.Equal(t, "s1", s1.SessionID)
+		require.Empty(t, s1.AppID)
+		require.Equal(t, start, s1.WindowStart)
+		require.Equal(t, start.Add(time.Hour), s1.WindowEnd)
+		require.Equal(t, 3, s1.ReceiptCount)
+		require.Equal(t, 2, s1.ParticipantCount)
+		require.Equal(t, int64(300), s1.BytesSent)
+		require.Equal(t, int64(600), s1.BytesReceived)
+		require.Equal(t, float64(50*60), s1.ConnectedSeconds)
+
+		s2 := summaries[1]
+		require.Equal(t, "s2", s2.SessionID)
+		require.Equal(t, start.Add(time.Hour), s2.WindowStart)
+
+		all := NewUsageLedger(0)
+		require.NoError(t, all.Ingest(newReceipt("s1", 1, 0, time.Minute), newReceipt("s2", 1, 0, 2*time.Hour)))
+
+		summaries = all.Summaries(GroupByApp | GroupByWallet)
+		require.Len(t, summaries, 1)
+		require.Equal(t, "app", summaries[0].AppID)
+		require.Equal(t, "0xwallet", summaries[0].HagallWalletAddr)
+		require.True(t, summaries[0].WindowStart.IsZero())
+		require.Equal(t, 2, summaries[0].ParticipantCount)
+	})
+
+	t.Run("duplicate and overlapping receipts are rejected", func(t *testing.T) {
+		ledger := NewUsageLedger(time.Hour)
+		r := newReceipt("s1", 1, 0, 10*time.Minute)
+		require.NoError(t, ledger.Ingest(r))
+
+		require.ErrorIs(t, ledger.Ingest(r), ErrDuplicateReceipt)
+		require.ErrorIs(t, ledger.Ingest(newReceipt("s1", 1, 5*time.Minute, 15*time.Minute)), ErrOverlappingReceipt)
+		require.NoError(t, ledger.Ingest(newReceipt("s1", 2, 5*time.Minute, 15*time.Minute)))
+
+		conflicts := ledger.Conflicts()
+		require.Len(t, conflicts, 2)
+		require.ErrorIs(t, conflicts[0].Err, ErrDuplicateReceipt)
+		require.ErrorIs(t, conflicts[1].Err, ErrOverlappingReceipt)
+		require.Equal(t, r, conflicts[1].Existing)
+
+		summaries := ledger.Summaries(GroupByAll)
+		require.Len(t, summaries, 1)
+		require.Equal(t, 2, summaries[0].ReceiptCount)
+	})
+
+	t.Run("cumulative receipts of the same stay are counted once", func(t *testing.T) {
+		ledger := NewUsageLedger(time.Hour)
+
+		first := newReceipt("s1", 1, 0, 10*time.Minute)
+		second := newReceipt("s1", 1, 0, 20*time.Minute)
+		second.BytesSent = 250
+		second.BytesReceived = 500
+		last := newReceipt("s1", 1, 0, 30*time.Minute)
+		last.BytesSent = 400
+		last.BytesReceived = 800
+
+		require.NoError(t, ledger.Ingest(first, last, second))
+		require.Empty(t, ledger.Conflicts())
+
+		summaries := ledger.Summaries(GroupByAll)
+		require.Len(t, summaries, 1)
+		require.Equal(t, 1, summaries[0].ReceiptCount)
+		require.Equal(t, 1, summaries[0].ParticipantCount)
+		require.Equal(t, int64(400), summaries[0].BytesSent)
+		require.Equal(t, int64(800), summaries[0].BytesReceived)
+		require.Equal(t, float64(30*60), summaries[0].ConnectedSeconds)
+
+		require.ErrorIs(t, ledger.Ingest(last), ErrDuplicateReceipt)
+
+		conflicting := last
+		conflicting.BytesSent = 1
+		require.ErrorIs(t, ledger.Ingest(conflicting), ErrOverlappingReceipt)
+		require.Len(t, ledger.Conflicts(), 2)
+	})
+
+	t.Run("stays crossing a window boundary are split between windows", func(t *testing.T) {
+		ledger := NewUsageLedger(time.Hour)
+
+		first := newReceipt("s1", 1, 50*time.Minute, 55*time.Minute)
+		last := newReceipt("s1", 1, 50*time.Minute, 70*time.Minute)
+		last.BytesSent = 400
+		last.BytesReceived = 800
+		require.NoError(t, ledger.Ingest(last, first))
+
+		summaries := ledger.Summaries(GroupBySession)
+		require.Len(t, summaries, 2)
+
+		require.Equal(t, start, summaries[0].WindowStart)
+		require.Equal(t, 1, summaries[0].ReceiptCount)
+		require.Equal(t, 1, summaries[0].ParticipantCount)
+		require.Equal(t, int64(100), summaries[0].BytesSent)
+		require.Equal(t, int64(200), summaries[0].BytesReceived)
+		require.Equal(t, float64(5*60), summaries[0].ConnectedSeconds)
+
+		require.Equal(t, start.Add(time.Hour), summaries[1].WindowStart)
+		require.Equal(t, 1, summaries[1].ReceiptCount)
+		require.Equal(t, 1, summaries[1].ParticipantCount)
+		require.Equal(t, int64(300), summaries[1].BytesSent)
+		require.Equal(t, int64(600), summaries[1].BytesReceived)
+		require.Equal(t, float64(15*60), summaries[1].ConnectedSeconds)
+
+		all := NewUsageLedger(0)
+		require.NoError(t, all.Ingest(first, last))
+
+		summaries = all.Summaries(GroupByAll)
+		require.Len(t, summaries, 1)
+		require.Equal(t, 1, summaries[0].ReceiptCount)
+		require.Equal(t, int64(400), summaries[0].BytesSent)
+		require.Equal(t, float64(20*60), summaries[0].ConnectedSeconds)
+	})
+
+	t.Run("summaries are exported as json and csv", func(t *testing.T) {
+		ledger := NewUsageLedger(time.Hour)
+		require.NoError(t, ledger.Ingest(newReceipt("s1", 1, 0, 90*time.Second)))
+		summaries := ledger.Summaries(GroupByApp)
+
+		var jsonBuf bytes.Buffer
+		require.NoError(t, summaries.WriteJSON(&jsonBuf))
+
+		var decoded UsageSummaries
+		require.NoError(t, json.Unmarshal(jsonBuf.Bytes(), &decoded))
+		require.Equal(t, summaries, decoded)
+
+		var csvBuf bytes.Buffer
+		require.NoError(t, summaries.WriteCSV(&csvBuf))
+		require.Equal(t,
+			"app_id,client_id,session_id,hagall_wallet_addr,window_start,window_end,receipt_count,participant_count,bytes_sent,bytes_received,connected_seconds\n"+
+				"app,,,,2024-01-01T10:00:00Z,2024-01-01T11:00:00Z,1,1,100,200,90\n",
+			csvBuf.String(),
+		)
+	})
+}
@@ -0,0 +1,292 @@
+package ncsclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aukilabs/go-tooling/pkg/errors"
+	"github.com/aukilabs/go-tooling/pkg/logs"
+)
+
+const (
+	receiptBatchFileExt    = ".json"
+	receiptBatchCorruptExt = ".corrupt"
+)
+
+// ReceiptBatch is a batch of receipts stored in a ReceiptQueue.
+type ReceiptBatch struct {
+	// The identifier of the batch. It is sent to NCS so that a batch sent
+	// several times is ingested only once.
+	ID string `json:"id"`
+
+	// The receipts of the batch.
+	Receipts []ReceiptPayload `json:"receipts"`
+}
+
+// ReceiptQueue is the interface that describes a storage for the receipts
+// that could not be sent to NCS. Batches are returned in the order they were
+// pushed.
+type ReceiptQueue interface {
+	// Stores the given batch.
+	Push(batch ReceiptBatch) error
+
+	// Returns the oldest stored batch, or false when the queue is empty.
+	Peek() (ReceiptBatch, bool, error)
+
+	// Removes the batch with the given ID.
+	Remove(id string) error
+}
+
+// MemoryReceiptQueue is a ReceiptQueue that keeps the receipts in memory.
+// Receipts are lost when the process exits.
+type MemoryReceiptQueue struct {
+	mutex   sync.Mutex
+	batches []ReceiptBatch
+}
+
+// NewMemoryReceiptQueue returns an empty in-memory receipt queue.
+func NewMemoryReceiptQueue() *MemoryReceiptQueue {
+	return &MemoryReceiptQueue{}
+}
+
+// Push satisfies the ReceiptQueue interface.
+func (q *MemoryReceiptQueue) Push(batch ReceiptBatch) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.batches = append(q.batches, ReceiptBatch{
+		ID:       batch.ID,
+		Receipts: append([]ReceiptPayload(nil), batch.Receipts...),
+	})
+	return nil
+}
+
+// Peek satisfies the ReceiptQueue interface.
+func (q *MemoryReceiptQueue) Peek() (ReceiptBatch, bool, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if len(q.batches) == 0 {
+		return ReceiptBatch{}, false, nil
+	}
+	return q.batches[0], true, nil
+}
+
+// Remove satisfies the ReceiptQueue interface.
+func (q *MemoryReceiptQueue) Remove(id string) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for i, b := range q.batches {
+		if b.ID == id {
+			q.batches = append(q.batches[:i], q.batches[i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
+
+// Len returns the number of queued batches.
+func (q *MemoryReceiptQueue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.batches)
+}
+
+// FileReceiptQueue is a ReceiptQueue that stores each batch of receipts in a
+// file within a directory, so the receipts survive restarts.
+//
+// Writes are atomic: a batch is written to a temporary file that is renamed
+// once fully written. Files that cannot be decoded are renamed with a
+// .corrupt extension and skipped.
+type FileReceiptQueue struct {
+	dir   string
+	mutex sync.Mutex
+	last  int64
+}
+
+// NewFileReceiptQueue returns a receipt queue that stores the batches in the
+// given directory. The directory is created when it does not exist.
+func NewFileReceiptQueue(dir string) (*FileReceiptQueue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.New("creating receipt queue directory failed").
+			WithTag("dir", dir).
+			Wrap(err)
+	}
+	return &FileReceiptQueue{dir: dir}, nil
+}
+
+// Push satisfies the ReceiptQueue interface.
+func (q *FileReceiptQueue) Push(batch ReceiptBatch) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	b, err := json.Marshal(batch)
+	if err != nil {
+		return errors.New("encoding receipts failed").Wrap(err)
+	}
+
+	// File names start with a timestamp so that lexical order matches push
+	// order, across restarts included.
+	seq := time.Now().UnixNano()
+	if seq <= q.last {
+		seq = q.last + 1
+	}
+	q.last = seq
+
+	name := fmt.Sprintf("%020d-%s%s", seq, filepath.Base(batch.ID), receiptBatchFileExt)
+	path := filepath.Join(q.dir, name)
+	tmp, err := os.CreateTemp(q.dir, ".receipts-*")
+	if err != nil {
+		return errors.New("creating temporary receipt file failed").
+			WithTag("dir", q.dir).
+			Wrap(err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return errors.New("writing receipts failed").
+			WithTag("path", tmp.Name()).
+			Wrap(err)
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return errors.New("syncing receipts failed").
+			WithTag("path", tmp.Name()).
+			Wrap(err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return errors.New("closing receipt file failed").
+			WithTag("path", tmp.Name()).
+			Wrap(err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return errors.New("replacing receipt file failed").
+			WithTag("path", path).
+			Wrap(err)
+	}
+	return nil
+}
+
+// Peek satisfies the ReceiptQueue interface.
+func (q *FileReceiptQueue) Peek() (ReceiptBatch, bool, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for {
+		names, err := q.names()
+		if err != nil || len(names) == 0 {
+			return ReceiptBatch{}, false, err
+		}
+
+		path := filepath.Join(q.dir, names[0])
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return ReceiptBatch{}, false, errors.New("reading receipts failed").
+				WithTag("path", path).
+				Wrap(err)
+		}
+
+		var batch ReceiptBatch
+		err = json.Unmarshal(b, &batch)
+		if err == nil && batch.ID != "" {
+			return batch, true, nil
+		}
+
+		if err == nil {
+			err = errors.New("batch id is missing")
+		}
+		if merr := q.moveAside(path); merr != nil {
+			return ReceiptBatch{}, false, merr
+		}
+
+		logs.WithTag("path", path).
+			Error(errors.New("decoding receipts failed, file moved aside").Wrap(err))
+	}
+}
+
+// Remove satisfies the ReceiptQueue interface.
+func (q *FileReceiptQueue) Remove(id string) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	names, err := q.names()
+	if err != nil {
+		return err
+	}
+
+	id = filepath.Base(id)
+	for _, name := range names {
+		if receiptBatchFileID(name) != id {
+			continue
+		}
+
+		path := filepath.Join(q.dir, name)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return errors.New("removing receipts failed").
+				WithTag("path", path).
+				Wrap(err)
+		}
+	}
+	return nil
+}
+
+// Len returns the number of queued batches.
+func (q *FileReceiptQueue) Len() (int, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	names, err := q.names()
+	return len(names), err
+}
+
+// names returns the file names of the queued batches, oldest first.
+func (q *FileReceiptQueue) names() ([]string, error) {
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return nil, errors.New("reading receipt queue directory failed").
+			WithTag("dir", q.dir).
+			Wrap(err)
+	}
+
+	var names []string
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || strings.HasPrefix(name, ".") || filepath.Ext(name) != receiptBatchFileExt {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// receiptBatchFileID returns the ID of the batch stored in the file with the
+// given name. File names are made of the push sequence number and the batch
+// ID, separated by the first dash.
+func receiptBatchFileID(name string) string {
+	_, id, _ := strings.Cut(strings.TrimSuffix(name, receiptBatchFileExt), "-")
+	return id
+}
+
+// moveAside renames the given batch file so that it is no longer read, while
+// keeping it for inspection.
+func (q *FileReceiptQueue) moveAside(path string) error {
+	corrupt := strings.TrimSuffix(path, receiptBatchFileExt) + receiptBatchCorruptExt
+	if err := os.Rename(path, corrupt); err != nil {
+		return errors.New("moving corrupt receipt file aside failed").
+			WithTag("path", path).
+			Wrap(err)
+	}
+	return nil
+}
@@ -1,8 +1,34 @@
 package ncsclient
 
 import (
+	"bytes"
 	"encoding/json"
 	"time"
+
+	"github.com/aukilabs/go-tooling/pkg/errors"
+)
+
+const (
+	// The receipt version encoded as the plain JSON of a Receipt, with no
+	// envelope. Its bytes depend on the Receipt field order.
+	ReceiptVersionLegacy = 0
+
+	// The receipt version encoded as an envelope with sorted keys and
+	// timestamps formatted in UTC with millisecond precision.
+	ReceiptVersion1 = 1
+
+	// The version used by EncodeReceipt. It stays the legacy version so that
+	// the receipts sent to NCS keep the bytes and hashes that SDKs produce.
+	DefaultReceiptVersion = ReceiptVersionLegacy
+
+	// The timestamp format of canonical receipts.
+	canonicalReceiptTimeFormat = "2006-01-02T15:04:05.000Z"
+)
+
+var (
+	// Error returned when encoding or decoding a receipt with an unknown
+	// version.
+	ErrUnsupportedReceiptVersion = errors.New("unsupported receipt version")
 )
 
 type Receipt struct {
@@ -15,21 +41,107 @@ type Receipt struct {
 	SessionJoinedAt  time.Time `json:"session_joined_at"`
 	BytesSent        int64     `json:"bytes_sent"`
 	BytesReceived    int64     `json:"bytes_received"`
+
+	// The version the receipt was decoded from. It is not part of the
+	// receipt encoding.
+	Version int `json:"-"`
+}
+
+// receiptEnvelope is the encoding of versioned receipts.
+type receiptEnvelope struct {
+	Version *int            `json:"version"`
+	Receipt json.RawMessage `json:"receipt"`
 }
 
+// DecodeReceipt decodes a receipt encoded with any supported version. The
+// version is set in the returned receipt.
 func DecodeReceipt(receiptEncoded string) (Receipt, error) {
-	var r Receipt
-	err := json.Unmarshal([]byte(receiptEncoded), &r)
-	if err != nil {
+	var envelope receiptEnvelope
+	if err := json.Unmarshal([]byte(receiptEncoded), &envelope); err != nil {
 		return Receipt{}, err
 	}
-	return r, nil
+
+	// Legacy receipts have no envelope.
+	if envelope.Version == nil || len(envelope.Receipt) == 0 {
+		var r Receipt
+		if err := json.Unmarshal([]byte(receiptEncoded), &r); err != nil {
+			return Receipt{}, err
+		}
+		r.Version = ReceiptVersionLegacy
+		return r, nil
+	}
+
+	switch *envelope.Version {
+	case ReceiptVersion1:
+		var r Receipt
+		if err := json.Unmarshal(envelope.Receipt, &r); err != nil {
+			return Receipt{}, err
+		}
+		r.Version = ReceiptVersion1
+		return r, nil
+
+	default:
+		return Receipt{}, errors.New("decoding receipt failed").
+			WithTag("version", *envelope.Version).
+			Wrap(ErrUnsupportedReceiptVersion)
+	}
 }
 
+// EncodeReceipt encodes a receipt with DefaultReceiptVersion.
 func EncodeReceipt(receipt Receipt) (string, error) {
-	receiptEncoded, err := json.Marshal(receipt)
-	if err != nil {
+	return EncodeReceiptVersion(receipt, DefaultReceiptVersion)
+}
+
+// EncodeReceiptVersion encodes a receipt with the given version. Use
+// ReceiptVersion1 to produce canonical receipts: the same receipt always
+// produces the same bytes, whatever its time zones and field order.
+func EncodeReceiptVersion(receipt Receipt, version int) (string, error) {
+	switch version {
+	case ReceiptVersionLegacy:
+		receiptEncoded, err := json.Marshal(receipt)
+		if err != nil {
+			return "", err
+		}
+		return string(receiptEncoded), nil
+
+	case ReceiptVersion1:
+		return encodeCanonical(map[string]interface{}{
+			"version": ReceiptVersion1,
+			"receipt": map[string]interface{}{
+				"app_id":             receipt.AppID,
+				"client_id":          receipt.ClientID,
+				"session_id":         receipt.SessionID,
+				"hagall_wallet_addr": receipt.HagallWalletAddr,
+				"participant_id":     receipt.ParticipantID,
+				"created_at":         formatCanonicalTime(receipt.CreatedAt),
+				"session_joined_at":  formatCanonicalTime(receipt.SessionJoinedAt),
+				"bytes_sent":         receipt.BytesSent,
+				"bytes_received":     receipt.BytesReceived,
+			},
+		})
+
+	default:
+		return "", errors.New("encoding receipt failed").
+			WithTag("version", version).
+			Wrap(ErrUnsupportedReceiptVersion)
+	}
+}
+
+// encodeCanonical encodes the given value as compact JSON with the object
+// keys sorted and without HTML escaping.
+func encodeCanonical(v interface{}) (string, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+
+	if err := enc.Encode(v); err != nil {
 		return "", err
 	}
-	return string(receiptEncoded), nil
+	return string(bytes.TrimSuffix(buf.Bytes(), []byte("\n"))), nil
+}
+
+// formatCanonicalTime formats the given time in UTC, truncated to the
+// millisecond.
+func formatCanonicalTime(t time.Time) string {
+	return t.UTC().Truncate(time.Millisecond).Format(canonicalReceiptTimeFormat)
 }
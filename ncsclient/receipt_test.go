@@ -0,0 +1,88 @@
+package ncsclient
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/require"
+)
+
+// goldenReceipt is the receipt used to produce the golden vectors. SDKs that
+// sign receipts must produce the same bytes and hashes.
+var goldenReceipt = Receipt{
+	AppID:            "app-1",
+	ClientID:         "client-1",
+	SessionID:        "session-1",
+	HagallWalletAddr: "0x8Ee7D9235e01e6B42345120b5d270bdB763624C7",
+	ParticipantID:    42,
+	CreatedAt:        time.Date(2024, 3, 1, 12, 30, 15, 123456789, time.UTC),
+	SessionJoinedAt:  time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC),
+	BytesSent:        1048576,
+	BytesReceived:    2097152,
+}
+
+var receiptGoldenVectors = map[int]struct {
+	encoded string
+	hash    string
+}{
+	ReceiptVersionLegacy: {
+		encoded: `{"app_id":"app-1","client_id":"client-1","session_id":"session-1","hagall_wallet_addr":"0x8Ee7D9235e01e6B42345120b5d270bdB763624C7","participant_id":42,"created_at":"2024-03-01T12:30:15.123456789Z","session_joined_at":"2024-03-01T12:00:00Z","bytes_sent":1048576,"bytes_received":2097152}`,
+		hash:    "0x06630843b9d472ce96777a11b751112f3e44c3a4f36def6015f3f6d2a18c1ee1",
+	},
+	ReceiptVersion1: {
+		encoded: `{"receipt":{"app_id":"app-1","bytes_received":2097152,"bytes_sent":1048576,"client_id":"client-1","created_at":"2024-03-01T12:30:15.123Z","hagall_wallet_addr":"0x8Ee7D9235e01e6B42345120b5d270bdB763624C7","participant_id":42,"session_id":"session-1","session_joined_at":"2024-03-01T12:00:00.000Z"},"version":1}`,
+		hash:    "0x15156e2199e8cf14e9179893f127578765d6f0f9191d020111a2a95dd80be4dc",
+	},
+}
+
+func TestReceiptGoldenVectors(t *testing.T) {
+	for version, v := range receiptGoldenVectors {
+		encoded, err := EncodeReceiptVersion(goldenReceipt, version)
+		require.NoError(t, err)
+		require.Equal(t, v.encoded, encoded, "version %d", version)
+		require.Equal(t, v.hash, hexutil.Encode(crypto.Keccak256([]byte(encoded))), "version %d", version)
+
+		decoded, err := DecodeReceipt(v.encoded)
+		require.NoError(t, err)
+		require.Equal(t, version, decoded.Version)
+		require.Equal(t, goldenReceipt.SessionID, decoded.SessionID)
+		require.Equal(t, goldenReceipt.BytesReceived, decoded.BytesReceived)
+		require.True(t, goldenReceipt.SessionJoinedAt.Equal(decoded.SessionJoinedAt))
+	}
+}
+
+func TestEncodeReceipt(t *testing.T) {
+	t.Run("default encoding is legacy", func(t *testing.T) {
+		encoded, err := EncodeReceipt(goldenReceipt)
+		require.NoError(t, err)
+		require.Equal(t, receiptGoldenVectors[ReceiptVersionLegacy].encoded, encoded)
+	})
+
+	t.Run("version 1 encoding is canonical", func(t *testing.T) {
+		r := goldenReceipt
+		r.CreatedAt = r.CreatedAt.In(time.FixedZone("UTC+8", 8*60*60)).Add(400 * time.Microsecond)
+
+		encoded, err := EncodeReceiptVersion(r, ReceiptVersion1)
+		require.NoError(t, err)
+		require.Equal(t, receiptGoldenVectors[ReceiptVersion1].encoded, encoded)
+	})
+
+	t.Run("version 1 html characters are not escaped", func(t *testing.T) {
+		r := goldenReceipt
+		r.AppID = "<app>&"
+
+		encoded, err := EncodeReceiptVersion(r, ReceiptVersion1)
+		require.NoError(t, err)
+		require.Contains(t, encoded, `"app_id":"<app>&"`)
+	})
+
+	t.Run("unsupported version", func(t *testing.T) {
+		_, err := EncodeReceiptVersion(goldenReceipt, 42)
+		require.ErrorIs(t, err, ErrUnsupportedReceiptVersion)
+
+		_, err = DecodeReceipt(`{"version":42,"receipt":{}}`)
+		require.ErrorIs(t, err, ErrUnsupportedReceiptVersion)
+	})
+}
@@ -0,0 +1,98 @@
+package ncsclient
+
+import (
+	"bytes"
+
+	"github.com/aukilabs/go-tooling/pkg/errors"
+	"github.com/aukilabs/hagall-common/crypt"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+var (
+	// Error returned when the hash of a receipt payload does not match its
+	// receipt.
+	ErrInvalidReceiptHash = errors.New("receipt hash mismatch")
+
+	// Error returned when the signature of a receipt payload is malformed or
+	// does not match its hash.
+	ErrInvalidReceiptSignature = errors.New("invalid receipt signature")
+
+	// Error returned when a receipt payload is not signed by the expected
+	// wallet.
+	ErrUnexpectedReceiptSigner = errors.New("unexpected receipt signer")
+
+	// Error returned when the fields of a receipt are not consistent.
+	ErrInvalidReceipt = errors.New("invalid receipt")
+)
+
+// VerifyReceiptPayload verifies that the given payload was signed by the
+// expected wallet with NewReceiptPayload, NewReceiptPayloadWithScheme or
+// NewReceiptPayloadWithSigner and returns the decoded receipt, whatever its
+// version.
+//
+// The hash is recomputed from the receipt with the payload scheme, the signer
+// is recovered from the signature and the receipt fields are checked with
+// ValidateReceipt.
+func VerifyReceiptPayload(payload ReceiptPayload, expectedSigner common.Address) (Receipt, error) {
+	hash, err := receiptHash(payload.Scheme, payload.ChainID, payload.Receipt)
+	if err != nil {
+		return Receipt{}, errors.New("hashing receipt failed").
+			WithTag("scheme", payload.Scheme).
+			WithTag("reason", err.Error()).
+			Wrap(ErrInvalidReceiptSignature)
+	}
+	if !bytes.Equal(hash, payload.Hash) {
+		return Receipt{}, ErrInvalidReceiptHash
+	}
+
+	signer, err := crypt.RecoverHashSigner(hash, payload.Signature)
+	if err != nil {
+		return Receipt{}, errors.New("recovering receipt signer failed").
+			WithTag("reason", err.Error()).
+			Wrap(ErrInvalidReceiptSignature)
+	}
+
+	if signer != expectedSigner {
+		return Receipt{}, errors.New("verifying receipt signer failed").
+			WithTag("signer", signer.Hex()).
+			WithTag("expected_signer", expectedSigner.Hex()).
+			Wrap(ErrUnexpectedReceiptSigner)
+	}
+
+	receipt, err := DecodeReceipt(payload.Receipt)
+	if err != nil {
+		return Receipt{}, errors.New("decoding receipt failed").
+			WithTag("reason", err.Error()).
+			Wrap(ErrInvalidReceipt)
+	}
+
+	if err := ValidateReceipt(receipt); err != nil {
+		return Receipt{}, err
+	}
+	return receipt, nil
+}
+
+// ValidateReceipt checks that the receipt fields are consistent. It returns an
+// error that wraps ErrInvalidReceipt otherwise.
+func ValidateReceipt(r Receipt) error {
+	var reason string
+
+	switch {
+	case r.ParticipantID == 0:
+		reason = "participant id is zero"
+	case r.SessionJoinedAt.After(r.CreatedAt):
+		reason = "session joined after the receipt creation"
+	case r.BytesSent < 0:
+		reason = "bytes sent is negative"
+	case r.BytesReceived < 0:
+		reason = "bytes received is negative"
+	default:
+		return nil
+	}
+
+	return errors.New("validating receipt failed").
+		WithTag("reason", reason).
+		WithTag("session_id", r.SessionID).
+		WithTag("participant_id", r.ParticipantID).
+		Wrap(ErrInvalidReceipt)
+}
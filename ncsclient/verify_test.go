@@ -0,0 +1,165 @@
+package ncsclient
+
+import (
+	"context"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/aukilabs/hagall-common/crypt"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyReceiptPayload(t *testing.T) {
+	privateKey, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	signer := crypto.PubkeyToAddress(privateKey.PublicKey)
+	privateKeyString := hex.EncodeToString(crypto.FromECDSA(privateKey))
+
+	now := time.Now().UTC()
+	receipt := Receipt{
+		AppID:           "app",
+		SessionID:       "session",
+		ParticipantID:   1,
+		CreatedAt:       now,
+		SessionJoinedAt: now.Add(-time.Minute),
+		BytesSent:       1024,
+		BytesReceived:   2048,
+	}
+
+	sign := func(t *testing.T, r Receipt) ReceiptPayload {
+		payload, err := NewReceiptPayload(r, privateKeyString)
+		require.NoError(t, err)
+		return payload
+	}
+
+	t.Run("valid payload", func(t *testing.T) {
+		verified, err := VerifyReceiptPayload(sign(t, receipt), signer)
+		require.NoError(t, err)
+		require.Equal(t, receipt.SessionID, verified.SessionID)
+		require.Equal(t, receipt.BytesReceived, verified.BytesReceived)
+	})
+
+	t.Run("legacy recovery id is accepted", func(t *testing.T) {
+		payload := sign(t, receipt)
+		payload.Signature[crypto.RecoveryIDOffset] += 27
+
+		_, err := VerifyReceiptPayload(payload, signer)
+		require.NoError(t, err)
+	})
+
+	t.Run("wallet schemes", func(t *testing.T) {
+		schemes := []crypt.SignatureScheme{
+			crypt.SignatureSchemePersonal,
+			crypt.SignatureSchemeTypedData,
+		}
+
+		for _, scheme := range schemes {
+			payload, err := NewReceiptPayloadWithScheme(receipt, privateKeyString, scheme, 1)
+			require.NoError(t, err)
+
+			_, err = VerifyReceiptPayload(payload, signer)
+			require.NoError(t, err)
+		}
+	})
+
+	t.Run("signer", func(t *testing.T) {
+		payload, err := NewReceiptPayloadWithSigner(context.Background(), receipt, DefaultReceiptVersion, crypt.NewPrivateKeySigner(privateKey), crypt.SignatureSchemeTypedData, 1)
+		require.NoError(t, err)
+
+		_, err = VerifyReceiptPayload(payload, signer)
+		require.NoError(t, err)
+	})
+
+	t.Run("canonical receipt", func(t *testing.T) {
+		payload, err := NewReceiptPayloadWithSigner(context.Background(), receipt, ReceiptVersion1, crypt.NewPrivateKeySigner(privateKey), crypt.SignatureSchemeTypedData, 1)
+		require.NoError(t, err)
+
+		encoded, err := EncodeReceiptVersion(receipt, ReceiptVersion1)
+		require.NoError(t, err)
+		require.Equal(t, encoded, payload.Receipt)
+
+		verified, err := VerifyReceiptPayload(payload, signer)
+		require.NoError(t, err)
+		require.Equal(t, ReceiptVersion1, verified.Version)
+		require.Equal(t, receipt.SessionID, verified.SessionID)
+		require.True(t, receipt.CreatedAt.Truncate(time.Millisecond).Equal(verified.CreatedAt))
+	})
+
+	t.Run("unsupported receipt version", func(t *testing.T) {
+		_, err := NewReceiptPayloadWithSigner(context.Background(), receipt, 42, crypt.NewPrivateKeySigner(privateKey), crypt.SignatureSchemeTypedData, 1)
+		require.ErrorIs(t, err, ErrUnsupportedReceiptVersion)
+	})
+
+	t.Run("typed data signature for another chain", func(t *testing.T) {
+		payload, err := NewReceiptPayloadWithScheme(receipt, privateKeyString, crypt.SignatureSchemeTypedData, 1)
+		require.NoError(t, err)
+		payload.ChainID = 5
+
+		_, err = VerifyReceiptPayload(payload, signer)
+		require.ErrorIs(t, err, ErrInvalidReceiptHash)
+	})
+
+	t.Run("unsupported scheme", func(t *testing.T) {
+		payload := sign(t, receipt)
+		payload.Scheme = "eip-42"
+
+		_, err := VerifyReceiptPayload(payload, signer)
+		require.ErrorIs(t, err, ErrInvalidReceiptSignature)
+	})
+
+	t.Run("tampered receipt", func(t *testing.T) {
+		payload := sign(t, receipt)
+		payload.Receipt = payload.Receipt[:len(payload.Receipt)-1] + " }"
+
+		_, err := VerifyReceiptPayload(payload, signer)
+		require.ErrorIs(t, err, ErrInvalidReceiptHash)
+	})
+
+	t.Run("forged hash", func(t *testing.T) {
+		tampered := receipt
+		tampered.BytesSent = 1
+		forged := sign(t, tampered)
+
+		payload := sign(t, receipt)
+		payload.Receipt = forged.Receipt
+		payload.Hash = forged.Hash
+
+		_, err := VerifyReceiptPayload(payload, signer)
+		require.ErrorIs(t, err, ErrUnexpectedReceiptSigner)
+	})
+
+	t.Run("malformed signature", func(t *testing.T) {
+		payload := sign(t, receipt)
+		payload.Signature = payload.Signature[:64]
+
+		_, err := VerifyReceiptPayload(payload, signer)
+		require.ErrorIs(t, err, ErrInvalidReceiptSignature)
+	})
+
+	t.Run("unexpected signer", func(t *testing.T) {
+		_, err := VerifyReceiptPayload(sign(t, receipt), common.HexToAddress("0x1"))
+		require.ErrorIs(t, err, ErrUnexpectedReceiptSigner)
+	})
+
+	t.Run("inconsistent fields", func(t *testing.T) {
+		tests := map[string]func(r *Receipt){
+			"zero participant":        func(r *Receipt) { r.ParticipantID = 0 },
+			"joined after creation":   func(r *Receipt) { r.SessionJoinedAt = r.CreatedAt.Add(time.Second) },
+			"negative bytes sent":     func(r *Receipt) { r.BytesSent = -1 },
+			"negative bytes received": func(r *Receipt) { r.BytesReceived = -1 },
+		}
+
+		for name, mutate := range tests {
+			t.Run(name, func(t *testing.T) {
+				r := receipt
+				mutate(&r)
+
+				_, err := VerifyReceiptPayload(sign(t, r), signer)
+				require.ErrorIs(t, err, ErrInvalidReceipt)
+			})
+		}
+	})
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/aukilabs/go-tooling/pkg/errors"
 	hds "github.com/aukilabs/hagall-common/hdsclient"
 	httpcmn "github.com/aukilabs/hagall-common/http"
+	hwebsocket "github.com/aukilabs/hagall-common/websocket"
 	"github.com/google/uuid"
 	"golang.org/x/net/websocket"
 )
@@ -92,25 +93,21 @@ func connectToHagall(ctx context.Context, opts Options) (*websocket.Conn, error)
 			Wrap(err)
 	}
 
-	wsEndpoint := opts.Hagall
-	wsEndpoint = strings.ReplaceAll(wsEndpoint, "host.docker.internal", "localhost")
-	wsEndpoint = strings.ReplaceAll(wsEndpoint, "https://", "wss://")
-	wsEndpoint = strings.ReplaceAll(wsEndpoint, "http://", "ws://")
+	endpoint := strings.ReplaceAll(opts.Hagall, "host.docker.internal", "localhost")
 
-	cfg, err := websocket.NewConfig(wsEndpoint, "https://localhost")
-	if err != nil {
-		return nil, errors.New("creating websocket config failed").
-			WithTag("endpoint", wsEndpoint).
-			Wrap(err)
-	}
-	cfg.Header.Set("Authorization", "Bearer "+server.AccessToken)
-	cfg.Header.Set("User-Agent", "HDS (Go WebSocket Client golang.org/x/net/websocket)")
-	cfg.Header.Set(httpcmn.HeaderPosemeshClientID, clientID)
+	header := make(http.Header)
+	header.Set(httpcmn.HeaderPosemeshClientID, clientID)
 
-	conn, err := websocket.DialConfig(cfg)
+	conn, err := hwebsocket.Dial(ctx, hwebsocket.DialOptions{
+		Endpoint:  endpoint,
+		Origin:    "https://localhost",
+		Token:     hwebsocket.StaticToken(server.AccessToken),
+		UserAgent: "HDS (Go WebSocket Client golang.org/x/net/websocket)",
+		Header:    header,
+	})
 	if err != nil {
 		return nil, errors.New("dialing to websocket failed").
-			WithTag("endpoint", wsEndpoint).
+			WithTag("endpoint", endpoint).
 			Wrap(err)
 	}
 	return conn, nil
@@ -3,14 +3,12 @@ package smoketest
 import (
 	"context"
 	"math/rand"
-	"strings"
 	"time"
 
 	"github.com/aukilabs/go-tooling/pkg/errors"
 	"github.com/aukilabs/hagall-common/messages/hagallpb"
 	"github.com/aukilabs/hagall-common/scenario"
 	hwebsocket "github.com/aukilabs/hagall-common/websocket"
-	"golang.org/x/net/websocket"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
@@ -34,18 +32,11 @@ func RunSmokeTest(ctx context.Context, opts RunSmokeTestOptions) (SmokeTestResul
 		ToEndpoint:   opts.ToEndpoint,
 	}
 
-	serverWSEndpoint := strings.ReplaceAll(opts.ToEndpoint, "https://", "wss://")
-	serverWSEndpoint = strings.ReplaceAll(serverWSEndpoint, "http://", "ws://")
-
-	cfg, err := websocket.NewConfig(serverWSEndpoint, opts.ToEndpoint)
-	if err != nil {
-		stRes.Status = StatusError
-		return stRes, errors.New("creating websocket config failed").Wrap(err)
-	}
-	cfg.Header.Set("Authorization", "Bearer "+opts.ToEndpointToken)
-	cfg.Header.Set("User-Agent", opts.UserAgent)
-
-	conn, err := websocket.DialConfig(cfg)
+	conn, err := hwebsocket.Dial(ctx, hwebsocket.DialOptions{
+		Endpoint:  opts.ToEndpoint,
+		Token:     hwebsocket.StaticToken(opts.ToEndpointToken),
+		UserAgent: opts.UserAgent,
+	})
 	if err != nil {
 		stRes.Status = StatusFailed
 		return stRes, errors.New("dial websocket failed").Wrap(err)
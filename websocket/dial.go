@@ -0,0 +1,99 @@
+package websocket
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/aukilabs/go-tooling/pkg/errors"
+	"golang.org/x/net/websocket"
+)
+
+// TokenFunc is a function that returns the access token to present to a
+// Hagall server.
+type TokenFunc func(ctx context.Context) (string, error)
+
+// StaticToken returns a token function that always returns the given token.
+func StaticToken(token string) TokenFunc {
+	return func(ctx context.Context) (string, error) {
+		return token, nil
+	}
+}
+
+// DialOptions are the options to dial a Hagall server.
+type DialOptions struct {
+	// The Hagall server endpoint. HTTP schemes are converted to their
+	// WebSocket equivalent.
+	Endpoint string
+
+	// The origin of the connection. Defaults to the endpoint.
+	Origin string
+
+	// The function called on every dial to get the access token. A token is
+	// never reused by a reconnecting client unless the function returns it.
+	Token TokenFunc
+
+	// The User-Agent header.
+	UserAgent string
+
+	// Additional headers.
+	Header http.Header
+}
+
+// Dial opens a WebSocket connection to a Hagall server, authenticated with the
+// token returned by the options token function.
+func Dial(ctx context.Context, opts DialOptions) (*websocket.Conn, error) {
+	endpoint := WebSocketEndpoint(opts.Endpoint)
+
+	origin := opts.Origin
+	if origin == "" {
+		origin = opts.Endpoint
+	}
+
+	cfg, err := websocket.NewConfig(endpoint, origin)
+	if err != nil {
+		return nil, errors.New("creating websocket config failed").
+			WithTag("endpoint", endpoint).
+			Wrap(err)
+	}
+
+	for k, v := range opts.Header {
+		cfg.Header[k] = append([]string(nil), v...)
+	}
+
+	if opts.UserAgent != "" {
+		cfg.Header.Set("User-Agent", opts.UserAgent)
+	}
+
+	if opts.Token != nil {
+		token, err := opts.Token(ctx)
+		if err != nil {
+			return nil, errors.New("getting access token failed").
+				WithTag("endpoint", endpoint).
+				Wrap(err)
+		}
+		cfg.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	conn, err := cfg.DialContext(ctx)
+	if err != nil {
+		return nil, errors.New("dialing websocket failed").
+			WithTag("endpoint", endpoint).
+			Wrap(err)
+	}
+	return conn, nil
+}
+
+// WebSocketEndpoint returns the WebSocket equivalent of a HTTP endpoint.
+func WebSocketEndpoint(endpoint string) string {
+	switch {
+	case strings.HasPrefix(endpoint, "https://"):
+		return "wss://" + strings.TrimPrefix(endpoint, "https://")
+
+	case strings.HasPrefix(endpoint, "http://"):
+		return "ws://" + strings.TrimPrefix(endpoint, "http://")
+
+	default:
+		return endpoint
+	}
+}
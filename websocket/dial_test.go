@@ -0,0 +1,59 @@
+package websocket
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/aukilabs/go-tooling/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/websocket"
+)
+
+func TestDial(t *testing.T) {
+	headers := make(chan http.Header, 2)
+	s := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		headers <- ws.Request().Header
+	}))
+	defer s.Close()
+
+	var dials int
+	token := func(ctx context.Context) (string, error) {
+		dials++
+		return "token-" + strconv.Itoa(dials), nil
+	}
+
+	for i := 1; i <= 2; i++ {
+		conn, err := Dial(context.Background(), DialOptions{
+			Endpoint:  s.URL,
+			Token:     token,
+			UserAgent: "hagall-test",
+			Header:    http.Header{"X-Test": []string{"test"}},
+		})
+		require.NoError(t, err)
+		conn.Close()
+
+		h := <-headers
+		require.Equal(t, "Bearer token-"+strconv.Itoa(i), h.Get("Authorization"))
+		require.Equal(t, "hagall-test", h.Get("User-Agent"))
+		require.Equal(t, "test", h.Get("X-Test"))
+	}
+}
+
+func TestDialTokenError(t *testing.T) {
+	_, err := Dial(context.Background(), DialOptions{
+		Endpoint: "http://localhost",
+		Token: func(ctx context.Context) (string, error) {
+			return "", errors.New("no token")
+		},
+	})
+	require.Error(t, err)
+}
+
+func TestWebSocketEndpoint(t *testing.T) {
+	require.Equal(t, "wss://hagall.auki.network", WebSocketEndpoint("https://hagall.auki.network"))
+	require.Equal(t, "ws://localhost:4000", WebSocketEndpoint("http://localhost:4000"))
+	require.Equal(t, "ws://localhost:4000", WebSocketEndpoint("ws://localhost:4000"))
+}